@@ -0,0 +1,292 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/utils"
+)
+
+var (
+	// the cache's size cap, unless configured otherwise
+	DefaultSizeMb int64 = 10 * 1024
+
+	// space the cache leaves free on its filesystem, unless configured otherwise
+	DefaultMinFreeMb int64 = 1024
+
+	// how often Get found the file it was asked for, or didn't
+	hits, misses int64
+)
+
+// A local store of files by key, e.g. compressed layers by the digest of
+// their content. Once it's over its size cap, or its filesystem is low on
+// space, the least recently used files are removed.
+//
+// A nil *Cache is a cache which is never hit, so callers needn't check
+// whether caching is configured.
+type Cache struct {
+	Dir     string
+	MaxSize int64
+	MinFree int64
+}
+
+// A cached file
+type Entry struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// The cache configured in the [cache] section, or nil if there's no `dir`.
+func New(config config.Config) *Cache {
+	if config.Cache.Dir == "" {
+		return nil
+	}
+
+	sizeMb := config.Cache.Size_Mb
+	if sizeMb <= 0 {
+		sizeMb = DefaultSizeMb
+	}
+
+	minFreeMb := config.Cache.Min_Free_Mb
+	if minFreeMb <= 0 {
+		minFreeMb = DefaultMinFreeMb
+	}
+
+	return &Cache{
+		Dir:     config.Cache.Dir,
+		MaxSize: sizeMb * 1024 * 1024,
+		MinFree: minFreeMb * 1024 * 1024,
+	}
+}
+
+func (c *Cache) path(key string) (string, error) {
+	if key == "" || strings.Contains(key, "..") {
+		return "", fmt.Errorf("invalid cache key '%s'", key)
+	}
+	return filepath.Join(c.Dir, filepath.FromSlash(key)), nil
+}
+
+// Puts the file cached under key at dst. False if it isn't cached.
+func (c *Cache) Get(key, dst string) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+
+	src, err := c.path(key)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		atomic.AddInt64(&misses, 1)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	atomic.AddInt64(&hits, 1)
+
+	// recently used files are the last to go
+	now := time.Now()
+	if err := os.Chtimes(src, now, now); err != nil {
+		return false, err
+	}
+
+	os.Remove(dst)
+	if err := linkOrCopy(src, dst); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// How many times Get has found a file, or hasn't, since dogestry started.
+func HitStats() (int64, int64) {
+	return atomic.LoadInt64(&hits), atomic.LoadInt64(&misses)
+}
+
+// Opens the file cached under key.
+func (c *Cache) Open(key string) (*os.File, error) {
+	if c == nil {
+		return nil, os.ErrNotExist
+	}
+
+	path, err := c.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Caches the file at src under key, then makes room if the cache is over its cap.
+func (c *Cache) Put(key, src string) error {
+	if c == nil {
+		return nil
+	}
+
+	dst, err := c.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+
+	// written aside and moved into place, so a half written file is never hit
+	tmp := fmt.Sprintf("%s.tmp-%d", dst, time.Now().UnixNano())
+	if err := linkOrCopy(src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return c.Prune()
+}
+
+type byLastUsed []Entry
+
+func (e byLastUsed) Len() int           { return len(e) }
+func (e byLastUsed) Less(i, j int) bool { return e[i].LastUsed.Before(e[j].LastUsed) }
+func (e byLastUsed) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// The cached files, least recently used first.
+func (c *Cache) List() ([]Entry, error) {
+	entries := make([]Entry, 0)
+	if c == nil {
+		return entries, nil
+	}
+
+	err := filepath.Walk(c.Dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// removed by another prune
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		key, err := filepath.Rel(c.Dir, path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, Entry{filepath.ToSlash(key), info.Size(), info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byLastUsed(entries))
+	return entries, nil
+}
+
+// The total size of the cached files.
+func (c *Cache) Usage() (int64, error) {
+	entries, err := c.List()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+	return total, nil
+}
+
+// Removes every cached file. Only files the cache can see are removed, in
+// case it's been pointed at a dir with other things in it.
+func (c *Cache) Clear() error {
+	entries, err := c.List()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := os.Remove(filepath.Join(c.Dir, filepath.FromSlash(entry.Key))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the least recently used files until the cache is under its cap and
+// leaves enough space free.
+func (c *Cache) Prune() error {
+	if c == nil {
+		return nil
+	}
+
+	entries, err := c.List()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	free := int64(-1)
+	if space, err := utils.FreeSpace(c.Dir); err == nil {
+		free = int64(space)
+	}
+
+	for _, entry := range entries {
+		if total <= c.MaxSize && (free == -1 || free >= c.MinFree) {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.Dir, filepath.FromSlash(entry.Key))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= entry.Size
+		if free != -1 {
+			free += entry.Size
+		}
+	}
+
+	return nil
+}
+
+// Hard links src to dst, so big files don't take twice the space, or copies
+// it if they're on different filesystems.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+
+	return os.Rename(out.Name(), dst)
+}
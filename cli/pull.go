@@ -1,207 +1,85 @@
 package cli
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"strings"
 
-	"github.com/blake-education/dogestry/remote"
-	docker "github.com/fsouza/go-dockerclient"
+	"github.com/blake-education/dogestry"
+	"github.com/blake-education/dogestry/internal/engine"
 )
 
-func (cli *DogestryCli) CmdPull(args ...string) error {
-	cmd := cli.Subcmd("pull", "REMOTE IMAGE[:TAG]", "pull IMAGE from the REMOTE and load it into docker. TAG defaults to 'latest'")
+func cmdPull(cli *engine.DogestryCli, args ...string) error {
+	cmd := cli.Subcmd("pull", "REMOTE IMAGE[:TAG]...", "pull each IMAGE from the REMOTE and load it into docker. TAG defaults to 'latest'")
+	concurrency := cmd.Int("concurrency", 0, "how many images to download at once (default `concurrency` in the [dogestry] section, or 4)")
+	stream := cmd.Bool("stream", false, "stream images straight into docker rather than downloading them first (default `stream-pull` in the [dogestry] section)")
+	dryRun := cmd.Bool("dry-run", false, "print what would be downloaded, without downloading anything")
+	force := cmd.Bool("force", false, "download and load every image again, even ones docker or the work dir already have")
+	retries := cmd.Int("retries", 0, "how many times to retry an image which fails to download (default `retries` in the [dogestry] section, or 3)")
+	ociDir := cmd.String("oci-dir", "", "write the image to the OCI image layout in this dir, for containerd, CRI-O or skopeo, rather than loading it into docker")
+	containerd := cmd.Bool("containerd", false, "import the image into containerd with `ctr images import`, rather than loading it into docker")
+	containerdNamespace := cmd.String("containerd-namespace", "", "the containerd namespace to import into (default `namespace` in the [containerd] section, or k8s.io, where kubernetes looks)")
+	platform := cmd.String("platform", "", "pull the image for this os/arch, e.g. linux/arm64, from tags with an image per platform (default docker's platform)")
+	tagAs := cmd.String("tag-as", "", "also tag the pulled image as this repo[:tag] in docker, moving the tag if another image has it")
+	pullHosts := cmd.String("pullhosts", "", "pull to the docker on each of these comma separated hosts, e.g. tcp://app-1:2375,ssh://deploy@app-2, rather than the local one")
+	hostConcurrency := cmd.Int("host-concurrency", engine.DefaultHostConcurrency, "how many of -pullhosts to pull to at once")
+	skipVerify := cmd.Bool("insecure-skip-verify", false, "don't check layers and configs against the digests recorded when they were pushed")
+	detailedExitCode := cmd.Bool("detailed-exit-code", false, fmt.Sprintf("exit %d, rather than 0, if docker already had every image", engine.UpToDateStatus))
+	profileLayers := cmd.Bool("profile-layers", false, "print how long each layer took to download and decompress, its size before and after decompression, and its download throughput")
+	applyTimeouts := cli.TimeoutFlags(cmd)
+	addComposeImages := engine.ComposeFlags(cmd)
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
 
-	if len(cmd.Args()) < 2 {
-		return fmt.Errorf("Error: REMOTE and IMAGE not specified")
+	if *force {
+		cli.Config.Dogestry.Force = true
 	}
+	applyTimeouts()
 
-	remoteDef := cmd.Arg(0)
-	image := cmd.Arg(1)
-
-	imageRoot, err := cli.WorkDir(image)
-	if err != nil {
-		return err
-	}
-	r, err := remote.NewRemote(remoteDef, cli.Config)
-	if err != nil {
-		return err
-	}
-
-	fmt.Println("remote", r.Desc())
-
-	fmt.Println("resolving image id")
-	id, err := r.ResolveImageNameToId(image)
-	if err != nil {
-		return err
-	}
-
-	fmt.Printf("image '%s' resolved on remote id '%s'\n", image, id.Short())
-
-	fmt.Println("preparing images")
-	if err := cli.preparePullImage(id, imageRoot, r); err != nil {
-		return err
-	}
-
-	fmt.Println("preparing repositories file")
-	if err := prepareRepositories(image, imageRoot, r); err != nil {
-		return err
-	}
-
-	fmt.Println("sending tar to docker")
-	if err := cli.sendTar(imageRoot); err != nil {
-		return err
+	if *concurrency > 0 {
+		cli.Config.Dogestry.Concurrency = *concurrency
 	}
-
-	// in the case where we already have the image, but its not tagged:
-	fmt.Println("ensuring tag")
-	if err := cli.retag(image, id); err != nil {
-		return err
+	if *stream {
+		cli.Config.Dogestry.Stream_Pull = true
 	}
-
-	return nil
-}
-
-func (cli *DogestryCli) preparePullImage(fromId remote.ID, imageRoot string, r remote.Remote) error {
-	toDownload := make([]remote.ID, 0)
-
-	// TODO flatten this list, then iterate and pull each required file
-	// TODO parallelize
-	err := r.WalkImages(fromId, func(id remote.ID, image docker.Image, err error) error {
-		fmt.Printf("examining id '%s' on remote\n", id.Short())
-		if err != nil {
-			fmt.Println("err", err)
-			return err
-		}
-
-		_, err = cli.client.InspectImage(string(id))
-		if err == docker.ErrNoSuchImage {
-			toDownload = append(toDownload, id)
-			return nil
-		} else if err != nil {
-			return err
-		} else {
-			fmt.Printf("docker already has id '%s', stopping\n", id.Short())
-			return remote.BreakWalk
-		}
-	})
-
-	if err != nil {
-		return err
+	if *retries > 0 {
+		cli.Config.Dogestry.Retries = *retries
 	}
 
-	for _, id := range toDownload {
-		if err := cli.pullImage(id, filepath.Join(imageRoot, string(id)), r); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func (cli *DogestryCli) pullImage(id remote.ID, dst string, r remote.Remote) error {
-	fmt.Printf("pulling image id '%s'\n", id.Short())
-
-	// XXX fix image name rewrite
-	err := r.PullImageId(id, dst)
+	remoteDef, images := cli.RemoteArgs(cmd)
+	images, err := addComposeImages(images)
 	if err != nil {
 		return err
 	}
-	return cli.processPulled(id, dst)
-}
-
-// no-op for now
-func (cli *DogestryCli) processPulled(id remote.ID, dst string) error {
-	return nil
-}
-
-func prepareRepositories(image, imageRoot string, r remote.Remote) error {
-	repoName, repoTag := remote.NormaliseImageName(image)
-
-	id, err := r.ParseTag(repoName, repoTag)
-	if err != nil {
-		return err
-	} else if id == "" {
-		return nil
+	if remoteDef == "" || len(images) < 1 {
+		return engine.MissingArgs("pull", "REMOTE and IMAGE (or -compose)")
 	}
 
-	reposPath := filepath.Join(imageRoot, "repositories")
-	reposFile, err := os.Create(reposPath)
-	if err != nil {
-		return err
+	opts := dogestry.PullOptions{
+		OCIDir:          *ociDir,
+		Platform:        *platform,
+		TagAs:           *tagAs,
+		HostConcurrency: *hostConcurrency,
+		SkipVerify:      *skipVerify,
+		DryRun:          *dryRun,
+		ProfileLayers:   *profileLayers,
 	}
-	defer reposFile.Close()
-
-	repositories := map[string]Repository{}
-	repositories[repoName] = Repository{}
-	repositories[repoName][repoTag] = string(id)
-
-	return json.NewEncoder(reposFile).Encode(&repositories)
-}
-
-// stream the tarball into docker
-// its easier here to use tar command, but it'd be neater to mirror Push's approach
-func (cli *DogestryCli) sendTar(imageRoot string) error {
-	notExist, err := dirNotExistOrEmpty(imageRoot)
-
-	if err != nil {
-		return err
+	for _, host := range strings.Split(*pullHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			opts.Hosts = append(opts.Hosts, host)
+		}
 	}
-	if notExist {
-		fmt.Println("no images to send to docker")
-		return nil
+	if *containerd {
+		opts.ContainerdNamespace = engine.ContainerdNamespaceFor(*containerdNamespace, cli.Config)
 	}
 
-	// DEBUG - write out a tar to see what's there!
-	// exec.Command("/bin/tar", "cvf", "/tmp/d.tar", "-C", imageRoot, ".").Run()
-
-	cmd := exec.Command("/bin/tar", "cvf", "-", "-C", imageRoot, ".")
-	cmd.Dir = imageRoot
-	defer cmd.Wait()
-
-	stdout, err := cmd.StdoutPipe()
+	client, err := newClient(cli)
 	if err != nil {
 		return err
 	}
-
-	if err := cmd.Start(); err != nil {
-		return err
+	changed, err := client.PullImages(remoteDef, images, opts)
+	if err == nil && *detailedExitCode && !changed {
+		return engine.UpToDate("pull")
 	}
-
-	fmt.Println("kicking off post")
-	return cli.client.PostImageTarball(stdout)
-}
-
-func (cli *DogestryCli) retag(tag string, id remote.ID) error {
-	return cli.client.SetImageTag(id.String(), tag, false)
-}
-
-func dirNotExistOrEmpty(path string) (bool, error) {
-	imagesDir, err := os.Open(path)
-	if err != nil {
-		// no images
-		if os.IsNotExist(err) {
-			return true, nil
-		} else {
-			return false, err
-		}
-	}
-	defer imagesDir.Close()
-
-	names, err := ioutil.ReadDir(path)
-	if err != nil {
-		return false, err
-	}
-
-	if len(names) <= 1 {
-		return true, nil
-	}
-
-	return false, nil
+	return err
 }
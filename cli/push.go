@@ -1,175 +1,100 @@
 package cli
 
 import (
-  "github.com/blake-education/dogestry/remote"
-  "github.com/blake-education/dogestry/utils"
-  "encoding/json"
+	"fmt"
 
-  "archive/tar"
-  "fmt"
-  "io"
-  "io/ioutil"
-  "os"
-  "path/filepath"
-  "strings"
+	"github.com/blake-education/dogestry"
+	"github.com/blake-education/dogestry/internal/engine"
 )
 
-func (cli *DogestryCli) CmdPush(args ...string) error {
-  cmd := cli.Subcmd("push", "REMOTE IMAGE[:TAG]", "push IMAGE to the REMOTE. TAG defaults to 'latest'")
-  if err := cmd.Parse(args); err != nil {
-    return nil
-  }
-
-  if len(cmd.Args()) < 2 {
-    return fmt.Errorf("Error: IMAGE and REMOTE not specified")
-  }
-
-  remoteDef := cmd.Arg(0)
-  image := cmd.Arg(1)
-
-  imageRoot, err := cli.WorkDir(image)
-  if err != nil {
-    return err
-  }
-
-  remote, err := remote.NewRemote(remoteDef, cli.Config)
-  if err != nil {
-    return err
-  }
-
-  fmt.Println("remote", remote.Desc())
-
-  fmt.Println("preparing image")
-  if err := cli.prepareImage(image, imageRoot); err != nil {
-    return err
-  }
-
-  fmt.Println("pushing image to remote")
-  if err := remote.Push(image, imageRoot); err != nil {
-    return err
-  }
-
-  return nil
-}
-
-// Stream the tarball from docker and translate it into the portable repo format
-// Note that its easier to handle as a stream on the way out.
-func (cli *DogestryCli) prepareImage(image, root string) error {
-  reader, writer := io.Pipe()
-  defer writer.Close()
-  defer reader.Close()
-
-  tarball := tar.NewReader(reader)
-
-  errch := make(chan error)
-
-  go func() {
-    // consume the tar
-    for {
-      header, err := tarball.Next()
-      if err == io.EOF {
-        // end of tar archive
-        break
-      }
-      if err != nil {
-        errch <- err
-        return
-      }
-
-      if err := cli.processTarEntry(root, header, tarball); err != nil {
-        errch <- err
-        return
-      }
-    }
-
-    // donno... read a bit more?
-    if _, err := ioutil.ReadAll(reader); err != nil {
-      errch <- err
-      return
-    }
-
-    errch <- nil
-  }()
-
-  if err := cli.client.GetImageTarball(image, writer); err != nil {
-    // this should stop the tar reader
-    writer.Close()
-    <-errch
-    return err
-  }
-
-  writer.Close()
-
-  // wait for the tar reader
-  if err := <-errch; err != nil {
-    return err
-  }
-
-  return nil
-}
-
-func (cli *DogestryCli) processTarEntry(root string, header *tar.Header, tarball io.Reader) error {
-  // only handle files (directories are implicit)
-  if header.Typeflag == tar.TypeReg {
-    fmt.Printf("  tar: processing %s\n", header.Name)
-
-    // special case - repositories file
-    if filepath.Base(header.Name) == "repositories" {
-      if err := writeRepositories(root, tarball); err != nil {
-        return err
-      }
-
-    } else {
-      barename := strings.TrimPrefix(header.Name, "./")
-
-      dest := filepath.Join(root, "images", barename)
-      if err := os.MkdirAll(filepath.Dir(dest), os.ModeDir|0700); err != nil {
-        return err
-      }
-
-      destFile, err := os.Create(dest)
-      if err != nil {
-        return err
-      }
-      defer destFile.Close()
-
-      if wrote, err := io.Copy(destFile, tarball); err != nil {
-        return err
-      } else {
-        fmt.Printf("  tar: wrote %s\n", utils.HumanSize(wrote))
-      }
-      destFile.Close()
-    }
-  }
-
-  return nil
+func cmdPush(cli *engine.DogestryCli, args ...string) error {
+	cmd := cli.Subcmd("push", "REMOTE IMAGE[:TAG]...", "push each IMAGE to the REMOTE. TAG defaults to 'latest'")
+	concurrency := cmd.Int("concurrency", 0, "how many files to upload at once (default `concurrency` in the [dogestry] section, or 4)")
+	delta := cmd.Bool("delta", false, "upload big layers as deltas against the previous version of the tag, where that's much smaller (default `delta` in the [dogestry] section)")
+	compressionLevel := cmd.Int("compression-level", 0, "how hard to compress layers (default `level` in the [compressor] section, or the algorithm's default)")
+	noCompress := cmd.Bool("no-compress", false, "don't compress layers, e.g. when they're already full of compressed files")
+	dryRun := cmd.Bool("dry-run", false, "print what would be uploaded, without uploading anything")
+	force := cmd.Bool("force", false, "upload every file again, even ones the remote already has")
+	retries := cmd.Int("retries", 0, "how many times to retry a file which fails to upload (default `retries` in the [dogestry] section, or 3)")
+	var alsoTags engine.StringsFlag
+	cmd.Var(&alsoTags, "also-tag", "another tag to give each IMAGE on the REMOTE, in the same push. Can be given more than once")
+	applyTimeouts := cli.TimeoutFlags(cmd)
+	addComposeImages := engine.ComposeFlags(cmd)
+	registry := cmd.Bool("registry", false, "also write a registry v2 manifest for each tag, and gzipped layers, so registry clients can read the remote through a thin server (default `registry` in the [dogestry] section)")
+	squash := cmd.Bool("squash", false, "flatten each IMAGE into a single layer before pushing it. Its files and config are kept, but it shares no layers with other images")
+	ociDir := cmd.String("oci-dir", "", "push images from the OCI image layout in this dir, e.g. built by buildah or buildkit, rather than from docker")
+	ociArchive := cmd.String("oci-archive", "", "push images from this oci-archive, a tar of an OCI image layout, rather than from docker")
+	detailedExitCode := cmd.Bool("detailed-exit-code", false, fmt.Sprintf("exit %d, rather than 0, if the remote already had every file", engine.UpToDateStatus))
+	skipScan := cmd.Bool("skip-scan", false, "push without scanning for vulnerabilities first, in an emergency, when the [scan] section sets a scanner")
+	profileLayers := cmd.Bool("profile-layers", false, "print how long each layer took to compress and upload, its size before and after compression, and its upload throughput")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	if *force {
+		cli.Config.Dogestry.Force = true
+	}
+	applyTimeouts()
+
+	if *concurrency > 0 {
+		cli.Config.Dogestry.Concurrency = *concurrency
+	}
+	if *compressionLevel > 0 {
+		cli.Config.Compressor.Level = *compressionLevel
+	}
+	if *noCompress {
+		cli.Config.Compressor.Algorithm = ""
+	}
+	if *delta {
+		cli.Config.Dogestry.Delta = true
+	}
+	if *registry {
+		cli.Config.Dogestry.Registry = true
+	}
+	if *retries > 0 {
+		cli.Config.Dogestry.Retries = *retries
+	}
+
+	remoteDef, images := cli.RemoteArgs(cmd)
+	images, err := addComposeImages(images)
+	if err != nil {
+		return err
+	}
+	if remoteDef == "" || len(images) < 1 {
+		return engine.MissingArgs("push", "REMOTE and IMAGE (or -compose)")
+	}
+
+	opts := dogestry.PushOptions{
+		AlsoTags:      alsoTags,
+		Squash:        *squash,
+		DryRun:        *dryRun,
+		SkipScan:      *skipScan,
+		ProfileLayers: *profileLayers,
+		OCIDir:        *ociDir,
+	}
+	if *ociArchive != "" {
+		if *ociDir != "" {
+			return fmt.Errorf("Error: use one of -oci-dir and -oci-archive")
+		}
+
+		dir, err := cli.WorkDir("oci-archive")
+		if err != nil {
+			return err
+		}
+		fmt.Println("unpacking", *ociArchive)
+		if err := engine.ExtractOciArchive(*ociArchive, dir); err != nil {
+			return err
+		}
+		opts.OCIDir = dir
+	}
+
+	client, err := newClient(cli)
+	if err != nil {
+		return err
+	}
+	changed, err := client.PushImages(remoteDef, images, opts)
+	if err == nil && *detailedExitCode && !changed {
+		return engine.UpToDate("push")
+	}
+	return err
 }
-
-type Repository map[string]string
-
-func writeRepositories(root string, tarball io.Reader) error {
-  destRoot := filepath.Join(root, "repositories")
-
-  repositories := map[string]Repository{}
-  if err := json.NewDecoder(tarball).Decode(&repositories); err != nil {
-    return err
-  }
-
-  for repoName, repo := range repositories {
-    for tag, id := range repo {
-      dest := filepath.Join(destRoot, repoName, tag)
-
-      if err := os.MkdirAll(filepath.Dir(dest), os.ModeDir|0700); err != nil {
-        return err
-      }
-
-      if err := ioutil.WriteFile(dest, []byte(id), 0600); err != nil {
-        return err
-      }
-    }
-  }
-
-  return nil
-}
-
-
@@ -9,6 +9,8 @@ package client
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -22,6 +24,9 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/fsouza/go-dockerclient/engine"
 )
 
 const userAgent = "go-dockerclient"
@@ -41,6 +46,14 @@ type Client struct {
 	endpointURL *url.URL
 	client      *http.Client
 	out         io.WriteCloser
+	apiVersion  string
+	negotiation *negotiation
+}
+
+type negotiation struct {
+	once   sync.Once
+	choose func(server *engine.Env) (string, error)
+	err    error
 }
 
 // NewClient returns a Client instance ready for communication with the
@@ -58,7 +71,115 @@ func NewClient(endpoint string) (*Client, error) {
 	}, nil
 }
 
+// NewTLSClient returns a Client instance ready for TLS communications with
+// the given server endpoint, authenticating with the given key pair and
+// verifying the server's certificate against the given CA. An empty ca uses
+// the system's CAs, and an empty cert doesn't authenticate.
+func NewTLSClient(endpoint string, cert, key, ca string) (*Client, error) {
+	u, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, ErrInvalidEndpoint
+	}
+
+	tlsConfig := &tls.Config{}
+	if cert != "" {
+		tlsCert, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{tlsCert}
+	}
+
+	if ca != "" {
+		caCert, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("Could not add CA certificates from " + ca)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &Client{
+		endpoint:    endpoint,
+		endpointURL: u,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		out: os.Stdout,
+	}, nil
+}
+
+// NewDialClient returns a Client instance which makes its connections to the
+// server with dial, e.g. through a tunnel, rather than to endpoint itself.
+// endpoint is an http URL, used only to build request URLs.
+func NewDialClient(endpoint string, dial func() (net.Conn, error)) (*Client, error) {
+	u, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" {
+		return nil, ErrInvalidEndpoint
+	}
+	return &Client{
+		endpoint:    endpoint,
+		endpointURL: u,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return dial()
+				},
+			},
+		},
+		out: os.Stdout,
+	}, nil
+}
+
+// NegotiateAPIVersion makes the client ask the server for its version before
+// its first request. choose is given the server's version information and
+// returns the API version to make requests with, e.g. "1.12", or an error,
+// which every request then returns.
+func (c *Client) NegotiateAPIVersion(choose func(server *engine.Env) (string, error)) {
+	c.negotiation = &negotiation{choose: choose}
+}
+
+// APIVersion returns the API version requests are made with. It's empty
+// until one is negotiated, in which case requests use the server's default.
+func (c *Client) APIVersion() string {
+	return c.apiVersion
+}
+
+func (c *Client) negotiate() error {
+	n := c.negotiation
+	if n == nil {
+		return nil
+	}
+	n.once.Do(func() {
+		server, err := c.version()
+		if err == nil {
+			c.apiVersion, err = n.choose(server)
+		}
+		n.err = err
+	})
+	return n.err
+}
+
 func (c *Client) do(method, path string, data interface{}) ([]byte, int, error) {
+	if err := c.negotiate(); err != nil {
+		return nil, -1, err
+	}
+	return c.doRequest(method, path, data)
+}
+
+func (c *Client) doRequest(method, path string, data interface{}) ([]byte, int, error) {
 	var params io.Reader
 	if data != nil {
 		buf, err := json.Marshal(data)
@@ -109,9 +230,19 @@ func (c *Client) do(method, path string, data interface{}) ([]byte, int, error)
 }
 
 func (c *Client) stream(method, path string, in io.Reader, out io.Writer) error {
+	return c.streamWithHeaders(method, path, nil, in, out)
+}
+
+func (c *Client) streamWithHeaders(method, path string, headers map[string]string, in io.Reader, out io.Writer) error {
+	if err := c.negotiate(); err != nil {
+		return err
+	}
 	if (method == "POST" || method == "PUT") && in == nil {
 		in = bytes.NewReader(nil)
 	}
+	if out == nil {
+		out = ioutil.Discard
+	}
 	req, err := http.NewRequest(method, c.getURL(path), in)
 	if err != nil {
 		return err
@@ -120,6 +251,9 @@ func (c *Client) stream(method, path string, in io.Reader, out io.Writer) error
 	if method == "POST" {
 		req.Header.Set("Content-Type", "plain/text")
 	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
 
 	protocol := c.endpointURL.Scheme
 	var resp *http.Response
@@ -169,10 +303,8 @@ func (c *Client) stream(method, path string, in io.Reader, out io.Writer) error
 			}
 		}
 	} else {
-		if copied, err := io.Copy(out, resp.Body); err != nil {
+		if _, err := io.Copy(out, resp.Body); err != nil {
 			return err
-		} else {
-			fmt.Printf("copied %d B\n", copied)
 		}
 	}
 	return nil
@@ -183,6 +315,9 @@ func (c *Client) getURL(path string) string {
 	if c.endpointURL.Scheme == "unix" {
 		urlStr = ""
 	}
+	if c.apiVersion != "" {
+		urlStr += "/v" + c.apiVersion
+	}
 	return fmt.Sprintf("%s%s", urlStr, path)
 }
 
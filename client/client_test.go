@@ -0,0 +1,99 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient/engine"
+)
+
+func TestNegotiateAPIVersion(t *testing.T) {
+	paths := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path == "/version" {
+			fmt.Fprint(w, `{"Version":"24.0.0","ApiVersion":"1.43"}`)
+			return
+		}
+		fmt.Fprint(w, `[]`)
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.NegotiateAPIVersion(func(server *engine.Env) (string, error) {
+		return server.Get("ApiVersion"), nil
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.ListImages(false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if client.APIVersion() != "1.43" {
+		t.Errorf("negotiated %q", client.APIVersion())
+	}
+	want := []string{"/version", "/v1.43/images/json", "/v1.43/images/json"}
+	if fmt.Sprint(paths) != fmt.Sprint(want) {
+		t.Errorf("requested %v, want %v", paths, want)
+	}
+}
+
+func TestNegotiateAPIVersionError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ApiVersion":"1.99"}`)
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.NegotiateAPIVersion(func(server *engine.Env) (string, error) {
+		return "", fmt.Errorf("too new")
+	})
+
+	if _, err := client.InspectImage("app"); err == nil || err.Error() != "too new" {
+		t.Errorf("got %v", err)
+	}
+	// the version can still be asked for, e.g. by doctor
+	if version, err := client.Version(); err != nil || version.Get("ApiVersion") != "1.99" {
+		t.Errorf("got %v, %v", version, err)
+	}
+}
+
+func TestPullImageAuth(t *testing.T) {
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("X-Registry-Auth")
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.PullImage(PullImageOptions{Repository: "app"}, AuthConfiguration{}); err != nil || header != "" {
+		t.Errorf("an unauthenticated pull: sent %q, %v", header, err)
+	}
+
+	auth := AuthConfiguration{Username: "user", Password: "secret", ServerAddress: "registry.example.com"}
+	if err := client.PullImage(PullImageOptions{Repository: "app"}, auth); err != nil {
+		t.Fatal(err)
+	}
+	data, err := base64.URLEncoding.DecodeString(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := AuthConfiguration{}
+	if err := json.Unmarshal(data, &sent); err != nil || sent != auth {
+		t.Errorf("sent %+v, %v", sent, err)
+	}
+}
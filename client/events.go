@@ -0,0 +1,77 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// APIEvents represents an event returned by the API.
+type APIEvents struct {
+	Status string `json:"status,omitempty"`
+	ID     string `json:"id,omitempty"`
+	From   string `json:"from,omitempty"`
+	Time   int64  `json:"time,omitempty"`
+
+	// Newer daemons describe the object the event is about here
+	Actor APIActor `json:"Actor,omitempty"`
+}
+
+// APIActor represents the object an event is about.
+type APIActor struct {
+	ID         string            `json:"ID,omitempty"`
+	Attributes map[string]string `json:"Attributes,omitempty"`
+}
+
+// MonitorEvents streams events from the daemon to listener until the
+// connection is closed or an error occurs.
+func (c *Client) MonitorEvents(listener chan<- *APIEvents) error {
+	if err := c.negotiate(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", c.getURL("/events"), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	protocol := c.endpointURL.Scheme
+	var resp *http.Response
+	if protocol == "unix" {
+		address := c.endpointURL.Path
+		dial, err := net.Dial(protocol, address)
+		if err != nil {
+			return err
+		}
+		clientconn := httputil.NewClientConn(dial, nil)
+		resp, err = clientconn.Do(req)
+		defer clientconn.Close()
+	} else {
+		resp, err = c.client.Do(req)
+	}
+
+	if err != nil {
+		if strings.Contains(err.Error(), "connection refused") {
+			return ErrConnectionRefused
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return newError(resp.StatusCode, nil)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event APIEvents
+		if err := dec.Decode(&event); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		listener <- &event
+	}
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"io"
@@ -12,6 +13,18 @@ var (
 	ErrNoSuchImage = errors.New("No such image")
 )
 
+// This work with api verion < v1.7 and > v1.9
+type APIImages struct {
+	ID          string   `json:"Id"`
+	RepoTags    []string `json:",omitempty"`
+	Created     int64
+	Size        int64
+	VirtualSize int64
+	ParentId    string `json:",omitempty"`
+	Repository  string `json:",omitempty"`
+	Tag         string `json:",omitempty"`
+}
+
 type Port string
 
 // Note: the Config structure should hold only portable information about the container.
@@ -57,6 +70,25 @@ type Image struct {
 	Size            int64
 }
 
+func (c *Client) ListImages(all bool) ([]APIImages, error) {
+	path := "/images/json?all="
+	if all {
+		path += "1"
+	} else {
+		path += "0"
+	}
+	body, _, err := c.do("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	var images []APIImages
+	err = json.Unmarshal(body, &images)
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
 func (c *Client) InspectImage(name string) (*Image, error) {
 	body, status, err := c.do("GET", "/images/"+name+"/json", nil)
 	if status == http.StatusNotFound {
@@ -80,3 +112,56 @@ func (c *Client) GetImageTarball(imageName string, w io.Writer) error {
 func (c *Client) PostImageTarball(r io.Reader) error {
 	return c.stream("POST", "/images/load", r, nil)
 }
+
+type TagImageOptions struct {
+	Repo  string `qs:"repo"`
+	Tag   string `qs:"tag"`
+	Force bool   `qs:"force"`
+}
+
+// TagImage adds a tag to the image identified by the given name.
+func (c *Client) TagImage(name string, opts TagImageOptions) error {
+	path := "/images/" + name + "/tag?" + queryString(&opts)
+	return c.stream("POST", path, nil, nil)
+}
+
+func (c *Client) SetImageTag(imageName, tag string, force bool) error {
+	return c.TagImage(imageName, TagImageOptions{Repo: tag, Force: force})
+}
+
+// AuthConfiguration is the authentication to pull with, for the registry at
+// ServerAddress.
+type AuthConfiguration struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Email         string `json:"email,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+
+	// an identity token, which some credential helpers give instead of a password
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// the X-Registry-Auth header newer daemons take auth in
+func (auth AuthConfiguration) headers() map[string]string {
+	if auth == (AuthConfiguration{}) {
+		return nil
+	}
+	data, _ := json.Marshal(auth)
+	return map[string]string{"X-Registry-Auth": base64.URLEncoding.EncodeToString(data)}
+}
+
+type PullImageOptions struct {
+	Repository   string `qs:"fromImage"`
+	Registry     string
+	OutputStream io.Writer `qs:"-"`
+}
+
+// PullImage pulls an image from a registry, logging progress to
+// opts.OutputStream. An empty auth pulls unauthenticated.
+func (c *Client) PullImage(opts PullImageOptions, auth AuthConfiguration) error {
+	if opts.Repository == "" {
+		return ErrNoSuchImage
+	}
+	path := "/images/create?" + queryString(&opts)
+	return c.streamWithHeaders("POST", path, auth.headers(), nil, opts.OutputStream)
+}
@@ -0,0 +1,26 @@
+package client
+
+import (
+	"bytes"
+
+	"github.com/fsouza/go-dockerclient/engine"
+)
+
+// Version returns version information about the docker server. It doesn't
+// negotiate the API version, so it works whatever the server's version.
+func (c *Client) Version() (*engine.Env, error) {
+	return c.version()
+}
+
+func (c *Client) version() (*engine.Env, error) {
+	body, _, err := c.doRequest("GET", "/version", nil)
+	if err != nil {
+		return nil, err
+	}
+	// decoded here, as engine.Output decodes in the background
+	var version engine.Env
+	if err := version.Decode(bytes.NewReader(body)); err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"github.com/blake-education/dogestry/cli"
+	"github.com/blake-education/dogestry/utils"
+)
+
+func main() {
+	// so no secret is ever printed, whichever error or log it's in
+	if err := utils.RedactOutput(); err != nil {
+		log.Fatal(err)
+	}
+
+	err := cli.ParseCommands(os.Args[1:]...)
+
+	if err != nil {
+		var sterr *cli.StatusError
+		if errors.As(err, &sterr) {
+			if sterr.Status != "" {
+				log.Println(sterr.Status)
+			}
+			utils.Exit(sterr.StatusCode)
+		}
+		utils.LogError(err)
+		utils.Exit(cli.ExitStatus(err))
+	}
+	utils.Exit(0)
+}
@@ -5,52 +5,141 @@ import (
 
   "os"
   "os/exec"
+  "strconv"
   "strings"
   "fmt"
 
   "io"
 )
 
+var (
+  // the extension compressed files get for each algorithm.
+  // This is how pull knows how to decompress a file.
+  Extensions = map[string]string{
+    "zstd": ".zst",
+    "lz4":  ".lz4",
+  }
+
+  DefaultZstdLevel = 3
+
+  // lz4 is low compression, but extremely fast. Good for fast networks and slow pull hosts
+  DefaultLz4Level = 1
+
+  // the highest level each algorithm supports
+  MaxLevels = map[string]int{
+    "zstd": 19,
+    "lz4":  12,
+  }
+)
+
 type Compressor struct {
-  lz4Path string
+  // the algorithm used to compress. Empty for no compression
+  Algorithm string
+  Level     int
+
+  config config.CompressorConfig
 }
 
 
 func NewCompressor(config config.Config) (Compressor, error) {
-  lz4 := config.Compressor.Lz4
-  if lz4 == "" {
-    lz4 = "lz4"
+  cmp := Compressor{
+    Algorithm: config.Compressor.Algorithm,
+    Level:     config.Compressor.Level,
+    config:    config.Compressor,
   }
 
-  path,err := exec.LookPath(lz4)
-  if err != nil {
-    return Compressor{}, fmt.Errorf("can't find executable lz4 on the $PATH")
+  if cmp.Algorithm == "" {
+    return cmp, nil
   }
 
-  return Compressor{
-    lz4Path: path,
-  }, nil
+  if _, ok := Extensions[cmp.Algorithm]; !ok {
+    return Compressor{}, fmt.Errorf("unknown compression algorithm '%s'", cmp.Algorithm)
+  }
+
+  if cmp.Level < 0 || cmp.Level > MaxLevels[cmp.Algorithm] {
+    return Compressor{}, fmt.Errorf("%s compression level must be between 1 and %d", cmp.Algorithm, MaxLevels[cmp.Algorithm])
+  }
+
+  // fail early, rather than part way through a push
+  if _, err := cmp.executable(cmp.Algorithm); err != nil {
+    return Compressor{}, err
+  }
+
+  return cmp, nil
 }
 
 
+// the path of the executable for algorithm
+func (cmp Compressor) executable(algorithm string) (string, error) {
+  name := algorithm
+  switch algorithm {
+  case "zstd":
+    if cmp.config.Zstd != "" {
+      name = cmp.config.Zstd
+    }
+  case "lz4":
+    if cmp.config.Lz4 != "" {
+      name = cmp.config.Lz4
+    }
+  case "xdelta3":
+    if cmp.config.Xdelta3 != "" {
+      name = cmp.config.Xdelta3
+    }
+  }
+
+  path,err := exec.LookPath(name)
+  if err != nil {
+    return "", fmt.Errorf("can't find executable %s on the $PATH", name)
+  }
+  return path, nil
+}
+
 
-// compress using lz4
-// would use go version if we could (needs a streaming version)
-// lz4 is low compression, but extremely fast
+// compress the file at path with the configured algorithm, replacing it with
+// one named with the algorithm's extension
 func (cmp Compressor) Compress(path string) error {
-  compressedPath := path + ".lz4"
+  if cmp.Algorithm == "" {
+    return nil
+  }
 
-  err := exec.Command(cmp.lz4Path, path, compressedPath).Run()
+  bin, err := cmp.executable(cmp.Algorithm)
   if err != nil {
     return err
   }
 
+  compressedPath := path + Extensions[cmp.Algorithm]
+
+  var cmd *exec.Cmd
+  switch cmp.Algorithm {
+  case "zstd":
+    level := cmp.Level
+    if level == 0 {
+      level = DefaultZstdLevel
+    }
+    cmd = exec.Command(bin, "-q", "-f", "-"+strconv.Itoa(level), path, "-o", compressedPath)
+  case "lz4":
+    level := cmp.Level
+    if level == 0 {
+      level = DefaultLz4Level
+    }
+    cmd = exec.Command(bin, "-q", "-f", "-"+strconv.Itoa(level), path, compressedPath)
+  }
+
+  if out, err := cmd.CombinedOutput(); err != nil {
+    return fmt.Errorf("compressing %s with %s: %s\noutput: %s", path, cmp.Algorithm, err, out)
+  }
+
   return os.Remove(path)
 }
 
 
 func (cmp Compressor) CompressReader(r io.Reader) (out io.Reader, err error) {
-  cmd := exec.Command(cmp.lz4Path, "-")
+  lz4Path, err := cmp.executable("lz4")
+  if err != nil {
+    return
+  }
+
+  cmd := exec.Command(lz4Path, "-")
 
   cmd.Stdin = r
   out,err = cmd.StdoutPipe()
@@ -67,21 +156,80 @@ func (cmp Compressor) CompressReader(r io.Reader) (out io.Reader, err error) {
 }
 
 
+// Whether the file at path was compressed by Compress.
+func IsCompressed(path string) bool {
+  return algorithmFor(path) != ""
+}
+
+// the algorithm a file was compressed with, going by its extension
+func algorithmFor(path string) string {
+  for algorithm, ext := range Extensions {
+    if strings.HasSuffix(path, ext) {
+      return algorithm
+    }
+  }
+  return ""
+}
+
+
+// Decompress the file at path, whichever algorithm it was compressed with,
+// replacing it with the uncompressed file. Files which aren't compressed are left alone.
 func (cmp Compressor) Decompress(path string) error {
-  if !strings.HasSuffix(path, ".lz4") {
+  algorithm := algorithmFor(path)
+  if algorithm == "" {
+    return nil
+  }
+
+  if _, err := os.Stat(path); os.IsNotExist(err) {
     return nil
   }
 
-  uncompressedPath := strings.TrimSuffix(path, ".lz4")
+  bin, err := cmp.executable(algorithm)
+  if err != nil {
+    return err
+  }
 
-  if _, err := os.Stat(path); !os.IsNotExist(err) {
-    cmd := exec.Command(cmp.lz4Path, "-d", "-f", path, uncompressedPath)
-    if err := cmd.Run(); err != nil {
-      return err
-    }
+  uncompressedPath := strings.TrimSuffix(path, Extensions[algorithm])
+
+  var cmd *exec.Cmd
+  switch algorithm {
+  case "zstd":
+    cmd = exec.Command(bin, "-d", "-q", "-f", path, "-o", uncompressedPath)
+  case "lz4":
+    cmd = exec.Command(bin, "-d", "-q", "-f", path, uncompressedPath)
+  }
 
-    return os.Remove(path)
+  if out, err := cmd.CombinedOutput(); err != nil {
+    return fmt.Errorf("decompressing %s with %s: %s\noutput: %s", path, algorithm, err, out)
   }
 
+  return os.Remove(path)
+}
+
+
+// write the difference between base and target to delta, using xdelta3
+func (cmp Compressor) Delta(base, target, delta string) error {
+  bin, err := cmp.executable("xdelta3")
+  if err != nil {
+    return err
+  }
+
+  if out, err := exec.Command(bin, "-e", "-f", "-s", base, target, delta).CombinedOutput(); err != nil {
+    return fmt.Errorf("diffing %s against %s: %s\noutput: %s", target, base, err, out)
+  }
+  return nil
+}
+
+
+// rebuild target from base and a delta written by Delta
+func (cmp Compressor) Patch(base, delta, target string) error {
+  bin, err := cmp.executable("xdelta3")
+  if err != nil {
+    return err
+  }
+
+  if out, err := exec.Command(bin, "-d", "-f", "-s", base, delta, target).CombinedOutput(); err != nil {
+    return fmt.Errorf("applying delta %s to %s: %s\noutput: %s", delta, base, err, out)
+  }
   return nil
 }
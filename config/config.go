@@ -1,28 +1,268 @@
 package config
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
 	"code.google.com/p/gcfg"
 )
 
 type RemoteConfig struct {
 	Url string
+
+	// tags matching any of these patterns (e.g. '*:v*', or '*' for all) can't be overwritten, except with -force
+	Immutable_Tags []string
+
+	// encrypt images pushed to the remote with the 256 bit key in this file,
+	// and decrypt them on pull. Empty for no encryption
+	Encryption_Key_File string
+
+	// encrypt each image with its own key instead, wrapped by this AWS KMS
+	// key (an id, arn or alias/name), or by this executable
+	Kms_Key_Id  string
+	Kms_Region  string
+	Kms_Command string
+
+	// or wrapped for these age or gpg public keys, so only hosts with one of
+	// their private keys can pull. Hosts decrypt with their age identity
+	// files, or their gpg keyring
+	Age_Recipient     []string
+	Age_Identity_File []string
+	Gpg_Recipient     []string
+
+	// read the encryption key, or the S3 keys for this remote, from these
+	// vault paths instead. See VaultConfig
+	Encryption_Key_Vault_Path string
+	S3_Vault_Path             string
+
+	// while an existing remote is being encrypted, still pull the images
+	// pushed to it before, which aren't. Otherwise an encrypted remote's image
+	// files must all be encrypted, so plaintext put in their place is refused
+	Allow_Unencrypted bool
+
+	// refuse to write to this remote: push, lock, anything
+	Readonly bool
 }
 
 type S3Config struct {
 	Access_Key_Id string
 	Secret_Key    string
+
+	// read the keys from this vault path instead, e.g. secret/data/dogestry/s3,
+	// or aws/creds/<role> for short lived keys
+	Vault_Path string
 }
 
 type CompressorConfig struct {
-	Lz4 string
+	Lz4     string
+	Zstd    string
+	Xdelta3 string
+
+	// compress layers on push with this algorithm, e.g. zstd. Empty for no compression
+	Algorithm string
+	Level     int
+}
+
+type CacheConfig struct {
+	// where compressed layers are kept between pushes and pulls. Empty for no cache
+	Dir     string
+	Size_Mb int64
+
+	// layers are removed to keep this much space free on the cache's filesystem
+	Min_Free_Mb int64
 }
 
 type DockerConfig struct {
 	Connection string
 }
 
+type ContainerdConfig struct {
+	// the ctr executable, and containerd's socket. Empty for ctr's defaults
+	Ctr     string
+	Address string
+
+	// the namespace pull -containerd imports images into. Kubernetes uses k8s.io
+	Namespace string
+}
+
+type SigningConfig struct {
+	// a PEM ECDSA or RSA private key to sign pushed images with. Empty to not sign them
+	Key string
+
+	// PEM public keys pulled images must be signed with, and whether images
+	// must be signed at all
+	Trusted_Keys string
+	Require      bool
+
+	// read the private key from this vault path instead of `key`
+	Key_Vault_Path string
+}
+
+// Where secrets configured with vault paths are read from. Hosts log in with
+// AppRole if there's a role id, otherwise with a token.
+type VaultConfig struct {
+	// default $VAULT_ADDR
+	Address   string
+	Ca_Cert   string
+	Namespace string
+
+	// default $VAULT_TOKEN, then ~/.vault-token
+	Token_File string
+
+	// the secret id defaults to $VAULT_SECRET_ID
+	Role_Id        string
+	Secret_Id_File string
+	Approle_Mount  string
+}
+
+// Scanning images for vulnerabilities before they're pushed
+type ScanConfig struct {
+	// trivy or grype. Empty to not scan
+	Scanner string
+
+	// the scanner's executable. Default the scanner, on the $PATH
+	Command string
+
+	// refuse to push images with findings this severe or worse: low, medium,
+	// high or critical. Default high
+	Severity string
+
+	// scan with trivy's server, so hosts needn't download its vulnerability db
+	Server string
+
+	// don't count vulnerabilities there's no fix for yet
+	Ignore_Unfixed bool
+}
+
+// Securing `dogestry server`: TLS, client certificates signed by client-ca,
+// and bearer tokens, each allowed to push or pull some repos.
+type ServerConfig struct {
+	Tls_Cert  string
+	Tls_Key   string
+	Client_Ca string
+
+	// lines of TOKEN SCOPE..., see the Readme
+	Tokens_File string
+
+	// how many pushes and pulls run at once; the rest wait their turn. Default 4
+	Max_Jobs int
+
+	// how many finished jobs are kept, default 1000, and for how long, a
+	// duration, default 24h
+	Keep_Jobs     int
+	Keep_Jobs_For string
+}
+
+// Sending each push's and pull's duration, bytes and result to statsd
+type StatsdConfig struct {
+	// host:port. Default $DOGESTRY_STATSD. Empty to not send any
+	Address string
+
+	// metric names start with this, e.g. <prefix>.push.duration. Default dogestry
+	Prefix string
+
+	// tag metrics with the command, remote, image and result, as dogstatsd does,
+	// and with these tags too, e.g. env:ci
+	Dogstatsd bool
+	Tag       []string
+}
+
+// Exporting spans of pushes and pulls to an OpenTelemetry collector
+type TracingConfig struct {
+	// the collector's OTLP/http traces url, e.g. http://localhost:4318/v1/traces.
+	// Default $OTEL_EXPORTER_OTLP_TRACES_ENDPOINT. Empty to not trace
+	Endpoint string
+
+	// key=value, e.g. an api key. Added to $OTEL_EXPORTER_OTLP_HEADERS
+	Header []string
+
+	// default $OTEL_SERVICE_NAME, then dogestry
+	Service_Name string
+}
+
+type TrustConfig struct {
+	// the remote's root metadata, as first trusted. Pulls check images against
+	// the remote's signed targets when it's set
+	Root string
+
+	// where the metadata versions pulls have seen are kept. Default ~/.dogestry/trust
+	Dir string
+
+	// how long targets signed by pushes stay valid, e.g. 168h. Default a week
+	Targets_Expiry string
+}
+
+// Logging to syslog or journald rather than stdout and stderr
+type LogConfig struct {
+	// stdout, syslog or journald. Default stdout, i.e. stdout and stderr
+	Output string
+
+	// syslog's facility, e.g. daemon or local0, default user, and the tag
+	// entries have, default dogestry
+	Facility string
+	Tag      string
+
+	// a remote syslog server, e.g. udp://logs:514. Default the local one
+	Address string
+}
+
+// Commands run before and after each push and pull, with sh -c. A pre hook
+// which fails stops the push or pull. See the Readme for their environment
+type HooksConfig struct {
+	Pre_Push  []string
+	Post_Push []string
+	Pre_Pull  []string
+	Post_Pull []string
+}
+
 type DogestryConfig struct {
-	Temp_Dir string
+	// the remote commands use when they're not given one, a name or url
+	Default_Remote string
+
+	Temp_Dir         string
+	Credentials_File string
+
+	// refuse to start a push or pull with less than this free where images
+	// are staged. Default 1000
+	Temp_Dir_Min_Free_Mb int64
+
+	// where `dogestry login` keeps credentials: keychain or file. Default the
+	// keychain if there is one. The file's passphrase can be kept in a file too
+	Credential_Store string
+	Passphrase_File  string
+
+	// read s3 keys and [credentials] sections from this file, which are
+	// otherwise ignored, as they're stored in plaintext
+	Plaintext_Credentials bool
+
+	Stats_File  string
+	Concurrency int
+	Retries     int
+	Stream_Pull bool
+	Delta       bool
+
+	// also write a registry v2 view of pushed images to the remote
+	Registry bool
+
+	// other hosts running `dogestry peer`, asked for layers before the remote
+	Peer []string
+
+	// repos `dogestry watch` pushes when they're tagged, e.g. myorg/*
+	Watch_Filter []string
+
+	// give up on push, pull or search after this long, and on a request
+	// which has been idle this long. Durations, e.g. 30m. Empty for never
+	Timeout         string
+	Request_Timeout string
+
+	// transfer everything, even files which look like they're already there. Set by -force
+	Force bool
+
+	// refuse to write to any remote, e.g. on production pull hosts. Also set by $DOGESTRY_READONLY
+	Readonly bool
 }
 
 type Config struct {
@@ -30,10 +270,75 @@ type Config struct {
 	S3         S3Config
 	Compressor CompressorConfig
 	Docker     DockerConfig
+	Cache      CacheConfig
+	Containerd ContainerdConfig
+	Signing    SigningConfig
+	Trust      TrustConfig
+	Vault      VaultConfig
+	Server     ServerConfig
+	Scan       ScanConfig
+	Statsd     StatsdConfig
+	Tracing    TracingConfig
+	Log        LogConfig
+	Hooks      HooksConfig
 	Dogestry   DogestryConfig
+
+	Credentials map[string]*RemoteCredentials
+
+	// where credentials from `dogestry login` are loaded from, when they're needed
+	CredentialStore CredentialStore
 }
 
-func ParseConfig(configFilePath string) (config Config, err error) {
-	err = gcfg.ReadFileInto(&config, configFilePath)
+// Parses dogestry.cfg, or a yaml config (see ParseYAML), with profile's keys
+// laid over the rest. Only yaml configs have profiles.
+func ParseConfig(configFilePath, profile string) (config Config, err error) {
+	return ParseConfigFiles([]string{configFilePath}, profile)
+}
+
+// Parses each of paths in turn, most general first, so each file's keys
+// override the ones before's. In dogestry.cfg files lists add to the lists
+// before, unless they're reset with an empty value first, e.g. `peer=`.
+// profile must be in at least one of the yaml files.
+func ParseConfigFiles(paths []string, profile string) (config Config, err error) {
+	found := profile == ""
+	for _, path := range paths {
+		if IsYAML(path) {
+			var has bool
+			if has, err = parseYAMLInto(&config, path, profile); err != nil {
+				return
+			}
+			found = found || has
+		} else if err = gcfg.ReadFileInto(&config, path); err != nil {
+			return
+		}
+	}
+
+	if !found {
+		err = fmt.Errorf("no profile '%s' in %s, only yaml configs have profiles", profile, strings.Join(paths, ", "))
+	}
 	return
 }
+
+// Parses a duration from the config, e.g. 30m. Empty is zero.
+func ParseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// where the trust metadata seen by pulls is kept. Overridable with `dir` in the [trust] section.
+func TrustDirPath(config Config) string {
+	if config.Trust.Dir != "" {
+		return config.Trust.Dir
+	}
+	return filepath.Join(os.Getenv("HOME"), ".dogestry", "trust")
+}
+
+// where push and pull stats are logged. Overridable with `stats-file` in the [dogestry] section.
+func StatsFilePath(config Config) string {
+	if config.Dogestry.Stats_File != "" {
+		return config.Dogestry.Stats_File
+	}
+	return filepath.Join(os.Getenv("HOME"), ".dogestry", "stats.log")
+}
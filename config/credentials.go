@@ -0,0 +1,108 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"code.google.com/p/gcfg"
+)
+
+// Credentials for a single remote, as stored by `dogestry login`.
+type RemoteCredentials struct {
+	Access_Key_Id string `json:"access_key_id"`
+	Secret_Key    string `json:"secret_key"`
+}
+
+// The plaintext credentials file `dogestry login` wrote before there was a
+// CredentialStore. It's still read, and the encrypted store's file goes beside
+// it. It's overridable with `credentials-file` in the [dogestry] section.
+func CredentialsFilePath(config Config) string {
+	if config.Dogestry.Credentials_File != "" {
+		return config.Dogestry.Credentials_File
+	}
+	return filepath.Join(os.Getenv("HOME"), ".dogestry", "credentials")
+}
+
+// Reads the credentials file at path into config.
+// A missing credentials file isn't an error.
+func ParseCredentials(config *Config, path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	creds := Config{}
+	if err := gcfg.ReadFileInto(&creds, path); err != nil {
+		return fmt.Errorf("reading credentials file %s: %w", path, err)
+	}
+
+	if config.Credentials == nil {
+		config.Credentials = make(map[string]*RemoteCredentials)
+	}
+	for name, remoteCreds := range creds.Credentials {
+		config.Credentials[name] = remoteCreds
+	}
+
+	return nil
+}
+
+// Drops the keys in the config file, which are plaintext, unless it has
+// `plaintext-credentials`. Returns whether it had any.
+func IgnorePlaintextKeys(config *Config) bool {
+	if config.Dogestry.Plaintext_Credentials {
+		return false
+	}
+
+	found := config.S3.Access_Key_Id != "" || config.S3.Secret_Key != "" || len(config.Credentials) > 0
+	config.S3.Access_Key_Id, config.S3.Secret_Key = "", ""
+	config.Credentials = nil
+	return found
+}
+
+// Removes the credentials for remoteName from the plaintext credentials file
+// at path, e.g. once they're in the store. The file is removed once it's empty.
+func RemoveCredentials(path, remoteName string) error {
+	creds := Config{}
+	if err := ParseCredentials(&creds, path); err != nil {
+		return err
+	}
+	if _, ok := creds.Credentials[remoteName]; !ok {
+		return nil
+	}
+	delete(creds.Credentials, remoteName)
+
+	if len(creds.Credentials) == 0 {
+		return os.Remove(path)
+	}
+
+	names := make([]string, 0, len(creds.Credentials))
+	for name := range creds.Credentials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		c := creds.Credentials[name]
+		fmt.Fprintf(&buf, "[credentials %s]\n", quoteValue(name))
+		fmt.Fprintf(&buf, "  access-key-id=%s\n", quoteValue(c.Access_Key_Id))
+		fmt.Fprintf(&buf, "  secret-key=%s\n\n", quoteValue(c.Secret_Key))
+	}
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	// WriteFile doesn't change the mode of an existing file
+	return os.Chmod(path, 0600)
+}
+
+func quoteValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return `"` + value + `"`
+}
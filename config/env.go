@@ -0,0 +1,166 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blake-education/dogestry/utils"
+)
+
+// Every config key can be set in the environment instead, as
+// DOGESTRY_<SECTION>_<KEY>, e.g. DOGESTRY_S3_VAULT_PATH, or for remotes
+// DOGESTRY_REMOTE_<NAME>_<KEY>, e.g. DOGESTRY_REMOTE_CENTRAL_URL. The
+// [dogestry] section's keys don't need the section, e.g. DOGESTRY_CONCURRENCY.
+// Lists are comma separated.
+//
+// The environment overrides the config file, and options override both.
+
+const EnvPrefix = "DOGESTRY_"
+
+// variables which are read where they're used instead. $DOGESTRY_READONLY
+// only ever makes remotes readonly, never writable
+var envUsedElsewhere = map[string]bool{
+	"DOGESTRY_READONLY": true,
+}
+
+// Sets the config keys environ's DOGESTRY_ variables name, and returns the
+// variables it used. environ is as os.Environ() has it. Variables which
+// aren't config keys are left alone, as some, e.g. $DOGESTRY_PASSPHRASE, are
+// read where they're used.
+func ApplyEnv(config *Config, environ []string) ([]string, error) {
+	used := make([]string, 0)
+	for _, pair := range environ {
+		i := strings.Index(pair, "=")
+		if i == -1 || !strings.HasPrefix(pair[:i], EnvPrefix) || envUsedElsewhere[pair[:i]] {
+			continue
+		}
+		name, value := pair[:i], pair[i+1:]
+		if strings.HasSuffix(name, "SECRET_KEY") {
+			utils.AddSecret(value)
+		}
+
+		field, ok := envField(config, name)
+		if !ok {
+			continue
+		}
+		if err := setEnvValue(field, value); err != nil {
+			return used, fmt.Errorf("$%s: %w", name, err)
+		}
+		used = append(used, name)
+	}
+	sort.Strings(used)
+	return used, nil
+}
+
+// the field of config the variable name is for, creating the remote it's in if needs be
+func envField(config *Config, name string) (reflect.Value, bool) {
+	rest := strings.TrimPrefix(name, EnvPrefix)
+
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		section := t.Field(i)
+		sectionName := envName(section.Name)
+
+		switch section.Type.Kind() {
+		case reflect.Struct:
+			key := strings.TrimPrefix(rest, sectionName+"_")
+			if key == rest && section.Name != "Dogestry" {
+				continue
+			}
+			if field, ok := envStructField(v.Field(i), key); ok {
+				return field, true
+			}
+
+		case reflect.Map:
+			if !strings.HasPrefix(rest, sectionName+"_") {
+				continue
+			}
+			nameAndKey := strings.TrimPrefix(rest, sectionName+"_")
+			elemType := section.Type.Elem().Elem()
+			for j := 0; j < elemType.NumField(); j++ {
+				key := envName(elemType.Field(j).Name)
+				if !strings.HasSuffix(nameAndKey, "_"+key) || len(nameAndKey) == len(key)+1 {
+					continue
+				}
+				entryName := envMapKey(v.Field(i), strings.TrimSuffix(nameAndKey, "_"+key))
+
+				m := v.Field(i)
+				if m.IsNil() {
+					m.Set(reflect.MakeMap(m.Type()))
+				}
+				entry := m.MapIndex(reflect.ValueOf(entryName))
+				if !entry.IsValid() {
+					entry = reflect.New(elemType)
+					m.SetMapIndex(reflect.ValueOf(entryName), entry)
+				}
+
+				return entry.Elem().Field(j), true
+			}
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func envStructField(v reflect.Value, key string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" && envName(t.Field(i).Name) == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// The configured remote name is for, e.g. my-remote for MY_REMOTE, or name
+// lowercased if there's none.
+func envMapKey(m reflect.Value, name string) string {
+	for _, key := range m.MapKeys() {
+		if envName(key.String()) == name {
+			return key.String()
+		}
+	}
+	return strings.ToLower(name)
+}
+
+// e.g. IMMUTABLE_TAGS for Immutable_Tags, or MY_REMOTE for my-remote
+func envName(name string) string {
+	return strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+func setEnvValue(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+
+	case reflect.Bool:
+		b, err := parseYAMLBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number '%s'", value)
+		}
+		field.SetInt(n)
+
+	case reflect.Slice:
+		items := make([]string, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+
+	default:
+		return fmt.Errorf("can't be set in the environment")
+	}
+	return nil
+}
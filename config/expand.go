@@ -0,0 +1,95 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Config values can use environment variables, as ${VAR}, or ${VAR:-default}
+// for when VAR isn't set, e.g. url=s3://builds-${AWS_ACCOUNT}/?region=${AWS_REGION},
+// so one config can be shared between accounts and regions. Only the braced
+// form is expanded, so a $ anywhere else is left as it is.
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// Expands the ${VAR}s in every value in config. It's an error for a
+// variable without a default not to be set, rather than, say, pushing to the
+// wrong bucket.
+func ExpandEnv(config *Config) error {
+	return expandValue(reflect.ValueOf(config).Elem(), "")
+}
+
+func expandValue(v reflect.Value, key string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return expandValue(v.Elem(), key)
+
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" || field.Type.Kind() == reflect.Interface {
+				continue
+			}
+			name := strings.ToLower(strings.Replace(field.Name, "_", "-", -1))
+			if key != "" {
+				name = key + "." + name
+			}
+			if err := expandValue(v.Field(i), name); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		names := make([]string, 0, v.Len())
+		for _, name := range v.MapKeys() {
+			names = append(names, name.String())
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := expandValue(v.MapIndex(reflect.ValueOf(name)), key+"."+name); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandValue(v.Index(i), key); err != nil {
+				return err
+			}
+		}
+
+	case reflect.String:
+		expanded, err := expandString(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		v.SetString(expanded)
+	}
+	return nil
+}
+
+func expandString(s string) (string, error) {
+	var err error
+	expanded := envReference.ReplaceAllStringFunc(s, func(ref string) string {
+		match := envReference.FindStringSubmatch(ref)
+		if value, ok := os.LookupEnv(match[1]); ok && value != "" {
+			return value
+		}
+		if match[2] != "" {
+			return match[3]
+		}
+		if err == nil {
+			err = fmt.Errorf("$%s isn't set", match[1])
+		}
+		return ref
+	})
+	return expanded, err
+}
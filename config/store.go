@@ -0,0 +1,351 @@
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/blake-education/dogestry/utils"
+)
+
+// Where `dogestry login` keeps credentials: the OS keychain where there is
+// one, otherwise a file encrypted with a passphrase.
+type CredentialStore interface {
+	// the stored credentials by remote name or url. Empty if there are none
+	Load() (map[string]*RemoteCredentials, error)
+	Save(creds map[string]*RemoteCredentials) error
+	Desc() string
+}
+
+// Asks the user for a passphrase, e.g. on the terminal
+type PassphrasePrompt func(prompt string) (string, error)
+
+var (
+	// the keychain item credentials are stored as
+	KeychainService = "dogestry"
+	KeychainAccount = "credentials"
+
+	// PBKDF2 iterations deriving the credentials file's key from its passphrase
+	PassphraseIterations = 600000
+
+	ErrWrongPassphrase = errors.New("wrong passphrase for the credentials store")
+)
+
+// The store `credential-store` in the [dogestry] section asks for: keychain
+// or file. By default, the keychain if there is one.
+func NewCredentialStore(config Config, prompt PassphrasePrompt) (CredentialStore, error) {
+	kind := config.Dogestry.Credential_Store
+	if kind == "" {
+		if keychainAvailable() {
+			kind = "keychain"
+		} else {
+			kind = "file"
+		}
+	}
+
+	switch kind {
+	case "keychain":
+		if !keychainAvailable() {
+			return nil, fmt.Errorf("no keychain: credential-store=keychain needs macOS's security, or secret-tool and a dbus session on linux")
+		}
+		return &keychainStore{}, nil
+	case "file":
+		return &encryptedFileStore{path: EncryptedCredentialsFilePath(config), passphraseFile: config.Dogestry.Passphrase_File, prompt: prompt}, nil
+	}
+	return nil, fmt.Errorf("invalid credential-store '%s' in the [dogestry] section, use keychain or file", kind)
+}
+
+// where the passphrase protected store is. Next to the old plaintext credentials file
+func EncryptedCredentialsFilePath(config Config) string {
+	return CredentialsFilePath(config) + ".enc"
+}
+
+func keychainAvailable() bool {
+	switch runtime.GOOS {
+	case "darwin":
+		_, err := exec.LookPath("security")
+		return err == nil
+	case "linux":
+		// secret-tool talks to the keyring over the session bus, which headless hosts don't have
+		_, err := exec.LookPath("secret-tool")
+		return err == nil && os.Getenv("DBUS_SESSION_BUS_ADDRESS") != ""
+	}
+	return false
+}
+
+// Keeps the credentials, as json, in the macOS keychain with `security`, or
+// the freedesktop secret service (e.g. gnome-keyring) with `secret-tool`.
+type keychainStore struct {
+	lock  sync.Mutex
+	creds map[string]*RemoteCredentials
+}
+
+func (store *keychainStore) Desc() string {
+	return "the " + runtime.GOOS + " keychain"
+}
+
+func (store *keychainStore) Load() (map[string]*RemoteCredentials, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.creds != nil {
+		return store.creds, nil
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "find-generic-password", "-s", KeychainService, "-a", KeychainAccount, "-w")
+	} else {
+		cmd = exec.Command("secret-tool", "lookup", "service", KeychainService, "account", KeychainAccount)
+	}
+
+	// both fail when there's no such item
+	out, err := cmd.Output()
+	data := bytes.TrimSpace(out)
+	if err != nil || len(data) == 0 {
+		store.creds = make(map[string]*RemoteCredentials)
+		return store.creds, nil
+	}
+
+	creds := make(map[string]*RemoteCredentials)
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("invalid credentials in the keychain: %w", err)
+	}
+	store.creds = creds
+	return creds, nil
+}
+
+func (store *keychainStore) Save(creds map[string]*RemoteCredentials) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	data, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+
+	// the secret goes on stdin, never in arguments other users can see
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -X %s\n", KeychainService, KeychainAccount, hex.EncodeToString(data)))
+	} else {
+		cmd = exec.Command("secret-tool", "store", "--label=dogestry credentials", "service", KeychainService, "account", KeychainAccount)
+		cmd.Stdin = bytes.NewReader(data)
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s\noutput: %s", cmd.Args[0], err, out)
+	}
+	store.creds = creds
+	return nil
+}
+
+// Keeps the credentials in a file, encrypted with AES-256-GCM under a key
+// derived from a passphrase with PBKDF2. The passphrase is read from
+// $DOGESTRY_PASSPHRASE, `passphrase-file` in the [dogestry] section, or
+// asked for.
+type encryptedFileStore struct {
+	path           string
+	passphraseFile string
+	prompt         PassphrasePrompt
+
+	lock       sync.Mutex
+	passphrase string
+	creds      map[string]*RemoteCredentials
+}
+
+type encryptedCredentials struct {
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func (store *encryptedFileStore) Desc() string {
+	return store.path + ", encrypted with a passphrase"
+}
+
+func (store *encryptedFileStore) Load() (map[string]*RemoteCredentials, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.creds != nil {
+		return store.creds, nil
+	}
+
+	data, err := ioutil.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		store.creds = make(map[string]*RemoteCredentials)
+		return store.creds, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	file := encryptedCredentials{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %w", store.path, err)
+	}
+
+	passphrase, err := store.getPassphrase(false)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := passphraseCipher(passphrase, file.Salt, file.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, file.Nonce, file.Ciphertext, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	creds := make(map[string]*RemoteCredentials)
+	if err := json.Unmarshal(plaintext, &creds); err != nil {
+		return nil, fmt.Errorf("invalid credentials in %s: %w", store.path, err)
+	}
+	store.creds = creds
+	return creds, nil
+}
+
+func (store *encryptedFileStore) Save(creds map[string]*RemoteCredentials) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	_, err := os.Stat(store.path)
+	passphrase, err := store.getPassphrase(os.IsNotExist(err))
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+
+	file := encryptedCredentials{Iterations: PassphraseIterations, Salt: make([]byte, 16)}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return err
+	}
+	aead, err := passphraseCipher(passphrase, file.Salt, file.Iterations)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	file.Ciphertext = aead.Seal(nil, file.Nonce, plaintext, nil)
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(store.path), 0700); err != nil {
+		return err
+	}
+	// written aside then renamed, so a failed write doesn't lose every credential
+	tmp := store.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, store.path); err != nil {
+		return err
+	}
+
+	store.creds = creds
+	return nil
+}
+
+// The store's passphrase, asked for twice when it's a new one.
+func (store *encryptedFileStore) getPassphrase(isNew bool) (string, error) {
+	if store.passphrase != "" {
+		return store.passphrase, nil
+	}
+
+	passphrase := os.Getenv("DOGESTRY_PASSPHRASE")
+	if store.passphraseFile != "" {
+		data, err := ioutil.ReadFile(store.passphraseFile)
+		if err != nil {
+			return "", fmt.Errorf("reading passphrase-file: %w", err)
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+
+	if passphrase == "" && store.prompt != nil {
+		var err error
+		if passphrase, err = store.prompt("Passphrase for " + store.path + ": "); err != nil {
+			return "", err
+		}
+		if isNew {
+			again, err := store.prompt("Passphrase again: ")
+			if err != nil {
+				return "", err
+			}
+			if again != passphrase {
+				return "", fmt.Errorf("the passphrases don't match")
+			}
+		}
+	}
+
+	if passphrase == "" {
+		return "", fmt.Errorf("no passphrase for %s. Set $DOGESTRY_PASSPHRASE, or `passphrase-file` in the [dogestry] section", store.path)
+	}
+	store.passphrase = passphrase
+	utils.AddSecret(passphrase)
+	return passphrase, nil
+}
+
+func passphraseCipher(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	if iterations < 1 {
+		return nil, fmt.Errorf("invalid credentials file: no key derivation iterations")
+	}
+	block, err := aes.NewCipher(pbkdf2([]byte(passphrase), salt, iterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PBKDF2 with HMAC-SHA256, from RFC 2898
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLen)
+
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+
+		t := make([]byte, len(u))
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
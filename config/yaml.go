@@ -0,0 +1,635 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The yaml config: the same sections and keys as dogestry.cfg, e.g.
+//
+//   dogestry:
+//     concurrency: 8
+//   defaults:
+//     immutable-tags: ['*:v*']
+//   remotes:
+//     central:
+//       url: s3://ops-goodies/docker-repo/?region=us-west-2
+//   profiles:
+//     ci:
+//       dogestry:
+//         concurrency: 32
+//
+// `defaults` are keys every remote has unless it sets them itself, and each
+// of `profiles` is more config, laid over the rest when it's chosen.
+//
+// Only as much yaml as config needs is understood: nested mappings, lists of
+// values, as `- value` lines or [a, b], and plain or quoted values.
+
+// whether path is a yaml config rather than a gcfg one
+func IsYAML(path string) bool {
+	return strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml")
+}
+
+func ParseYAML(path, profile string) (config Config, err error) {
+	found, err := parseYAMLInto(&config, path, profile)
+	if err == nil && !found {
+		err = fmt.Errorf("%s: no profile '%s'", path, profile)
+	}
+	return
+}
+
+// Sets the keys in the yaml config at path, with profile's, if it has it,
+// laid over the rest, and whether it had it.
+func parseYAMLInto(config *Config, path, profile string) (found bool, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	root, err := parseYAML(string(data))
+	if err != nil {
+		return false, fmt.Errorf("%s:%w", path, err)
+	}
+	if root.fields == nil {
+		return profile == "", nil
+	}
+
+	if root, found, err = mergeYAMLProfile(root, profile); err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	if err = decodeYAML(root, reflect.ValueOf(config).Elem()); err != nil {
+		return found, fmt.Errorf("%s:%w", path, err)
+	}
+	return found, nil
+}
+
+// A mapping, a list or a value, from the line it starts on.
+type yamlNode struct {
+	line   int
+	value  string
+	list   []*yamlNode
+	fields map[string]*yamlNode
+	keys   []string
+
+	// the value before it was formatted, for nodes from config
+	typed interface{}
+}
+
+func (n *yamlNode) set(key string, value *yamlNode) {
+	if _, ok := n.fields[key]; !ok {
+		n.keys = append(n.keys, key)
+	}
+	n.fields[key] = value
+}
+
+// Lays profile's keys, or the file's own profile's, over root's, and
+// defaults' keys under each remote's. Also whether root had profile.
+func mergeYAMLProfile(root *yamlNode, profile string) (*yamlNode, bool, error) {
+	profiles := root.fields["profiles"]
+	found := profile == ""
+	if profile == "" {
+		if chosen := root.fields["profile"]; chosen != nil && chosen.value != "" {
+			if profiles == nil || profiles.fields[chosen.value] == nil {
+				return nil, false, fmt.Errorf("no profile '%s'", chosen.value)
+			}
+			profile = chosen.value
+		}
+	}
+
+	layered := root
+	if profiles != nil && profiles.fields[profile] != nil {
+		layered = mergeYAML(root, profiles.fields[profile])
+		found = true
+	}
+	defaults := layered.fields["defaults"]
+
+	merged := &yamlNode{line: root.line, fields: make(map[string]*yamlNode)}
+	for _, key := range layered.keys {
+		switch node := layered.fields[key]; key {
+		case "profiles", "profile", "defaults":
+		case "remotes", "remote":
+			if defaults != nil && node.fields != nil {
+				remotes := &yamlNode{line: node.line, fields: make(map[string]*yamlNode)}
+				for _, name := range node.keys {
+					remotes.set(name, mergeYAML(defaults, node.fields[name]))
+				}
+				node = remotes
+			}
+			merged.set(key, node)
+		default:
+			merged.set(key, node)
+		}
+	}
+	return merged, found, nil
+}
+
+// over's keys laid over under's, mappings merged and anything else replaced
+func mergeYAML(under, over *yamlNode) *yamlNode {
+	if under == nil || under.fields == nil || over.fields == nil {
+		return over
+	}
+
+	merged := &yamlNode{line: over.line, fields: make(map[string]*yamlNode)}
+	for _, key := range under.keys {
+		merged.set(key, under.fields[key])
+	}
+	for _, key := range over.keys {
+		merged.set(key, mergeYAML(merged.fields[key], over.fields[key]))
+	}
+	return merged
+}
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+func parseYAML(data string) (*yamlNode, error) {
+	lines := make([]yamlLine, 0)
+	for i, text := range strings.Split(data, "\n") {
+		text = strings.TrimRight(stripYAMLComment(text), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("%d: indent with spaces, not tabs", i+1)
+		}
+		lines = append(lines, yamlLine{number: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+
+	if len(lines) == 0 {
+		return &yamlNode{}, nil
+	}
+
+	node, next, err := parseYAMLBlock(lines, 0, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if next < len(lines) {
+		return nil, fmt.Errorf("%d: unexpected indent", lines[next].number)
+	}
+	if node.fields == nil {
+		return nil, fmt.Errorf("%d: expected sections, e.g. 'dogestry:'", lines[0].number)
+	}
+	return node, nil
+}
+
+// the mapping or list of lines[i:] indented by indent, and the line after it
+func parseYAMLBlock(lines []yamlLine, i, indent int) (*yamlNode, int, error) {
+	if isYAMLListItem(lines[i].text) {
+		return parseYAMLList(lines, i, indent)
+	}
+
+	node := &yamlNode{line: lines[i].number, fields: make(map[string]*yamlNode)}
+	for i < len(lines) && lines[i].indent == indent {
+		line := lines[i]
+		if isYAMLListItem(line.text) {
+			return nil, i, fmt.Errorf("%d: expected a key, got a list item", line.number)
+		}
+
+		key, value, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, i, fmt.Errorf("%d: expected 'key: value', got '%s'", line.number, line.text)
+		}
+		if _, dup := node.fields[key]; dup {
+			return nil, i, fmt.Errorf("%d: '%s' is set twice", line.number, key)
+		}
+		i++
+
+		var child *yamlNode
+		var err error
+		switch {
+		case value != "":
+			child, err = parseYAMLValue(value, line.number)
+		case i < len(lines) && lines[i].indent > indent:
+			child, i, err = parseYAMLBlock(lines, i, lines[i].indent)
+		case i < len(lines) && lines[i].indent == indent && isYAMLListItem(lines[i].text):
+			// a list needn't be indented under its key
+			child, i, err = parseYAMLList(lines, i, indent)
+		default:
+			child = &yamlNode{line: line.number}
+		}
+		if err != nil {
+			return nil, i, err
+		}
+		node.set(key, child)
+	}
+
+	if i < len(lines) && lines[i].indent > indent {
+		return nil, i, fmt.Errorf("%d: unexpected indent", lines[i].number)
+	}
+	return node, i, nil
+}
+
+func parseYAMLList(lines []yamlLine, i, indent int) (*yamlNode, int, error) {
+	node := &yamlNode{line: lines[i].number, list: make([]*yamlNode, 0)}
+	for i < len(lines) && lines[i].indent == indent && isYAMLListItem(lines[i].text) {
+		line := lines[i]
+		item := strings.TrimSpace(strings.TrimPrefix(line.text, "-"))
+		if _, _, ok := splitYAMLKey(item); ok || item == "" {
+			return nil, i, fmt.Errorf("%d: only lists of values are supported", line.number)
+		}
+
+		value, err := parseYAMLValue(item, line.number)
+		if err != nil {
+			return nil, i, err
+		}
+		node.list = append(node.list, value)
+		i++
+	}
+	return node, i, nil
+}
+
+func isYAMLListItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// key: value, or key: for a block under it. Keys may be quoted
+func splitYAMLKey(text string) (key, value string, ok bool) {
+	if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'") {
+		end := strings.Index(text[1:], text[:1])
+		if end == -1 {
+			return "", "", false
+		}
+		key, text = text[1:end+1], text[end+2:]
+		if text != ":" && !strings.HasPrefix(text, ": ") {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(text[1:]), true
+	}
+
+	if strings.HasSuffix(text, ":") && !strings.Contains(text, ": ") {
+		return text[:len(text)-1], "", true
+	}
+	i := strings.Index(text, ": ")
+	if i == -1 {
+		return "", "", false
+	}
+	return text[:i], strings.TrimSpace(text[i+2:]), true
+}
+
+func parseYAMLValue(text string, line int) (*yamlNode, error) {
+	if strings.HasPrefix(text, "[") {
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("%d: unterminated list '%s'", line, text)
+		}
+		node := &yamlNode{line: line, list: make([]*yamlNode, 0)}
+		for _, item := range splitYAMLFlow(text[1 : len(text)-1]) {
+			value, err := parseYAMLScalar(item, line)
+			if err != nil {
+				return nil, err
+			}
+			node.list = append(node.list, &yamlNode{line: line, value: value})
+		}
+		return node, nil
+	}
+	if strings.HasPrefix(text, "{") || strings.HasPrefix(text, "|") || strings.HasPrefix(text, ">") ||
+		strings.HasPrefix(text, "&") || strings.HasPrefix(text, "*") {
+		return nil, fmt.Errorf("%d: '%s' isn't supported, use a plain or quoted value", line, text)
+	}
+
+	value, err := parseYAMLScalar(text, line)
+	if err != nil {
+		return nil, err
+	}
+	return &yamlNode{line: line, value: value}, nil
+}
+
+func parseYAMLScalar(text string, line int) (string, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return "", fmt.Errorf("%d: invalid quoted value %s", line, text)
+		}
+		return value, nil
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return "", fmt.Errorf("%d: invalid quoted value %s", line, text)
+		}
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	case text == "~" || text == "null":
+		return "", nil
+	}
+	return text, nil
+}
+
+// the items of a [a, b] list, which may be quoted and contain commas
+func splitYAMLFlow(text string) []string {
+	items := make([]string, 0)
+	var quote byte
+	start := 0
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(text[start:]); last != "" || len(items) > 0 {
+		items = append(items, last)
+	}
+	return items
+}
+
+// text without its # comment, if it has one outside quotes
+func stripYAMLComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && startsYAMLScalar(text[:i]):
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// whether a scalar starts after before, so a quote there opens a quoted
+// value, rather than being part of a plain one like ops' team
+func startsYAMLScalar(before string) bool {
+	trimmed := strings.TrimRight(before, " \t")
+	if trimmed == "" || strings.HasSuffix(trimmed, "[") || strings.HasSuffix(trimmed, ",") {
+		return true
+	}
+	// key: 'value' and - 'item', but not a-'b'
+	return trimmed != before && (strings.HasSuffix(trimmed, ":") || strings.HasSuffix(trimmed, "-"))
+}
+
+// Sets v from node, matching keys to fields as gcfg does, e.g. immutable-tags
+// to Immutable_Tags. Keys missing from node leave their fields as they are.
+func decodeYAML(node *yamlNode, v reflect.Value) error {
+	// e.g. a section with nothing in it yet
+	empty := node.fields == nil && node.list == nil && node.value == ""
+	if empty && (v.Kind() == reflect.Struct || v.Kind() == reflect.Map) {
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeYAML(node, v.Elem())
+
+	case reflect.Struct:
+		if node.fields == nil {
+			return fmt.Errorf("%d: expected keys, got '%s'", node.line, node.value)
+		}
+		for _, key := range node.keys {
+			field := yamlField(v, key)
+			if !field.IsValid() {
+				return fmt.Errorf("%d: unknown key '%s'", node.fields[key].line, key)
+			}
+			if err := decodeYAML(node.fields[key], field); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		if node.fields == nil {
+			return fmt.Errorf("%d: expected names, e.g. of remotes, got '%s'", node.line, node.value)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for _, key := range node.keys {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if existing := v.MapIndex(reflect.ValueOf(key)); existing.IsValid() {
+				elem.Set(existing)
+			}
+			if err := decodeYAML(node.fields[key], elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key), elem)
+		}
+
+	case reflect.Slice:
+		items := node.list
+		if items == nil {
+			if node.fields != nil {
+				return fmt.Errorf("%d: expected a list", node.line)
+			}
+			items = []*yamlNode{node}
+		}
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := decodeYAML(item, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+
+	case reflect.String:
+		if node.fields != nil || node.list != nil {
+			return fmt.Errorf("%d: expected a value", node.line)
+		}
+		v.SetString(node.value)
+
+	case reflect.Bool:
+		b, err := parseYAMLBool(node.value)
+		if err != nil {
+			return fmt.Errorf("%d: %w", node.line, err)
+		}
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(node.value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%d: invalid number '%s'", node.line, node.value)
+		}
+		v.SetInt(n)
+
+	default:
+		return fmt.Errorf("%d: can't be set in config", node.line)
+	}
+	return nil
+}
+
+func parseYAMLBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0", "":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean '%s'", value)
+}
+
+// the field of struct v key names, or an invalid value if there's none
+func yamlField(v reflect.Value, key string) reflect.Value {
+	name := strings.ToLower(strings.Replace(key, "-", "_", -1))
+	// the remotes section, as it reads better in yaml
+	if name == "remotes" {
+		name = "remote"
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" || field.Type.Kind() == reflect.Interface {
+			continue
+		}
+		if strings.ToLower(field.Name) == name {
+			return v.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// config as yaml, in the same layout ParseYAML reads, without the keys
+// which aren't set. Secret keys are masked, and credentials left out.
+func FormatYAML(config Config) string {
+	root := configNode(reflect.ValueOf(config))
+	if root == nil {
+		return ""
+	}
+	lines := make([]string, 0)
+	formatYAMLNode(root, "", &lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// config as maps, lists and values, for printing as json
+func ConfigMap(config Config) map[string]interface{} {
+	root := configNode(reflect.ValueOf(config))
+	if root == nil {
+		return map[string]interface{}{}
+	}
+	return nodeInterface(root).(map[string]interface{})
+}
+
+// the node of v, or nil if it's not set
+func configNode(v reflect.Value) *yamlNode {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return configNode(v.Elem())
+
+	case reflect.Struct:
+		node := &yamlNode{fields: make(map[string]*yamlNode)}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			// credentials are secret, and the store is code
+			if field.PkgPath != "" || field.Name == "Credentials" || field.Type.Kind() == reflect.Interface {
+				continue
+			}
+			child := configNode(v.Field(i))
+			if child == nil {
+				continue
+			}
+			if field.Name == "Secret_Key" {
+				child.value, child.typed = "<redacted>", "<redacted>"
+			}
+			key := strings.ToLower(strings.Replace(field.Name, "_", "-", -1))
+			if key == "remote" {
+				key = "remotes"
+			}
+			node.set(key, child)
+		}
+		if len(node.keys) == 0 {
+			return nil
+		}
+		return node
+
+	case reflect.Map:
+		names := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			names = append(names, key.String())
+		}
+		sort.Strings(names)
+
+		node := &yamlNode{fields: make(map[string]*yamlNode)}
+		for _, name := range names {
+			if child := configNode(v.MapIndex(reflect.ValueOf(name))); child != nil {
+				node.set(name, child)
+			}
+		}
+		if len(node.keys) == 0 {
+			return nil
+		}
+		return node
+
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return nil
+		}
+		node := &yamlNode{list: make([]*yamlNode, v.Len())}
+		for i := 0; i < v.Len(); i++ {
+			node.list[i] = &yamlNode{value: fmt.Sprint(v.Index(i).Interface()), typed: v.Index(i).Interface()}
+		}
+		return node
+
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64:
+		if v.IsZero() {
+			return nil
+		}
+		return &yamlNode{value: fmt.Sprint(v.Interface()), typed: v.Interface()}
+	}
+	return nil
+}
+
+func formatYAMLNode(node *yamlNode, indent string, lines *[]string) {
+	for _, key := range node.keys {
+		child := node.fields[key]
+		switch {
+		case child.fields != nil:
+			*lines = append(*lines, indent+formatYAMLScalar(key)+":")
+			formatYAMLNode(child, indent+"  ", lines)
+		case child.list != nil:
+			*lines = append(*lines, indent+formatYAMLScalar(key)+":")
+			for _, item := range child.list {
+				*lines = append(*lines, indent+"  - "+formatYAMLScalar(item.value))
+			}
+		default:
+			*lines = append(*lines, indent+formatYAMLScalar(key)+": "+formatYAMLScalar(child.value))
+		}
+	}
+}
+
+// value, quoted if it would otherwise read as something else
+func formatYAMLScalar(value string) string {
+	if value == "" || value == "~" || value == "null" || strings.TrimSpace(value) != value ||
+		strings.ContainsAny(value[:1], "[]{}'\"&*!|>%@`#-?,:") ||
+		strings.Contains(value, ": ") || strings.Contains(value, " #") || strings.ContainsAny(value, "\n\t") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+func nodeInterface(node *yamlNode) interface{} {
+	switch {
+	case node.fields != nil:
+		m := make(map[string]interface{}, len(node.keys))
+		for _, key := range node.keys {
+			m[key] = nodeInterface(node.fields[key])
+		}
+		return m
+	case node.list != nil:
+		l := make([]interface{}, len(node.list))
+		for i, item := range node.list {
+			l[i] = item.typed
+		}
+		return l
+	}
+	return node.typed
+}
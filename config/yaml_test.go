@@ -0,0 +1,149 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the node at path in root, e.g. "dogestry.concurrency"
+func yamlAt(root *yamlNode, path string) *yamlNode {
+	node := root
+	for _, key := range strings.Split(path, ".") {
+		if node == nil || node.fields == nil {
+			return nil
+		}
+		node = node.fields[key]
+	}
+	return node
+}
+
+// node's value, or its items' joined with |
+func yamlString(node *yamlNode) string {
+	if node.list == nil {
+		return node.value
+	}
+	values := make([]string, len(node.list))
+	for i, item := range node.list {
+		values[i] = item.value
+	}
+	return strings.Join(values, "|")
+}
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		// values by path, or the error
+		want map[string]string
+		err  string
+	}{
+		{
+			name: "comments",
+			yaml: "# dogestry\ndogestry: # the section\n  # a whole line\n  concurrency: 8 # trailing\n  temp-dir: /tmp/#not-a-comment\n  owner: ops' team # it's theirs\n  group: a-'b # c'\n",
+			want: map[string]string{"dogestry.concurrency": "8", "dogestry.temp-dir": "/tmp/#not-a-comment", "dogestry.owner": "ops' team", "dogestry.group": "a-'b"},
+		},
+		{
+			name: "quoting",
+			yaml: "dogestry:\n  double: \"a: b # c\"\n  single: 'it''s'\n  escaped: \"tab\\there\"\n  empty: ''\n  \"quoted key\": x\n  tilde: ~\n  null: null\n",
+			want: map[string]string{
+				"dogestry.double":     "a: b # c",
+				"dogestry.single":     "it's",
+				"dogestry.escaped":    "tab\there",
+				"dogestry.empty":      "",
+				"dogestry.quoted key": "x",
+				"dogestry.tilde":      "",
+				"dogestry.null":       "",
+			},
+		},
+		{
+			name: "lists",
+			yaml: "defaults:\n  immutable-tags:\n    - '*:v*'\n    - latest\n  flow: [a, \"b, c\", 'd']\n  empty: []\nhooks:\n  pre-push:\n  - echo one\n  - echo two\n",
+			want: map[string]string{
+				"defaults.immutable-tags": "*:v*|latest",
+				"defaults.flow":           "a|b, c|d",
+				"defaults.empty":          "",
+				"hooks.pre-push":          "echo one|echo two",
+			},
+		},
+		{
+			name: "crlf",
+			yaml: "---\r\ndogestry:\r\n  concurrency: 8\r\n  temp-dir: '/tmp/x'\r\nremotes:\r\n  central:\r\n    url: s3://bucket/\r\n",
+			want: map[string]string{"dogestry.concurrency": "8", "dogestry.temp-dir": "/tmp/x", "remotes.central.url": "s3://bucket/"},
+		},
+		{
+			name: "empty section",
+			yaml: "dogestry:\nremotes:\n",
+			want: map[string]string{"dogestry": "", "remotes": ""},
+		},
+		{name: "duplicate key", yaml: "dogestry:\n  concurrency: 8\n  concurrency: 4\n", err: "3: 'concurrency' is set twice"},
+		{name: "duplicate section", yaml: "dogestry:\n  concurrency: 8\ndogestry:\n  retries: 2\n", err: "3: 'dogestry' is set twice"},
+		{name: "tab", yaml: "dogestry:\n\tconcurrency: 8\n", err: "2: indent with spaces, not tabs"},
+		{name: "tab after spaces", yaml: "dogestry:\n  \tconcurrency: 8\n", err: "2: indent with spaces, not tabs"},
+		{name: "anchor", yaml: "defaults: &defaults\n  url: s3://bucket/\n", err: "1: '&defaults' isn't supported"},
+		{name: "alias", yaml: "remotes:\n  central: *defaults\n", err: "2: '*defaults' isn't supported"},
+		{name: "flow mapping", yaml: "dogestry: {concurrency: 8}\n", err: "isn't supported"},
+		{name: "block scalar", yaml: "hooks:\n  pre-push: |\n    echo\n", err: "isn't supported"},
+		{name: "list of mappings", yaml: "hooks:\n  pre-push:\n    - run: echo\n", err: "3: only lists of values are supported"},
+		{name: "unterminated list", yaml: "defaults:\n  immutable-tags: [a, b\n", err: "2: unterminated list"},
+		{name: "unterminated quote", yaml: "dogestry:\n  temp-dir: \"/tmp\n", err: "2: invalid quoted value"},
+		{name: "unexpected indent", yaml: "dogestry:\n  concurrency: 8\n    retries: 2\n", err: "3: unexpected indent"},
+		{name: "no key", yaml: "dogestry:\n  concurrency\n", err: "2: expected 'key: value'"},
+		{name: "no sections", yaml: "- a\n- b\n", err: "1: expected sections"},
+	}
+
+	for _, test := range tests {
+		root, err := parseYAML(test.yaml)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		for path, want := range test.want {
+			node := yamlAt(root, path)
+			if node == nil {
+				t.Errorf("%s: no %s", test.name, path)
+			} else if got := yamlString(node); got != want {
+				t.Errorf("%s: %s: got %q, want %q", test.name, path, got, want)
+			}
+		}
+	}
+}
+
+func TestParseYAMLFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dogestry.yaml")
+	yaml := "dogestry:\r\n  concurrency: 8 # more on ci\r\ndefaults:\r\n  immutable-tags: ['*:v*']\r\nremotes:\r\n  central:\r\n    url: s3://bucket/\r\nprofiles:\r\n  ci:\r\n    dogestry:\r\n      concurrency: 32\r\n"
+	if err := ioutil.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ParseYAML(path, "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Dogestry.Concurrency != 32 {
+		t.Errorf("concurrency: got %d, want 32", config.Dogestry.Concurrency)
+	}
+	central := config.Remote["central"]
+	if central == nil || central.Url != "s3://bucket/" || len(central.Immutable_Tags) != 1 || central.Immutable_Tags[0] != "*:v*" {
+		t.Errorf("central: got %+v", central)
+	}
+
+	if _, err := ParseYAML(path, "missing"); err == nil || !strings.Contains(err.Error(), "no profile 'missing'") {
+		t.Errorf("a missing profile: got %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("dogestry:\n  concurrency: lots\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseYAML(path, ""); err == nil || !strings.Contains(err.Error(), path+":2: invalid number 'lots'") {
+		t.Errorf("an invalid number: got %v", err)
+	}
+}
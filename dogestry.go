@@ -0,0 +1,257 @@
+// Package dogestry pushes docker images to remotes, such as s3 buckets, and
+// pulls them back, for programs which embed dogestry rather than running the
+// dogestry command, which is in cmd/dogestry.
+//
+// Unlike the cli package, which the command is built from, what this package
+// exports is kept compatible between versions. The command's push and pull
+// are built on it.
+//
+//	client, err := dogestry.New(dogestry.Options{})
+//	...
+//	err = client.Pull("central", "myapp:v1")
+//
+// Nothing is printed unless Options.Output is set, which is then written what
+// the command would print. To show progress, set Options.Progress, which is
+// called with typed events as each file is transferred.
+package dogestry
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/internal/engine"
+	"github.com/blake-education/dogestry/remote"
+)
+
+// A repo:tag on a remote, and the id of the image it points to.
+type Tag = remote.Tag
+
+// Something that happened during a push or pull: a file it's transferring,
+// by Key, starting, being retried, failing or being done, with its Bytes, its
+// progress, or the push or pull as a whole being complete.
+type Event = remote.Event
+
+const (
+	EventStarted  = remote.EventStarted
+	EventRetrying = remote.EventRetrying
+	EventFailed   = remote.EventFailed
+	EventDone     = remote.EventDone
+
+	// a file's Bytes so far, each second it's transferring
+	EventProgress = remote.EventProgress
+
+	// the last event of every push, pull or verify. Key is the image, Bytes
+	// how many were transferred, and Error is set if it failed
+	EventComplete = remote.EventComplete
+)
+
+type Options struct {
+	// the config to use. If nil, it's read as the command reads it: from
+	// ConfigFile, or the config files found in the current dir, the user's
+	// config dir and /etc/dogestry, with the environment's DOGESTRY_ variables
+	// laid over it
+	Config *config.Config
+
+	ConfigFile string
+
+	// the config file profile to use, as -config-profile
+	Profile string
+
+	// the docker to push from and pull into, as -docker-host. Default the
+	// config's, or docker's own
+	DockerHost string
+
+	// where images are staged during pushes and pulls, as -work-dir. Default
+	// the config's temp-dir, or $TMPDIR
+	WorkDir string
+
+	// where to print what pushes and pulls are doing, as the command prints
+	// it. Nothing is printed if it's nil
+	Output io.Writer
+
+	// called with each push, pull or verify's events as they happen, from
+	// whichever goroutine is transferring, so it must be safe to call from
+	// several at once, and quick. Pushes and pulls run at the same time
+	// interleave their events. To receive them on a channel, send to it from
+	// here
+	Progress func(Event)
+}
+
+// Pushes and pulls with one config. It's safe to use from several goroutines
+// at once: each push or pull has its own work dir.
+type Client struct {
+	cli *engine.DogestryCli
+}
+
+// How to push images, besides the config.
+type PushOptions struct {
+	// more tags to give each image on the remote, in the same repo, as
+	// -also-tag
+	AlsoTags []string
+
+	// flatten each image into a single layer before pushing it, as -squash
+	Squash bool
+
+	// print what would be uploaded to Output, without uploading anything
+	DryRun bool
+
+	// push without scanning for vulnerabilities, when the [scan] section
+	// sets a scanner
+	SkipScan bool
+
+	// print how long each layer took and its size to Output, as
+	// -profile-layers
+	ProfileLayers bool
+
+	// push from the OCI image layout in this dir, rather than from docker
+	OCIDir string
+}
+
+// How to pull images, besides the config.
+type PullOptions struct {
+	// write images to the OCI image layout in this dir, rather than loading
+	// them into docker
+	OCIDir string
+
+	// import images into this containerd namespace, rather than loading them
+	// into docker
+	ContainerdNamespace string
+
+	// pull images for this os/arch, e.g. linux/arm64, from tags with an image
+	// per platform. Default docker's platform
+	Platform string
+
+	// also tag the pulled image as this repo[:tag] in docker. Only for a
+	// single image
+	TagAs string
+
+	// pull to the docker on each of these hosts, e.g. tcp://app-1:2375,
+	// rather than the local one, HostConcurrency at once (default 4). Each
+	// image is downloaded once and sent to every host which needs it
+	Hosts           []string
+	HostConcurrency int
+
+	// don't check layers and configs against the digests recorded when they
+	// were pushed
+	SkipVerify bool
+
+	// print what would be downloaded to Output, without downloading anything
+	DryRun bool
+
+	// print how long each layer took and its size to Output, as
+	// -profile-layers
+	ProfileLayers bool
+}
+
+func New(opts Options) (*Client, error) {
+	var cfg config.Config
+	if opts.Config != nil {
+		cfg = *opts.Config
+	} else {
+		var err error
+		if cfg, err = engine.LoadConfig(opts.ConfigFile, opts.Profile); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.DockerHost != "" {
+		cfg.Docker.Connection = opts.DockerHost
+	}
+
+	dogestryCli, err := engine.NewDogestryCli(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	workDir := opts.WorkDir
+	if workDir == "" {
+		workDir = cfg.Dogestry.Temp_Dir
+	}
+	dogestryCli.SetWorkDir(workDir)
+	dogestryCli.SetProgress(opts.Progress)
+
+	output := opts.Output
+	if output == nil {
+		output = ioutil.Discard
+	}
+	dogestryCli.SetOutput(output)
+
+	return &Client{cli: dogestryCli}, nil
+}
+
+// Pushes image from docker to remoteDef, a remote's name in the config or
+// its url.
+func (c *Client) Push(remoteDef, image string) error {
+	_, err := c.PushImages(remoteDef, []string{image}, PushOptions{})
+	return err
+}
+
+// Pushes image to remoteDef from tarball, as `docker save` writes it, without
+// docker.
+func (c *Client) PushTarball(remoteDef, image string, tarball io.Reader) error {
+	_, err := c.cli.Push(remoteDef, []string{image}, engine.PushOptions{Tarball: tarball})
+	return err
+}
+
+// Pushes each of images to remoteDef, one after another, so layers they share
+// are only uploaded once. Images can have wildcards, e.g. 'myorg/app:*',
+// matching docker's tags. One failing doesn't stop the others. Returns
+// whether anything was uploaded: false if the remote already had it all.
+func (c *Client) PushImages(remoteDef string, images []string, opts PushOptions) (bool, error) {
+	return c.cli.Push(remoteDef, images, engine.PushOptions{
+		AlsoTags:      opts.AlsoTags,
+		Squash:        opts.Squash,
+		DryRun:        opts.DryRun,
+		SkipScan:      opts.SkipScan,
+		ProfileLayers: opts.ProfileLayers,
+		OCIDir:        opts.OCIDir,
+	})
+}
+
+// Pulls image from remoteDef into docker.
+func (c *Client) Pull(remoteDef, image string) error {
+	_, err := c.PullImages(remoteDef, []string{image}, PullOptions{})
+	return err
+}
+
+// Pulls image from remoteDef and writes it to tarball, as `docker load` reads
+// it, without docker.
+func (c *Client) PullTarball(remoteDef, image string, tarball io.Writer) error {
+	_, err := c.cli.Pull(remoteDef, []string{image}, engine.PullOptions{Tarball: tarball})
+	return err
+}
+
+// Pulls each of images from remoteDef, one after another, so layers they
+// share are only downloaded once. One failing doesn't stop the others.
+// Returns whether anything was loaded: false if docker, or wherever they're
+// pulled to, already had them all.
+func (c *Client) PullImages(remoteDef string, images []string, opts PullOptions) (bool, error) {
+	return c.cli.Pull(remoteDef, images, engine.PullOptions{
+		OCIDir:              opts.OCIDir,
+		ContainerdNamespace: opts.ContainerdNamespace,
+		Platform:            opts.Platform,
+		TagAs:               opts.TagAs,
+		Hosts:               opts.Hosts,
+		HostConcurrency:     opts.HostConcurrency,
+		SkipVerify:          opts.SkipVerify,
+		DryRun:              opts.DryRun,
+		ProfileLayers:       opts.ProfileLayers,
+	})
+}
+
+// Lists every repo:tag on remoteDef.
+func (c *Client) List(remoteDef string) ([]Tag, error) {
+	r, err := remote.NewRemote(remoteDef, c.cli.Config)
+	if err != nil {
+		return nil, err
+	}
+	return remote.ListTags(r)
+}
+
+// Checks image on remoteDef can be pulled: its signature and trust, if the
+// remote has them, and every layer and config against its digest, without
+// loading it anywhere or recording anything on the remote.
+func (c *Client) Verify(remoteDef, image string) error {
+	return c.cli.Verify(remoteDef, image)
+}
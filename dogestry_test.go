@@ -0,0 +1,101 @@
+package dogestry
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/remote"
+)
+
+// a client of a local remote with app:latest on it, with opts.Config if set
+func newTestClient(t *testing.T, opts Options) (*Client, string) {
+	remoteDir := filepath.Join(t.TempDir(), "remote")
+	r, err := remote.NewRemote(remoteDir, config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Put("repositories/app/latest", []byte("0123456789ab")); err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.Config == nil {
+		opts.Config = &config.Config{}
+	}
+	opts.Config.Dogestry.Temp_Dir = t.TempDir()
+	opts.Config.Dogestry.Stats_File = filepath.Join(t.TempDir(), "stats.log")
+	client, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, remoteDir
+}
+
+func TestList(t *testing.T) {
+	client, remoteDir := newTestClient(t, Options{})
+
+	tags, err := client.List(remoteDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Repo != "app" || tags[0].Tag != "latest" || tags[0].ID != "0123456789ab" {
+		t.Errorf("got %+v", tags)
+	}
+}
+
+func TestOutputAndProgress(t *testing.T) {
+	var output bytes.Buffer
+	var events []Event
+	client, remoteDir := newTestClient(t, Options{
+		Output:   &output,
+		Progress: func(event Event) { events = append(events, event) },
+	})
+
+	var tarball bytes.Buffer
+	if err := client.PullTarball(remoteDir, "missing", &tarball); err == nil {
+		t.Fatal("an image the remote doesn't have was pulled")
+	}
+
+	if !strings.Contains(output.String(), "remote local("+remoteDir+")") {
+		t.Errorf("got output %q", output.String())
+	}
+	if len(events) != 1 || events[0].Event != EventComplete || events[0].Key != "missing" || events[0].Error == "" {
+		t.Errorf("got events %+v", events)
+	}
+}
+
+func TestPullOptions(t *testing.T) {
+	client, remoteDir := newTestClient(t, Options{})
+
+	for _, opts := range []PullOptions{
+		{TagAs: "other:v1"},
+		{OCIDir: t.TempDir(), ContainerdNamespace: "k8s.io"},
+		{Hosts: []string{"tcp://app-1:2375"}, OCIDir: t.TempDir()},
+		{Platform: "not a platform"},
+	} {
+		if _, err := client.PullImages(remoteDir, []string{"app:latest", "app:v2"}, opts); err == nil {
+			t.Errorf("%+v: expected an error", opts)
+		}
+	}
+}
+
+func TestVerifyIsNotAPull(t *testing.T) {
+	var output bytes.Buffer
+	client, remoteDir := newTestClient(t, Options{
+		Output: &output,
+		Config: &config.Config{Hooks: config.HooksConfig{Pre_Pull: []string{"exit 1"}}},
+	})
+
+	err := client.Verify(remoteDir, "missing")
+	if err == nil {
+		t.Fatal("an image the remote doesn't have was verified")
+	}
+	if strings.Contains(err.Error(), "hook") {
+		t.Errorf("the pre-pull hook ran: %s", err)
+	}
+	if strings.Contains(output.String(), "summary") {
+		t.Errorf("a run was recorded: %q", output.String())
+	}
+}
@@ -0,0 +1,182 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+)
+
+// how often the agent looks for changes to its images file
+var AgentFilePollInterval = 5 * time.Second
+
+// An image the agent keeps pulled, and how its last pull went
+type agentImage struct {
+	Image  string `json:"image"`
+	Remote string `json:"remote"`
+	Error  string `json:"error,omitempty"`
+}
+
+type agentStatus struct {
+	sync.Mutex
+	ready  bool
+	images []agentImage
+}
+
+func (cli *DogestryCli) CmdAgent(args ...string) error {
+	cmd := cli.Subcmd("agent", "[REMOTE]", "keep the images listed in a file, e.g. a mounted ConfigMap, pulled on this host, as a kubernetes DaemonSet. Each line is IMAGE[:TAG][@REMOTE], where REMOTE defaults to the one given")
+	imagesFile := cmd.String("images", "/etc/dogestry/images", "the file listing the images to keep pulled. Changes are picked up straight away")
+	interval := cmd.Duration("interval", time.Minute, "how often to check the remotes for new versions of the images")
+	listen := cmd.String("listen", ":4246", "address to serve /healthz and /ready on, for the kubelet's probes, and /metrics for prometheus")
+	containerd := cmd.Bool("containerd", false, "import the images into containerd, as pull -containerd, rather than loading them into docker")
+	containerdNamespace := cmd.String("containerd-namespace", "", "the containerd namespace to import into (default `namespace` in the [containerd] section, or k8s.io)")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	defaultRemote, _ := cli.RemoteArgs(cmd)
+	if *containerd {
+		cli.containerdNamespace = ContainerdNamespaceFor(*containerdNamespace, cli.Config)
+	}
+	cli.agent = true
+
+	status := &agentStatus{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/ready", status.handleReady)
+	mux.HandleFunc("/metrics", runMetrics.handle)
+
+	go func() {
+		log.Println(http.ListenAndServe(*listen, mux))
+		utils.Exit(1)
+	}()
+	fmt.Println("serving readiness on", *listen)
+
+	var synced []byte
+	var lastSync time.Time
+	for {
+		data, err := ioutil.ReadFile(*imagesFile)
+		if err != nil {
+			fmt.Fprintf(cli.err, "reading %s: %s\n", *imagesFile, err)
+			status.set(false, nil)
+		} else if !bytes.Equal(data, synced) || time.Since(lastSync) >= *interval {
+			images := cli.syncAgentImages(cli.parseAgentImages(data, defaultRemote))
+			status.set(agentImagesReady(images), images)
+			synced, lastSync = data, time.Now()
+		}
+
+		time.Sleep(AgentFilePollInterval)
+	}
+}
+
+// The images listed in data, one per line. Blank lines and lines starting
+// with # are skipped.
+func (cli *DogestryCli) parseAgentImages(data []byte, defaultRemote string) []agentImage {
+	images := make([]agentImage, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		image := agentImage{Image: line, Remote: defaultRemote}
+		// IMAGE@ID pins an image, so only a remote's name or url counts
+		if i := strings.LastIndex(line, "@"); i != -1 && cli.agentRemote(line[i+1:]) {
+			image.Image, image.Remote = line[:i], line[i+1:]
+		}
+		if image.Remote == "" {
+			image.Error = "no remote: use IMAGE@REMOTE, or give the agent a REMOTE"
+		}
+		images = append(images, image)
+	}
+	return images
+}
+
+// whether s is a remote, rather than the id of a pinned image
+func (cli *DogestryCli) agentRemote(s string) bool {
+	if _, ok := cli.Config.Remote[s]; ok {
+		return true
+	}
+	if strings.Contains(s, "://") || strings.HasPrefix(s, "/") || strings.HasPrefix(s, ".") {
+		return true
+	}
+	return strings.Trim(strings.ToLower(s), "0123456789abcdef") != "" && !strings.HasPrefix(s, "sha256:")
+}
+
+// Pulls each image, returning how each went.
+func (cli *DogestryCli) syncAgentImages(images []agentImage) []agentImage {
+	remotes := make(map[string]remote.Remote)
+
+	for i, image := range images {
+		if image.Error != "" {
+			fmt.Fprintf(cli.err, "%s: %s\n", image.Image, image.Error)
+			continue
+		}
+
+		r, ok := remotes[image.Remote]
+		if !ok {
+			var err error
+			if r, err = cli.newRemote(image.Remote); err != nil {
+				runMetrics.remoteError("pull", image.Remote)
+				images[i].Error = utils.Redact(err.Error())
+				fmt.Fprintf(cli.err, "%s: %s\n", image.Image, err)
+				continue
+			}
+			remotes[image.Remote] = r
+		}
+
+		cli.changed = false
+		if err := cli.pullImageName(r, image.Remote, image.Image); err != nil {
+			runMetrics.remoteError("pull", image.Remote)
+			images[i].Error = utils.Redact(err.Error())
+			fmt.Fprintf(cli.err, "pulling %s: %s\n", image.Image, err)
+		}
+	}
+	return images
+}
+
+// ready once every image has been pulled
+func agentImagesReady(images []agentImage) bool {
+	for _, image := range images {
+		if image.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (status *agentStatus) set(ready bool, images []agentImage) {
+	status.Lock()
+	defer status.Unlock()
+	status.ready = ready
+	status.images = images
+}
+
+// GET /ready
+//
+// 200 once every image is pulled, 503 until then, with each image's status
+func (status *agentStatus) handleReady(w http.ResponseWriter, r *http.Request) {
+	status.Lock()
+	ready, images := status.ready, status.images
+	status.Unlock()
+
+	if images == nil {
+		images = []agentImage{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ready": ready, "images": images})
+}
@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/blake-education/dogestry/remote"
+)
+
+type auditResult struct {
+	Repo    string               `json:"repo"`
+	Records []remote.AuditRecord `json:"records"`
+	// the hash of the last record. Keep it to check nothing's removed from the end later
+	Head  string `json:"head"`
+	Valid bool   `json:"valid"`
+	// whether it was checked against a head from an earlier audit. Otherwise a
+	// rewritten log is as valid as the original
+	Pinned bool   `json:"pinned"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (cli *DogestryCli) CmdAudit(args ...string) error {
+	cmd := cli.Subcmd("audit", "REMOTE REPO", "show REPO's audit log on the REMOTE, and check that no record in it has been changed or removed")
+	expect := cmd.String("expect", "", "the head hash from an earlier audit. Fails if the log no longer has that record, e.g. if records were removed from its end or the log was rewritten")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	remoteDef, rest := cli.RemoteArgs(cmd)
+	if remoteDef == "" || len(rest) < 1 {
+		return MissingArgs("audit", "REMOTE and REPO")
+	}
+
+	repo, _ := remote.NormaliseImageName(rest[0])
+
+	r, err := cli.newRemote(remoteDef)
+	if err != nil {
+		return err
+	}
+
+	records, err := remote.ReadAudit(r, repo)
+	if err != nil {
+		return err
+	}
+
+	result := auditResult{Repo: repo, Records: records, Valid: true, Pinned: *expect != ""}
+	if len(records) > 0 {
+		result.Head = records[len(records)-1].Hash
+	}
+
+	err = remote.VerifyAudit(repo, records)
+	if err == nil && *expect != "" && !hasAuditRecord(records, *expect) {
+		err = fmt.Errorf("the audit log of '%s' has no record %s: records have been removed, or the log rewritten", repo, *expect)
+	}
+	if err != nil {
+		result.Valid, result.Error = false, err.Error()
+	}
+
+	if cli.Options.Json {
+		if printErr := printJson(result); printErr != nil {
+			return printErr
+		}
+		return err
+	}
+
+	if len(records) == 0 {
+		fmt.Fprintf(cli.out, "no audit log for '%s'\n", repo)
+		return err
+	}
+
+	for _, record := range records {
+		digest := record.Digest
+		if digest == "" {
+			digest = "-"
+		}
+		fmt.Fprintf(cli.out, "%4d  %s  %-6s  %s:%s  %s  %s  %s@%s\n", record.Seq, record.Time.Format("2006-01-02 15:04:05 UTC"), record.Action, record.Repo, record.Tag, record.ID.Short(), digest, record.Actor, record.Host)
+	}
+
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.out, "the chain of %d records is intact, head %s\n", len(records), result.Head)
+	if *expect == "" {
+		// anyone who can write the remote can make a new chain
+		fmt.Fprintf(cli.out, "pass -expect %s to later audits to check it hasn't been rewritten since\n", result.Head)
+	} else {
+		fmt.Fprintf(cli.out, "and unchanged up to %s\n", *expect)
+	}
+	return nil
+}
+
+func hasAuditRecord(records []remote.AuditRecord, hash string) bool {
+	for _, record := range records {
+		if record.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// record action on each of names in their repo's audit log. The repo must be locked.
+func (cli *DogestryCli) recordAudit(r remote.Remote, action string, names []string, id remote.ID) error {
+	digest, err := configDigest(r, id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cli.out, "recording %s in the audit log\n", action)
+	for _, name := range names {
+		if _, err := remote.AppendAudit(r, action, name, id, digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package engine
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/remote"
+)
+
+func TestAudit(t *testing.T) {
+	remoteDir := filepath.Join(t.TempDir(), "central")
+	r, err := remote.NewRemote(remoteDir, config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var head string
+	for _, tag := range []string{"v1", "v2"} {
+		record, err := remote.AppendAudit(r, "push", "app:"+tag, remote.ID("0123456789ab"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag == "v1" {
+			head = record.Hash
+		}
+	}
+
+	tests := []struct {
+		args []string
+		want string
+		fail bool
+	}{
+		{[]string{remoteDir, "app"}, "pass -expect", false},
+		{[]string{"-expect", head, remoteDir, "app"}, "unchanged up to " + head, false},
+		{[]string{"-expect", "sha256:gone", remoteDir, "app"}, "", true},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		cli := &DogestryCli{out: &out}
+		err := cli.CmdAudit(test.args...)
+		if (err != nil) != test.fail {
+			t.Errorf("%v: got %v", test.args, err)
+		}
+		if !strings.Contains(out.String(), test.want) {
+			t.Errorf("%v: no %q in %s", test.args, test.want, out.String())
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/blake-education/dogestry/cache"
+	"github.com/blake-education/dogestry/utils"
+)
+
+func (cli *DogestryCli) CmdCache(args ...string) error {
+	cmd := cli.Subcmd("cache", "ls|du|prune|clear", "manage the local layer cache: list what's in it, show its size, remove layers to get under its limits, or empty it")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	if cmd.NArg() < 1 {
+		return MissingArgs("cache", "ls, du, prune or clear")
+	}
+
+	c := cache.New(cli.Config)
+	if c == nil {
+		return fmt.Errorf("no cache configured. Set `dir` in the [cache] section of dogestry.cfg")
+	}
+
+	switch cmd.Arg(0) {
+	case "ls":
+		entries, err := c.List()
+		if err != nil {
+			return err
+		}
+		if cli.Options.Json {
+			return printJson(entries)
+		}
+		for _, entry := range entries {
+			fmt.Printf("%-90s  %10s  %s\n", entry.Key, utils.HumanSize(entry.Size), entry.LastUsed.Format("2006-01-02 15:04:05"))
+		}
+
+	case "du":
+		entries, err := c.List()
+		if err != nil {
+			return err
+		}
+		var total int64
+		for _, entry := range entries {
+			total += entry.Size
+		}
+		if cli.Options.Json {
+			return printJson(map[string]interface{}{"dir": c.Dir, "files": len(entries), "bytes": total, "max_bytes": c.MaxSize})
+		}
+		fmt.Printf("%s: %s in %d files (limit %s)\n", c.Dir, utils.HumanSize(total), len(entries), utils.HumanSize(c.MaxSize))
+
+	case "prune":
+		before, err := c.Usage()
+		if err != nil {
+			return err
+		}
+		if err := c.Prune(); err != nil {
+			return err
+		}
+		after, err := c.Usage()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("removed %s\n", utils.HumanSize(before-after))
+
+	case "clear":
+		if err := c.Clear(); err != nil {
+			return err
+		}
+		fmt.Println("cleared", c.Dir)
+
+	default:
+		return fmt.Errorf("Error: unknown cache command '%s'. See 'dogestry help cache'", cmd.Arg(0))
+	}
+
+	return nil
+}
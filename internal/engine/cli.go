@@ -0,0 +1,508 @@
+package engine
+
+import (
+	dockerclient "github.com/blake-education/dogestry/client"
+	"github.com/blake-education/dogestry/compressor"
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/tracing"
+	"github.com/blake-education/dogestry/utils"
+
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var (
+	DefaultConfigFilePath = "./dogestry.cfg"
+	DefaultConfig         = config.Config{
+		Remote: make(map[string]*config.RemoteConfig),
+		Compressor: config.CompressorConfig{
+			Lz4: "lz4",
+		},
+	}
+)
+
+// Where config is looked for without -config, most specific first: the
+// current directory, the user's config dir, then the host's. The first file
+// found in each is used, and the more specific ones' keys win.
+func configSearchPath() [][]string {
+	userDir := os.Getenv("XDG_CONFIG_HOME")
+	if userDir == "" {
+		userDir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	userDir = filepath.Join(userDir, "dogestry")
+
+	return [][]string{
+		{DefaultConfigFilePath, "./dogestry.yaml", "./dogestry.yml"},
+		{filepath.Join(userDir, "config"), filepath.Join(userDir, "config.yaml"), filepath.Join(userDir, "config.yml")},
+		{"/etc/dogestry/config", "/etc/dogestry/config.yaml", "/etc/dogestry/config.yml"},
+	}
+}
+
+type DogestryCli struct {
+	client      *dockerclient.Client
+	out         io.Writer
+	err         io.Writer
+	tempDir     string
+	tempDirRoot string
+	Config      config.Config
+	Options     GlobalOptions
+	compressor  compressor.Compressor
+	dryRun      bool
+
+	// the span of the push or pull running, for tracing. Nil if tracing isn't configured
+	span *tracing.Span
+
+	// guards transferSpan and profile, which the events the remote reports
+	// from its transfers' goroutines are added to
+	eventsLock sync.Mutex
+
+	// the phase of span the remote's transfers are part of, e.g. a push's upload
+	transferSpan *tracing.Span
+
+	// more tags for pushed images, in the same repo
+	alsoTags []string
+
+	// flatten pushed images into one layer, from -squash
+	squash bool
+
+	// the local tag to give a pulled image, from -tag-as
+	tagAsName string
+
+	// the OCI image layout pulls write to, or pushes read from, instead of docker. From -oci-dir
+	ociDir string
+
+	// the containerd namespace pulls import images into, from -containerd. Empty for docker
+	containerdNamespace string
+
+	// where pulls write the tarball they'd load into docker, and pushes read
+	// what docker would export, for the dogestry package. Nil for docker
+	loadTo   io.Writer
+	exportOf io.Reader
+
+	// pulls only check the image, for the dogestry package's Verify
+	verifying bool
+
+	// following and stopping the pushes and pulls this cli runs, for server
+	// jobs and the dogestry package. Remotes get remoteControl(), which also
+	// prints, traces and profiles their events
+	control remote.Control
+
+	// called with the events of each push or pull the dogestry package runs,
+	// then EventComplete. Nil if it has no callback
+	progress func(remote.Event)
+
+	// images downloaded once for every host of a -pullhosts pull. Nil otherwise
+	shared *sharedImages
+
+	// pulls are from `dogestry agent`, which pulls the same images over and
+	// over, so only records pulls which loaded something in the history
+	agent bool
+
+	// the platform to pull images for, from -platform. Empty for docker's
+	platform string
+
+	// don't check pulled layers and configs against their digests, from -insecure-skip-verify
+	skipVerify bool
+
+	// the digests signed, or in the remote's targets, for the images being
+	// pulled. Nil if the image pulled isn't signed and trust isn't configured
+	signed map[remote.ID]signedLayer
+
+	// push without scanning for vulnerabilities, from -skip-scan
+	skipScan bool
+
+	// time and size each layer, from -profile-layers. profile is the push or
+	// pull running's
+	profiling bool
+	profile   *runProfile
+
+	pushLocks heldLocks
+
+	// images a pull didn't need because docker already had them
+	localSkipped int
+
+	// whether a push or pull transferred anything, or loaded anything into docker
+	changed bool
+
+	// the config files used, most general first, and the error parsing them, for `doctor`
+	configFiles []string
+	configErr   error
+
+	// the DOGESTRY_ variables which set config keys, for `config show`
+	envVars []string
+}
+
+func NewDogestryCli(config config.Config) (*DogestryCli, error) {
+	newClient, err := newDockerClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DogestryCli{
+		Config:  config,
+		Options: commandOptions,
+		client:  newClient,
+		out:     os.Stdout,
+		err:     os.Stderr,
+	}, nil
+}
+
+// The control for the cli's remotes: its own, reporting their events to
+// report as well.
+func (cli *DogestryCli) remoteControl() remote.Control {
+	control := cli.control
+	control.Report = cli.report
+	return control
+}
+
+// a remote with the cli's config and control
+func (cli *DogestryCli) newRemote(remoteDef string) (remote.Remote, error) {
+	return remote.NewControlledRemote(remoteDef, cli.Config, cli.remoteControl())
+}
+
+// Prints a transfer event, for -json or -log-format json, adds it to the
+// trace and profile of the push or pull running, then passes it on to
+// whatever's following the cli's control.
+func (cli *DogestryCli) report(event remote.Event) {
+	switch {
+	case cli.Options.Json:
+		printJson(event)
+	case utils.LogFormat() == utils.LogJson:
+		logEvent(event)
+	}
+
+	cli.traceEvent(event)
+
+	cli.eventsLock.Lock()
+	p := cli.profile
+	cli.eventsLock.Unlock()
+	p.transferred(event)
+
+	if cli.control.Report != nil {
+		cli.control.Report(event)
+	}
+}
+
+// Note: snatched from docker
+
+// the global options of the command running, for the DogestryClis it makes.
+// Unset where dogestry is embedded
+var commandOptions GlobalOptions
+
+// commands registered by the cli package, by name
+var commands = make(map[string]func(cli *DogestryCli, args ...string) error)
+
+// Adds a command, which is run rather than the Cmd method of the same name.
+func RegisterCommand(name string, fn func(cli *DogestryCli, args ...string) error) {
+	commands[name] = fn
+}
+
+func (cli *DogestryCli) getMethod(name string) (func(...string) error, bool) {
+	if fn, ok := commands[name]; ok {
+		return func(args ...string) error {
+			return fn(cli, args...)
+		}, true
+	}
+
+	// upgrade-repo -> CmdUpgradeRepo
+	methodName := "Cmd"
+	for _, part := range strings.Split(name, "-") {
+		if part != "" {
+			methodName += strings.ToUpper(part[:1]) + strings.ToLower(part[1:])
+		}
+	}
+	method := reflect.ValueOf(cli).MethodByName(methodName)
+	if !method.IsValid() {
+		return nil, false
+	}
+	return method.Interface().(func(...string) error), true
+}
+
+func ParseCommands(args ...string) error {
+	opts, args, err := ParseGlobalOptions(args)
+	if err != nil {
+		return err
+	}
+
+	// os.Stdout may have been replaced since jsonOut was, by utils.RedactOutput
+	jsonOut = os.Stdout
+	if opts.Json {
+		jsonOutput()
+	}
+
+	if err := utils.SetLogFormat(opts.LogFormat); err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		utils.SetLogComponent(args[0])
+	}
+	switch {
+	case opts.Quiet:
+		utils.SetVerbosity(utils.VerbosityQuiet)
+	case opts.Trace:
+		opts.Verbose = true
+		utils.SetVerbosity(utils.VerbosityTrace)
+		http.DefaultTransport = remote.TraceRequests(http.DefaultTransport)
+	case opts.Verbose:
+		utils.SetVerbosity(utils.VerbosityDetail)
+	}
+
+	if opts.Quiet {
+		// errors are logged to stderr, so still get through, but not warnings
+		if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+			os.Stdout = devNull
+		}
+	}
+
+	config, configFiles, envVars, configErr := parseConfig(opts.ConfigFile, opts.ConfigProfile)
+	if configErr != nil {
+		// doctor reports config problems itself, and init writes the config
+		if len(args) == 0 || (args[0] != "doctor" && args[0] != "init") {
+			return configErr
+		}
+		config = DefaultConfig
+	}
+
+	logOutput := opts.LogOutput
+	if logOutput == "" {
+		logOutput = config.Log.Output
+	}
+	if err := utils.SetLogOutput(logOutput, config.Log.Facility, config.Log.Tag, config.Log.Address); err != nil {
+		return err
+	}
+
+	if err := tracing.Configure(config.Tracing); err != nil {
+		return err
+	}
+
+	if opts.DockerHost != "" {
+		config.Docker.Connection = opts.DockerHost
+	}
+	if opts.TempDir != "" {
+		config.Dogestry.Temp_Dir = opts.TempDir
+	}
+	commandOptions = opts
+
+	cli, err := NewDogestryCli(config)
+	if err != nil {
+		return err
+	}
+	defer cli.Cleanup()
+
+	cli.Options = opts
+	cli.configFiles = configFiles
+	cli.envVars = envVars
+	cli.configErr = configErr
+
+	cli.tempDirRoot = config.Dogestry.Temp_Dir
+	cleanOrphanedWorkDirs(cli.workDirRoot())
+
+	if len(args) > 0 {
+		method, exists := cli.getMethod(args[0])
+		if !exists {
+			fmt.Fprintf(cli.err, "Error: Command not found: %s\n", args[0])
+			return cli.CmdHelp(args[1:]...)
+		}
+		return method(args[1:]...)
+	}
+	return cli.CmdHelp(args...)
+}
+
+// Parses the config file, or the ones found on the search path merged, with
+// the environment's DOGESTRY_ variables laid over it.
+func parseConfig(configFilePath, profile string) (cfg config.Config, paths []string, envVars []string, err error) {
+	if configFilePath != "" {
+		paths = []string{configFilePath}
+	} else {
+		// most general first, so the more specific are laid over them
+		search := configSearchPath()
+		for i := len(search) - 1; i >= 0; i-- {
+			for _, path := range search[i] {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					paths = append(paths, path)
+					break
+				}
+			}
+		}
+	}
+
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "Note: no config file found, using default config.")
+		cfg = DefaultConfig
+		if profile != "" {
+			err = fmt.Errorf("no profile '%s', as there's no config file", profile)
+			return
+		}
+	} else if cfg, err = config.ParseConfigFiles(paths, profile); err != nil {
+		return
+	}
+
+	if config.IgnorePlaintextKeys(&cfg) {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring the keys in %s, which are plaintext. Store them with `dogestry login`, or set plaintext-credentials in the [dogestry] section\n", strings.Join(paths, ", "))
+	}
+
+	// after ignoring the file's keys, as keys in the environment aren't stored in plaintext
+	if envVars, err = config.ApplyEnv(&cfg, os.Environ()); err != nil {
+		return
+	}
+	if err = config.ExpandEnv(&cfg); err != nil {
+		return
+	}
+
+	// the old plaintext credentials file, from before there was a store
+	credsPath := config.CredentialsFilePath(cfg)
+	legacy := config.Config{}
+	if err = config.ParseCredentials(&legacy, credsPath); err != nil {
+		return
+	}
+	if len(legacy.Credentials) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %s stores keys in plaintext. Move them to the encrypted store with `dogestry login -import`\n", credsPath)
+		if cfg.Credentials == nil {
+			cfg.Credentials = make(map[string]*config.RemoteCredentials)
+		}
+		for name, creds := range legacy.Credentials {
+			cfg.Credentials[name] = creds
+		}
+	}
+
+	cfg.CredentialStore, err = config.NewCredentialStore(cfg, promptPassphrase)
+	return
+}
+
+func (cli *DogestryCli) CmdHelp(args ...string) error {
+	if len(args) > 0 {
+		method, exists := cli.getMethod(args[0])
+		if !exists {
+			fmt.Fprintf(cli.err, "Error: Command not found: %s\n", args[0])
+		} else {
+			method("--help")
+			return nil
+		}
+	}
+
+	help := fmt.Sprintf(
+		`Usage: dogestry [GLOBAL OPTIONS] COMMAND [OPTIONS] [arg...]
+ Alternate registry and simple image storage for docker.
+  Typical S3 Usage:
+     export AWS_ACCESS_KEY=ABC
+     export AWS_SECRET_KEY=DEF
+     dogestry pull s3://<bucket name>/<path name>/?region=us-east-1 <repo name>
+  Commands:
+     agent - Keep the images listed in a file pulled, e.g. as a kubernetes DaemonSet
+     audit - Show a repo's audit log and check it hasn't been tampered with
+     cache - List, size, prune or clear the local layer cache
+     config - Show the effective config
+     doctor - Check config, credentials, docker and remotes for problems
+     exists - Check whether an image exists on a remote
+     history - Show the push and pull history of a repo
+     iam-policy - Print the IAM policy for pulling or pushing repos on an s3 remote
+     init - Set up a config file, asking for a remote and checking it works
+     inspect - Show an image's id, platform and digests on a remote
+     lock - Lock a repo on a remote against pushes
+     login - Store credentials for a remote
+     mirror - Mirror an image from a docker registry to a remote
+     peer - Serve cached layers to other pull hosts
+     pull - Pull an image from a remote
+     push  - Push an image to a remote
+     remote - Check a remote
+     search - Search a remote's repos and tags
+     serve-registry - Serve a remote as a read-only docker registry
+     server - Run an http api for pushing and pulling
+     stats - Summarise recent pushes and pulls
+     trust - Sign or show a remote's root and targets metadata
+     unlock - Unlock a repo on a remote
+     upgrade-repo - Migrate a remote to the current repository format
+     watch - Push images to a remote as they're tagged
+  Run 'dogestry help COMMAND' for a command's options.
+  Global options can be given before or after the command:`)
+	fmt.Fprintln(cli.err, help)
+	printGlobalDefaults()
+	return nil
+}
+
+func (cli *DogestryCli) Subcmd(name, signature, description string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(cli.err)
+	flags.Usage = func() {
+		fmt.Fprintf(cli.err, "\nUsage: dogestry %s [OPTIONS] %s\n\n%s\n\nOptions:\n", name, signature, description)
+		flags.PrintDefaults()
+		fmt.Fprintf(cli.err, "\nGlobal options:\n")
+		printGlobalDefaults()
+		utils.Exit(2)
+	}
+	return flags
+}
+
+// Creates and returns temporary work dir
+// This dir is cleaned up on exit
+func (cli *DogestryCli) TempDir() string {
+	if cli.tempDir == "" {
+		if cli.tempDirRoot != "" {
+			if err := os.MkdirAll(cli.tempDirRoot, 0755); err != nil {
+				log.Println(err)
+				utils.Exit(1)
+			}
+		}
+
+		if tempDir, err := ioutil.TempDir(cli.tempDirRoot, "dogestry"); err != nil {
+			log.Println(err)
+			utils.Exit(1)
+		} else {
+			cli.tempDir = tempDir
+		}
+		if err := ownWorkDir(cli.tempDir); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return cli.tempDir
+}
+
+// Creates and returns a workdir under TempDir
+func (cli *DogestryCli) WorkDir(suffix string) (string, error) {
+	path := filepath.Join(cli.TempDir(), suffix)
+
+	if err := os.MkdirAll(path, os.ModeDir|0700); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// The work dir for pulling image. Unlike WorkDir it's the same for every pull
+// of image, and is left behind if the pull fails, so pulling again can reuse
+// what was already downloaded.
+func (cli *DogestryCli) PullDir(image string) (string, error) {
+	root := cli.tempDirRoot
+	if root == "" {
+		root = os.TempDir()
+	}
+
+	name := strings.NewReplacer("/", "_", ":", "_").Replace(image)
+	path := filepath.Join(root, "dogestry-pull-"+name)
+
+	if err := os.MkdirAll(path, os.ModeDir|0700); err != nil {
+		return "", err
+	}
+
+	return path, ownWorkDir(path)
+}
+
+// clean up the tempDir
+func (cli *DogestryCli) Cleanup() {
+	if cli.tempDir != "" {
+		if err := os.RemoveAll(cli.tempDir); err != nil {
+			log.Println(err)
+		}
+	}
+}
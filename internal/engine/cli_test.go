@@ -0,0 +1,43 @@
+package engine
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/blake-education/dogestry/remote"
+)
+
+func TestRemoteControl(t *testing.T) {
+	var reported [2][]remote.Event
+	clis := make([]*DogestryCli, 2)
+	for i := range clis {
+		i := i
+		clis[i] = &DogestryCli{profiling: true}
+		clis[i].control.Report = func(event remote.Event) { reported[i] = append(reported[i], event) }
+		clis[i].startProfile()
+	}
+
+	var printed bytes.Buffer
+	defer func(out io.Writer) { jsonOut = out }(jsonOut)
+	jsonOut = &printed
+	clis[0].Options.Json = true
+
+	done := remote.Event{Event: remote.EventDone, Key: "images/abc/layer.tar", Bytes: 42, Seconds: 2}
+	clis[0].remoteControl().Report(done)
+
+	// each cli's events are its own, however many run at once
+	if len(reported[0]) != 1 || reported[0][0] != done || len(reported[1]) != 0 {
+		t.Errorf("reported %+v", reported)
+	}
+	if layer := clis[0].profile.layer("abc"); layer.TransferBytes != 42 || layer.TransferSeconds != 2 {
+		t.Errorf("profiled %+v", layer)
+	}
+	if layer := clis[1].profile.layer("abc"); layer.TransferBytes != 0 {
+		t.Errorf("the other cli profiled %+v", layer)
+	}
+	if !strings.Contains(printed.String(), `"event":"done"`) {
+		t.Errorf("printed %q", printed.String())
+	}
+}
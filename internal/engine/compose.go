@@ -0,0 +1,323 @@
+package engine
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A service in a compose file, as far as dogestry cares
+type composeService struct {
+	Name     string
+	Image    string
+	Profiles []string
+}
+
+// Adds -compose and -profile to cmd. The returned func adds the images of the
+// compose file's services to images, once cmd is parsed.
+func ComposeFlags(cmd *flag.FlagSet) func(images []string) ([]string, error) {
+	composeFile := cmd.String("compose", "", "also transfer the image of every service in this docker-compose file")
+	profiles := cmd.String("profile", "", "with -compose, include services with these comma separated profiles too (default $COMPOSE_PROFILES)")
+
+	return func(images []string) ([]string, error) {
+		if *composeFile == "" {
+			return images, nil
+		}
+
+		active := *profiles
+		if active == "" {
+			active = os.Getenv("COMPOSE_PROFILES")
+		}
+
+		services, err := readComposeFile(*composeFile)
+		if err != nil {
+			return nil, err
+		}
+
+		seen := make(map[string]bool)
+		for _, image := range images {
+			seen[image] = true
+		}
+		for _, service := range services {
+			if !service.enabled(active) {
+				continue
+			}
+			if service.Image == "" {
+				fmt.Printf("service '%s' has no image, skipping it\n", service.Name)
+				continue
+			}
+			if !seen[service.Image] {
+				seen[service.Image] = true
+				images = append(images, service.Image)
+			}
+		}
+		return images, nil
+	}
+}
+
+// Whether the service runs with the comma separated profiles active. As with
+// compose, services without profiles always run.
+func (service composeService) enabled(active string) bool {
+	if len(service.Profiles) == 0 {
+		return true
+	}
+	for _, profile := range strings.Split(active, ",") {
+		for _, p := range service.Profiles {
+			if strings.TrimSpace(profile) == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The services in the compose file at path, with variables interpolated from
+// the environment and the .env file beside it.
+//
+// This reads just the parts of the yaml compose files use for services'
+// images and profiles: block mappings, and block or [flow] lists. Anchors and
+// merge keys aren't followed.
+func readComposeFile(path string) ([]composeService, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	env, err := readEnvFile(filepath.Join(filepath.Dir(path), ".env"))
+	if err != nil {
+		return nil, err
+	}
+	// the environment wins over .env
+	for _, variable := range os.Environ() {
+		if parts := strings.SplitN(variable, "=", 2); len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	services := make([]composeService, 0)
+	var service *composeService
+	inServices, inProfiles := false, false
+	serviceIndent, keyIndent, profilesIndent := -1, -1, -1
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := stripYamlComment(scanner.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		line = strings.TrimSpace(line)
+
+		if inProfiles && indent > profilesIndent && strings.HasPrefix(line, "-") {
+			profile, err := interpolate(yamlScalar(strings.TrimPrefix(line, "-")), lookup)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+			service.Profiles = append(service.Profiles, profile)
+			continue
+		}
+		inProfiles = false
+
+		key, value := splitYamlKey(line)
+		if indent == 0 {
+			inServices, service = key == "services", nil
+			continue
+		}
+		if !inServices || key == "" {
+			continue
+		}
+
+		if serviceIndent == -1 {
+			serviceIndent = indent
+		}
+		if indent == serviceIndent {
+			services = append(services, composeService{Name: key})
+			service, keyIndent = &services[len(services)-1], -1
+			continue
+		}
+		if service == nil || indent < serviceIndent {
+			continue
+		}
+
+		// only the service's own keys, not those of its nested mappings
+		if keyIndent == -1 {
+			keyIndent = indent
+		}
+		if indent != keyIndent {
+			continue
+		}
+		switch {
+		case key == "image" && value != "":
+			if service.Image, err = interpolate(yamlScalar(value), lookup); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+		case key == "profiles" && strings.HasPrefix(value, "["):
+			for _, item := range strings.Split(strings.Trim(value, "[]"), ",") {
+				if item = yamlScalar(item); item == "" {
+					continue
+				}
+				profile, err := interpolate(item, lookup)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+				}
+				service.Profiles = append(service.Profiles, profile)
+			}
+		case key == "profiles" && value == "":
+			inProfiles, profilesIndent = true, indent
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+// splits "key: value" into its key and value. No key if line isn't a mapping entry
+func splitYamlKey(line string) (string, string) {
+	i := strings.Index(line, ":")
+	if i == -1 || (i+1 < len(line) && line[i+1] != ' ') || strings.HasPrefix(line, "-") {
+		return "", ""
+	}
+	return yamlScalar(line[:i]), strings.TrimSpace(line[i+1:])
+}
+
+// a plain, 'single' or "double" quoted yaml scalar's value
+func yamlScalar(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// removes a # comment from a yaml line, unless it's in quotes
+func stripYamlComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+	return strings.TrimRight(line, " \t")
+}
+
+// Reads a compose .env file of NAME=VALUE lines. No file, no variables.
+func readEnvFile(path string) (map[string]string, error) {
+	env := make(map[string]string)
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return env, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(line, "export "), "=", 2)
+		if len(parts) == 2 {
+			env[strings.TrimSpace(parts[0])] = yamlScalar(parts[1])
+		}
+	}
+	return env, scanner.Err()
+}
+
+// Substitutes variables in s as compose does: $VAR, ${VAR}, ${VAR:-default}
+// (for unset or empty), ${VAR-default} (for unset), ${VAR:?error} and
+// ${VAR?error}. $$ is a literal $.
+func interpolate(s string, lookup func(string) (string, bool)) (string, error) {
+	out := ""
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			out += s[i : i+1]
+			continue
+		}
+
+		switch next := s[i+1]; {
+		case next == '$':
+			out += "$"
+			i++
+
+		case next == '{':
+			end := strings.Index(s[i:], "}")
+			if end == -1 {
+				return "", fmt.Errorf("unclosed ${ in '%s'", s)
+			}
+			value, err := expandVariable(s[i+2:i+end], lookup)
+			if err != nil {
+				return "", err
+			}
+			out += value
+			i += end
+
+		case isVariableChar(next, true):
+			j := i + 1
+			for j < len(s) && isVariableChar(s[j], j == i+1) {
+				j++
+			}
+			value, _ := lookup(s[i+1 : j])
+			out += value
+			i = j - 1
+
+		default:
+			out += "$"
+		}
+	}
+	return out, nil
+}
+
+// the value of the inside of a ${...}
+func expandVariable(expr string, lookup func(string) (string, bool)) (string, error) {
+	name, op, arg := expr, "", ""
+	for _, candidate := range []string{":-", ":?", "-", "?"} {
+		if i := strings.Index(expr, candidate); i != -1 && (op == "" || i < strings.Index(expr, op)) {
+			name, op, arg = expr[:i], candidate, expr[i+len(candidate):]
+		}
+	}
+
+	value, set := lookup(name)
+	switch op {
+	case ":-":
+		if value == "" {
+			return arg, nil
+		}
+	case "-":
+		if !set {
+			return arg, nil
+		}
+	case ":?":
+		if value == "" {
+			return "", fmt.Errorf("%s is unset or empty: %s", name, arg)
+		}
+	case "?":
+		if !set {
+			return "", fmt.Errorf("%s is unset: %s", name, arg)
+		}
+	}
+	return value, nil
+}
+
+func isVariableChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
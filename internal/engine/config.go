@@ -0,0 +1,41 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/blake-education/dogestry/config"
+)
+
+func (cli *DogestryCli) CmdConfig(args ...string) error {
+	cmd := cli.Subcmd("config", "show", "print the effective config: the config file, with its profile and defaults merged in, and the options which change it")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	if cmd.NArg() < 1 {
+		return MissingArgs("config", "show")
+	}
+
+	switch cmd.Arg(0) {
+	case "show":
+		if cli.Options.Json {
+			return printJson(config.ConfigMap(cli.Config))
+		}
+		for i, path := range cli.configFiles {
+			if i == 0 {
+				fmt.Printf("# from %s\n", path)
+			} else {
+				fmt.Printf("# and %s\n", path)
+			}
+		}
+		for _, name := range cli.envVars {
+			fmt.Printf("# and $%s\n", name)
+		}
+		fmt.Print(config.FormatYAML(cli.Config))
+
+	default:
+		return fmt.Errorf("Error: unknown config command '%s'. See 'dogestry help config'", cmd.Arg(0))
+	}
+
+	return nil
+}
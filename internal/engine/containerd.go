@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/remote"
+)
+
+// where kubernetes' kubelet looks for images
+const DefaultContainerdNamespace = "k8s.io"
+
+// the label recording the id on the remote of an image pull -containerd imported
+const ContainerdIdLabel = "io.dogestry.id"
+
+// the namespace pull -containerd imports into: -containerd-namespace, then the config's
+func ContainerdNamespaceFor(flag string, cfg config.Config) string {
+	if flag != "" {
+		return flag
+	}
+	if cfg.Containerd.Namespace != "" {
+		return cfg.Containerd.Namespace
+	}
+	return DefaultContainerdNamespace
+}
+
+// Pulls image id into an OCI layout, as pullToOci, and imports that into
+// containerd with ctr, for hosts, like kubernetes nodes, which don't run docker.
+func (cli *DogestryCli) pullToContainerd(image string, id remote.ID, imageRoot string, r remote.Remote) error {
+	name := cli.Config.Containerd.Ctr
+	if name == "" {
+		name = "ctr"
+	}
+	// fail early, rather than after downloading everything
+	ctr, err := exec.LookPath(name)
+	if err != nil {
+		return fmt.Errorf("can't find executable %s on the $PATH", name)
+	}
+
+	fullName := containerdName(pulledImageName(image, id))
+	if has, err := cli.containerdHas(ctr, fullName, id); err != nil {
+		return err
+	} else if has && !cli.Config.Dogestry.Force {
+		fmt.Fprintf(cli.out, "containerd already has '%s' as %s, stopping\n", id.Short(), fullName)
+		cli.localSkipped++
+		return nil
+	}
+
+	layoutDir, err := cli.WorkDir("containerd-" + string(id))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(layoutDir)
+
+	if err := cli.pullToOci(image, id, imageRoot, layoutDir, r); err != nil {
+		return err
+	}
+
+	archive := layoutDir + ".tar"
+	defer os.Remove(archive)
+	if out, err := exec.Command("/bin/tar", "cf", archive, "-C", layoutDir, ".").CombinedOutput(); err != nil {
+		return fmt.Errorf("archiving %s: %s\noutput: %s", layoutDir, err, out)
+	}
+
+	fmt.Fprintf(cli.out, "importing into containerd namespace %s\n", cli.containerdNamespace)
+	out, err := cli.runCtr(ctr, "images", "import", archive)
+	if err != nil {
+		return fmt.Errorf("importing into containerd: %s\noutput: %s", err, out)
+	}
+	if cli.Options.Verbose {
+		fmt.Fprint(cli.out, string(out))
+	}
+
+	// so pulling again knows containerd has it
+	if out, err := cli.runCtr(ctr, "images", "label", fullName, ContainerdIdLabel+"="+string(id)); err != nil {
+		return fmt.Errorf("labelling %s in containerd: %s\noutput: %s", fullName, err, out)
+	}
+	return nil
+}
+
+// Whether containerd has image id as name, imported by an earlier pull.
+func (cli *DogestryCli) containerdHas(ctr, name string, id remote.ID) (bool, error) {
+	out, err := cli.runCtr(ctr, "images", "ls", "name=="+name)
+	if err != nil {
+		return false, fmt.Errorf("listing containerd's images: %s\noutput: %s", err, out)
+	}
+
+	// the labels are the last column
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == name {
+			for _, label := range strings.Split(fields[len(fields)-1], ",") {
+				if label == ContainerdIdLabel+"="+string(id) {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// runs ctr with args, against the configured containerd and the pull's namespace
+func (cli *DogestryCli) runCtr(ctr string, args ...string) ([]byte, error) {
+	global := []string{}
+	if cli.Config.Containerd.Address != "" {
+		global = append(global, "--address", cli.Config.Containerd.Address)
+	}
+	global = append(global, "--namespace", cli.containerdNamespace)
+	return exec.Command(ctr, append(global, args...)...).CombinedOutput()
+}
+
+// The name containerd, and kubernetes through it, knows an image by. Names
+// are fully qualified there, so redis:latest is docker.io/library/redis:latest.
+func containerdName(repoName, repoTag string) string {
+	if registryHost(repoName) == "" {
+		if !strings.Contains(repoName, "/") {
+			repoName = "library/" + repoName
+		}
+		repoName = "docker.io/" + repoName
+	}
+	return repoName + ":" + repoTag
+}
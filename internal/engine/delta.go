@@ -0,0 +1,230 @@
+package engine
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	dockerclient "github.com/blake-education/dogestry/client"
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// a layer pushed as a delta, and the id of the image whose layer it's against
+	DeltaFile     = "layer.tar.xdelta"
+	DeltaBaseFile = "delta-base"
+)
+
+var (
+	// layers smaller than this are always pushed whole
+	DeltaMinSize int64 = 64 * 1024 * 1024
+
+	// a delta is only pushed if it's smaller than this fraction of its layer
+	DeltaMaxRatio = 0.5
+)
+
+func isDeltaFile(name string) bool {
+	base := filepath.Base(name)
+	return base == DeltaFile || base == DeltaBaseFile
+}
+
+// Replaces big layers of the prepared image with deltas against the layers of
+// the version of the tag already on the remote, where the delta is much smaller.
+// Base layers come from the local docker, so without them layers are pushed whole.
+func (cli *DogestryCli) deltaLayers(image, root string, r remote.Remote) error {
+	repoName, repoTag := remote.NormaliseImageName(image)
+
+	previousId, err := remote.ParseTag(r, repoName, repoTag)
+	if err == remote.ErrNoSuchTag || previousId == "" {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// the previous version's layers, which the new image doesn't share
+	bases := make(map[remote.ID]int64)
+	err = r.WalkImages(previousId, func(id remote.ID, image docker.Image, err error) error {
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(root, "images", string(id))); os.IsNotExist(err) {
+			bases[id] = image.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	layers, err := filepath.Glob(filepath.Join(root, "images", "*", "layer.tar"))
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		info, err := os.Stat(layer)
+		if err != nil {
+			return err
+		}
+		if info.Size() < DeltaMinSize {
+			continue
+		}
+
+		// the most likely base is the layer closest in size
+		baseId := remote.ID("")
+		closest := int64(math.MaxInt64)
+		for id, size := range bases {
+			distance := size - info.Size()
+			if distance < 0 {
+				distance = -distance
+			}
+			if size > 0 && distance < closest {
+				baseId, closest = id, distance
+			}
+		}
+		if baseId == "" {
+			continue
+		}
+
+		if err := cli.deltaLayer(layer, baseId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replaces layer with a delta against baseId's layer, if it's worth it.
+func (cli *DogestryCli) deltaLayer(layer string, baseId remote.ID) error {
+	dir, err := cli.WorkDir("delta-" + string(baseId))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "layer.tar")
+	found, err := cli.localLayer(baseId, base)
+	if err != nil {
+		return err
+	} else if !found {
+		if cli.Options.Verbose {
+			fmt.Fprintf(cli.out, "docker doesn't have '%s', pushing layer whole\n", baseId.Short())
+		}
+		return nil
+	}
+
+	fmt.Fprintf(cli.out, "diffing %s against '%s'\n", layer, baseId.Short())
+
+	delta := filepath.Join(filepath.Dir(layer), DeltaFile)
+	if err := cli.compressor.Delta(base, layer, delta); err != nil {
+		return err
+	}
+
+	layerInfo, err := os.Stat(layer)
+	if err != nil {
+		return err
+	}
+	deltaInfo, err := os.Stat(delta)
+	if err != nil {
+		return err
+	}
+
+	if float64(deltaInfo.Size()) > DeltaMaxRatio*float64(layerInfo.Size()) {
+		fmt.Fprintf(cli.out, "delta is %s, pushing layer whole\n", utils.HumanSize(deltaInfo.Size()))
+		return os.Remove(delta)
+	}
+
+	fmt.Fprintf(cli.out, "pushing %s delta instead of %s layer\n", utils.HumanSize(deltaInfo.Size()), utils.HumanSize(layerInfo.Size()))
+
+	if err := ioutil.WriteFile(filepath.Join(filepath.Dir(layer), DeltaBaseFile), []byte(baseId), 0600); err != nil {
+		return err
+	}
+	return os.Remove(layer)
+}
+
+// Rebuilds the layer of a pulled image pushed as a delta. The base layer comes
+// from the local docker if it has it, otherwise it's pulled from the remote.
+func (cli *DogestryCli) applyDelta(imageDir string, r remote.Remote) error {
+	delta := filepath.Join(imageDir, DeltaFile)
+	if _, err := os.Stat(delta); os.IsNotExist(err) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(imageDir, DeltaBaseFile))
+	if err != nil {
+		return fmt.Errorf("delta without a base: %w", err)
+	}
+	baseId := remote.ID(strings.TrimSpace(string(data)))
+
+	dir, err := cli.WorkDir("delta-" + string(baseId))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "layer.tar")
+	found, err := cli.localLayer(baseId, base)
+	if err != nil {
+		return err
+	} else if !found {
+		fmt.Fprintf(cli.out, "pulling delta base '%s'\n", baseId.Short())
+		if err := r.PullImageId(baseId, dir); err != nil {
+			return err
+		}
+		// the base may be compressed, or a delta itself
+		if err := cli.processPulled(baseId, dir, r); err != nil {
+			return err
+		}
+	}
+
+	if err := cli.compressor.Patch(base, delta, filepath.Join(imageDir, "layer.tar")); err != nil {
+		return err
+	}
+
+	if err := os.Remove(delta); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(imageDir, DeltaBaseFile))
+}
+
+// Writes the layer of image id in the local docker to dst. False if docker doesn't have it.
+func (cli *DogestryCli) localLayer(id remote.ID, dst string) (bool, error) {
+	// pulling to an oci layout or containerd doesn't need docker, so doesn't use it
+	if !cli.usesDocker() {
+		return false, nil
+	}
+
+	if _, err := cli.client.InspectImage(string(id)); err == dockerclient.ErrNoSuchImage {
+		return false, nil
+	} else if err != nil {
+		return false, dockerError(err)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(cli.client.GetImageTarball(string(id), writer))
+	}()
+	// stops the export once we have the layer
+	defer reader.Close()
+
+	tarball := tar.NewReader(reader)
+	for {
+		header, err := tarball.Next()
+		if err == io.EOF {
+			return false, fmt.Errorf("docker's export of '%s' has no layer", id.Short())
+		} else if err != nil {
+			return false, err
+		}
+
+		if strings.TrimPrefix(header.Name, "./") == string(id)+"/layer.tar" {
+			return true, writeFile(dst, tarball)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package engine
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	dockerclient "github.com/blake-education/dogestry/client"
+	"github.com/blake-education/dogestry/config"
+	"github.com/fsouza/go-dockerclient/engine"
+)
+
+const DefaultDockerConnection = "unix:///var/run/docker.sock"
+
+var (
+	// docker's image save/load endpoints arrived in this api version
+	MinDockerApiVersion = "1.7"
+
+	// the last api version whose `docker save` has a directory per layer.
+	// Later ones save an OCI layout, which push can't read.
+	MaxDockerApiVersion = "1.43"
+)
+
+// A client for the docker daemon given by dockerConnection.
+// As with the docker cli, DOCKER_TLS_VERIFY connects over TLS with the
+// ca.pem, cert.pem and key.pem in DOCKER_CERT_PATH (default ~/.docker), and
+// a docker cli context with certificates connects with those.
+//
+// The api version is agreed with the daemon on the first request, so
+// requests and responses have the shape dogestry expects, rather than
+// whatever the daemon's default is.
+func newDockerClient(cfg config.Config) (*dockerclient.Client, error) {
+	client, err := connectDocker(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	client.NegotiateAPIVersion(dockerApiVersion)
+	return client, nil
+}
+
+func connectDocker(cfg config.Config) (*dockerclient.Client, error) {
+	connection, context, err := dockerConnection(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	useTLS := os.Getenv("DOCKER_TLS_VERIFY") != ""
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		certPath = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	// a context brings its own TLS material
+	if context != nil {
+		useTLS = context.TLSDir != ""
+		certPath = context.TLSDir
+	}
+
+	endpoint, err := dockerEndpoint(connection, useTLS)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(endpoint, "ssh://") {
+		return newSSHDockerClient(endpoint)
+	}
+
+	if !useTLS {
+		return dockerclient.NewClient(endpoint)
+	}
+
+	if strings.HasPrefix(endpoint, "unix://") {
+		return nil, fmt.Errorf("DOCKER_TLS_VERIFY is set, but the docker connection '%s' isn't tcp", connection)
+	}
+
+	cert, key, ca := filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem"), filepath.Join(certPath, "ca.pem")
+	// contexts can have just a ca, or just a client certificate
+	if context != nil {
+		if _, err := os.Stat(cert); os.IsNotExist(err) {
+			cert, key = "", ""
+		}
+		if _, err := os.Stat(ca); os.IsNotExist(err) {
+			ca = ""
+		}
+	}
+
+	client, err := dockerclient.NewTLSClient(endpoint, cert, key, ca)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to docker with the TLS certificates in %s: %w", certPath, err)
+	}
+	return client, nil
+}
+
+// The api version to talk to a daemon with the given version info in: the
+// daemon's own, if dogestry supports it. Daemons too old to save and load
+// images, or too new to save them in a way push understands, are an error.
+func dockerApiVersion(version *engine.Env) (string, error) {
+	apiVersion := version.Get("ApiVersion")
+	if apiVersion == "" {
+		return "", fmt.Errorf("docker %s didn't say which api version it has", version.Get("Version"))
+	}
+
+	if apiVersionLess(apiVersion, MinDockerApiVersion) {
+		return "", fmt.Errorf("docker %s has api version %s, but dogestry needs %s or later", version.Get("Version"), apiVersion, MinDockerApiVersion)
+	}
+	if apiVersionLess(MaxDockerApiVersion, apiVersion) {
+		return "", fmt.Errorf("docker %s has api version %s, which is newer than dogestry supports (up to %s)", version.Get("Version"), apiVersion, MaxDockerApiVersion)
+	}
+
+	return apiVersion, nil
+}
+
+// The docker daemon to use: `connection` in the [docker] section (which
+// -docker-host sets), otherwise DOCKER_HOST, otherwise the docker cli's
+// current context, as with the docker cli, otherwise the local socket. Hosts
+// with podman rather than docker use podman's docker-compatible socket.
+// The context is returned too, if the connection is its.
+func dockerConnection(cfg config.Config) (string, *dockerContext, error) {
+	if cfg.Docker.Connection != "" {
+		return cfg.Docker.Connection, nil, nil
+	}
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		return host, nil, nil
+	}
+
+	context, err := currentDockerContext()
+	if err != nil {
+		return "", nil, err
+	} else if context != nil {
+		return context.Host, context, nil
+	}
+
+	if _, err := os.Stat(strings.TrimPrefix(DefaultDockerConnection, "unix://")); os.IsNotExist(err) {
+		for _, socket := range podmanSockets() {
+			if _, err := os.Stat(socket); err == nil {
+				return "unix://" + socket, nil, nil
+			}
+		}
+	}
+	return DefaultDockerConnection, nil, nil
+}
+
+// Podman's docker-compatible sockets: the user's own, for rootless podman,
+// then the system one. Either needs `podman.socket` enabled in systemd.
+func podmanSockets() []string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = fmt.Sprintf("/run/user/%d", os.Getuid())
+	}
+	return []string{
+		filepath.Join(runtimeDir, "podman", "podman.sock"),
+		"/run/podman/podman.sock",
+	}
+}
+
+// docker or podman, going by the daemon's version info
+func engineName(version *engine.Env) string {
+	components := []struct{ Name string }{}
+	if err := version.GetJson("Components", &components); err == nil {
+		for _, component := range components {
+			if strings.HasPrefix(component.Name, "Podman") {
+				return "podman"
+			}
+		}
+	}
+	return "docker"
+}
+
+// Turns a connection as the docker cli takes it (unix://, tcp://, fd://,
+// ssh://, or a bare host:port) into the http, https, unix or ssh url the client needs.
+func dockerEndpoint(connection string, useTLS bool) (string, error) {
+	if !strings.Contains(connection, "://") {
+		connection = "tcp://" + connection
+	}
+
+	u, err := url.Parse(connection)
+	if err != nil {
+		return "", fmt.Errorf("invalid docker connection '%s': %w", connection, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		if u.Path == "" {
+			return DefaultDockerConnection, nil
+		}
+		return connection, nil
+	case "fd":
+		// socket activation is for the daemon. Its clients use the usual socket
+		return DefaultDockerConnection, nil
+	case "ssh":
+		if u.Host == "" {
+			return "", fmt.Errorf("invalid docker connection '%s': no host", connection)
+		}
+		// ssh has its own encryption, so TLS doesn't apply
+		return connection, nil
+	case "tcp", "http", "https":
+		if u.Host == "" {
+			return "", fmt.Errorf("invalid docker connection '%s': no host", connection)
+		}
+		// docker's TLS port speaks https, whatever the connection says
+		if useTLS {
+			u.Scheme = "https"
+		} else if u.Scheme == "tcp" {
+			u.Scheme = "http"
+		}
+		return u.String(), nil
+	}
+
+	return "", fmt.Errorf("invalid docker connection '%s': use unix://, tcp://, fd:// or ssh://", connection)
+}
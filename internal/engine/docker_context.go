@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The docker endpoint of a docker cli context, as `docker context create` stores it
+type dockerContext struct {
+	Name string
+	Host string
+
+	// where the context's ca.pem, cert.pem and key.pem are. Empty if it has none
+	TLSDir string
+}
+
+// the docker cli's config dir: $DOCKER_CONFIG, or ~/.docker
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), ".docker")
+}
+
+// The docker cli's current context: $DOCKER_CONTEXT, otherwise currentContext
+// in its config.json. Nil for the default context, which is DOCKER_HOST or the
+// local socket, as without contexts.
+func currentDockerContext() (*dockerContext, error) {
+	name := os.Getenv("DOCKER_CONTEXT")
+	if name == "" {
+		data, err := ioutil.ReadFile(filepath.Join(dockerConfigDir(), "config.json"))
+		if os.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		cfg := dockerConfigFile{}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid docker config %s: %w", filepath.Join(dockerConfigDir(), "config.json"), err)
+		}
+		name = cfg.CurrentContext
+	}
+	if name == "" || name == "default" {
+		return nil, nil
+	}
+
+	// contexts are stored under the digest of their name
+	id := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))
+	metaPath := filepath.Join(dockerConfigDir(), "contexts", "meta", id, "meta.json")
+
+	data, err := ioutil.ReadFile(metaPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("docker context '%s' doesn't exist. See `docker context ls`", name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	meta := struct {
+		Endpoints map[string]struct {
+			Host string
+		}
+	}{}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("invalid docker context %s: %w", metaPath, err)
+	}
+
+	context := &dockerContext{Name: name, Host: meta.Endpoints["docker"].Host}
+	if context.Host == "" {
+		return nil, fmt.Errorf("docker context '%s' has no docker endpoint", name)
+	}
+
+	tlsDir := filepath.Join(dockerConfigDir(), "contexts", "tls", id, "docker")
+	if _, err := os.Stat(tlsDir); err == nil {
+		context.TLSDir = tlsDir
+	}
+	return context, nil
+}
@@ -0,0 +1,39 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient/engine"
+)
+
+func TestDockerApiVersion(t *testing.T) {
+	tests := []struct {
+		apiVersion string
+		want       string
+	}{
+		{"1.7", "1.7"},
+		{"1.24", "1.24"},
+		{"1.43", "1.43"},
+		{"1.6", ""},
+		{"1.44", ""},
+		{"2.0", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		version := &engine.Env{}
+		version.Set("Version", "test")
+		version.Set("ApiVersion", test.apiVersion)
+
+		got, err := dockerApiVersion(version)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("api version %q: got %q, want an error", test.apiVersion, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("api version %q: got %q, %v, want %q", test.apiVersion, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+)
+
+var (
+	// warn if the temp dir has less space than this
+	MinTempDirSpace uint64 = 1000 * 1000 * 1000
+)
+
+type doctor struct {
+	problems int
+}
+
+func (d *doctor) ok(format string, a ...interface{}) {
+	fmt.Printf("  ok    "+format+"\n", a...)
+}
+
+func (d *doctor) fail(hint string, format string, a ...interface{}) {
+	d.problems++
+	fmt.Printf("  FAIL  "+format+"\n", a...)
+	fmt.Printf("        -> %s\n", hint)
+}
+
+func (cli *DogestryCli) CmdDoctor(args ...string) error {
+	cmd := cli.Subcmd("doctor", "[REMOTE...]", "check the config, credentials, docker connection, temp dir and remotes for problems. Checks all configured remotes if none are given")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	d := &doctor{}
+
+	fmt.Println("config:")
+	cli.checkConfig(d)
+
+	fmt.Println("docker:")
+	cli.checkDocker(d)
+
+	fmt.Println("temp dir:")
+	cli.checkTempDir(d)
+
+	remoteDefs := cmd.Args()
+	if cli.Options.Remote != "" {
+		remoteDefs = append([]string{cli.Options.Remote}, remoteDefs...)
+	}
+	if len(remoteDefs) == 0 {
+		for name := range cli.Config.Remote {
+			remoteDefs = append(remoteDefs, name)
+		}
+		sort.Strings(remoteDefs)
+	}
+
+	fmt.Println("remotes:")
+	if len(remoteDefs) == 0 {
+		fmt.Println("  no remotes configured or given")
+	}
+	for _, remoteDef := range remoteDefs {
+		cli.checkRemote(d, remoteDef)
+	}
+
+	if d.problems > 0 {
+		return fmt.Errorf("%d problem(s) found", d.problems)
+	}
+
+	fmt.Println("no problems found")
+	return nil
+}
+
+func (cli *DogestryCli) checkConfig(d *doctor) {
+	if cli.configErr != nil {
+		d.fail("fix the syntax of the config file, see dogestry.eg.cfg for an example", "config file: %s", cli.configErr)
+	} else if len(cli.configFiles) == 0 {
+		d.ok("no config file, using defaults")
+	} else {
+		d.ok("config from %s", strings.Join(cli.configFiles, ", "))
+	}
+
+	if cli.Config.CredentialStore != nil {
+		d.ok("credentials from `dogestry login` are kept in %s", cli.Config.CredentialStore.Desc())
+	}
+
+	credsPath := config.CredentialsFilePath(cli.Config)
+	if info, err := os.Stat(credsPath); os.IsNotExist(err) {
+		d.ok("no plaintext credentials file")
+	} else if err != nil {
+		d.fail("check the permissions of the credentials file", "credentials file %s: %s", credsPath, err)
+	} else if info.Mode().Perm()&0077 != 0 {
+		d.fail(fmt.Sprintf("run: chmod 600 %s, or move them to the encrypted store with `dogestry login -import`", credsPath), "credentials file %s is readable by other users", credsPath)
+	} else {
+		d.fail("move them to the encrypted store with `dogestry login -import`", "credentials file %s stores keys in plaintext", credsPath)
+	}
+
+	// remotes' vault secrets are checked with the remotes
+	if path := cli.Config.Signing.Key_Vault_Path; path != "" {
+		if _, err := cli.signingKey(); err != nil {
+			d.fail("check the [vault] section, and that its token or AppRole can read the path", "signing key from vault: %s", err)
+		} else {
+			d.ok("signing key from vault %s", path)
+		}
+	}
+}
+
+func (cli *DogestryCli) checkDocker(d *doctor) {
+	version, err := cli.client.Version()
+	if err != nil {
+		d.fail("check docker (or podman.socket, for podman) is running, and that `connection` in the [docker] section of the config (or $DOCKER_HOST) is correct and you have permission to use it",
+			"connecting to docker: %s", err)
+		return
+	}
+
+	apiVersion, err := dockerApiVersion(version)
+	if err != nil {
+		d.fail(fmt.Sprintf("use a docker supporting an api version between %s and %s", MinDockerApiVersion, MaxDockerApiVersion), "%s", err)
+		return
+	}
+
+	d.ok("%s %s (api version %s)", engineName(version), version.Get("Version"), apiVersion)
+}
+
+func (cli *DogestryCli) checkTempDir(d *doctor) {
+	tempDir := cli.tempDirRoot
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		d.fail("use -tempdir or `temp-dir` in the [dogestry] section to choose a writable temp dir", "creating temp dir %s: %s", tempDir, err)
+		return
+	}
+
+	free, err := utils.FreeSpace(tempDir)
+	if err != nil {
+		d.fail("use -tempdir or `temp-dir` in the [dogestry] section to choose another temp dir", "checking free space in %s: %s", tempDir, err)
+		return
+	}
+
+	min := MinTempDirSpace
+	if cli.Config.Dogestry.Temp_Dir_Min_Free_Mb > 0 {
+		min = uint64(cli.Config.Dogestry.Temp_Dir_Min_Free_Mb) * 1000 * 1000
+	}
+	if free < min {
+		d.fail("free some space, or use -tempdir or `temp-dir` in the [dogestry] section to choose a larger volume. Images are staged here during push and pull",
+			"temp dir %s only has %s free", tempDir, utils.HumanSize(int64(free)))
+		return
+	}
+
+	d.ok("temp dir %s has %s free", tempDir, utils.HumanSize(int64(free)))
+}
+
+func (cli *DogestryCli) checkRemote(d *doctor, remoteDef string) {
+	r, err := cli.newRemote(remoteDef)
+	if err != nil {
+		d.fail("check the remote's url, that its credentials are valid (see `dogestry login`) and that they allow listing the remote",
+			"%s: %s", remoteDef, err)
+		return
+	}
+
+	if _, err := remote.ListTags(r); err != nil {
+		d.fail("check the credentials allow reading from the remote", "%s: listing tags: %s", remoteDef, err)
+		return
+	}
+
+	d.ok("%s: %s", remoteDef, r.Desc())
+}
+
+// compare docker api versions like "1.10" and "1.7"
+func apiVersionLess(a, b string) bool {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aPart, _ := strconv.Atoi(aParts[i])
+		bPart, _ := strconv.Atoi(bParts[i])
+		if aPart != bPart {
+			return aPart < bPart
+		}
+	}
+
+	return len(aParts) < len(bParts)
+}
@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/blake-education/dogestry/compressor"
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+)
+
+// What a push or pull would transfer
+type transferPlan struct {
+	Command string               `json:"command"`
+	Image   string               `json:"image"`
+	Files   []remote.PlannedFile `json:"files"`
+	Bytes   int64                `json:"bytes"`
+}
+
+// Prepares the image as push would, then compares it with the remote.
+// Nothing is written to the remote, not even a lock.
+func (cli *DogestryCli) dryRunPush(image, imageRoot string, r remote.Remote) (err error) {
+	if cli.compressor, err = compressor.NewCompressor(cli.Config); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.out, "preparing image")
+	if err := cli.prepareImage(image, imageRoot); err != nil {
+		return err
+	}
+	if err := cli.reshapeImage(image, imageRoot); err != nil {
+		return err
+	}
+	if err := cli.processImage(image, imageRoot, r); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.out, "comparing with remote")
+	files, err := r.PushPlan(imageRoot)
+	if err != nil {
+		return err
+	}
+
+	return cli.printPlan("push", image, files)
+}
+
+// Works out which images docker is missing, and what they'd take to download.
+func (cli *DogestryCli) dryRunPull(image string, r remote.Remote) error {
+	id, err := r.ResolveImageNameToId(image)
+	if err != nil {
+		return err
+	}
+	if id, err = cli.platformImage(r, image, id); err != nil {
+		return err
+	}
+
+	ids, _, err := cli.imagesToPull(id, r)
+	if err != nil {
+		return err
+	}
+
+	files := make([]remote.PlannedFile, 0)
+	for _, id := range ids {
+		imageFiles, err := r.PullPlan(id)
+		if err != nil {
+			return err
+		}
+		files = append(files, imageFiles...)
+	}
+
+	return cli.printPlan("pull", image, files)
+}
+
+func (cli *DogestryCli) printPlan(command, image string, files []remote.PlannedFile) error {
+	plan := transferPlan{
+		Command: command,
+		Image:   image,
+		Files:   files,
+		Bytes:   remote.PlannedSize(files),
+	}
+
+	if cli.Options.Json {
+		return printJson(plan)
+	}
+
+	verb := "upload"
+	if command == "pull" {
+		verb = "download"
+	}
+
+	for _, file := range files {
+		fmt.Fprintf(cli.out, "would %s %s (%s)\n", verb, file.Key, utils.HumanSize(file.Size))
+	}
+	fmt.Fprintf(cli.out, "dry run: would %s %d files, %s\n", verb, len(files), utils.HumanSize(plan.Bytes))
+
+	return nil
+}
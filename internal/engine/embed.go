@@ -0,0 +1,283 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/remote"
+)
+
+// What the dogestry package, which the cli package's push and pull and
+// programs embedding dogestry use, is built on. Each push or pull gets a
+// DogestryCli of its own, as the server's jobs do, so any number can run at
+// once.
+
+// The config the dogestry command would use given -config path, or "" to
+// search for it, and -config-profile profile.
+func LoadConfig(path, profile string) (config.Config, error) {
+	cfg, _, _, err := parseConfig(path, profile)
+	return cfg, err
+}
+
+// Stages pushes and pulls under dir rather than $TMPDIR, first removing the
+// work dirs crashed runs left there.
+func (cli *DogestryCli) SetWorkDir(dir string) {
+	cli.tempDirRoot = dir
+	cleanOrphanedWorkDirs(cli.workDirRoot())
+}
+
+// Prints what pushes and pulls are doing, and their warnings, to w rather
+// than stdout and stderr.
+func (cli *DogestryCli) SetOutput(w io.Writer) {
+	cli.out = w
+	cli.err = w
+}
+
+// Sends the events of each push or pull to progress, as they happen, then an
+// EventComplete once it's finished.
+func (cli *DogestryCli) SetProgress(progress func(remote.Event)) {
+	cli.progress = progress
+}
+
+// a DogestryCli for one push or pull, with its own work dir
+func (cli *DogestryCli) job() (*DogestryCli, error) {
+	jobCli, err := NewDogestryCli(cli.Config)
+	if err != nil {
+		return nil, err
+	}
+	jobCli.tempDirRoot = cli.tempDirRoot
+	jobCli.Options = cli.Options
+	jobCli.out = cli.out
+	jobCli.err = cli.err
+	jobCli.control.Output = cli.out
+	return jobCli, nil
+}
+
+// How to push images, besides the config.
+type PushOptions struct {
+	// more tags to give each image, in the same repo
+	AlsoTags []string
+
+	// flatten each image into one layer
+	Squash bool
+
+	// print what would be uploaded, without uploading anything
+	DryRun bool
+
+	// push without scanning for vulnerabilities
+	SkipScan bool
+
+	// time and size each layer
+	ProfileLayers bool
+
+	// push from the OCI image layout in this dir, rather than from docker
+	OCIDir string
+
+	// push from this tarball, as `docker save` writes it, rather than from
+	// docker. Only for a single image
+	Tarball io.Reader
+}
+
+// How to pull images, besides the config.
+type PullOptions struct {
+	// write images to the OCI image layout in this dir, rather than docker
+	OCIDir string
+
+	// import images into this containerd namespace, rather than docker
+	ContainerdNamespace string
+
+	// pull images for this os/arch, rather than docker's
+	Platform string
+
+	// also tag the pulled image as this in docker. Only for a single image
+	TagAs string
+
+	// pull to the docker on each of these hosts, HostConcurrency at once,
+	// rather than the local one
+	Hosts           []string
+	HostConcurrency int
+
+	// don't check pulled layers and configs against their digests
+	SkipVerify bool
+
+	// print what would be downloaded, without downloading anything
+	DryRun bool
+
+	// time and size each layer
+	ProfileLayers bool
+
+	// write images to this tarball, as `docker load` reads it, rather than
+	// loading them into docker. Only for a single image
+	Tarball io.Writer
+}
+
+// Pushes each of images to remoteDef, one after another, so layers they share
+// are only uploaded once. Returns whether anything was uploaded.
+func (cli *DogestryCli) Push(remoteDef string, images []string, opts PushOptions) (bool, error) {
+	if opts.Tarball != nil && len(images) != 1 {
+		return false, fmt.Errorf("a tarball holds a single image")
+	}
+
+	jobCli, err := cli.job()
+	if err != nil {
+		return false, err
+	}
+	defer jobCli.Cleanup()
+
+	jobCli.alsoTags = opts.AlsoTags
+	jobCli.squash = opts.Squash
+	jobCli.dryRun = opts.DryRun
+	jobCli.skipScan = opts.SkipScan
+	jobCli.profiling = opts.ProfileLayers
+	jobCli.ociDir = opts.OCIDir
+	jobCli.exportOf = opts.Tarball
+
+	track := cli.tracker(jobCli)
+	err = jobCli.withTimeout("push", func() error {
+		images, err := jobCli.expandImages(images)
+		if err != nil {
+			return err
+		}
+
+		r, err := jobCli.newRemote(remoteDef)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(jobCli.out, "remote", r.Desc())
+
+		return jobCli.eachImage("push", images, func(image string) error {
+			return track(image, r, func() error {
+				return jobCli.pushImage(r, remoteDef, image)
+			})
+		})
+	})
+	return jobCli.changed, err
+}
+
+// Pulls each of images from remoteDef, one after another, so layers they
+// share are only downloaded once. Returns whether anything was loaded.
+func (cli *DogestryCli) Pull(remoteDef string, images []string, opts PullOptions) (bool, error) {
+	if opts.TagAs != "" && len(images) != 1 {
+		return false, fmt.Errorf("Error: -tag-as needs a single IMAGE")
+	}
+	if opts.Tarball != nil && len(images) != 1 {
+		return false, fmt.Errorf("a tarball holds a single image")
+	}
+	if opts.TagAs != "" && opts.OCIDir != "" {
+		return false, fmt.Errorf("Error: -tag-as tags the image in docker, so can't be used with -oci-dir")
+	}
+	if len(opts.Hosts) > 0 && (opts.OCIDir != "" || opts.ContainerdNamespace != "" || opts.Tarball != nil) {
+		return false, fmt.Errorf("Error: -pullhosts pulls to docker on each host, so can't be used with -oci-dir or -containerd")
+	}
+	if opts.ContainerdNamespace != "" && opts.OCIDir != "" {
+		return false, fmt.Errorf("Error: use one of -oci-dir and -containerd")
+	}
+	if opts.TagAs != "" && opts.ContainerdNamespace != "" {
+		return false, fmt.Errorf("Error: -tag-as tags the image in docker, so can't be used with -containerd")
+	}
+	if opts.Platform != "" {
+		if _, err := remote.ParsePlatform(opts.Platform); err != nil {
+			return false, err
+		}
+	}
+
+	jobCli, err := cli.job()
+	if err != nil {
+		return false, err
+	}
+	defer jobCli.Cleanup()
+
+	if opts.SkipVerify {
+		fmt.Fprintln(jobCli.err, "Warning: -insecure-skip-verify, so pulled layers and configs aren't checked against their digests")
+	}
+	jobCli.skipVerify = opts.SkipVerify
+	jobCli.dryRun = opts.DryRun
+	jobCli.profiling = opts.ProfileLayers
+	jobCli.tagAsName = opts.TagAs
+	jobCli.ociDir = opts.OCIDir
+	jobCli.containerdNamespace = opts.ContainerdNamespace
+	jobCli.platform = opts.Platform
+	jobCli.loadTo = opts.Tarball
+
+	track := cli.tracker(jobCli)
+	err = jobCli.withTimeout("pull", func() error {
+		if len(opts.Hosts) > 0 {
+			return jobCli.pullHosts(remoteDef, opts.Hosts, images, opts.HostConcurrency)
+		}
+
+		r, err := jobCli.newRemote(remoteDef)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(jobCli.out, "remote", r.Desc())
+
+		return jobCli.eachImage("pull", images, func(image string) error {
+			return track(image, r, func() error {
+				return jobCli.pullImageName(r, remoteDef, image)
+			})
+		})
+	})
+	return jobCli.changed, err
+}
+
+// Checks image on remoteDef can be pulled: its signature and trust, if the
+// remote has them, and every layer and config against its digest. It's
+// downloaded as a pull would, then thrown away, and nothing is recorded on the
+// remote.
+func (cli *DogestryCli) Verify(remoteDef, image string) error {
+	jobCli, err := cli.job()
+	if err != nil {
+		return err
+	}
+	defer jobCli.Cleanup()
+
+	jobCli.loadTo = ioutil.Discard
+	jobCli.verifying = true
+	track := cli.tracker(jobCli)
+
+	r, err := jobCli.newRemote(remoteDef)
+	if err != nil {
+		return err
+	}
+	return track(image, r, func() error {
+		return jobCli.pullImageName(remote.NewReadOnlyRemote(r), remoteDef, image)
+	})
+}
+
+// Sends jobCli's events to the progress callback, if there is one. The
+// returned func runs the push or pull of an image with r, then sends an
+// EventComplete with the bytes r transferred for it, and its error if it
+// failed. Images are pushed or pulled one after another, so what r
+// transferred meanwhile was the image's.
+func (cli *DogestryCli) tracker(jobCli *DogestryCli) func(image string, r remote.Remote, run func() error) error {
+	if cli.progress == nil {
+		return func(image string, r remote.Remote, run func() error) error {
+			return run()
+		}
+	}
+
+	jobCli.control.Report = cli.progress
+
+	return func(image string, r remote.Remote, run func() error) error {
+		started, before := time.Now(), r.Stats()
+		err := run()
+
+		complete := remote.Event{
+			Event:   remote.EventComplete,
+			Key:     image,
+			Time:    time.Now().UTC(),
+			Bytes:   r.Stats().Since(before).Bytes,
+			Seconds: time.Since(started).Seconds(),
+		}
+		if err != nil {
+			complete.Error = err.Error()
+		}
+		cli.progress(complete)
+		return err
+	}
+}
@@ -0,0 +1,135 @@
+package engine
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	dockerclient "github.com/blake-education/dogestry/client"
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/remote"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// An error that sets the exit status of dogestry.
+// Snatched from docker.
+type StatusError struct {
+	Status     string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return e.Status
+}
+
+// the exit status of push and pull with -detailed-exit-code when there was nothing to do
+const UpToDateStatus = 3
+
+func UpToDate(command string) error {
+	return &StatusError{Status: command + ": already up to date", StatusCode: UpToDateStatus}
+}
+
+// Exit statuses for the kinds of failure a wrapper might react to, e.g. by
+// refreshing credentials or retrying later. Anything else exits 1.
+const (
+	// the remote refused the credentials, or there were none
+	AuthStatus = 10
+	// couldn't connect to the remote
+	UnreachableStatus = 11
+	// docker doesn't have the image
+	LocalMissingStatus = 12
+	// the remote doesn't have the image
+	RemoteMissingStatus = 13
+	// a file didn't match its digest or checksum
+	ChecksumStatus = 14
+	// the docker daemon failed, or couldn't be reached
+	DockerStatus = 15
+	// a pre-push or pre-pull hook refused
+	HookStatus = 16
+)
+
+// An error from the docker daemon.
+type DockerError struct {
+	Err error
+}
+
+func (e *DockerError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DockerError) Unwrap() error {
+	return e.Err
+}
+
+func dockerError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &DockerError{err}
+}
+
+// s3's codes for credentials it doesn't accept
+var s3AuthCodes = map[string]bool{
+	"AccessDenied":          true,
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+	"ExpiredToken":          true,
+	"InvalidToken":          true,
+}
+
+// The status dogestry exits with for err: a StatusError's own, or one of
+// the statuses above for the kind of failure it was, or 1. An error joining
+// several exits with their status if they all share one, else 1.
+func ExitStatus(err error) int {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			return sharedExitStatus(joined.Unwrap())
+		}
+
+		switch e := err.(type) {
+		case *StatusError:
+			return e.StatusCode
+		case *remote.ChecksumError:
+			return ChecksumStatus
+		case *HookError:
+			return HookStatus
+		case *remote.AuthError:
+			return AuthStatus
+		case *s3.Error:
+			if e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden || s3AuthCodes[e.Code] {
+				return AuthStatus
+			}
+		case *DockerError:
+			if e.Err == dockerclient.ErrNoSuchImage {
+				return LocalMissingStatus
+			}
+			if apiErr, ok := e.Err.(*dockerclient.Error); ok && apiErr.Status == http.StatusNotFound {
+				return LocalMissingStatus
+			}
+			return DockerStatus
+		case net.Error:
+			return UnreachableStatus
+		}
+
+		switch err {
+		case config.ErrWrongPassphrase:
+			return AuthStatus
+		case remote.ErrNoSuchImage, remote.ErrNoSuchTag:
+			return RemoteMissingStatus
+		}
+	}
+	return 1
+}
+
+// the exit status of every one of errs, or 1 if they differ
+func sharedExitStatus(errs []error) int {
+	status := 1
+	for i, err := range errs {
+		if i == 0 {
+			status = ExitStatus(err)
+		} else if ExitStatus(err) != status {
+			return 1
+		}
+	}
+	return status
+}
@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	dockerclient "github.com/blake-education/dogestry/client"
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/remote"
+	"github.com/mitchellh/goamz/s3"
+)
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{UpToDate("push"), UpToDateStatus},
+		{&remote.AuthError{Err: errors.New("no credentials")}, AuthStatus},
+		{&s3.Error{StatusCode: 403, Code: "AccessDenied"}, AuthStatus},
+		{&s3.Error{StatusCode: 400, Code: "ExpiredToken"}, AuthStatus},
+		{config.ErrWrongPassphrase, AuthStatus},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, UnreachableStatus},
+		{&DockerError{dockerclient.ErrNoSuchImage}, LocalMissingStatus},
+		{&DockerError{&dockerclient.Error{Status: 404, Message: "no such image"}}, LocalMissingStatus},
+		{remote.ErrNoSuchImage, RemoteMissingStatus},
+		{remote.ErrNoSuchTag, RemoteMissingStatus},
+		{&remote.ChecksumError{File: "layer.tar", Expected: "sha256:a", Actual: "sha256:b"}, ChecksumStatus},
+		{&DockerError{&dockerclient.Error{Status: 500, Message: "daemon broke"}}, DockerStatus},
+		{&HookError{Hook: "pre-push", Command: "false", Err: errors.New("exit status 1")}, HookStatus},
+		{&s3.Error{StatusCode: 500, Code: "InternalError"}, 1},
+		{errors.New("something else"), 1},
+	}
+
+	for _, test := range tests {
+		if got := ExitStatus(test.err); got != test.want {
+			t.Errorf("%v: got %d, want %d", test.err, got, test.want)
+		}
+
+		// as the commands return them, wrapped in what they were doing
+		wrapped := fmt.Errorf("pushing app: %w", fmt.Errorf("uploading layer: %w", test.err))
+		if got := ExitStatus(wrapped); got != test.want {
+			t.Errorf("%v: got %d, want %d", wrapped, got, test.want)
+		}
+	}
+
+	transferErr := &remote.TransferError{Files: []remote.FileStatus{
+		{Key: "a", Attempts: 1},
+		{Key: "b", Attempts: 3, Err: fmt.Errorf("getting b: %w", remote.ErrNoSuchImage)},
+	}}
+	if got := ExitStatus(transferErr); got != RemoteMissingStatus {
+		t.Errorf("%v: got %d, want %d", transferErr, got, RemoteMissingStatus)
+	}
+
+	// several images failing, alike or not
+	authErr := &remote.AuthError{Err: errors.New("no credentials")}
+	alike := &imagesError{command: "push", images: 3, errs: []error{authErr, fmt.Errorf("pushing b: %w", authErr)}}
+	if got := ExitStatus(fmt.Errorf("push: %w", alike)); got != AuthStatus {
+		t.Errorf("%v: got %d, want %d", alike, got, AuthStatus)
+	}
+	mixed := &imagesError{command: "push", images: 3, errs: []error{authErr, remote.ErrNoSuchImage}}
+	if got := ExitStatus(mixed); got != 1 {
+		t.Errorf("%v: got %d, want 1", mixed, got)
+	}
+	if !errors.Is(mixed, remote.ErrNoSuchImage) {
+		t.Errorf("%v: doesn't wrap its images' errors", mixed)
+	}
+}
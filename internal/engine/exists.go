@@ -0,0 +1,68 @@
+package engine
+
+import (
+	"fmt"
+
+	dockerclient "github.com/blake-education/dogestry/client"
+	"github.com/blake-education/dogestry/remote"
+)
+
+const (
+	ExistsStatusMissing = 1
+	ExistsStatusError   = 2
+)
+
+func (cli *DogestryCli) CmdExists(args ...string) error {
+	cmd := cli.Subcmd("exists", "REMOTE IMAGE[:TAG]", "check whether IMAGE exists on the REMOTE. Exits 0 if it does, 1 if it doesn't and 2 on error. TAG defaults to 'latest'")
+	matchLocal := cmd.Bool("local", false, "also require the remote image id to match the image in the local docker")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	remoteDef, rest := cli.RemoteArgs(cmd)
+	if remoteDef == "" || len(rest) < 1 {
+		return &StatusError{Status: MissingArgs("exists", "REMOTE and IMAGE").Error(), StatusCode: ExistsStatusError}
+	}
+
+	image := rest[0]
+
+	r, err := cli.newRemote(remoteDef)
+	if err != nil {
+		return &StatusError{Status: err.Error(), StatusCode: ExistsStatusError}
+	}
+
+	id, err := r.ResolveImageNameToId(image)
+	if err == remote.ErrNoSuchImage {
+		return &StatusError{Status: fmt.Sprintf("image '%s' doesn't exist on the remote", image), StatusCode: ExistsStatusMissing}
+	} else if err != nil {
+		return &StatusError{Status: err.Error(), StatusCode: ExistsStatusError}
+	}
+
+	if *matchLocal {
+		localImage, err := cli.client.InspectImage(image)
+		if err == dockerclient.ErrNoSuchImage {
+			return &StatusError{Status: fmt.Sprintf("image '%s' doesn't exist in docker", image), StatusCode: ExistsStatusError}
+		} else if err != nil {
+			return &StatusError{Status: err.Error(), StatusCode: ExistsStatusError}
+		}
+
+		dockerId, err := remote.DockerImageId(r, id)
+		if err != nil {
+			return &StatusError{Status: err.Error(), StatusCode: ExistsStatusError}
+		}
+
+		if localImage.ID != dockerId {
+			return &StatusError{
+				Status:     fmt.Sprintf("image '%s' is '%s' on the remote but '%s' in docker", image, remote.ID(dockerId).Short(), remote.ID(localImage.ID).Short()),
+				StatusCode: ExistsStatusMissing,
+			}
+		}
+	}
+
+	if cli.Options.Json {
+		return printJson(map[string]string{"image": image, "id": id.String()})
+	}
+
+	fmt.Printf("image '%s' exists on the remote with id '%s'\n", image, id.Short())
+	return nil
+}
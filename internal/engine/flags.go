@@ -0,0 +1,231 @@
+package engine
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+)
+
+// Options shared by every command. They can be given before or after the command name.
+type GlobalOptions struct {
+	ConfigFile    string
+	ConfigProfile string
+	TempDir       string
+	Remote        string
+	Verbose       bool
+	Trace         bool
+	Json          bool
+	Quiet         bool
+	DockerHost    string
+	LogFormat     string
+	LogOutput     string
+}
+
+func globalFlagSet(opts *GlobalOptions) *flag.FlagSet {
+	flags := flag.NewFlagSet("dogestry", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+
+	flags.StringVar(&opts.ConfigFile, "config", "", "the dogestry config file, dogestry.cfg or yaml, instead of the ones found in the current directory, ~/.config/dogestry and /etc/dogestry, merged. Config is optional - if using s3 you can use env vars or signed URLs.")
+	flags.StringVar(&opts.ConfigProfile, "config-profile", "", "the profile of a yaml config file to lay over the rest of it, e.g. ci (default `profile` in the file)")
+	flags.StringVar(&opts.TempDir, "work-dir", "", "where images are staged during push and pull (default `temp-dir` in the [dogestry] section, then $TMPDIR)")
+	flags.StringVar(&opts.TempDir, "tempdir", "", "the old name of -work-dir")
+	flags.StringVar(&opts.Remote, "remote", "", "the remote to use, for commands taking a REMOTE. It's then left out of the command's arguments")
+	flags.BoolVar(&opts.Verbose, "verbose", false, "print more detail about what's happening, e.g. each layer and file transferred, with progress")
+	flags.BoolVar(&opts.Verbose, "v", false, "short for -verbose")
+	flags.BoolVar(&opts.Trace, "vv", false, "as -verbose, and print each http request made to remotes too")
+	flags.BoolVar(&opts.Json, "json", false, "print results as json lines on stdout, for commands that list things and push and pull progress")
+	flags.BoolVar(&opts.Quiet, "quiet", false, "print nothing but errors, not even warnings")
+	flags.BoolVar(&opts.Quiet, "q", false, "short for -quiet")
+	flags.StringVar(&opts.DockerHost, "docker-host", "", "the docker daemon to use, e.g. unix:///var/run/docker.sock, tcp://host:2375 or ssh://user@host (default `connection` in the [docker] section, then $DOCKER_HOST)")
+
+	flags.StringVar(&opts.LogOutput, "log-output", "", "stdout, or syslog or journald to log there rather than print to stdout and stderr, e.g. from cron (default `output` in the [log] section)")
+	flags.StringVar(&opts.LogFormat, "log-format", utils.LogText, "text, or json to print everything as json records, with level, time, component, image, and for transfers layer and bytes")
+
+	return flags
+}
+
+// Pulls the global options out of args, wherever they appear before a "--",
+// leaving the command and its own args.
+func ParseGlobalOptions(args []string) (opts GlobalOptions, rest []string, err error) {
+	flags := globalFlagSet(&opts)
+	rest = make([]string, 0, len(args))
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+
+		if len(arg) < 2 || arg[0] != '-' {
+			rest = append(rest, arg)
+			continue
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		value := ""
+		hasValue := false
+		if eq := strings.Index(name, "="); eq != -1 {
+			name, value, hasValue = name[:eq], name[eq+1:], true
+		}
+
+		f := flags.Lookup(name)
+		if f == nil {
+			// the command's own flag
+			rest = append(rest, arg)
+			continue
+		}
+
+		if !hasValue {
+			if isBoolFlag(f) {
+				value = "true"
+			} else if i+1 < len(args) {
+				i++
+				value = args[i]
+			} else {
+				return opts, rest, fmt.Errorf("Error: flag needs an argument: -%s", name)
+			}
+		}
+
+		if err := flags.Set(name, value); err != nil {
+			return opts, rest, fmt.Errorf("Error: invalid value %q for flag -%s: %w", value, name, err)
+		}
+	}
+
+	return opts, rest, nil
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface {
+		IsBoolFlag() bool
+	})
+	return ok && b.IsBoolFlag()
+}
+
+func printGlobalDefaults() {
+	flags := globalFlagSet(&GlobalOptions{})
+	flags.SetOutput(os.Stderr)
+	flags.PrintDefaults()
+}
+
+// A flag which can be given more than once, collecting its values.
+type StringsFlag []string
+
+func (s *StringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *StringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// The remote for a command whose first argument is REMOTE, and the arguments after it.
+// With -remote, the command's arguments don't include the remote. Nor do
+// they with `default-remote` set, if the first argument isn't a remote.
+func (cli *DogestryCli) RemoteArgs(cmd *flag.FlagSet) (string, []string) {
+	if cli.Options.Remote != "" {
+		return cli.Options.Remote, cmd.Args()
+	}
+
+	defaultRemote := cli.Config.Dogestry.Default_Remote
+	if defaultRemote != "" && (cmd.NArg() == 0 || !cli.isRemote(cmd.Arg(0))) {
+		desc := defaultRemote
+		if r, ok := cli.Config.Remote[defaultRemote]; ok {
+			desc = fmt.Sprintf("%s (%s)", defaultRemote, utils.Redact(r.Url))
+		}
+		fmt.Fprintf(cli.err, "Note: using the default remote %s\n", desc)
+		return defaultRemote, cmd.Args()
+	}
+
+	if cmd.NArg() == 0 {
+		return "", cmd.Args()
+	}
+	return cmd.Arg(0), cmd.Args()[1:]
+}
+
+// Whether arg names a remote, rather than e.g. an image: a remote in the
+// config, a url, or a local remote's directory.
+func (cli *DogestryCli) isRemote(arg string) bool {
+	if _, ok := cli.Config.Remote[arg]; ok {
+		return true
+	}
+	if strings.Contains(arg, "://") || strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return true
+	}
+	info, err := os.Stat(arg)
+	return err == nil && info.IsDir()
+}
+
+// The error for a command missing required arguments.
+func MissingArgs(command, what string) error {
+	return fmt.Errorf("Error: %s not specified. See 'dogestry help %s'", what, command)
+}
+
+// where -json output goes. With -json everything else goes to stderr, so
+// this is the only thing on stdout
+var jsonOut io.Writer = os.Stdout
+
+var jsonLock sync.Mutex
+
+// Prints v as json, for -json. Each value is a line, so progress can be
+// followed as it's printed.
+func printJson(v interface{}) error {
+	jsonLock.Lock()
+	defer jsonLock.Unlock()
+	return json.NewEncoder(jsonOut).Encode(v)
+}
+
+// Sends everything but -json output to stderr, where transfer events go.
+func jsonOutput() {
+	jsonOut = os.Stdout
+	os.Stdout = os.Stderr
+}
+
+// Prints a transfer event as a record, for -log-format json. A record for
+// each file's progress would swamp the log, so those are left out.
+func logEvent(event remote.Event) {
+	if event.Event == remote.EventProgress {
+		return
+	}
+
+	level := "info"
+	msg := event.Event + " " + event.Key
+	switch event.Event {
+	case remote.EventRetrying:
+		level = "warn"
+	case remote.EventFailed:
+		level = "error"
+	}
+	if event.Error != "" {
+		msg += ": " + event.Error
+	}
+
+	record := utils.NewLogRecord(level, msg)
+	record.Time = event.Time
+	record.Key = event.Key
+	record.Layer = eventLayer(event.Key)
+	record.Bytes = event.Bytes
+	record.Seconds = event.Seconds
+	utils.PrintLogRecord(record)
+}
+
+// The layer key is part of, i.e. the <id> of images/<id>/..., if it's one.
+func eventLayer(key string) string {
+	parts := strings.Split(key, "/")
+	for i := 0; i+2 < len(parts); i++ {
+		if parts[i] == "images" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
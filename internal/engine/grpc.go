@@ -0,0 +1,304 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+)
+
+// The server's gRPC api, proto/dogestry.proto, served over http/2 on the same
+// address as the http api. gRPC's framing is simple enough to serve with
+// net/http: each message is a byte saying whether it's compressed, its length
+// as 4 bytes, then the message, and the call's status is sent in trailers.
+
+const grpcService = "/dogestry.v1.Dogestry/"
+
+// gRPC's status codes
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// the biggest request accepted. Requests are a few short strings
+const grpcMaxRequest = 64 * 1024
+
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// POST /dogestry.v1.Dogestry/METHOD
+func (s *server) handleGrpc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC needs an http/2 POST of application/grpc", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	err := s.serveGrpc(w, r, strings.TrimPrefix(r.URL.Path, grpcService))
+
+	code, message := grpcOK, ""
+	if err != nil {
+		code, message = grpcInternal, err.Error()
+		if grpcErr, ok := err.(*grpcError); ok {
+			code = grpcErr.code
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEscape(utils.Redact(message)))
+	}
+}
+
+func (s *server) serveGrpc(w http.ResponseWriter, r *http.Request, method string) error {
+	token, authorized := s.bearer(r)
+	if s.tokens != nil && !authorized {
+		return grpcErrorf(grpcUnauthenticated, "a valid bearer token is required")
+	}
+
+	req, err := readGrpcRequest(r.Body)
+	if err != nil {
+		return err
+	}
+
+	switch method {
+	case "Push", "Pull":
+		kind := strings.ToLower(method)
+		remoteDef, image := req.string(1), req.string(2)
+		if remoteDef == "" || image == "" {
+			return grpcErrorf(grpcInvalidArgument, "remote and image are required")
+		}
+		if err := s.checkRemote(remoteDef); err != nil {
+			return grpcErrorf(grpcInvalidArgument, "%s", err)
+		}
+		if s.tokens != nil && !token.allows(kind, remoteDef, image) {
+			return grpcErrorf(grpcPermissionDenied, "the token isn't allowed to do that")
+		}
+
+		return writeGrpcMessage(w, encodeJob(s.enqueue(kind, remoteDef, image)))
+
+	case "GetJob":
+		job, err := s.grpcJob(token, int(req.int64(1)))
+		if err != nil {
+			return err
+		}
+		return writeGrpcMessage(w, encodeJob(job))
+
+	case "CancelJob":
+		job, err := s.grpcJob(token, int(req.int64(1)))
+		if err != nil {
+			return err
+		}
+		if job, err = s.jobs.cancel(job.ID); err != nil {
+			return grpcErrorf(grpcFailedPrecondition, "%s", err)
+		}
+		return writeGrpcMessage(w, encodeJob(job))
+
+	case "ListJobs":
+		limit := int(req.int64(2))
+		if limit < 1 || limit > maxJobsPage {
+			limit = maxJobsPage
+		}
+		jobs, next := s.jobs.list(int(req.int64(1)), limit, func(job Job) bool {
+			return s.tokens == nil || token.allows(job.Kind, job.Remote, job.Image)
+		})
+
+		list := &protoEncoder{}
+		for _, job := range jobs {
+			list.message(1, encodeJob(job))
+		}
+		list.int64(2, int64(next))
+		return writeGrpcMessage(w, list)
+
+	case "WatchJob":
+		job, err := s.grpcJob(token, int(req.int64(1)))
+		if err != nil {
+			return err
+		}
+		return s.watchGrpc(w, r, job.ID)
+
+	case "ListTags":
+		remoteDef := req.string(1)
+		if remoteDef == "" {
+			return grpcErrorf(grpcInvalidArgument, "remote is required")
+		}
+		if err := s.checkRemote(remoteDef); err != nil {
+			return grpcErrorf(grpcInvalidArgument, "%s", err)
+		}
+		if s.tokens != nil && !token.covers(remoteDef) {
+			return grpcErrorf(grpcPermissionDenied, "the token isn't allowed to do that")
+		}
+		tags, err := s.tags(remoteDef)
+		if err != nil {
+			return grpcErrorf(grpcUnavailable, "%s", err)
+		}
+		if s.tokens != nil {
+			tags = token.pullableTags(remoteDef, tags)
+		}
+
+		list := &protoEncoder{}
+		for _, tag := range tags {
+			t := &protoEncoder{}
+			t.string(1, tag.Repo)
+			t.string(2, tag.Tag)
+			t.string(3, string(tag.ID))
+			list.message(1, t)
+		}
+		return writeGrpcMessage(w, list)
+	}
+
+	return grpcErrorf(grpcUnimplemented, "unknown method '%s'", method)
+}
+
+// The job with id, if the token may see it: only if it could have started it.
+func (s *server) grpcJob(token serverToken, id int) (Job, error) {
+	job, ok := s.jobs.get(id)
+	if !ok {
+		return Job{}, grpcErrorf(grpcNotFound, "no job %d", id)
+	}
+	if s.tokens != nil && !token.allows(job.Kind, job.Remote, job.Image) {
+		return Job{}, grpcErrorf(grpcPermissionDenied, "the token isn't allowed to do that")
+	}
+	return job, nil
+}
+
+// Streams job id's events so far, then its progress until it's finished, or
+// the client goes away.
+func (s *server) watchGrpc(w http.ResponseWriter, r *http.Request, id int) error {
+	job, events, updates, ok := s.jobs.watch(id)
+	if !ok {
+		return grpcErrorf(grpcNotFound, "no job %d", id)
+	}
+	if updates != nil {
+		defer s.jobs.unwatch(id, updates)
+	}
+
+	for i := range events {
+		if err := writeGrpcProgress(w, job, &events[i]); err != nil {
+			return err
+		}
+	}
+	if err := writeGrpcProgress(w, job, nil); err != nil || updates == nil {
+		return err
+	}
+
+	for {
+		select {
+		case update, open := <-updates:
+			if !open {
+				return nil
+			}
+			if err := writeGrpcProgress(w, update.Job, update.Event); err != nil {
+				return err
+			}
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
+
+// Reads a unary call's request message.
+func readGrpcRequest(body io.Reader) (protoMessage, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(body, header); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading the request: %s", err)
+	}
+	if header[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed requests aren't supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxRequest {
+		return nil, grpcErrorf(grpcInvalidArgument, "the request is too big")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading the request: %s", err)
+	}
+	m, err := decodeProto(data)
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "invalid request: %s", err)
+	}
+	return m, nil
+}
+
+func writeGrpcMessage(w http.ResponseWriter, m *protoEncoder) error {
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(m.buf)))
+	if _, err := w.Write(append(header, m.buf...)); err != nil {
+		return err
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+func writeGrpcProgress(w http.ResponseWriter, job Job, event *remote.Event) error {
+	progress := &protoEncoder{}
+	progress.message(1, encodeJob(job))
+	if event != nil {
+		e := &protoEncoder{}
+		e.string(1, event.Event)
+		e.string(2, event.Key)
+		e.time(3, event.Time)
+		e.int64(4, int64(event.Attempt))
+		e.int64(5, event.Bytes)
+		e.double(6, event.Seconds)
+		e.string(7, utils.Redact(event.Error))
+		progress.message(2, e)
+	}
+	return writeGrpcMessage(w, progress)
+}
+
+func encodeJob(job Job) *protoEncoder {
+	m := &protoEncoder{}
+	m.int64(1, int64(job.ID))
+	m.string(2, job.Kind)
+	m.string(3, job.Remote)
+	m.string(4, job.Image)
+	m.string(5, job.Status)
+	m.string(6, job.Error)
+	if job.Started != nil {
+		m.time(7, *job.Started)
+	}
+	if job.Finished != nil {
+		m.time(8, *job.Finished)
+	}
+	m.time(9, job.Queued)
+	return m
+}
+
+// grpc-message is percent encoded, as it may not be ascii
+func grpcEscape(message string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(message) {
+		if b < 0x20 || b > 0x7e || b == '%' {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		} else {
+			escaped.WriteByte(b)
+		}
+	}
+	return escaped.String()
+}
@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func grpcFrame(m *protoEncoder) []byte {
+	frame := make([]byte, 5)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(m.buf)))
+	return append(frame, m.buf...)
+}
+
+// Calls method on the h2c server at url, returning the response's
+// messages and its grpc-status.
+func grpcCall(t *testing.T, url, method, token string, body []byte) ([]protoMessage, string, string) {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	r, err := http.NewRequest("POST", url+grpcService+method, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/grpc")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []protoMessage
+	for len(data) >= 5 {
+		size := int(binary.BigEndian.Uint32(data[1:5]))
+		m, err := decodeProto(data[5 : 5+size])
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages, data = append(messages, m), data[5+size:]
+	}
+	if len(data) != 0 {
+		t.Errorf("%d bytes left over", len(data))
+	}
+	return messages, resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+}
+
+func newGrpcTestServer(t *testing.T, lines ...string) string {
+	server := httptest.NewUnstartedServer(newTestServer(t, lines...).handler())
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestGrpc(t *testing.T) {
+	url := newGrpcTestServer(t, "ci push@staging:teamA/*", "deploy pull")
+
+	req := &protoEncoder{}
+	req.string(1, "staging")
+	req.string(2, "teamA/app")
+
+	messages, status, message := grpcCall(t, url, "Push", "ci", grpcFrame(req))
+	if status != "0" || len(messages) != 1 {
+		t.Fatalf("got %d messages, status %s: %s", len(messages), status, message)
+	}
+	job := messages[0]
+	if job.int64(1) != 1 || job.string(2) != "push" || job.string(3) != "staging" || job.string(4) != "teamA/app" || job.string(5) != "queued" {
+		t.Errorf("got job %+v", job)
+	}
+
+	get := &protoEncoder{}
+	get.int64(1, 1)
+	if messages, status, _ = grpcCall(t, url, "GetJob", "ci", grpcFrame(get)); status != "0" || messages[0].int64(1) != 1 {
+		t.Errorf("GetJob: got %v, status %s", messages, status)
+	}
+
+	tests := []struct {
+		method, token string
+		body          []byte
+		status        string
+	}{
+		{"Push", "", grpcFrame(req), "16"},
+		{"Push", "deploy", grpcFrame(req), "7"},
+		{"GetJob", "deploy", grpcFrame(get), "7"},
+		{"Pull", "deploy", grpcFrame(&protoEncoder{}), "3"},
+		{"Nope", "ci", grpcFrame(&protoEncoder{}), "12"},
+
+		// the framing
+		{"GetJob", "ci", []byte{0, 0, 0}, "3"},
+		{"GetJob", "ci", []byte{1, 0, 0, 0, 0}, "12"},
+		{"GetJob", "ci", []byte{0, 0, 1, 0, 0}, "3"},
+		{"GetJob", "ci", []byte{0, 0, 0, 0, 2, 0x80}, "3"},
+	}
+	for _, test := range tests {
+		if _, status, message := grpcCall(t, url, test.method, test.token, test.body); status != test.status {
+			t.Errorf("%s % x as %q: got status %s (%s), want %s", test.method, test.body, test.token, status, message, test.status)
+		}
+	}
+}
+
+func TestGrpcNeedsHTTP2(t *testing.T) {
+	url := newGrpcTestServer(t)
+
+	resp, err := http.Post(url+grpcService+"ListJobs", "application/grpc", bytes.NewReader(grpcFrame(&protoEncoder{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("got %d", resp.StatusCode)
+	}
+}
+
+func TestGrpcEscape(t *testing.T) {
+	if got := grpcEscape("100% done\nnaïve"); got != "100%25 done%0Ana%C3%AFve" {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/blake-education/dogestry/remote"
+)
+
+func (cli *DogestryCli) CmdHistory(args ...string) error {
+	cmd := cli.Subcmd("history", "REMOTE REPO", "show who pushed and pulled REPO on the REMOTE, and when")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	remoteDef, rest := cli.RemoteArgs(cmd)
+	if remoteDef == "" || len(rest) < 1 {
+		return MissingArgs("history", "REMOTE and REPO")
+	}
+
+	repo, _ := remote.NormaliseImageName(rest[0])
+
+	r, err := cli.newRemote(remoteDef)
+	if err != nil {
+		return err
+	}
+
+	history, err := remote.History(r, repo)
+	if err != nil {
+		return err
+	}
+
+	if cli.Options.Json {
+		return printJson(history)
+	}
+
+	if len(history) == 0 {
+		fmt.Printf("no history for '%s'\n", repo)
+		return nil
+	}
+
+	for _, entry := range history {
+		fmt.Printf("%s  %-5s  %s:%s  %s  %s@%s\n", entry.Time.Format("2006-01-02 15:04:05 UTC"), entry.Action, entry.Repo, entry.Tag, entry.ID.Short(), entry.User, entry.Host)
+	}
+
+	return nil
+}
+
+// record action on image in the remote's history
+func recordHistory(r remote.Remote, action, image string, id remote.ID) error {
+	fmt.Printf("recording %s in history\n", action)
+	return remote.AddHistory(r, remote.NewHistoryEntry(action, image, id))
+}
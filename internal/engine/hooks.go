@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/blake-education/dogestry/utils"
+)
+
+var (
+	// what docker allows in a [registry/]repo[:tag][@digest], which keeps
+	// anything a shell would act on out of $DOGESTRY_IMAGE
+	imageNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._/:@-]*$`)
+
+	// the only variables hooks get from dogestry's environment, so they don't
+	// see credentials it was given, e.g. $AWS_SECRET_ACCESS_KEY or $VAULT_TOKEN
+	hookEnvVars = []string{"PATH", "HOME", "USER", "LOGNAME", "LANG", "LC_ALL", "TZ", "TMPDIR"}
+)
+
+// A pre hook which refused a push or pull.
+type HookError struct {
+	Hook    string
+	Command string
+	Err     error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s hook `%s` failed: %s", e.Hook, e.Command, e.Err)
+}
+
+// the hooks configured for hook, e.g. pre-push
+func (cli *DogestryCli) hookCommands(hook string) []string {
+	hooks := cli.Config.Hooks
+	switch hook {
+	case "pre-push":
+		return hooks.Pre_Push
+	case "post-push":
+		return hooks.Post_Push
+	case "pre-pull":
+		return hooks.Pre_Pull
+	case "post-pull":
+		return hooks.Post_Pull
+	}
+	return nil
+}
+
+// Checks image is a name docker would accept, before it's given to hooks.
+func validateImageName(image string) error {
+	if !imageNamePattern.MatchString(image) || strings.Contains(image, "..") {
+		return fmt.Errorf("invalid image name %q", image)
+	}
+	return nil
+}
+
+// Runs hook's commands in turn, with what the push or pull is about in
+// their environment as DOGESTRY_ variables, stopping at the first which fails.
+// They get little else of dogestry's environment, see hookEnvVars.
+func (cli *DogestryCli) runHooks(hook string, vars map[string]string) error {
+	commands := cli.hookCommands(hook)
+	if len(commands) == 0 {
+		return nil
+	}
+	if err := validateImageName(vars["IMAGE"]); err != nil {
+		return err
+	}
+
+	env := []string{"DOGESTRY_HOOK=" + hook}
+	for _, name := range hookEnvVars {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	for name, value := range vars {
+		env = append(env, "DOGESTRY_"+name+"="+value)
+	}
+
+	for _, command := range commands {
+		utils.Detailf("running %s hook `%s`\n", hook, command)
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = env
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return &HookError{Hook: hook, Command: command, Err: err}
+		}
+	}
+	return nil
+}
+
+// Runs the pre-push or pre-pull hooks. If any fails, the push or pull doesn't happen.
+func (cli *DogestryCli) preHooks(command, remoteDef, image string) error {
+	return cli.runHooks("pre-"+command, map[string]string{
+		"OPERATION": command,
+		"REMOTE":    utils.Redact(remoteDef),
+		"IMAGE":     image,
+	})
+}
+
+// Runs the post-push or post-pull hooks, with how it went. As the push or
+// pull is done, one failing is only a warning.
+func (cli *DogestryCli) postHooks(run runStats) {
+	result := "success"
+	if run.Error != "" {
+		result = "failure"
+	}
+
+	err := cli.runHooks("post-"+run.Command, map[string]string{
+		"OPERATION":   run.Command,
+		"REMOTE":      utils.Redact(run.Remote),
+		"IMAGE":       run.Image,
+		"RESULT":      result,
+		"ERROR":       strings.Replace(run.Error, "\n", " ", -1),
+		"SECONDS":     strconv.FormatFloat(run.Seconds, 'f', 1, 64),
+		"BYTES":       strconv.FormatInt(run.Bytes, 10),
+		"TRANSFERRED": strconv.Itoa(run.Transferred),
+		"SKIPPED":     strconv.Itoa(run.Skipped),
+	})
+	if err != nil {
+		fmt.Fprintf(cli.err, "Warning: %s\n", err)
+	}
+}
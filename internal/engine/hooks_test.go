@@ -0,0 +1,51 @@
+package engine
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blake-education/dogestry/config"
+)
+
+func TestHooks(t *testing.T) {
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "not-for-hooks")
+	envFile := filepath.Join(t.TempDir(), "env")
+	cli := &DogestryCli{Config: config.Config{Hooks: config.HooksConfig{
+		Pre_Push: []string{`env > "` + envFile + `"`},
+	}}}
+
+	if err := cli.preHooks("push", "central", "registry.example.com:5000/myorg/app:v1.2"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := string(data)
+	for _, want := range []string{"DOGESTRY_HOOK=pre-push\n", "DOGESTRY_IMAGE=registry.example.com:5000/myorg/app:v1.2\n", "PATH="} {
+		if !strings.Contains(env, want) {
+			t.Errorf("no %q in %s", want, env)
+		}
+	}
+	if strings.Contains(env, "not-for-hooks") {
+		t.Errorf("the hook got dogestry's credentials: %s", env)
+	}
+}
+
+func TestHooksInvalidImage(t *testing.T) {
+	ran := filepath.Join(t.TempDir(), "ran")
+	cli := &DogestryCli{Config: config.Config{Hooks: config.HooksConfig{
+		Pre_Pull: []string{"touch " + ran},
+	}}}
+
+	for _, image := range []string{"app;rm -rf ~", "app:$(id)", "app\nlatest", "../../etc", "-app", ""} {
+		if err := cli.preHooks("pull", "central", image); err == nil {
+			t.Errorf("%q: hooks ran", image)
+		}
+	}
+	if _, err := ioutil.ReadFile(ran); err == nil {
+		t.Error("a hook ran for an invalid image")
+	}
+}
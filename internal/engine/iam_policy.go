@@ -0,0 +1,200 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/blake-education/dogestry/remote"
+)
+
+type iamPolicy struct {
+	Version   string         `json:"Version"`
+	Statement []iamStatement `json:"Statement"`
+}
+
+type iamStatement struct {
+	Sid       string                         `json:"Sid"`
+	Effect    string                         `json:"Effect"`
+	Action    []string                       `json:"Action"`
+	Resource  []string                       `json:"Resource"`
+	Condition map[string]map[string][]string `json:"Condition,omitempty"`
+}
+
+func (cli *DogestryCli) CmdIamPolicy(args ...string) error {
+	cmd := cli.Subcmd("iam-policy", "-repos PATTERNS [-mode pull|push] REMOTE", "print the least privilege IAM policy for pulling, or pushing, the repos matching PATTERNS on the s3 REMOTE, e.g. 'teamA/*,base/ruby'")
+	remoteFlag := cmd.String("remote", "", "the REMOTE, instead of giving it as an argument")
+	repos := cmd.String("repos", "", "comma separated repos the policy allows, which may end in or contain *")
+	mode := cmd.String("mode", "pull", "pull, or push, which also allows pulling")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	remoteDef := *remoteFlag
+	if remoteDef == "" {
+		remoteDef, _ = cli.RemoteArgs(cmd)
+	}
+	if remoteDef == "" || *repos == "" {
+		return MissingArgs("iam-policy", "REMOTE and -repos")
+	}
+	if *mode != "pull" && *mode != "push" {
+		return fmt.Errorf("invalid -mode '%s', use pull or push", *mode)
+	}
+
+	// the policy is for other hosts, so there's no need to connect
+	remoteConfig, err := remote.ResolveConfig(remoteDef, cli.Config)
+	if err != nil {
+		return err
+	}
+	if remoteConfig.Kind != "s3" {
+		return fmt.Errorf("iam-policy is for s3 remotes, '%s' is %s", remoteDef, remoteConfig.Kind)
+	}
+
+	patterns := []string{}
+	for _, pattern := range strings.Split(*repos, ",") {
+		pattern = strings.Trim(strings.TrimSpace(pattern), "/")
+		if pattern == "" {
+			continue
+		}
+		if strings.ContainsAny(pattern, "[]:") {
+			return fmt.Errorf("invalid repo pattern '%s': only * is supported, and no tags", pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	if len(patterns) == 0 {
+		return MissingArgs("iam-policy", "-repos")
+	}
+
+	policy := cli.iamPolicy(remoteConfig, patterns, *mode == "push")
+
+	data, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(jsonOut, string(data))
+	return nil
+}
+
+// The policy for the remote's keys. Images and blobs are shared by every
+// repo, and named by their ids and digests, so they can't be limited to
+// repos. Everything named by repo can.
+func (cli *DogestryCli) iamPolicy(remoteConfig remote.RemoteConfig, repos []string, push bool) iamPolicy {
+	bucket := "arn:aws:s3:::" + remoteConfig.Url.Host
+	prefix := strings.Trim(remoteConfig.Url.Path, "/")
+
+	objects := func(keys ...string) []string {
+		arns := []string{}
+		for _, key := range keys {
+			arns = append(arns, bucket+"/"+path.Join(prefix, key))
+		}
+		return arns
+	}
+	// the key in dir named by each repo, with suffix
+	repoKeys := func(dir, suffix string) []string {
+		keys := []string{}
+		for _, repo := range repos {
+			keys = append(keys, path.Join(dir, repo)+suffix)
+		}
+		return keys
+	}
+
+	read := []string{remote.FormatVersionKey, "images/*", remote.BlobsDir + "/*", remote.ConfigIdsDir + "/*", SignaturesDir + "/*", TrustDir + "/*"}
+	read = append(read, repoKeys("repositories", "/*")...)
+	read = append(read, repoKeys(remote.PlatformsDir, "/*")...)
+
+	// as S3Remote lists them: the prefix to check it's there, and image dirs, always after a /
+	listPrefixes := []string{prefix, prefix + "/images*"}
+
+	policy := iamPolicy{Version: "2012-10-17"}
+	policy.Statement = append(policy.Statement,
+		iamStatement{
+			Sid:      "DogestryList",
+			Effect:   "Allow",
+			Action:   []string{"s3:ListBucket"},
+			Resource: []string{bucket},
+			// IfExists, as S3 only says a missing key is missing, rather than
+			// denied, to those who may list the bucket. Pulls and pushes rely on that.
+			Condition: map[string]map[string][]string{"StringLikeIfExists": {"s3:prefix": listPrefixes}},
+		},
+		iamStatement{
+			Sid:      "DogestryRead",
+			Effect:   "Allow",
+			Action:   []string{"s3:GetObject"},
+			Resource: objects(read...),
+		},
+	)
+
+	if push {
+		// the repo's lock, history and audit log are only read and written by pushes
+		write := []string{"images/*", remote.BlobsDir + "/*", remote.ConfigIdsDir + "/*"}
+		write = append(write, repoKeys("repositories", "/*")...)
+		write = append(write, repoKeys(remote.PlatformsDir, "/*")...)
+		write = append(write, repoKeys("history", "/*")...)
+		write = append(write, repoKeys(remote.AuditDir, ".log")...)
+		write = append(write, repoKeys("locks", "")...)
+
+		// tags are written to a temporary key and copied into place, and locks are deleted when released
+		remove := append(repoKeys("repositories", "/*"), repoKeys("locks", "")...)
+
+		if cli.Config.Signing.Key != "" || cli.Config.Signing.Key_Vault_Path != "" {
+			write = append(write, SignaturesDir+"/*", path.Join(TrustDir, "targets.json"), path.Join("locks", trustLockName))
+			remove = append(remove, path.Join("locks", trustLockName))
+		}
+		if cli.Config.Dogestry.Registry {
+			write = append(write, repoKeys(RegistryDir, "/*")...)
+		}
+
+		policy.Statement = append(policy.Statement,
+			iamStatement{
+				Sid:      "DogestryListUploads",
+				Effect:   "Allow",
+				Action:   []string{"s3:ListBucketMultipartUploads"},
+				Resource: []string{bucket},
+			},
+			iamStatement{
+				Sid:      "DogestryWrite",
+				Effect:   "Allow",
+				Action:   []string{"s3:GetObject", "s3:PutObject", "s3:ListMultipartUploadParts", "s3:AbortMultipartUpload"},
+				Resource: objects(write...),
+			},
+			iamStatement{
+				Sid:      "DogestryDelete",
+				Effect:   "Allow",
+				Action:   []string{"s3:DeleteObject"},
+				Resource: objects(remove...),
+			},
+		)
+	}
+
+	if statement, ok := kmsStatement(remoteConfig, push); ok {
+		policy.Statement = append(policy.Statement, statement)
+	}
+	return policy
+}
+
+// Access to the remote's kms-key-id: Decrypt to pull, and Encrypt to push.
+func kmsStatement(remoteConfig remote.RemoteConfig, push bool) (iamStatement, bool) {
+	keyId := remoteConfig.Kms_Key_Id
+	if keyId == "" {
+		return iamStatement{}, false
+	}
+
+	statement := iamStatement{Sid: "DogestryKms", Effect: "Allow", Action: []string{"kms:Decrypt"}}
+	if push {
+		statement.Action = append(statement.Action, "kms:Encrypt")
+	}
+
+	keyArn := "arn:aws:kms:" + remote.KmsRegion(remoteConfig) + ":*:"
+	switch {
+	case strings.HasPrefix(keyId, "arn:"):
+		statement.Resource = []string{keyId}
+	case strings.HasPrefix(keyId, "alias/"):
+		// permissions are on keys, not their aliases
+		statement.Resource = []string{keyArn + "key/*"}
+		statement.Condition = map[string]map[string][]string{"ForAnyValue:StringEquals": {"kms:ResourceAliases": {keyId}}}
+	default:
+		statement.Resource = []string{keyArn + "key/" + keyId}
+	}
+	return statement, true
+}
@@ -0,0 +1,135 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/blake-education/dogestry/utils"
+)
+
+// How a push or pull of one of several images went
+type imageResult struct {
+	Image string `json:"image"`
+	Error string `json:"error,omitempty"`
+}
+
+// Several images failing to push or pull, each with its own error.
+type imagesError struct {
+	command string
+	images  int
+	errs    []error
+}
+
+func (e *imagesError) Error() string {
+	return fmt.Sprintf("%s failed for %d of %d images", e.command, len(e.errs), e.images)
+}
+
+// each image's error, so ExitStatus can tell whether they failed alike
+func (e *imagesError) Unwrap() []error {
+	return e.errs
+}
+
+// Runs fn for each image, carrying on past failures. With several images,
+// finishes with the status of each.
+func (cli *DogestryCli) eachImage(command string, images []string, fn func(image string) error) error {
+	defer utils.SetLogImage("")
+
+	if len(images) == 1 {
+		utils.SetLogImage(images[0])
+		return fn(images[0])
+	}
+
+	results := make([]imageResult, 0, len(images))
+	var errs []error
+
+	for _, image := range images {
+		utils.SetLogImage(image)
+		fmt.Fprintf(cli.out, "%s %s\n", command, image)
+
+		result := imageResult{Image: image}
+		if err := fn(image); err != nil {
+			result.Error = err.Error()
+			errs = append(errs, err)
+		}
+		results = append(results, result)
+	}
+
+	if cli.Options.Json {
+		printJson(results)
+	} else {
+		for _, result := range results {
+			if result.Error != "" {
+				fmt.Fprintf(cli.out, "%-40s  failed: %s\n", result.Image, result.Error)
+			} else {
+				fmt.Fprintf(cli.out, "%-40s  ok\n", result.Image)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return &imagesError{command: command, images: len(images), errs: errs}
+	}
+	return nil
+}
+
+// Expands image names with wildcards, like 'myorg/app:*', into every matching
+// repo:tag docker has. Names without wildcards are left as they are.
+func (cli *DogestryCli) expandImages(names []string) ([]string, error) {
+	expanded := make([]string, 0, len(names))
+	var localTags []string
+
+	for _, name := range names {
+		if !strings.ContainsAny(name, "*?[") {
+			expanded = append(expanded, name)
+			continue
+		}
+
+		if cli.ociDir != "" {
+			return nil, fmt.Errorf("can't expand '%s': wildcards match docker's tags, not an OCI layout's", name)
+		}
+
+		match, err := tagMatcher(name, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if localTags == nil {
+			if localTags, err = cli.localTags(); err != nil {
+				return nil, err
+			}
+		}
+
+		matched := 0
+		for _, tag := range localTags {
+			if match(tag) {
+				expanded = append(expanded, tag)
+				matched++
+			}
+		}
+		if matched == 0 {
+			return nil, fmt.Errorf("no images in docker match '%s'", name)
+		}
+	}
+
+	return expanded, nil
+}
+
+// every repo:tag docker has, sorted
+func (cli *DogestryCli) localTags() ([]string, error) {
+	images, err := cli.client.ListImages(false)
+	if err != nil {
+		return nil, dockerError(err)
+	}
+
+	tags := make([]string, 0, len(images))
+	for _, image := range images {
+		for _, tag := range image.RepoTags {
+			if tag != "<none>:<none>" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
@@ -0,0 +1,311 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/blake-education/dogestry/compressor"
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/remote"
+	"github.com/mitchellh/goamz/aws"
+)
+
+// the answers to `dogestry init`'s questions
+type initAnswers struct {
+	name   string
+	kind   string
+	path   string
+	bucket string
+	prefix string
+	region string
+
+	// env, login or vault
+	credentials  string
+	creds        config.RemoteCredentials
+	vaultAddress string
+	vaultPath    string
+
+	compression string
+}
+
+func (a *initAnswers) url() string {
+	if a.kind == "local" {
+		return a.path
+	}
+	prefix := strings.Trim(a.prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return fmt.Sprintf("s3://%s/%s?region=%s", a.bucket, prefix, a.region)
+}
+
+func (cli *DogestryCli) CmdInit(args ...string) error {
+	cmd := cli.Subcmd("init", "", "set up dogestry: asks for a remote, how to get its credentials and how to compress layers, checks each works, and writes the config file")
+	force := cmd.Bool("force", false, "overwrite the config file if there's one already")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	path := cli.Options.ConfigFile
+	if path == "" {
+		path = DefaultConfigFilePath
+	}
+	if _, err := os.Stat(path); err == nil && !*force {
+		return fmt.Errorf("%s already exists. Use -force to overwrite it", path)
+	}
+
+	a := &initAnswers{name: "central", kind: "s3", region: "us-east-1", credentials: "env"}
+	for {
+		if err := cli.askRemote(a); err != nil {
+			return err
+		}
+
+		fmt.Println("checking the remote...")
+		err := cli.checkInitRemote(a)
+		if err == nil {
+			fmt.Println("ok")
+			break
+		}
+		fmt.Printf("couldn't use the remote: %s\n", err)
+
+		again, err := confirm("Change the answers?", true)
+		if err != nil {
+			return err
+		}
+		if !again {
+			break
+		}
+	}
+
+	for {
+		var err error
+		if a.compression, err = askChoice("Compress layers with (none, lz4, zstd)", []string{"none", "lz4", "zstd"}, "zstd"); err != nil {
+			return err
+		}
+		if err := checkInitCompression(a.compression); err == nil {
+			break
+		} else {
+			fmt.Println(err)
+		}
+	}
+
+	if a.credentials == "login" {
+		if err := cli.storeInitCredentials(a); err != nil {
+			return err
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte(a.config()), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s. Try `dogestry search %s`\n", path, a.name)
+	return nil
+}
+
+// Asks about the remote, with a's answers so far as the defaults.
+func (cli *DogestryCli) askRemote(a *initAnswers) (err error) {
+	if a.name, err = ask("Remote name", a.name); err != nil {
+		return
+	}
+	if a.kind, err = askChoice("Remote type (s3, local)", []string{"s3", "local"}, a.kind); err != nil {
+		return
+	}
+
+	if a.kind == "local" {
+		a.path, err = ask("Directory", a.path)
+		return
+	}
+
+	if a.bucket, err = ask("S3 bucket", a.bucket); err != nil {
+		return
+	}
+	if a.prefix, err = ask("Path in the bucket, if any", a.prefix); err != nil {
+		return
+	}
+	for {
+		if a.region, err = ask("Region", a.region); err != nil {
+			return
+		}
+		if _, ok := aws.Regions[a.region]; ok {
+			break
+		}
+		fmt.Printf("unknown region '%s'\n", a.region)
+	}
+
+	fmt.Println("Credentials:")
+	fmt.Println("  env   - from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY, or the instance's IAM role")
+	fmt.Println("  login - stored by dogestry in the keychain or its encrypted credentials file")
+	fmt.Println("  vault - read from a vault path")
+	if a.credentials, err = askChoice("Credentials (env, login, vault)", []string{"env", "login", "vault"}, a.credentials); err != nil {
+		return
+	}
+
+	switch a.credentials {
+	case "login":
+		if a.creds.Access_Key_Id, err = ask("Access key id", a.creds.Access_Key_Id); err != nil {
+			return
+		}
+		fmt.Print("Secret key: ")
+		a.creds.Secret_Key, err = readSecret(stdin)
+	case "vault":
+		address := a.vaultAddress
+		if address == "" {
+			address = os.Getenv("VAULT_ADDR")
+		}
+		if a.vaultAddress, err = ask("Vault address", address); err != nil {
+			return
+		}
+		a.vaultPath, err = ask("Vault path of the keys, e.g. secret/data/dogestry/s3", a.vaultPath)
+	}
+	return
+}
+
+// the config a describes, before it's written
+func (cli *DogestryCli) initConfig(a *initAnswers) config.Config {
+	cfg := config.Config{
+		Remote:          map[string]*config.RemoteConfig{a.name: {Url: a.url()}},
+		CredentialStore: cli.Config.CredentialStore,
+	}
+
+	switch a.credentials {
+	case "login":
+		creds := a.creds
+		cfg.Credentials = map[string]*config.RemoteCredentials{a.name: &creds}
+	case "vault":
+		cfg.Vault.Address = a.vaultAddress
+		cfg.Remote[a.name].S3_Vault_Path = a.vaultPath
+	}
+	return cfg
+}
+
+// Checks the remote a describes can be reached with its credentials,
+// creating a local remote's directory if it's not there.
+func (cli *DogestryCli) checkInitRemote(a *initAnswers) error {
+	if a.kind == "local" {
+		if a.path == "" {
+			return fmt.Errorf("no directory given")
+		}
+		if _, err := os.Stat(a.path); os.IsNotExist(err) {
+			create, err := confirm(fmt.Sprintf("%s doesn't exist. Create it?", a.path), true)
+			if err != nil {
+				return err
+			}
+			if !create {
+				return fmt.Errorf("%s doesn't exist", a.path)
+			}
+			if err := os.MkdirAll(a.path, 0755); err != nil {
+				return err
+			}
+		}
+	} else if a.bucket == "" {
+		return fmt.Errorf("no bucket given")
+	}
+
+	// checks s3 remotes can be listed
+	_, err := remote.NewRemote(a.name, cli.initConfig(a))
+	return err
+}
+
+// whether algorithm can be used, i.e. its executable is on the $PATH
+func checkInitCompression(algorithm string) error {
+	if algorithm == "none" {
+		return nil
+	}
+	cfg := config.Config{Compressor: config.CompressorConfig{Algorithm: algorithm}}
+	_, err := compressor.NewCompressor(cfg)
+	return err
+}
+
+func (cli *DogestryCli) storeInitCredentials(a *initAnswers) error {
+	store := cli.Config.CredentialStore
+	stored, err := store.Load()
+	if err != nil {
+		return err
+	}
+	creds := a.creds
+	stored[a.name] = &creds
+	if err := store.Save(stored); err != nil {
+		return err
+	}
+	fmt.Printf("credentials for '%s' saved to %s\n", a.name, store.Desc())
+	return nil
+}
+
+// a as dogestry.cfg
+func (a *initAnswers) config() string {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "# written by `dogestry init`. See the Readme for everything else which can go here")
+	fmt.Fprintln(&buf, "[dogestry]")
+	fmt.Fprintf(&buf, "  default-remote=%s\n", a.name)
+	fmt.Fprintln(&buf)
+	fmt.Fprintf(&buf, "[remote %q]\n", a.name)
+	fmt.Fprintf(&buf, "  url=%s\n", a.url())
+	if a.credentials == "vault" {
+		fmt.Fprintf(&buf, "  s3-vault-path=%s\n", a.vaultPath)
+		fmt.Fprintln(&buf)
+		fmt.Fprintln(&buf, "[vault]")
+		fmt.Fprintf(&buf, "  address=%s\n", a.vaultAddress)
+	}
+
+	if a.compression != "none" {
+		fmt.Fprintln(&buf)
+		fmt.Fprintln(&buf, "[compressor]")
+		fmt.Fprintf(&buf, "  algorithm=%s\n", a.compression)
+	}
+	return buf.String()
+}
+
+// Asks question, returning def if nothing's entered.
+func ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+
+	answer, err := readLine(stdin)
+	if err != nil {
+		return "", err
+	}
+	if answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// Asks question until the answer is one of choices.
+func askChoice(question string, choices []string, def string) (string, error) {
+	for {
+		answer, err := ask(question, def)
+		if err != nil {
+			return "", err
+		}
+		for _, choice := range choices {
+			if strings.EqualFold(answer, choice) {
+				return choice, nil
+			}
+		}
+		fmt.Printf("'%s' isn't one of %s\n", answer, strings.Join(choices, ", "))
+	}
+}
+
+func confirm(question string, def bool) (bool, error) {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	answer, err := ask(question+" ("+hint+")", "")
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(answer) {
+	case "":
+		return def, nil
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
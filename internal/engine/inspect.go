@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+type inspectResult struct {
+	ID remote.ID `json:"id"`
+	// the sha256 of the image's config, which is what newer dockers call its id
+	Digest   string         `json:"digest,omitempty"`
+	Platform string         `json:"platform"`
+	Size     int64          `json:"size"`
+	Layers   []inspectLayer `json:"layers"`
+}
+
+type inspectLayer struct {
+	ID remote.ID `json:"id"`
+	// the sha256 of the uncompressed layer, recorded on push
+	Digest string `json:"digest,omitempty"`
+	Size   int64  `json:"size"`
+}
+
+func (cli *DogestryCli) CmdInspect(args ...string) error {
+	cmd := cli.Subcmd("inspect", "REMOTE IMAGE[:TAG]", "show IMAGE on the REMOTE: its id, the digest of its config, its platform, and the digest of each of its layers, top first. TAG defaults to 'latest'")
+	platform := cmd.String("platform", "", "show the image for this os/arch, e.g. linux/arm64, from tags with an image per platform (default the image the tag points at)")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	remoteDef, rest := cli.RemoteArgs(cmd)
+	if remoteDef == "" || len(rest) < 1 {
+		return MissingArgs("inspect", "REMOTE and IMAGE")
+	}
+	image := rest[0]
+
+	r, err := cli.newRemote(remoteDef)
+	if err != nil {
+		return err
+	}
+
+	id, err := r.ResolveImageNameToId(image)
+	if err != nil {
+		return err
+	}
+	if *platform != "" {
+		if _, err := remote.ParsePlatform(*platform); err != nil {
+			return err
+		}
+		cli.platform = *platform
+		if id, err = cli.platformImage(r, image, id); err != nil {
+			return err
+		}
+	}
+
+	result, err := inspectImage(r, id)
+	if err != nil {
+		return err
+	}
+
+	if cli.Options.Json {
+		return printJson(result)
+	}
+
+	fmt.Printf("id:       %s\n", result.ID)
+	if result.Digest != "" {
+		fmt.Printf("digest:   %s\n", result.Digest)
+	}
+	fmt.Printf("platform: %s\n", result.Platform)
+	fmt.Printf("size:     %s\n", utils.HumanSize(result.Size))
+	fmt.Println("layers:")
+	for _, layer := range result.Layers {
+		digest := layer.Digest
+		if digest == "" {
+			digest = "-"
+		}
+		fmt.Printf("  %s  %-71s  %10s\n", layer.ID.Short(), digest, utils.HumanSize(layer.Size))
+	}
+	return nil
+}
+
+func inspectImage(r remote.Remote, id remote.ID) (inspectResult, error) {
+	result := inspectResult{ID: id, Layers: []inspectLayer{}}
+
+	digest, err := configDigest(r, id)
+	if err != nil {
+		return result, err
+	}
+	result.Digest = digest
+
+	platform, err := remote.ImagePlatform(r, id)
+	if err != nil {
+		return result, err
+	}
+	result.Platform = platform.String()
+
+	err = r.WalkImages(id, func(id remote.ID, image docker.Image, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// images pushed before digests were recorded have none
+		digest, err := readRemoteImageFile(r, id, LayerDigestFile)
+		if err != nil {
+			return err
+		}
+
+		result.Size += image.Size
+		result.Layers = append(result.Layers, inspectLayer{ID: id, Digest: strings.TrimSpace(string(digest)), Size: image.Size})
+		return nil
+	})
+	return result, err
+}
+
+// The digest of image id's config. Empty for images pushed from dockers
+// without configs.
+func configDigest(r remote.Remote, id remote.ID) (string, error) {
+	config, err := remote.ImageConfig(r, id)
+	if err != nil || config == nil {
+		return "", err
+	}
+	return sha256Digest(config), nil
+}
@@ -0,0 +1,359 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCanceling = "canceling"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// how many of the server's jobs run at once, unless configured otherwise
+const DefaultMaxJobs = 4
+
+var errNoSuchJob = fmt.Errorf("no such job")
+
+// how many of a job's transfer events are kept, for watchers who start late
+const jobEventsKept = 1000
+
+// how many finished jobs are kept, and for how long, unless configured otherwise
+const (
+	DefaultKeepJobs    = 1000
+	DefaultKeepJobsFor = 24 * time.Hour
+)
+
+// A push or pull triggered via the server
+type Job struct {
+	ID       int        `json:"id"`
+	Kind     string     `json:"kind"`
+	Remote   string     `json:"remote"`
+	Image    string     `json:"image"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Queued   time.Time  `json:"queued"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+func (job Job) finished() bool {
+	return job.Finished != nil
+}
+
+// A job as it is now, and the transfer event which changed it, if one did
+type jobProgress struct {
+	Job   Job           `json:"job"`
+	Event *remote.Event `json:"event,omitempty"`
+}
+
+type jobEntry struct {
+	Job
+
+	// closed to cancel the job
+	cancel chan struct{}
+
+	// its latest transfer events
+	events []remote.Event
+
+	// the channels of those watching its progress
+	watchers []chan jobProgress
+}
+
+func (entry *jobEntry) canceled() bool {
+	select {
+	case <-entry.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// The server's jobs. They're queued, then started in the order they came
+// once fewer than max are running. Once finished, the last keep are kept for
+// keepFor, then forgotten, so a long running server doesn't fill up with them.
+type jobs struct {
+	sync.Mutex
+	lastId int
+	byId   map[int]*jobEntry
+
+	queue   []int
+	running int
+	max     int
+
+	// the ids of finished jobs, oldest first
+	finished []int
+	keep     int
+	keepFor  time.Duration
+}
+
+func newJobs(max, keep int, keepFor time.Duration) *jobs {
+	return &jobs{byId: make(map[int]*jobEntry), max: max, keep: keep, keepFor: keepFor}
+}
+
+func (j *jobs) add(kind, remoteDef, image string) Job {
+	j.Lock()
+	defer j.Unlock()
+
+	j.lastId++
+	entry := &jobEntry{
+		Job: Job{
+			ID:     j.lastId,
+			Kind:   kind,
+			Remote: remoteDef,
+			Image:  image,
+			Status: JobQueued,
+			Queued: time.Now(),
+		},
+		cancel: make(chan struct{}),
+	}
+	j.byId[entry.ID] = entry
+	j.queue = append(j.queue, entry.ID)
+
+	return entry.Job
+}
+
+// Starts as many queued jobs as there are free slots, and returns them.
+func (j *jobs) next() []Job {
+	j.Lock()
+	defer j.Unlock()
+
+	started := []Job{}
+	for j.running < j.max && len(j.queue) > 0 {
+		entry := j.byId[j.queue[0]]
+		j.queue = j.queue[1:]
+
+		now := time.Now()
+		entry.Status = JobRunning
+		entry.Started = &now
+		j.running++
+		started = append(started, entry.Job)
+	}
+	return started
+}
+
+// The control of job id's push or pull, to report its progress and cancel it.
+func (j *jobs) control(id int) remote.Control {
+	j.Lock()
+	defer j.Unlock()
+
+	return remote.Control{
+		Report: func(event remote.Event) { j.progress(id, event) },
+		Cancel: j.byId[id].cancel,
+	}
+}
+
+func (j *jobs) finish(id int, err error) {
+	j.Lock()
+	defer j.Unlock()
+
+	entry := j.byId[id]
+	j.running--
+	entry.end(err)
+	j.retire(id)
+}
+
+// Keeps job id, which has just finished, until it's one too many or too old.
+func (j *jobs) retire(id int) {
+	j.finished = append(j.finished, id)
+	j.prune()
+}
+
+// Forgets the finished jobs beyond the last keep, and those finished longer
+// than keepFor ago.
+func (j *jobs) prune() {
+	drop := 0
+	if len(j.finished) > j.keep {
+		drop = len(j.finished) - j.keep
+	}
+	for drop < len(j.finished) && time.Since(*j.byId[j.finished[drop]].Finished) > j.keepFor {
+		drop++
+	}
+
+	for _, id := range j.finished[:drop] {
+		delete(j.byId, id)
+	}
+	j.finished = j.finished[drop:]
+}
+
+// Cancels job id: at once if it's queued, otherwise once its current file
+// is transferred.
+func (j *jobs) cancel(id int) (Job, error) {
+	j.Lock()
+	defer j.Unlock()
+
+	entry, ok := j.byId[id]
+	if !ok {
+		return Job{}, errNoSuchJob
+	}
+
+	switch entry.Status {
+	case JobQueued:
+		for i, queued := range j.queue {
+			if queued == id {
+				j.queue = append(j.queue[:i], j.queue[i+1:]...)
+				break
+			}
+		}
+		close(entry.cancel)
+		entry.end(remote.ErrCanceled)
+		j.retire(id)
+	case JobRunning:
+		close(entry.cancel)
+		entry.Status = JobCanceling
+	case JobCanceling:
+	default:
+		return entry.Job, fmt.Errorf("job %d has already finished", id)
+	}
+	return entry.Job, nil
+}
+
+// Records how the job ended, and lets its watchers know. A job canceled as
+// its last file was transferred still succeeds.
+func (entry *jobEntry) end(err error) {
+	finished := time.Now()
+	entry.Finished = &finished
+
+	switch {
+	case err == nil:
+		entry.Status = JobSucceeded
+	case entry.canceled():
+		entry.Status = JobCanceled
+	default:
+		entry.Status = JobFailed
+		entry.Error = utils.Redact(err.Error())
+	}
+
+	// the job as it finished is the last thing each watcher is sent, as it
+	// may be forgotten by the time they read it. A watcher which isn't
+	// keeping up misses an event to make room for it
+	final := jobProgress{Job: entry.Job}
+	for _, ch := range entry.watchers {
+		for sent := false; !sent; {
+			select {
+			case ch <- final:
+				sent = true
+			default:
+				select {
+				case <-ch:
+				default:
+				}
+			}
+		}
+		close(ch)
+	}
+	entry.watchers = nil
+}
+
+// Records one of job id's events, and sends it to its watchers. Watchers
+// which aren't keeping up miss events, rather than holding up the transfer.
+// Progress events are only sent, as they'd soon crowd out the rest.
+func (j *jobs) progress(id int, event remote.Event) {
+	j.Lock()
+	defer j.Unlock()
+
+	entry := j.byId[id]
+	if event.Event != remote.EventProgress {
+		entry.events = append(entry.events, event)
+		if len(entry.events) > jobEventsKept {
+			entry.events = entry.events[len(entry.events)-jobEventsKept:]
+		}
+	}
+
+	update := jobProgress{Job: entry.Job, Event: &event}
+	for _, ch := range entry.watchers {
+		select {
+		case ch <- update:
+		default:
+		}
+	}
+}
+
+// The job with id as it is now, its events so far, and, unless it's
+// finished, a channel of its progress from now on, ending with the job as it
+// finished, without an event, then closed.
+func (j *jobs) watch(id int) (Job, []remote.Event, chan jobProgress, bool) {
+	j.Lock()
+	defer j.Unlock()
+
+	entry, ok := j.byId[id]
+	if !ok {
+		return Job{}, nil, nil, false
+	}
+	events := append([]remote.Event{}, entry.events...)
+	if entry.finished() {
+		return entry.Job, events, nil, true
+	}
+
+	ch := make(chan jobProgress, 100)
+	entry.watchers = append(entry.watchers, ch)
+	return entry.Job, events, ch, true
+}
+
+// Stops sending job id's progress to ch.
+func (j *jobs) unwatch(id int, ch chan jobProgress) {
+	j.Lock()
+	defer j.Unlock()
+
+	entry, ok := j.byId[id]
+	if !ok {
+		// finished and forgotten, which stopped its watchers
+		return
+	}
+	for i, watcher := range entry.watchers {
+		if watcher == ch {
+			entry.watchers = append(entry.watchers[:i], entry.watchers[i+1:]...)
+			break
+		}
+	}
+}
+
+func (j *jobs) get(id int) (Job, bool) {
+	j.Lock()
+	defer j.Unlock()
+
+	entry, ok := j.byId[id]
+	if !ok {
+		return Job{}, false
+	}
+	return entry.Job, true
+}
+
+// Up to limit of the jobs after id which include allows, oldest first, and
+// the id to list the next page after, or 0 if there are no more.
+func (j *jobs) list(after, limit int, include func(Job) bool) ([]Job, int) {
+	j.Lock()
+	defer j.Unlock()
+
+	j.prune()
+
+	ids := make([]int, 0, len(j.byId))
+	for id := range j.byId {
+		if id > after {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	list := []Job{}
+	for _, id := range ids {
+		entry := j.byId[id]
+		if !include(entry.Job) {
+			continue
+		}
+		if len(list) == limit {
+			return list, list[len(list)-1].ID
+		}
+		list = append(list, entry.Job)
+	}
+	return list, 0
+}
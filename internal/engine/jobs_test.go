@@ -0,0 +1,216 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blake-education/dogestry/remote"
+)
+
+func jobStatus(t *testing.T, j *jobs, id int) string {
+	job, ok := j.get(id)
+	if !ok {
+		t.Fatalf("no job %d", id)
+	}
+	return job.Status
+}
+
+func TestJobsQueue(t *testing.T) {
+	j := newJobs(2, DefaultKeepJobs, DefaultKeepJobsFor)
+	for i := 0; i < 3; i++ {
+		j.add("push", "central", "app")
+	}
+
+	started := j.next()
+	if len(started) != 2 || started[0].ID != 1 || started[1].ID != 2 {
+		t.Fatalf("started %+v", started)
+	}
+	if status := jobStatus(t, j, 3); status != JobQueued {
+		t.Errorf("job 3 is %s with no free slot", status)
+	}
+	if started := j.next(); len(started) != 0 {
+		t.Errorf("started %+v with no free slot", started)
+	}
+
+	j.finish(1, nil)
+	j.finish(2, errors.New("bucket's gone"))
+	if status := jobStatus(t, j, 1); status != JobSucceeded {
+		t.Errorf("job 1 is %s", status)
+	}
+	if job, _ := j.get(2); job.Status != JobFailed || job.Error != "bucket's gone" || job.Finished == nil {
+		t.Errorf("job 2 is %+v", job)
+	}
+
+	if started := j.next(); len(started) != 1 || started[0].ID != 3 || started[0].Started == nil {
+		t.Errorf("started %+v once slots were free", started)
+	}
+}
+
+func TestJobsCancel(t *testing.T) {
+	j := newJobs(1, DefaultKeepJobs, DefaultKeepJobsFor)
+	for i := 0; i < 4; i++ {
+		j.add("pull", "central", "app")
+	}
+	j.next()
+
+	// queued, so canceled at once, and never started
+	if job, err := j.cancel(2); err != nil || job.Status != JobCanceled {
+		t.Errorf("canceling queued job 2: %+v, %v", job, err)
+	}
+
+	// running, so canceled once its current file's done
+	control := j.control(1)
+	if job, err := j.cancel(1); err != nil || job.Status != JobCanceling {
+		t.Errorf("canceling running job 1: %+v, %v", job, err)
+	}
+	select {
+	case <-control.Cancel:
+	default:
+		t.Error("job 1's control wasn't canceled")
+	}
+	if _, err := j.cancel(1); err != nil {
+		t.Errorf("canceling job 1 again: %v", err)
+	}
+	j.finish(1, remote.ErrCanceled)
+	if status := jobStatus(t, j, 1); status != JobCanceled {
+		t.Errorf("job 1 is %s", status)
+	}
+
+	if _, err := j.cancel(1); err == nil {
+		t.Error("a finished job was canceled")
+	}
+	if _, err := j.cancel(99); err != errNoSuchJob {
+		t.Errorf("canceling a missing job: %v", err)
+	}
+
+	// job 2 left the queue, so 3 is next
+	if started := j.next(); len(started) != 1 || started[0].ID != 3 {
+		t.Errorf("started %+v", started)
+	}
+
+	// canceled as its last file was transferred, so it still succeeded
+	j.cancel(3)
+	j.finish(3, nil)
+	if status := jobStatus(t, j, 3); status != JobSucceeded {
+		t.Errorf("job 3 is %s", status)
+	}
+}
+
+func TestJobsRetention(t *testing.T) {
+	j := newJobs(10, 2, time.Hour)
+	for i := 0; i < 4; i++ {
+		j.add("push", "central", "app")
+	}
+	j.next()
+
+	j.finish(1, nil)
+	j.finish(3, nil)
+	j.finish(2, nil)
+
+	// the first to finish is forgotten, once there are more than 2
+	if _, ok := j.get(1); ok {
+		t.Error("job 1 was kept")
+	}
+	for _, id := range []int{2, 3, 4} {
+		if _, ok := j.get(id); !ok {
+			t.Errorf("job %d was forgotten", id)
+		}
+	}
+
+	// and so are those finished too long ago, but not running ones
+	long := time.Now().Add(-2 * time.Hour)
+	j.byId[3].Finished = &long
+	list, _ := j.list(0, maxJobsPage, func(Job) bool { return true })
+	if len(list) != 2 || list[0].ID != 2 || list[1].ID != 4 {
+		t.Errorf("listed %+v", list)
+	}
+}
+
+// With no finished jobs kept, a job's forgotten as it finishes, while it's
+// still being watched
+func TestJobsWatchForgotten(t *testing.T) {
+	s := newTestServer(t)
+	s.jobs = newJobs(1, 0, DefaultKeepJobsFor)
+	s.jobs.add("push", "central", "app")
+	s.jobs.next()
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- request(t, s.handler(), "GET", "/jobs/1/events", "") }()
+	for watched := false; !watched; {
+		time.Sleep(time.Millisecond)
+		s.jobs.Lock()
+		watched = len(s.jobs.byId[1].watchers) > 0
+		s.jobs.Unlock()
+	}
+	s.jobs.finish(1, nil)
+
+	w := <-done
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	var last jobProgress
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+		t.Fatalf("%s: %s", err, w.Body.String())
+	}
+	if last.Job.Status != JobSucceeded || last.Event != nil {
+		t.Errorf("the last line was %+v", last)
+	}
+	if _, ok := s.jobs.get(1); ok {
+		t.Error("job 1 was kept")
+	}
+}
+
+func TestJobsList(t *testing.T) {
+	j := newJobs(0, DefaultKeepJobs, DefaultKeepJobsFor)
+	for _, image := range []string{"app", "db", "app", "app", "db", "app"} {
+		j.add("push", "central", image)
+	}
+	apps := func(job Job) bool { return job.Image == "app" }
+
+	var ids []int
+	after := 0
+	for page := 0; page < 5; page++ {
+		list, next := j.list(after, 2, apps)
+		for _, job := range list {
+			ids = append(ids, job.ID)
+		}
+		if next == 0 {
+			break
+		}
+		after = next
+	}
+	if len(ids) != 4 || ids[0] != 1 || ids[1] != 3 || ids[2] != 4 || ids[3] != 6 {
+		t.Errorf("listed %v", ids)
+	}
+
+	// a full last page has no next
+	if list, next := j.list(4, 1, apps); len(list) != 1 || next != 0 {
+		t.Errorf("listed %+v, next %d", list, next)
+	}
+}
+
+func TestServerJobsPage(t *testing.T) {
+	s := newTestServer(t)
+	handler := s.handler()
+	for i := 0; i < 3; i++ {
+		s.enqueue("push", "central", "app")
+	}
+
+	w := request(t, handler, "GET", "/jobs?after=1&limit=1", "")
+	var page jobPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("%s: %s", err, w.Body.String())
+	}
+	if len(page.Jobs) != 1 || page.Jobs[0].ID != 2 || page.Next != 2 {
+		t.Errorf("got %+v", page)
+	}
+
+	for _, url := range []string{"/jobs?after=x", "/jobs?after=-1", "/jobs?limit=0"} {
+		if w := request(t, handler, "GET", url, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", url, w.Code)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/blake-education/dogestry/remote"
+)
+
+var (
+	// pushes lock their repo for at most this long, so a crashed push doesn't block others forever
+	PushLockTTL = time.Hour
+
+	// held locks are renewed this often, as a fraction of their ttl, so a push
+	// taking longer than PushLockTTL keeps its lock
+	LockRenewFraction = 3
+)
+
+func (cli *DogestryCli) CmdLock(args ...string) error {
+	cmd := cli.Subcmd("lock", "REMOTE REPO", "lock REPO on the REMOTE, so pushes to it fail until it's unlocked")
+	ttl := cmd.Duration("ttl", 0, "release the lock automatically after this long (e.g. 30m). Never, by default")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	remoteDef, rest := cli.RemoteArgs(cmd)
+	if remoteDef == "" || len(rest) < 1 {
+		return MissingArgs("lock", "REMOTE and REPO")
+	}
+
+	r, err := cli.newRemote(remoteDef)
+	if err != nil {
+		return err
+	}
+
+	repo, _ := remote.NormaliseImageName(rest[0])
+	lock, err := remote.AcquireLock(r, repo, *ttl)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cli.out, "locked '%s' as %s\n", lock.Name, lock.Owner)
+	return nil
+}
+
+func (cli *DogestryCli) CmdUnlock(args ...string) error {
+	cmd := cli.Subcmd("unlock", "REMOTE REPO", "unlock REPO on the REMOTE")
+	force := cmd.Bool("force", false, "remove the lock even if it's held by someone else")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	remoteDef, rest := cli.RemoteArgs(cmd)
+	if remoteDef == "" || len(rest) < 1 {
+		return MissingArgs("unlock", "REMOTE and REPO")
+	}
+
+	r, err := cli.newRemote(remoteDef)
+	if err != nil {
+		return err
+	}
+
+	repo, _ := remote.NormaliseImageName(rest[0])
+	lock, err := remote.ReadLock(r, repo)
+	if err != nil {
+		return err
+	}
+	if lock == nil {
+		fmt.Fprintf(cli.out, "'%s' isn't locked\n", repo)
+		return nil
+	}
+
+	host, _ := os.Hostname()
+	if owner := fmt.Sprintf("%s@%s", os.Getenv("USER"), host); lock.Owner != owner && !*force {
+		return &remote.LockedError{Lock: lock}
+	}
+
+	if err := remote.ForceUnlock(r, repo); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cli.out, "unlocked '%s'\n", repo)
+	return nil
+}
+
+// The push locks a cli holds, renewed until they're released, so a push which
+// times out can release them.
+type heldLocks struct {
+	sync.Mutex
+	locks map[*remote.Lock]*heldLock
+}
+
+type heldLock struct {
+	remote remote.Remote
+
+	// where renewing it says it failed
+	out io.Writer
+
+	// closed to stop renewing it
+	stop chan struct{}
+
+	// closed once it's no longer being renewed
+	stopped chan struct{}
+}
+
+// holds lock, printing to out if renewing it fails
+func (held *heldLocks) add(lock *remote.Lock, r remote.Remote, out io.Writer) {
+	held.Lock()
+	defer held.Unlock()
+
+	if held.locks == nil {
+		held.locks = make(map[*remote.Lock]*heldLock)
+	}
+	h := &heldLock{remote: r, out: out, stop: make(chan struct{}), stopped: make(chan struct{})}
+	held.locks[lock] = h
+	go h.renew(lock)
+}
+
+// Renews lock before it expires, until it's released or lost. Locks which
+// never expire aren't renewed.
+func (h *heldLock) renew(lock *remote.Lock) {
+	defer close(h.stopped)
+
+	if lock.Expires.IsZero() {
+		return
+	}
+	ttl := lock.Expires.Sub(lock.Created)
+
+	ticker := time.NewTicker(ttl / time.Duration(LockRenewFraction))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := lock.Renew(h.remote, ttl)
+		var locked *remote.LockedError
+		if errors.As(err, &locked) || errors.Is(err, remote.ErrNoSuchKey) || (err != nil && time.Now().After(lock.Expires)) {
+			fmt.Fprintf(h.out, "lost lock on '%s': %s\n", lock.Name, err)
+			return
+		} else if err != nil {
+			// try again next time, while it hasn't expired
+			fmt.Fprintf(h.out, "couldn't renew lock on '%s': %s\n", lock.Name, err)
+		}
+	}
+}
+
+// stops renewing the lock, waiting for a renewal in progress so it can't
+// rewrite the lock once it's released
+func (h *heldLock) stopRenewing() {
+	close(h.stop)
+	<-h.stopped
+}
+
+func (held *heldLocks) release(lock *remote.Lock) error {
+	held.Lock()
+	h := held.locks[lock]
+	delete(held.locks, lock)
+	held.Unlock()
+
+	if h == nil {
+		return nil
+	}
+	h.stopRenewing()
+	return lock.Release(h.remote)
+}
+
+// releases every lock, printing to out any which couldn't be
+func (held *heldLocks) releaseAll(out io.Writer) {
+	held.Lock()
+	locks := held.locks
+	held.locks = nil
+	held.Unlock()
+
+	for lock, h := range locks {
+		h.stopRenewing()
+		if err := lock.Release(h.remote); err != nil {
+			fmt.Fprintf(out, "couldn't release lock on '%s': %s\n", lock.Name, err)
+		}
+	}
+}
+
+// lock image's repo for the duration of a push. Release it with cli.pushLocks.release
+func (cli *DogestryCli) lockForPush(r remote.Remote, image string) (*remote.Lock, error) {
+	repo, _ := remote.NormaliseImageName(image)
+
+	fmt.Fprintf(cli.out, "locking '%s'\n", repo)
+	lock, err := remote.AcquireLock(r, repo, PushLockTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	cli.pushLocks.add(lock, r, cli.out)
+	return lock, nil
+}
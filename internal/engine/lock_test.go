@@ -0,0 +1,43 @@
+package engine
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/remote"
+)
+
+func TestHeldLocksRenew(t *testing.T) {
+	r, err := remote.NewRemote(t.TempDir(), config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock, err := remote.AcquireLock(r, "app", 150*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var held heldLocks
+	held.add(lock, r, ioutil.Discard)
+
+	// held beyond its ttl, as it's renewed every 50ms
+	time.Sleep(300 * time.Millisecond)
+	current, err := remote.ReadLock(r, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current == nil || current.Token != lock.Token || current.Expired() {
+		t.Errorf("the lock wasn't renewed: %+v", current)
+	}
+
+	if err := held.release(lock); err != nil {
+		t.Fatal(err)
+	}
+	// nothing renews it once it's released
+	time.Sleep(100 * time.Millisecond)
+	if current, err := remote.ReadLock(r, "app"); err != nil || current != nil {
+		t.Errorf("released, but the remote has %+v, %v", current, err)
+	}
+}
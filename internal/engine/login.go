@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/blake-education/dogestry/config"
+)
+
+func (cli *DogestryCli) CmdLogin(args ...string) error {
+	cmd := cli.Subcmd("login", "REMOTE", "store credentials for REMOTE in the keychain, or the passphrase protected credentials file. Prompts for any credentials not given as flags")
+	accessKeyId := cmd.String("access-key-id", "", "the s3 access key id")
+	importPlaintext := cmd.Bool("import", false, "move every credential in the old plaintext credentials file into the store, rather than logging in to a REMOTE")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	if *importPlaintext {
+		return cli.importCredentials()
+	}
+
+	remoteDef, _ := cli.RemoteArgs(cmd)
+	if remoteDef == "" {
+		return MissingArgs("login", "REMOTE")
+	}
+
+	in := stdin
+
+	creds := config.RemoteCredentials{
+		Access_Key_Id: *accessKeyId,
+	}
+
+	var err error
+	if creds.Access_Key_Id == "" {
+		fmt.Print("Access key id: ")
+		if creds.Access_Key_Id, err = readLine(in); err != nil {
+			return err
+		}
+	}
+
+	// the secret is never taken as a flag, so it stays out of shell history
+	fmt.Print("Secret key: ")
+	if creds.Secret_Key, err = readSecret(in); err != nil {
+		return err
+	}
+
+	// check the credentials actually work before saving them
+	if cli.Config.Credentials == nil {
+		cli.Config.Credentials = make(map[string]*config.RemoteCredentials)
+	}
+	cli.Config.Credentials[remoteDef] = &creds
+
+	r, err := cli.newRemote(remoteDef)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("remote", r.Desc())
+
+	store := cli.Config.CredentialStore
+	stored, err := store.Load()
+	if err != nil {
+		return err
+	}
+	stored[remoteDef] = &creds
+	if err := store.Save(stored); err != nil {
+		return err
+	}
+
+	// so the old plaintext credentials don't take precedence
+	if err := config.RemoveCredentials(config.CredentialsFilePath(cli.Config), remoteDef); err != nil {
+		return err
+	}
+
+	fmt.Printf("credentials for '%s' saved to %s\n", remoteDef, store.Desc())
+
+	return nil
+}
+
+// Moves the credentials in the plaintext credentials file into the store,
+// then removes the file.
+func (cli *DogestryCli) importCredentials() error {
+	credsPath := config.CredentialsFilePath(cli.Config)
+
+	legacy := config.Config{}
+	if err := config.ParseCredentials(&legacy, credsPath); err != nil {
+		return err
+	}
+	if len(legacy.Credentials) == 0 {
+		fmt.Printf("no credentials in %s to import\n", credsPath)
+		return nil
+	}
+
+	store := cli.Config.CredentialStore
+	stored, err := store.Load()
+	if err != nil {
+		return err
+	}
+	for name, creds := range legacy.Credentials {
+		stored[name] = creds
+	}
+	if err := store.Save(stored); err != nil {
+		return err
+	}
+
+	if err := os.Remove(credsPath); err != nil {
+		return err
+	}
+
+	fmt.Printf("moved credentials for %d remote(s) from %s to %s\n", len(legacy.Credentials), credsPath, store.Desc())
+	return nil
+}
+
+// shared by everything reading from stdin, so none loses what another buffered
+var stdin = bufio.NewReader(os.Stdin)
+
+// asks for the credential store's passphrase on the terminal
+func promptPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	return readSecret(stdin)
+}
+
+func readLine(in *bufio.Reader) (string, error) {
+	line, err := in.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// read a line without echoing it, if stdin is a terminal
+func readSecret(in *bufio.Reader) (string, error) {
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		return cmd.Run()
+	}
+
+	if err := stty("-echo"); err == nil {
+		defer fmt.Println()
+		defer stty("echo")
+	}
+
+	return readLine(in)
+}
@@ -0,0 +1,301 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/blake-education/dogestry/oci"
+	"github.com/blake-education/dogestry/remote"
+)
+
+// Docker 1.10 on saves a manifest.json alongside the legacy image dirs,
+// listing each image's config and its layers, base first. The config, which
+// the legacy format doesn't have, is what docker names the image by, so it's
+// kept in the top image's dir (see remote.ImageConfigFile) to give back to
+// docker on pull.
+const ManifestFile = "manifest.json"
+
+type ManifestItem struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+	// where foreign layers, e.g. Windows base layers, come from, by diff id.
+	// Kept in the top image's dir as remote.LayerSourcesFile
+	LayerSources map[string]oci.Descriptor `json:",omitempty"`
+}
+
+// Files the manifest and image configs docker saved at the top of the prepared
+// root: each image's tags are written to the repositories, as docker doesn't
+// write the repositories file for images saved by id, and its config is moved
+// into its top image's dir, along with any layer sources.
+func applyManifest(root string) error {
+	manifestPath := filepath.Join(root, ManifestFile)
+
+	data, err := ioutil.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	items := []ManifestItem{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("invalid %s: %w", ManifestFile, err)
+	}
+
+	for _, item := range items {
+		if len(item.Layers) == 0 {
+			continue
+		}
+
+		top := path.Dir(item.Layers[len(item.Layers)-1])
+		if top != path.Base(top) || top == "." || top == ".." {
+			return fmt.Errorf("invalid layer '%s' in %s", item.Layers[len(item.Layers)-1], ManifestFile)
+		}
+
+		for _, repoTag := range item.RepoTags {
+			repoName, tag := remote.NormaliseImageName(repoTag)
+			dest := filepath.Join(root, "repositories", repoName, tag)
+			if err := os.MkdirAll(filepath.Dir(dest), os.ModeDir|0700); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(dest, []byte(top), 0600); err != nil {
+				return err
+			}
+		}
+
+		if item.Config == "" || item.Config != filepath.Base(item.Config) {
+			continue
+		}
+		err := os.Rename(filepath.Join(root, item.Config), filepath.Join(root, "images", top, remote.ImageConfigFile))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if len(item.LayerSources) > 0 {
+			data, err := json.Marshal(item.LayerSources)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(root, "images", top, remote.LayerSourcesFile), data, 0600); err != nil {
+				return err
+			}
+		}
+	}
+
+	// anything else at the top was only for docker
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			if err := os.Remove(filepath.Join(root, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Adds a manifest.json for the image id to a prepared pull, so docker 1.10 on
+// loads it with its original config and id. It's left out for images pushed
+// from older dockers, which have no config, and when docker already has
+// some of the image's layers, as the manifest must list all of them. Docker
+// then loads the image from the legacy format instead.
+func prepareManifest(id remote.ID, imageRoot string, repositories map[string]Repository) error {
+	config, err := ioutil.ReadFile(filepath.Join(imageRoot, string(id), remote.ImageConfigFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// base first
+	layers := make([]remote.ID, 0)
+	for layer := id; layer != ""; {
+		dir := filepath.Join(imageRoot, string(layer))
+		if _, err := os.Stat(filepath.Join(dir, "layer.tar")); os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		layers = append([]remote.ID{layer}, layers...)
+
+		metadata, err := readImageJson(dir)
+		if err != nil {
+			return err
+		}
+		layer = remote.ID(metadata.Parent)
+	}
+
+	// docker only needs the layer sources in the manifest
+	sourcesPath := filepath.Join(imageRoot, string(id), remote.LayerSourcesFile)
+	sources, err := readLayerSources(sourcesPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(sourcesPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	configName, manifest, err := manifestFor(config, layers, repositories, sources)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(imageRoot, configName), config, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(imageRoot, ManifestFile), manifest, 0600)
+}
+
+// The name docker gives config in a saved tarball, and the manifest for the
+// image with config and layers, base first, tagged as in repositories.
+func manifestFor(config []byte, layers []remote.ID, repositories map[string]Repository, sources map[string]oci.Descriptor) (string, []byte, error) {
+	item := ManifestItem{
+		Config:       fmt.Sprintf("%x.json", sha256.Sum256(config)),
+		RepoTags:     make([]string, 0),
+		Layers:       make([]string, len(layers)),
+		LayerSources: sources,
+	}
+
+	for i, layer := range layers {
+		item.Layers[i] = path.Join(string(layer), "layer.tar")
+	}
+	for repoName, repo := range repositories {
+		for tag := range repo {
+			item.RepoTags = append(item.RepoTags, repoName+":"+tag)
+		}
+	}
+
+	data, err := json.Marshal([]ManifestItem{item})
+	return item.Config, data, err
+}
+
+// The layer sources saved at path. Nil if there's no file, as for images
+// without foreign layers.
+func readLayerSources(path string) (map[string]oci.Descriptor, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseLayerSources(data)
+}
+
+func parseLayerSources(data []byte) (map[string]oci.Descriptor, error) {
+	if data == nil {
+		return nil, nil
+	}
+	sources := make(map[string]oci.Descriptor)
+	if err := json.Unmarshal(data, &sources); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", remote.LayerSourcesFile, err)
+	}
+	return sources, nil
+}
+
+// Maps the config digest of each pushed image which has one to the image on the
+// remote, so it can be pulled by the id docker 1.10 on gives it.
+func putConfigIds(r remote.Remote, root string) error {
+	configs, err := filepath.Glob(filepath.Join(root, "images", "*", remote.ImageConfigFile))
+	if err != nil {
+		return err
+	}
+
+	for _, config := range configs {
+		data, err := ioutil.ReadFile(config)
+		if err != nil {
+			return err
+		}
+
+		id := remote.ID(filepath.Base(filepath.Dir(config)))
+		if err := remote.PutConfigId(r, fmt.Sprintf("sha256:%x", sha256.Sum256(data)), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The prepared image whose config's digest is, or starts with, digest. Empty
+// if there isn't one.
+func configImageDir(root, digest string) (remote.ID, error) {
+	digest = strings.TrimPrefix(digest, "sha256:")
+	if digest == "" {
+		return "", nil
+	}
+
+	configs, err := filepath.Glob(filepath.Join(root, "images", "*", remote.ImageConfigFile))
+	if err != nil {
+		return "", err
+	}
+
+	for _, config := range configs {
+		data, err := ioutil.ReadFile(config)
+		if err != nil {
+			return "", err
+		}
+
+		if strings.HasPrefix(fmt.Sprintf("%x", sha256.Sum256(data)), digest) {
+			return remote.ID(filepath.Base(filepath.Dir(config))), nil
+		}
+	}
+	return "", nil
+}
+
+// Checks the layers of each prepared image with a config are the ones its
+// config lists by diff id, the sha256 of each layer, base first. Docker names
+// the image by its config, so a mismatch would only show up on pull.
+func checkDiffIds(root string) error {
+	configs, err := filepath.Glob(filepath.Join(root, "images", "*", remote.ImageConfigFile))
+	if err != nil {
+		return err
+	}
+
+	for _, config := range configs {
+		image := oci.Image{}
+		data, err := ioutil.ReadFile(config)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &image); err != nil {
+			return fmt.Errorf("invalid image config %s: %w", config, err)
+		}
+
+		// top first
+		diffIds := make([]string, 0)
+		for id := filepath.Base(filepath.Dir(config)); id != ""; {
+			dir := filepath.Join(root, "images", id)
+
+			digest, err := ioutil.ReadFile(filepath.Join(dir, LayerDigestFile))
+			if err != nil {
+				return err
+			}
+			diffIds = append(diffIds, strings.TrimSpace(string(digest)))
+
+			metadata, err := readImageJson(dir)
+			if err != nil {
+				return err
+			}
+			id = metadata.Parent
+		}
+
+		expected := image.RootFS.DiffIDs
+		mismatch := len(diffIds) != len(expected)
+		for i := 0; !mismatch && i < len(expected); i++ {
+			mismatch = diffIds[len(diffIds)-1-i] != expected[i]
+		}
+		if mismatch {
+			return fmt.Errorf("the layers docker saved for image '%s' don't match its config", remote.ID(filepath.Base(filepath.Dir(config))).Short())
+		}
+	}
+	return nil
+}
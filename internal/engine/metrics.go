@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/blake-education/dogestry/cache"
+	"github.com/blake-education/dogestry/utils"
+)
+
+// Counters and histograms of the pushes and pulls this process has run,
+// served at /metrics by `server` and `agent` in prometheus' text format.
+
+// upper bounds, in seconds, of the push and pull duration histograms' buckets
+var metricsDurationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800}
+
+var runMetrics = &metrics{
+	runs:         make(map[runLabels]int64),
+	durations:    make(map[runLabels]*histogram),
+	bytes:        make(map[runLabels]int64),
+	transferred:  make(map[runLabels]int64),
+	skipped:      make(map[runLabels]int64),
+	remoteErrors: make(map[runLabels]int64),
+}
+
+// push or pull, the remote, and for runs, success or error
+type runLabels struct {
+	command string
+	remote  string
+	result  string
+}
+
+type histogram struct {
+	buckets []int64
+	sum     float64
+	count   int64
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range metricsDurationBuckets {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+type metrics struct {
+	sync.Mutex
+	runs         map[runLabels]int64
+	durations    map[runLabels]*histogram
+	bytes        map[runLabels]int64
+	transferred  map[runLabels]int64
+	skipped      map[runLabels]int64
+	remoteErrors map[runLabels]int64
+}
+
+// Counts a finished push or pull.
+func (m *metrics) observeRun(run runStats) {
+	m.Lock()
+	defer m.Unlock()
+
+	labels := runLabels{command: run.Command, remote: utils.Redact(run.Remote)}
+	h, ok := m.durations[labels]
+	if !ok {
+		h = &histogram{buckets: make([]int64, len(metricsDurationBuckets))}
+		m.durations[labels] = h
+	}
+	h.observe(run.Seconds)
+	m.bytes[labels] += run.Bytes
+	m.transferred[labels] += int64(run.Transferred)
+	m.skipped[labels] += int64(run.Skipped)
+
+	labels.result = "success"
+	if run.Error != "" {
+		labels.result = "error"
+	}
+	m.runs[labels]++
+}
+
+// Counts a push or pull from remoteDef which failed, whether or not it got as
+// far as starting, e.g. as the remote's credentials were wrong.
+func (m *metrics) remoteError(command, remoteDef string) {
+	m.Lock()
+	defer m.Unlock()
+	m.remoteErrors[runLabels{command: command, remote: utils.Redact(remoteDef)}]++
+}
+
+// GET /metrics
+func (m *metrics) handle(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeCounter(w, "dogestry_runs_total", "Pushes and pulls, by remote and whether they succeeded.", m.runs)
+	writeCounter(w, "dogestry_transferred_bytes_total", "Bytes pushed or pulled, by remote.", m.bytes)
+	writeCounter(w, "dogestry_transferred_files_total", "Files, i.e. layers, configs and tags, pushed or pulled, by remote.", m.transferred)
+	writeCounter(w, "dogestry_skipped_files_total", "Files pushes or pulls didn't need to transfer, as the remote or docker already had them, by remote.", m.skipped)
+	writeCounter(w, "dogestry_remote_errors_total", "Pushes and pulls which failed, including those which couldn't start, by remote.", m.remoteErrors)
+
+	fmt.Fprintf(w, "# HELP dogestry_run_duration_seconds How long pushes and pulls took, by remote.\n")
+	fmt.Fprintf(w, "# TYPE dogestry_run_duration_seconds histogram\n")
+	for _, labels := range sortedLabels(m.durations) {
+		h := m.durations[labels]
+		for i, bound := range metricsDurationBuckets {
+			fmt.Fprintf(w, "dogestry_run_duration_seconds_bucket%s %d\n", labels.format(fmt.Sprintf("%g", bound)), h.buckets[i])
+		}
+		fmt.Fprintf(w, "dogestry_run_duration_seconds_bucket%s %d\n", labels.format("+Inf"), h.count)
+		fmt.Fprintf(w, "dogestry_run_duration_seconds_sum%s %g\n", labels.format(""), h.sum)
+		fmt.Fprintf(w, "dogestry_run_duration_seconds_count%s %d\n", labels.format(""), h.count)
+	}
+
+	hits, misses := cache.HitStats()
+	fmt.Fprintf(w, "# HELP dogestry_layer_cache_hits_total Layers and blobs found in the local layer cache.\n")
+	fmt.Fprintf(w, "# TYPE dogestry_layer_cache_hits_total counter\n")
+	fmt.Fprintf(w, "dogestry_layer_cache_hits_total %d\n", hits)
+	fmt.Fprintf(w, "# HELP dogestry_layer_cache_misses_total Layers and blobs looked for in the local layer cache, but not found.\n")
+	fmt.Fprintf(w, "# TYPE dogestry_layer_cache_misses_total counter\n")
+	fmt.Fprintf(w, "dogestry_layer_cache_misses_total %d\n", misses)
+}
+
+func writeCounter(w http.ResponseWriter, name, help string, values map[runLabels]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+
+	lines := make([]string, 0, len(values))
+	for labels, value := range values {
+		lines = append(lines, fmt.Sprintf("%s%s %d", name, labels.format(""), value))
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+func sortedLabels(histograms map[runLabels]*histogram) []runLabels {
+	keys := make([]runLabels, 0, len(histograms))
+	for labels := range histograms {
+		keys = append(keys, labels)
+	}
+	sort.Sort(runLabelsByName(keys))
+	return keys
+}
+
+type runLabelsByName []runLabels
+
+func (l runLabelsByName) Len() int      { return len(l) }
+func (l runLabelsByName) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l runLabelsByName) Less(i, j int) bool {
+	return l[i].format("") < l[j].format("")
+}
+
+// {command="push",remote="..."}, with le for a histogram bucket
+func (labels runLabels) format(le string) string {
+	pairs := []string{
+		fmt.Sprintf(`command="%s"`, escapeLabel(labels.command)),
+		fmt.Sprintf(`remote="%s"`, escapeLabel(labels.remote)),
+	}
+	if labels.result != "" {
+		pairs = append(pairs, fmt.Sprintf(`result="%s"`, labels.result))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
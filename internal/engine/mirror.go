@@ -0,0 +1,42 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+
+	dockerclient "github.com/blake-education/dogestry/client"
+)
+
+func (cli *DogestryCli) CmdMirror(args ...string) error {
+	cmd := cli.Subcmd("mirror", "IMAGE[:TAG] REMOTE", "pull IMAGE from its docker registry via docker, then push it to the REMOTE. TAG defaults to 'latest'")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	// the remote comes after the image here, so -remote can't use RemoteArgs
+	image := cmd.Arg(0)
+	remoteDef := cli.Options.Remote
+	if remoteDef == "" {
+		remoteDef = cmd.Arg(1)
+	}
+
+	if image == "" || remoteDef == "" {
+		return MissingArgs("mirror", "IMAGE and REMOTE")
+	}
+
+	auth, err := registryAuth(image)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("pulling image '%s' from registry\n", image)
+	opts := dockerclient.PullImageOptions{
+		Repository:   image,
+		OutputStream: os.Stdout,
+	}
+	if err := cli.client.PullImage(opts, auth); err != nil {
+		return err
+	}
+
+	return cli.push(remoteDef, image)
+}
@@ -0,0 +1,384 @@
+package engine
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/blake-education/dogestry/oci"
+	"github.com/blake-education/dogestry/remote"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// Pulls image id, and all its ancestors, into the OCI layout at layoutDir,
+// known there by image's tag. Docker isn't involved at all.
+func (cli *DogestryCli) pullToOci(image string, id remote.ID, imageRoot, layoutDir string, r remote.Remote) error {
+	// top image first. Without docker, every ancestor is needed
+	ids := make([]remote.ID, 0)
+	err := r.WalkImages(id, func(id remote.ID, _ docker.Image, err error) error {
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := cli.pullImages(ids, imageRoot, r); err != nil {
+		return err
+	}
+
+	if err := oci.Init(layoutDir); err != nil {
+		return err
+	}
+
+	manifest := oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     oci.MediaTypeManifest,
+		Layers:        []oci.Descriptor{},
+	}
+	platform, err := remote.ImagePlatform(r, id)
+	if err != nil {
+		return err
+	}
+	config := oci.Image{
+		Architecture: platform.Architecture,
+		OS:           platform.OS,
+		OSVersion:    platform.OSVersion,
+		Variant:      platform.Variant,
+		RootFS:       oci.RootFS{Type: "layers", DiffIDs: []string{}},
+	}
+
+	// layers are applied base first
+	for i := len(ids) - 1; i >= 0; i-- {
+		dir := filepath.Join(imageRoot, string(ids[i]))
+
+		metadata, err := readImageJson(dir)
+		if err != nil {
+			return err
+		}
+
+		history := ociHistory(metadata)
+
+		layerPath := filepath.Join(dir, "layer.tar")
+		if _, err := os.Stat(layerPath); os.IsNotExist(err) {
+			history.EmptyLayer = true
+		} else {
+			layer, err := oci.MoveBlob(layoutDir, oci.MediaTypeLayer, layerPath)
+			if err != nil {
+				return err
+			}
+			manifest.Layers = append(manifest.Layers, layer)
+			// layers aren't compressed, so their digest is their diff id
+			config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, layer.Digest)
+		}
+		config.History = append(config.History, history)
+
+		if i == 0 {
+			setTopImage(&config, metadata)
+		}
+	}
+
+	if manifest.Config, err = oci.WriteJsonBlob(layoutDir, oci.MediaTypeConfig, config); err != nil {
+		return err
+	}
+
+	desc, err := oci.WriteJsonBlob(layoutDir, oci.MediaTypeManifest, manifest)
+	if err != nil {
+		return err
+	}
+
+	repoName, repoTag := pulledImageName(image, id)
+	desc.Annotations = map[string]string{
+		oci.AnnotationRefName:        repoTag,
+		oci.AnnotationContainerdName: containerdName(repoName, repoTag),
+	}
+
+	fmt.Fprintf(cli.out, "writing '%s' to oci layout %s\n", repoName+":"+repoTag, layoutDir)
+	if err := oci.AddManifest(layoutDir, desc); err != nil {
+		return err
+	}
+
+	cli.changed = true
+	return nil
+}
+
+// The repo and tag a pull without docker names image id by. Pinned images
+// have no tag, so are tagged with their short id.
+func pulledImageName(image string, id remote.ID) (string, string) {
+	if name, pinned := remote.SplitImageId(image); pinned != "" {
+		return name, string(id.Short())
+	}
+	return remote.NormaliseImageName(image)
+}
+
+// the metadata of a pulled image
+func readImageJson(dir string) (docker.Image, error) {
+	image := docker.Image{}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "json"))
+	if err != nil {
+		return image, err
+	}
+
+	if err := json.Unmarshal(data, &image); err != nil {
+		return image, fmt.Errorf("invalid image json in %s: %w", dir, err)
+	}
+	return image, nil
+}
+
+// the history entry for a docker image's layer
+func ociHistory(metadata docker.Image) oci.History {
+	created := metadata.Created
+	return oci.History{
+		Created:   &created,
+		Author:    metadata.Author,
+		Comment:   metadata.Comment,
+		CreatedBy: strings.Join(metadata.ContainerConfig.Cmd, " "),
+	}
+}
+
+// sets the parts of config which come from the metadata of the image's top layer
+func setTopImage(config *oci.Image, metadata docker.Image) {
+	created := metadata.Created
+	config.Created = &created
+	config.Author = metadata.Author
+	if metadata.Architecture != "" {
+		config.Architecture = metadata.Architecture
+	}
+	if metadata.Config != nil {
+		config.Config = ociConfig(*metadata.Config)
+	}
+}
+
+// the parts of a docker image's config which OCI images have
+func ociConfig(config docker.Config) oci.ImageConfig {
+	ociConfig := oci.ImageConfig{
+		User:       config.User,
+		Env:        config.Env,
+		Entrypoint: config.Entrypoint,
+		Cmd:        config.Cmd,
+		Volumes:    config.Volumes,
+		WorkingDir: config.WorkingDir,
+	}
+
+	if len(config.ExposedPorts) > 0 {
+		ociConfig.ExposedPorts = make(map[string]struct{})
+		for port := range config.ExposedPorts {
+			ociConfig.ExposedPorts[string(port)] = struct{}{}
+		}
+	}
+
+	return ociConfig
+}
+
+// Writes the image in the OCI layout at cli.ociDir into root, in the form
+// prepareImage gives docker's images, tagged as image. The layout's image is
+// the one with image's tag, or its only image.
+func (cli *DogestryCli) prepareOciImage(image, root string) error {
+	repoName, repoTag := remote.NormaliseImageName(image)
+
+	manifest, config, err := oci.FindImage(cli.ociDir, repoTag)
+	if err != nil {
+		return err
+	}
+	if len(manifest.Layers) != len(config.RootFS.DiffIDs) {
+		return fmt.Errorf("image has %d layers but %d diff ids", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	// the history of each layer, skipping entries which didn't make one
+	history := make([]oci.History, 0, len(config.History))
+	for _, entry := range config.History {
+		if !entry.EmptyLayer {
+			history = append(history, entry)
+		}
+	}
+
+	parent := ""
+	for i, layer := range manifest.Layers {
+		diffId := config.RootFS.DiffIDs[i]
+		top := i == len(manifest.Layers)-1
+
+		// docker's images are named by id rather than content, so ids are made
+		// from the layer and its ancestors, and the config for the top image
+		idSource := parent + "\n" + diffId
+		if top {
+			idSource += "\n" + manifest.Config.Digest
+		}
+		id := fmt.Sprintf("%x", sha256.Sum256([]byte(idSource)))
+
+		fmt.Fprintf(cli.out, "preparing layer %s as image '%s'\n", layer.Digest, remote.ID(id).Short())
+
+		dir := filepath.Join(root, "images", id)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+
+		size, err := writeOciLayer(cli.ociDir, layer, diffId, filepath.Join(dir, "layer.tar"))
+		if err != nil {
+			return err
+		}
+
+		metadata := docker.Image{
+			ID:           id,
+			Parent:       parent,
+			Architecture: config.Architecture,
+			Size:         size,
+		}
+		if config.Created != nil {
+			metadata.Created = *config.Created
+		}
+		if i < len(history) {
+			if history[i].Created != nil {
+				metadata.Created = *history[i].Created
+			}
+			metadata.Author = history[i].Author
+			metadata.Comment = history[i].Comment
+			if history[i].CreatedBy != "" {
+				metadata.ContainerConfig.Cmd = []string{history[i].CreatedBy}
+			}
+		}
+		if top {
+			metadata.Config = dockerConfig(config.Config)
+		}
+
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "json"), data, 0600); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "VERSION"), []byte("1.0"), 0600); err != nil {
+			return err
+		}
+
+		parent = id
+	}
+
+	tagPath := filepath.Join(root, "repositories", repoName, repoTag)
+	if err := os.MkdirAll(filepath.Dir(tagPath), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(tagPath, []byte(parent), 0600)
+}
+
+// Writes the layer desc describes to dst uncompressed, checking the blob
+// against its digest and the layer against diffId. Returns the layer's size.
+func writeOciLayer(dir string, desc oci.Descriptor, diffId, dst string) (int64, error) {
+	blob, err := oci.OpenBlob(dir, desc.Digest)
+	if err != nil {
+		return 0, err
+	}
+	defer blob.Close()
+
+	blobHash := sha256.New()
+	var layer io.Reader = io.TeeReader(blob, blobHash)
+
+	switch desc.MediaType {
+	case oci.MediaTypeLayer, oci.MediaTypeDockerLayer:
+	case oci.MediaTypeLayerGz, oci.MediaTypeDockerLayerGz:
+		gz, err := gzip.NewReader(layer)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		layer = gz
+	default:
+		return 0, fmt.Errorf("layer %s has unsupported media type %s", desc.Digest, desc.MediaType)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	layerHash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, layerHash), layer)
+	if err != nil {
+		return 0, err
+	}
+	// the rest of the blob, after the end of the gzip stream
+	if _, err := io.Copy(ioutil.Discard, io.TeeReader(blob, blobHash)); err != nil {
+		return 0, err
+	}
+
+	if digest := fmt.Sprintf("sha256:%x", blobHash.Sum(nil)); digest != desc.Digest {
+		return 0, &remote.ChecksumError{File: "layer " + desc.Digest, Expected: desc.Digest, Actual: digest}
+	}
+	if digest := fmt.Sprintf("sha256:%x", layerHash.Sum(nil)); digest != diffId {
+		return 0, &remote.ChecksumError{File: "layer " + desc.Digest, Expected: "diff id " + diffId, Actual: digest}
+	}
+
+	return size, nil
+}
+
+// an OCI image's config as docker has it
+func dockerConfig(config oci.ImageConfig) *docker.Config {
+	dockerConfig := &docker.Config{
+		User:       config.User,
+		Env:        config.Env,
+		Entrypoint: config.Entrypoint,
+		Cmd:        config.Cmd,
+		Volumes:    config.Volumes,
+		WorkingDir: config.WorkingDir,
+	}
+
+	if len(config.ExposedPorts) > 0 {
+		dockerConfig.ExposedPorts = make(map[docker.Port]struct{})
+		for port := range config.ExposedPorts {
+			dockerConfig.ExposedPorts[docker.Port(port)] = struct{}{}
+		}
+	}
+
+	return dockerConfig
+}
+
+// Unpacks an oci-archive, a tar of an OCI layout, into dir.
+func ExtractOciArchive(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tarball := tar.NewReader(f)
+	for {
+		header, err := tarball.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(strings.TrimPrefix(header.Name, "./"))
+		if name == "." || filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+			continue
+		}
+
+		dst := filepath.Join(dir, name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+				return err
+			}
+			if err := writeFile(dst, tarball); err != nil {
+				return err
+			}
+		}
+	}
+}
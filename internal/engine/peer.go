@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/blake-education/dogestry/cache"
+	"github.com/blake-education/dogestry/remote"
+)
+
+func (cli *DogestryCli) CmdPeer(args ...string) error {
+	cmd := cli.Subcmd("peer", "", "serve the layers in the local cache to other hosts pulling the same images, so they don't all download them from the remote")
+	listen := cmd.String("listen", ":4245", "address to listen on")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	c := cache.New(cli.Config)
+	if c == nil {
+		return fmt.Errorf("no cache configured. Set `dir` in the [cache] section of dogestry.cfg")
+	}
+
+	http.HandleFunc("/"+remote.BlobsDir+"/", func(w http.ResponseWriter, r *http.Request) {
+		servePeerBlob(c, w, r)
+	})
+
+	fmt.Println("serving", c.Dir, "on", *listen)
+	return http.ListenAndServe(*listen, nil)
+}
+
+// GET /blobs/sha256/HEX
+func servePeerBlob(c *cache.Cache, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// only blobs, which pullers can check against their digest
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if _, err := remote.BlobKey("sha256:" + strings.TrimPrefix(key, remote.BlobsDir+"/")); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := c.Open(key)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Println("serving", key, err)
+		http.Error(w, "couldn't read blob", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "couldn't read blob", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/blake-education/dogestry/remote"
+)
+
+// The platform to pull images for: -platform, otherwise docker's, otherwise
+// this host's for pulls which don't involve docker.
+func (cli *DogestryCli) pullPlatform() (remote.Platform, error) {
+	if cli.platform != "" {
+		return remote.ParsePlatform(cli.platform)
+	}
+
+	if cli.usesDocker() {
+		version, err := cli.client.Version()
+		if err != nil {
+			return remote.Platform{}, err
+		}
+		if version.Get("Os") != "" && version.Get("Arch") != "" {
+			platform := remote.Platform{OS: version.Get("Os"), Architecture: version.Get("Arch")}
+			if platform.OS == "windows" {
+				platform.OSVersion = windowsBuild(version.Get("KernelVersion"))
+			}
+			return platform, nil
+		}
+	}
+
+	return remote.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}, nil
+}
+
+// The Windows build, e.g. 10.0.17763, of a Windows docker's kernel version,
+// which it gives as "10.0 17763 (17763.1.amd64fre.rs5_release.180914-1434)"
+func windowsBuild(kernelVersion string) string {
+	fields := strings.Fields(kernelVersion)
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[0] + "." + fields[1]
+}
+
+// The image to pull for the pull platform, when image is a tag with an image
+// per platform. Otherwise id, the image the tag points at.
+func (cli *DogestryCli) platformImage(r remote.Remote, image string, id remote.ID) (remote.ID, error) {
+	if _, pinned := remote.SplitImageId(image); pinned != "" {
+		return id, cli.checkPlatform(r, image, id)
+	}
+
+	repoName, repoTag := remote.NormaliseImageName(image)
+	index, err := remote.ReadPlatformIndex(r, repoName, repoTag)
+	if err != nil {
+		return "", err
+	} else if len(index.Manifests) == 0 {
+		return id, cli.checkPlatform(r, image, id)
+	}
+
+	platform, err := cli.pullPlatform()
+	if err != nil {
+		return "", err
+	}
+
+	platformId, found := index.Find(platform)
+	if !found {
+		return "", fmt.Errorf("%s:%s has no image for %s, only for %s. Use -platform to pull one of those", repoName, repoTag, platform, index)
+	}
+
+	fmt.Fprintf(cli.out, "using the %s image '%s'\n", platform, platformId.Short())
+	return platformId, nil
+}
+
+// Checks image id, which has no other platforms' images to choose from, is for
+// the -platform asked for. Without -platform, whatever the image is for is pulled.
+func (cli *DogestryCli) checkPlatform(r remote.Remote, image string, id remote.ID) error {
+	if cli.platform == "" {
+		return nil
+	}
+
+	want, err := remote.ParsePlatform(cli.platform)
+	if err != nil {
+		return err
+	}
+	platform, err := remote.ImagePlatform(r, id)
+	if err != nil {
+		return err
+	}
+
+	if !platform.Matches(want) {
+		return fmt.Errorf("%s only has an image for %s, not %s", image, platform, want)
+	}
+	return nil
+}
+
+// Records image id, pushed from imageRoot, as the image for its platform of
+// each tag in names. Images pushed by id have no tag to record.
+func recordPlatforms(r remote.Remote, imageRoot string, names []string, id remote.ID) error {
+	platform, err := remote.PreparedPlatform(imageRoot, id)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		repoName, repoTag := remote.NormaliseImageName(name)
+		if _, err := os.Stat(filepath.Join(imageRoot, "repositories", repoName, repoTag)); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := remote.AddPlatformImage(r, repoName, repoTag, platform, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
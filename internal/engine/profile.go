@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+)
+
+// How long each layer of a push or pull took to compress and transfer, and
+// how big it was before and after, for -profile-layers.
+type layerProfile struct {
+	Layer          string `json:"layer"`
+	Size           int64  `json:"size"`
+	CompressedSize int64  `json:"compressed_size"`
+
+	// compressing on push, decompressing on pull
+	CompressSeconds float64 `json:"compress_seconds"`
+
+	// uploading or downloading its files, which overlap with other layers' with -concurrency
+	TransferSeconds float64 `json:"transfer_seconds"`
+	TransferBytes   int64   `json:"transfer_bytes"`
+}
+
+func (layer *layerProfile) ratio() string {
+	if layer.Size == 0 || layer.CompressedSize == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", 100*float64(layer.CompressedSize)/float64(layer.Size))
+}
+
+func (layer *layerProfile) throughput() string {
+	if layer.TransferSeconds <= 0 {
+		return "-"
+	}
+	return utils.HumanSize(int64(float64(layer.TransferBytes)/layer.TransferSeconds)) + "/s"
+}
+
+type runProfile struct {
+	sync.Mutex
+	layers map[string]*layerProfile
+}
+
+// Starts profiling a push or pull, with -profile-layers.
+func (cli *DogestryCli) startProfile() {
+	if !cli.profiling {
+		return
+	}
+
+	cli.eventsLock.Lock()
+	cli.profile = &runProfile{layers: make(map[string]*layerProfile)}
+	cli.eventsLock.Unlock()
+}
+
+// The layer's profile, to add to. Nil if profiling isn't on.
+func (p *runProfile) layer(id string) *layerProfile {
+	if p == nil {
+		return nil
+	}
+
+	if _, ok := p.layers[id]; !ok {
+		p.layers[id] = &layerProfile{Layer: id}
+	}
+	return p.layers[id]
+}
+
+// Profiles compressing or decompressing a layer with fn.
+func (p *runProfile) compress(id string, fn func() error) error {
+	if p == nil {
+		return fn()
+	}
+
+	started := time.Now()
+	err := fn()
+
+	p.Lock()
+	defer p.Unlock()
+	p.layer(id).CompressSeconds += time.Since(started).Seconds()
+	return err
+}
+
+// Records a layer's size, and its size compressed.
+func (p *runProfile) sizes(id string, size, compressed int64) {
+	if p == nil {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	layer := p.layer(id)
+	layer.Size, layer.CompressedSize = size, compressed
+}
+
+// the size of the file at path, or of the files under it
+func diskSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// Adds a file the remote transferred to its layer's profile.
+func (p *runProfile) transferred(event remote.Event) {
+	if p == nil || event.Event != remote.EventDone {
+		return
+	}
+	id := eventLayer(event.Key)
+	if id == "" {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	layer := p.layer(id)
+	layer.TransferSeconds += event.Seconds
+	layer.TransferBytes += event.Bytes
+}
+
+// biggest first
+type layersBySize []*layerProfile
+
+func (l layersBySize) Len() int           { return len(l) }
+func (l layersBySize) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l layersBySize) Less(i, j int) bool { return l[i].Size > l[j].Size }
+
+// Prints the profile, as a table or with -json, as json, and stops profiling.
+func (cli *DogestryCli) printProfile(command string) {
+	cli.eventsLock.Lock()
+	p := cli.profile
+	cli.profile = nil
+	cli.eventsLock.Unlock()
+	if p == nil {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	layers := make([]*layerProfile, 0, len(p.layers))
+	for _, layer := range p.layers {
+		layers = append(layers, layer)
+	}
+	sort.Sort(layersBySize(layers))
+
+	if cli.Options.Json {
+		printJson(map[string]interface{}{"profile": command, "layers": layers})
+		return
+	}
+
+	compressing, transfer := "compress", "upload"
+	if command == "pull" {
+		compressing, transfer = "decompress", "download"
+	}
+
+	total := &layerProfile{Layer: "total"}
+	for _, layer := range layers {
+		total.Size += layer.Size
+		total.CompressedSize += layer.CompressedSize
+		total.CompressSeconds += layer.CompressSeconds
+		total.TransferSeconds += layer.TransferSeconds
+		total.TransferBytes += layer.TransferBytes
+	}
+
+	fmt.Fprintf(cli.out, "%-12s  %10s  %10s  %5s  %10s  %10s  %12s\n", "layer", "size", "compressed", "ratio", compressing, transfer, "throughput")
+	for _, layer := range append(layers, total) {
+		fmt.Fprintf(cli.out, "%-12s  %10s  %10s  %5s  %9.1fs  %9.1fs  %12s\n",
+			remote.ID(layer.Layer).Short(), utils.HumanSize(layer.Size), utils.HumanSize(layer.CompressedSize),
+			layer.ratio(), layer.CompressSeconds, layer.TransferSeconds, layer.throughput())
+	}
+}
@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Just enough of protobuf's wire format for the gRPC api's messages, in
+// proto/dogestry.proto, so the server needn't depend on a protobuf library.
+// Fields with their default values are left out, as proto3 leaves them out.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type protoEncoder struct {
+	buf []byte
+}
+
+func (e *protoEncoder) varint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *protoEncoder) key(field, wireType int) {
+	e.varint(uint64(field<<3 | wireType))
+}
+
+func (e *protoEncoder) string(field int, s string) {
+	if s != "" {
+		e.bytes(field, []byte(s))
+	}
+}
+
+func (e *protoEncoder) bytes(field int, b []byte) {
+	e.key(field, wireBytes)
+	e.varint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *protoEncoder) int64(field int, v int64) {
+	if v != 0 {
+		e.key(field, wireVarint)
+		e.varint(uint64(v))
+	}
+}
+
+func (e *protoEncoder) double(field int, v float64) {
+	if v != 0 {
+		e.key(field, wireFixed64)
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(v))
+	}
+}
+
+// an embedded message, which is there even if it's empty
+func (e *protoEncoder) message(field int, m *protoEncoder) {
+	e.bytes(field, m.buf)
+}
+
+// as a google.protobuf.Timestamp. Left out if t is zero
+func (e *protoEncoder) time(field int, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	ts := &protoEncoder{}
+	ts.int64(1, t.Unix())
+	ts.int64(2, int64(t.Nanosecond()))
+	e.message(field, ts)
+}
+
+// A decoded message's fields, by number. Only the last of a repeated field is kept.
+type protoMessage map[int]protoField
+
+type protoField struct {
+	varint uint64
+	bytes  []byte
+}
+
+func decodeProto(data []byte) (protoMessage, error) {
+	m := make(protoMessage)
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid field key")
+		}
+		data = data[n:]
+
+		field := protoField{}
+		switch key & 7 {
+		case wireVarint:
+			if field.varint, n = binary.Uvarint(data); n <= 0 {
+				return nil, fmt.Errorf("invalid varint")
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return nil, fmt.Errorf("truncated fixed64")
+			}
+			field.varint, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return nil, fmt.Errorf("truncated fixed32")
+			}
+			field.varint, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return nil, fmt.Errorf("truncated field")
+			}
+			field.bytes, data = data[n:n+int(size)], data[n+int(size):]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		m[int(key>>3)] = field
+	}
+	return m, nil
+}
+
+func (m protoMessage) string(field int) string {
+	return string(m[field].bytes)
+}
+
+func (m protoMessage) int64(field int) int64 {
+	return int64(m[field].varint)
+}
@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestProtoEncoder(t *testing.T) {
+	tests := []struct {
+		encode func(e *protoEncoder)
+		want   []byte
+	}{
+		// the examples from protobuf's encoding docs
+		{func(e *protoEncoder) { e.int64(1, 150) }, []byte{0x08, 0x96, 0x01}},
+		{func(e *protoEncoder) { e.string(2, "testing") }, []byte{0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}},
+		{func(e *protoEncoder) { e.double(1, 1) }, []byte{0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}},
+
+		// defaults are left out
+		{func(e *protoEncoder) { e.int64(1, 0); e.string(2, ""); e.double(3, 0); e.time(4, time.Time{}) }, nil},
+
+		// but an empty message isn't
+		{func(e *protoEncoder) { e.message(3, &protoEncoder{}) }, []byte{0x1a, 0x00}},
+
+		{func(e *protoEncoder) { e.time(1, time.Unix(2, 3)) }, []byte{0x0a, 0x04, 0x08, 0x02, 0x10, 0x03}},
+	}
+
+	for i, test := range tests {
+		e := &protoEncoder{}
+		test.encode(e)
+		if !bytes.Equal(e.buf, test.want) {
+			t.Errorf("%d: got % x, want % x", i, e.buf, test.want)
+		}
+	}
+}
+
+func TestDecodeProto(t *testing.T) {
+	e := &protoEncoder{}
+	e.string(1, "central")
+	e.string(2, "app:latest")
+	e.int64(3, 1<<40)
+	e.double(4, 2.5)
+	e.buf = append(e.buf, 0x2d, 1, 0, 0, 0) // field 5, fixed32
+
+	m, err := decodeProto(e.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.string(1) != "central" || m.string(2) != "app:latest" || m.int64(3) != 1<<40 || m.int64(5) != 1 {
+		t.Errorf("got %+v", m)
+	}
+	if m.string(6) != "" || m.int64(6) != 0 {
+		t.Errorf("a missing field isn't its default")
+	}
+
+	// a repeated field keeps its last value
+	e = &protoEncoder{}
+	e.int64(1, 1)
+	e.int64(1, 2)
+	if m, err := decodeProto(e.buf); err != nil || m.int64(1) != 2 {
+		t.Errorf("got %v, %v", m, err)
+	}
+}
+
+func TestDecodeProtoInvalid(t *testing.T) {
+	for _, data := range [][]byte{
+		{0x80},                   // a truncated key
+		{0x08, 0x96},             // a truncated varint
+		{0x09, 0, 0, 0},          // a truncated fixed64
+		{0x0d, 0},                // a truncated fixed32
+		{0x12, 0x07, 't', 'e'},   // a truncated string
+		{0x12, 0xff, 0xff, 0x0f}, // a huge length
+		{0x0b},                   // a group
+	} {
+		if _, err := decodeProto(data); err == nil {
+			t.Errorf("% x: expected an error", data)
+		}
+	}
+}
@@ -0,0 +1,774 @@
+package engine
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	dockerclient "github.com/blake-education/dogestry/client"
+	"github.com/blake-education/dogestry/compressor"
+	"github.com/blake-education/dogestry/remote"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func (cli *DogestryCli) pull(remoteDef, image string) error {
+	r, err := cli.newRemote(remoteDef)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.out, "remote", r.Desc())
+
+	return cli.pullImageName(r, remoteDef, image)
+}
+
+func (cli *DogestryCli) pullImageName(r remote.Remote, remoteDef, image string) (err error) {
+	if cli.dryRun {
+		return cli.dryRunPull(image, r)
+	}
+
+	imageRoot, err := cli.PullDir(image)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			os.RemoveAll(imageRoot)
+		}
+	}()
+
+	// verifying isn't a pull, so it runs no hooks and records no run
+	if !cli.verifying {
+		started, before := time.Now(), r.Stats()
+		defer func() { cli.finishRun("pull", remoteDef, image, r, before, started, err) }()
+	}
+
+	span := cli.startRunSpan("pull", remoteDef, image)
+	defer func() { span.End(err) }()
+	cli.startProfile()
+
+	if !cli.verifying {
+		if err := cli.preHooks("pull", remoteDef, image); err != nil {
+			return err
+		}
+	}
+
+	if err := cli.checkWorkDirSpace(0); err != nil {
+		return err
+	}
+
+	if err := checkRemoteFormat(r, false); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.out, "resolving image id")
+	var id remote.ID
+	err = cli.phase("resolve", func() error {
+		if id, err = r.ResolveImageNameToId(image); err != nil {
+			return err
+		}
+		id, err = cli.platformImage(r, image, id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cli.out, "image '%s' resolved on remote id '%s'\n", image, id.Short())
+
+	statement, err := cli.verifySignature(r, id)
+	if err != nil {
+		return err
+	}
+	if statement, err = cli.checkTrust(r, remoteDef, image, id, statement); err != nil {
+		return err
+	}
+	cli.signed = nil
+	if statement != nil {
+		if cli.signed, err = signedDigests(id, statement); err != nil {
+			return err
+		}
+	}
+
+	// newer dockers know the image by its config's digest, rather than its id on the remote
+	dockerId, err := remote.DockerImageId(r, id)
+	if err != nil {
+		return err
+	}
+
+	if cli.compressor, err = compressor.NewCompressor(cli.Config); err != nil {
+		return err
+	}
+
+	if cli.containerdNamespace != "" {
+		if err := cli.transferPhase("download", func() error { return cli.pullToContainerd(image, id, imageRoot, r) }); err != nil {
+			return err
+		}
+	} else if cli.ociDir != "" {
+		if err := cli.transferPhase("download", func() error { return cli.pullToOci(image, id, imageRoot, cli.ociDir, r) }); err != nil {
+			return err
+		}
+	} else if cli.Config.Dogestry.Stream_Pull || cli.loadTo != nil {
+		fmt.Fprintln(cli.out, "streaming images to docker")
+		if err := cli.transferPhase("stream", func() error { return cli.streamPull(image, id, r) }); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintln(cli.out, "preparing images")
+		if err := cli.transferPhase("download", func() error { return cli.preparePullImage(id, imageRoot, r) }); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(cli.out, "preparing repositories file")
+		if err := prepareRepositories(image, id, imageRoot, r); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(cli.out, "sending tar to docker")
+		if err := cli.phase("load", func() error { return cli.sendTar(imageRoot) }); err != nil {
+			return err
+		}
+	}
+
+	// in the case where we already have the image, but its not tagged:
+	if _, pinned := remote.SplitImageId(image); pinned == "" && cli.usesDocker() {
+		fmt.Fprintln(cli.out, "ensuring tag")
+		if err := cli.retag(image, dockerId); err != nil {
+			return err
+		}
+	}
+
+	if cli.tagAsName != "" {
+		if err := cli.tagAs(cli.tagAsName, dockerId); err != nil {
+			return err
+		}
+	}
+
+	// pull hosts often have read-only access, so this is best effort
+	if (cli.changed || !cli.agent) && !remote.IsReadOnly(r) {
+		if err := cli.phase("metadata", func() error { return recordHistory(r, "pull", image, id) }); err != nil {
+			fmt.Fprintln(cli.out, "couldn't record pull in history:", err)
+		}
+	}
+
+	return nil
+}
+
+func (cli *DogestryCli) preparePullImage(fromId remote.ID, imageRoot string, r remote.Remote) error {
+	toDownload, localIds, err := cli.imagesToPull(fromId, r)
+	if err != nil {
+		return err
+	}
+
+	// an earlier failed pull may have left images behind which docker has since loaded
+	if err := removeLocalImages(imageRoot, localIds); err != nil {
+		return err
+	}
+
+	return cli.pullImages(toDownload, imageRoot, r)
+}
+
+// Pulls the images docker doesn't have, as a tar stream straight into docker.
+// Nothing is written to disk, but images are downloaded one at a time and an
+// interrupted pull starts again from scratch.
+func (cli *DogestryCli) streamPull(image string, fromId remote.ID, r remote.Remote) error {
+	skipped := cli.localSkipped
+	ids, _, err := cli.imagesToPull(fromId, r)
+	if err != nil {
+		return err
+	}
+	// docker has none of the image, so every layer is streamed
+	complete := cli.localSkipped == skipped
+
+	repositories, err := repositoriesFor(image, fromId, r)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) == 0 && repositories == nil {
+		fmt.Fprintln(cli.out, "no images to send to docker")
+		return nil
+	}
+	if len(ids) > 0 {
+		cli.changed = true
+	}
+
+	reader, writer := io.Pipe()
+
+	posted := make(chan error, 1)
+	go func() {
+		err := cli.load(reader)
+		// stop the writer if docker gave up early
+		reader.CloseWithError(err)
+		posted <- err
+	}()
+
+	err = func() error {
+		counter := &countingWriter{w: writer}
+		tarball := tar.NewWriter(counter)
+
+		var config []byte
+		for _, id := range ids {
+			fmt.Fprintf(cli.out, "pulling image id '%s'\n", id.Short())
+			var imageConfig []byte
+			err := remote.ReportTransfer(cli.remoteControl(), string(id), func() (int64, error) {
+				before := counter.n
+				var err error
+				imageConfig, err = cli.streamImage(id, r, tarball)
+				return counter.n - before, err
+			})
+			if err != nil {
+				return err
+			}
+			if id == fromId {
+				config = imageConfig
+			}
+		}
+
+		// as prepareManifest, for newer dockers
+		if config != nil && complete {
+			// ids are newest first
+			layers := make([]remote.ID, len(ids))
+			for i, id := range ids {
+				layers[len(ids)-1-i] = id
+			}
+
+			data, err := remote.LayerSources(r, fromId)
+			if err != nil {
+				return err
+			}
+			sources, err := parseLayerSources(data)
+			if err != nil {
+				return err
+			}
+
+			configName, manifest, err := manifestFor(config, layers, repositories, sources)
+			if err != nil {
+				return err
+			}
+			if err := writeTarBytes(tarball, configName, config); err != nil {
+				return err
+			}
+			if err := writeTarBytes(tarball, ManifestFile, manifest); err != nil {
+				return err
+			}
+		}
+
+		if repositories != nil {
+			data, err := json.Marshal(repositories)
+			if err != nil {
+				return err
+			}
+			if err := writeTarBytes(tarball, "repositories", data); err != nil {
+				return err
+			}
+		}
+
+		return tarball.Close()
+	}()
+
+	// a nil err ends the stream normally
+	writer.CloseWithError(err)
+
+	if postErr := <-posted; err == nil {
+		err = postErr
+	}
+	return err
+}
+
+// Streams an image's files from the remote into tarball. Compressed files are
+// decompressed via the work dir first, since tar needs to know their size up front.
+// The image's config, if it has one, is returned rather than streamed.
+func (cli *DogestryCli) streamImage(id remote.ID, r remote.Remote, tarball *tar.Writer) ([]byte, error) {
+	var config []byte
+
+	reader, writer := io.Pipe()
+
+	streamed := make(chan error, 1)
+	go func() {
+		files := tar.NewWriter(writer)
+		err := r.StreamImageId(id, files)
+		if err == nil {
+			err = files.Close()
+		}
+		writer.CloseWithError(err)
+		streamed <- err
+	}()
+
+	err := func() error {
+		deltaDir := ""
+		// the recorded digest of the layer, and the digest of what was sent to docker
+		expected, actual := "", ""
+		expectedConfig := ""
+		// the digest of the metadata sent to docker
+		metadata := ""
+
+		files := tar.NewReader(reader)
+		for {
+			header, err := files.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			digest := ""
+			if path.Base(header.Name) == remote.ImageConfigFile {
+				config, err = ioutil.ReadAll(files)
+			} else if path.Base(header.Name) == remote.LayerSourcesFile {
+				// goes in the manifest instead
+				continue
+			} else if path.Base(header.Name) == LayerDigestFile {
+				var data []byte
+				if data, err = ioutil.ReadAll(files); err == nil {
+					expected = strings.TrimSpace(string(data))
+				}
+			} else if path.Base(header.Name) == ConfigDigestFile {
+				var data []byte
+				if data, err = ioutil.ReadAll(files); err == nil {
+					expectedConfig = strings.TrimSpace(string(data))
+				}
+			} else if isDeltaFile(header.Name) {
+				// keep the delta until we have all of it, then rebuild the layer
+				if deltaDir == "" {
+					if deltaDir, err = cli.WorkDir("stream-" + string(id)); err != nil {
+						return err
+					}
+				}
+				err = writeFile(filepath.Join(deltaDir, filepath.Base(header.Name)), files)
+			} else if compressor.IsCompressed(header.Name) {
+				digest, err = cli.writeDecompressed(header, files, tarball)
+			} else {
+				digest, err = writeTarEntry(tarball, header, files)
+			}
+			if err != nil {
+				return err
+			}
+
+			if strings.HasPrefix(path.Base(header.Name), "layer.tar") {
+				actual = digest
+			} else if path.Base(header.Name) == "json" {
+				metadata = digest
+			}
+		}
+
+		if deltaDir != "" {
+			defer os.RemoveAll(deltaDir)
+
+			if err := cli.applyDelta(deltaDir, r); err != nil {
+				return err
+			}
+
+			var err error
+			if actual, err = writeTarFile(tarball, path.Join(string(id), "layer.tar"), filepath.Join(deltaDir, "layer.tar")); err != nil {
+				return err
+			}
+		}
+
+		digests := map[string]string{"json": metadata, "layer.tar": actual}
+		if config != nil {
+			digests[remote.ImageConfigFile] = sha256Digest(config)
+		}
+		if err := cli.checkSigned(id, digests); err != nil {
+			return err
+		}
+
+		if cli.skipVerify {
+			return nil
+		}
+		if expectedConfig != "" && config != nil {
+			if err := checkDigest(remote.ImageConfigFile, string(id), expectedConfig, sha256Digest(config)); err != nil {
+				return err
+			}
+		}
+		// docker gets the corrupt layer, but the load is aborted before it finishes
+		if expected != "" {
+			return checkDigest("layer.tar", string(id), expected, actual)
+		}
+		return nil
+	}()
+
+	// stop the remote if we gave up early
+	reader.CloseWithError(err)
+
+	if streamErr := <-streamed; err == nil {
+		err = streamErr
+	}
+	return config, err
+}
+
+// writes a compressed file into tarball, decompressed. Returns the digest of what was written
+func (cli *DogestryCli) writeDecompressed(header *tar.Header, r io.Reader, tarball *tar.Writer) (string, error) {
+	dir, err := cli.WorkDir("stream")
+	if err != nil {
+		return "", err
+	}
+
+	compressed := filepath.Join(dir, filepath.Base(header.Name))
+	if err := writeFile(compressed, r); err != nil {
+		return "", err
+	}
+
+	if err := cli.compressor.Decompress(compressed); err != nil {
+		return "", err
+	}
+
+	name := strings.TrimSuffix(header.Name, filepath.Ext(header.Name))
+	decompressed := filepath.Join(dir, filepath.Base(name))
+	defer os.Remove(decompressed)
+
+	return writeTarFile(tarball, name, decompressed)
+}
+
+func writeFile(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// writes the file at path into tarball as name. Returns the digest of its content
+func writeTarFile(tarball *tar.Writer, name, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	header := &tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}
+	return writeTarEntry(tarball, header, f)
+}
+
+// writes data into tarball as name
+func writeTarBytes(tarball *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tarball.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tarball.Write(data)
+	return err
+}
+
+// writes an entry into tarball. Returns the digest of its content
+func writeTarEntry(tarball *tar.Writer, header *tar.Header, r io.Reader) (string, error) {
+	if err := tarball.WriteHeader(header); err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tarball, hash), r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil)), nil
+}
+
+// The images to pull, newest first, stopping at the first one docker already has.
+// Also returns the ids of every image docker has.
+func (cli *DogestryCli) imagesToPull(fromId remote.ID, r remote.Remote) ([]remote.ID, map[string]bool, error) {
+	toDownload := make([]remote.ID, 0)
+
+	localIds, err := cli.localImageIds()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// newer dockers don't know the ids on the remote, only the image's config
+	// digest, and need every layer to load it
+	if dockerId, err := remote.DockerImageId(r, fromId); err != nil {
+		return nil, nil, err
+	} else if dockerId != string(fromId) {
+		if localIds[dockerId] && !cli.Config.Dogestry.Force {
+			fmt.Fprintf(cli.out, "docker already has id '%s', stopping\n", remote.ID(dockerId).Short())
+			cli.localSkipped++
+			return toDownload, localIds, nil
+		}
+	}
+
+	err = r.WalkImages(fromId, func(id remote.ID, image docker.Image, err error) error {
+		if cli.Options.Verbose {
+			fmt.Fprintf(cli.out, "examining id '%s' on remote\n", id.Short())
+		}
+		if err != nil {
+			fmt.Fprintln(cli.out, "err", err)
+			return err
+		}
+
+		// docker has this image, so it has all of its ancestors too
+		if localIds[string(id)] && !cli.Config.Dogestry.Force {
+			fmt.Fprintf(cli.out, "docker already has id '%s', stopping\n", id.Short())
+			cli.localSkipped++
+			return remote.BreakWalk
+		}
+
+		toDownload = append(toDownload, id)
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return toDownload, localIds, nil
+}
+
+// whether pulls load images into docker, rather than an OCI layout, containerd or loadTo
+func (cli *DogestryCli) usesDocker() bool {
+	return cli.ociDir == "" && cli.containerdNamespace == "" && cli.loadTo == nil
+}
+
+// the ids of every image docker has, including intermediate layers. None
+// when pulling without docker, which then needs every image
+func (cli *DogestryCli) localImageIds() (map[string]bool, error) {
+	if !cli.usesDocker() {
+		return map[string]bool{}, nil
+	}
+
+	images, err := cli.client.ListImages(true)
+	if err != nil {
+		return nil, dockerError(err)
+	}
+
+	ids := make(map[string]bool, len(images))
+	for _, image := range images {
+		ids[image.ID] = true
+	}
+	return ids, nil
+}
+
+// remove images docker already has from imageRoot, so they're not loaded again
+func removeLocalImages(imageRoot string, localIds map[string]bool) error {
+	entries, err := ioutil.ReadDir(imageRoot)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() && localIds[entry.Name()] {
+			if err := os.RemoveAll(filepath.Join(imageRoot, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// download images, several at a time
+func (cli *DogestryCli) pullImages(ids []remote.ID, imageRoot string, r remote.Remote) error {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = string(id)
+	}
+
+	return remote.TransferEach(keys, cli.concurrency(), cli.retries(), cli.remoteControl(), func(id string) (int64, error) {
+		dst := filepath.Join(imageRoot, id)
+		var err error
+		if cli.shared != nil {
+			err = cli.shared.pull(cli, remote.ID(id), dst, r)
+		} else {
+			err = cli.pullImage(remote.ID(id), dst, r)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		// what was pulled, which may be from another host's pull, not what was signed
+		return diskSize(dst), cli.checkPulledSigned(remote.ID(id), dst)
+	})
+}
+
+// how many images or files to transfer at once
+func (cli *DogestryCli) concurrency() int {
+	if cli.Config.Dogestry.Concurrency > 0 {
+		return cli.Config.Dogestry.Concurrency
+	}
+	return remote.DefaultConcurrency
+}
+
+// how many times to retry an image or file which fails to transfer
+func (cli *DogestryCli) retries() int {
+	if cli.Config.Dogestry.Retries > 0 {
+		return cli.Config.Dogestry.Retries
+	}
+	return remote.DefaultRetries
+}
+
+func (cli *DogestryCli) pullImage(id remote.ID, dst string, r remote.Remote) error {
+	fmt.Fprintf(cli.out, "pulling image id '%s'\n", id.Short())
+
+	// XXX fix image name rewrite
+	err := r.PullImageId(id, dst)
+	if err != nil {
+		return err
+	}
+
+	span := cli.span.Child("decompress")
+	span.Set("layer", string(id))
+	compressed := diskSize(dst)
+	err = cli.profile.compress(string(id), func() error { return cli.processPulled(id, dst, r) })
+	cli.profile.sizes(string(id), diskSize(dst), compressed)
+	span.End(err)
+	return err
+}
+
+// decompress the pulled image's files, and rebuild its layer if it was pushed as a delta.
+// Each file records how it was compressed, so images pushed with different settings can be pulled together
+func (cli *DogestryCli) processPulled(id remote.ID, dst string, r remote.Remote) error {
+	err := filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return cli.compressor.Decompress(path)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := cli.applyDelta(dst, r); err != nil {
+		return err
+	}
+
+	return cli.verifyImage(dst)
+}
+
+// writes the repositories file, and the manifest newer dockers load instead, tagging image as id
+func prepareRepositories(image string, id remote.ID, imageRoot string, r remote.Remote) error {
+	repositories, err := repositoriesFor(image, id, r)
+	if err != nil {
+		return err
+	}
+
+	if repositories != nil {
+		reposPath := filepath.Join(imageRoot, "repositories")
+		reposFile, err := os.Create(reposPath)
+		if err != nil {
+			return err
+		}
+		defer reposFile.Close()
+
+		if err := json.NewEncoder(reposFile).Encode(&repositories); err != nil {
+			return err
+		}
+	}
+
+	return prepareManifest(id, imageRoot, repositories)
+}
+
+// The contents of the repositories file tagging id as image, or nil if image
+// isn't a tag on the remote. id is the tag's image for the pull's platform,
+// which needn't be the one the tag points at.
+func repositoriesFor(image string, id remote.ID, r remote.Remote) (map[string]Repository, error) {
+	if _, pinned := remote.SplitImageId(image); pinned != "" {
+		return nil, nil
+	}
+
+	repoName, repoTag := remote.NormaliseImageName(image)
+
+	if tagId, err := remote.ParseTag(r, repoName, repoTag); err != nil {
+		return nil, err
+	} else if tagId == "" {
+		return nil, nil
+	}
+
+	repositories := map[string]Repository{}
+	repositories[repoName] = Repository{}
+	repositories[repoName][repoTag] = string(id)
+
+	return repositories, nil
+}
+
+// stream the tarball into docker
+// its easier here to use tar command, but it'd be neater to mirror Push's approach
+func (cli *DogestryCli) sendTar(imageRoot string) error {
+	notExist, err := dirNotExistOrEmpty(imageRoot)
+
+	if err != nil {
+		return err
+	}
+	if notExist {
+		fmt.Fprintln(cli.out, "no images to send to docker")
+		return nil
+	}
+	cli.changed = true
+
+	// DEBUG - write out a tar to see what's there!
+	// exec.Command("/bin/tar", "cvf", "/tmp/d.tar", "-C", imageRoot, ".").Run()
+
+	cmd := exec.Command("/bin/tar", "cvf", "-", "-C", imageRoot, ".")
+	cmd.Dir = imageRoot
+	defer cmd.Wait()
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.out, "kicking off post")
+	return cli.load(stdout)
+}
+
+// loads tarball into docker, or writes it to loadTo
+func (cli *DogestryCli) load(tarball io.Reader) error {
+	if cli.loadTo != nil {
+		_, err := io.Copy(cli.loadTo, tarball)
+		return err
+	}
+	return dockerError(cli.client.PostImageTarball(tarball))
+}
+
+// tags docker's image id (see remote.DockerImageId) as tag
+func (cli *DogestryCli) retag(tag string, id string) error {
+	return dockerError(cli.client.SetImageTag(id, tag, false))
+}
+
+// Tags docker's image id as name (repo[:tag]), moving the tag if it's on another image.
+func (cli *DogestryCli) tagAs(name string, id string) error {
+	repoName, repoTag := remote.NormaliseImageName(name)
+	fmt.Fprintf(cli.out, "tagging '%s' as '%s'\n", remote.ID(id).Short(), repoName+":"+repoTag)
+	return dockerError(cli.client.TagImage(id, dockerclient.TagImageOptions{Repo: repoName, Tag: repoTag, Force: true}))
+}
+
+func dirNotExistOrEmpty(path string) (bool, error) {
+	imagesDir, err := os.Open(path)
+	if err != nil {
+		// no images
+		if os.IsNotExist(err) {
+			return true, nil
+		} else {
+			return false, err
+		}
+	}
+	defer imagesDir.Close()
+
+	names, err := ioutil.ReadDir(path)
+	if err != nil {
+		return false, err
+	}
+
+	if len(names) <= 1 {
+		return true, nil
+	}
+
+	return false, nil
+}
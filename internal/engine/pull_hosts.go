@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/blake-education/dogestry/remote"
+)
+
+// how many hosts -pullhosts pulls to at once, by default
+const DefaultHostConcurrency = 4
+
+// How a pull to one of several hosts went
+type hostResult struct {
+	Host    string `json:"host"`
+	Changed bool   `json:"changed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Pulls images to the docker on each host, concurrency hosts at a time. Hosts
+// are docker connections, e.g. tcp://app-1:2375 or ssh://deploy@app-1. A host
+// failing doesn't stop the others, and each host's result is printed at the end.
+//
+// Each image is downloaded from the remote once, here, and sent from here to
+// every host which doesn't have it, rather than each host downloading it.
+func (cli *DogestryCli) pullHosts(remoteDef string, hosts, images []string, concurrency int) error {
+	if concurrency <= 0 {
+		concurrency = DefaultHostConcurrency
+	}
+
+	dir, err := cli.WorkDir("pullhosts")
+	if err != nil {
+		return err
+	}
+	shared := &sharedImages{dir: dir, images: make(map[remote.ID]*sharedImage)}
+
+	results := make([]hostResult, len(hosts))
+	slots := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			fmt.Fprintf(cli.out, "pulling to %s\n", host)
+			result := hostResult{Host: host}
+			result.Changed, result.Error = cli.pullToHost(remoteDef, host, images, shared)
+			results[i] = result
+		}(i, host)
+	}
+	wg.Wait()
+
+	failed := 0
+	cli.changed = false
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+		if result.Changed {
+			cli.changed = true
+		}
+	}
+
+	if cli.Options.Json {
+		printJson(results)
+	} else {
+		for _, result := range results {
+			if result.Error != "" {
+				fmt.Fprintf(cli.out, "%-40s  failed: %s\n", result.Host, result.Error)
+			} else if result.Changed {
+				fmt.Fprintf(cli.out, "%-40s  ok\n", result.Host)
+			} else {
+				fmt.Fprintf(cli.out, "%-40s  up to date\n", result.Host)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("pull failed on %d of %d hosts", failed, len(hosts))
+	}
+	return nil
+}
+
+// Pulls images to host, returning whether anything was loaded, and the error, if any.
+func (cli *DogestryCli) pullToHost(remoteDef, host string, images []string, shared *sharedImages) (bool, string) {
+	hostCli, err := cli.forHost(host)
+	if err != nil {
+		return false, err.Error()
+	}
+	defer hostCli.Cleanup()
+	hostCli.shared = shared
+
+	r, err := hostCli.newRemote(remoteDef)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	err = hostCli.eachImage("pull", images, func(image string) error {
+		return hostCli.pullImageName(r, remoteDef, image)
+	})
+	if err != nil {
+		return hostCli.changed, err.Error()
+	}
+	return hostCli.changed, ""
+}
+
+// A cli like this one, but pulling to the docker at host, with its own work
+// dirs, so pulls to several hosts don't trip over each other.
+func (cli *DogestryCli) forHost(host string) (*DogestryCli, error) {
+	cfg := cli.Config
+	cfg.Docker.Connection = host
+	// streaming downloads each image again for each host
+	cfg.Dogestry.Stream_Pull = false
+
+	client, err := newDockerClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	root := cli.tempDirRoot
+	if root == "" {
+		root = os.TempDir()
+	}
+	name := strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(host)
+
+	return &DogestryCli{
+		client:      client,
+		out:         cli.out,
+		err:         cli.err,
+		tempDirRoot: filepath.Join(root, "dogestry-host-"+name),
+		Config:      cfg,
+		Options:     cli.Options,
+		control:     cli.control,
+		dryRun:      cli.dryRun,
+		tagAsName:   cli.tagAsName,
+		platform:    cli.platform,
+	}, nil
+}
+
+// Images downloaded once for all the hosts of a -pullhosts pull
+type sharedImages struct {
+	dir string
+
+	sync.Mutex
+	images map[remote.ID]*sharedImage
+}
+
+type sharedImage struct {
+	done chan struct{}
+	err  error
+}
+
+// Puts image id, downloaded and processed, in dst. The first host to need it
+// downloads it, and the rest wait for that and link to the same files.
+func (shared *sharedImages) pull(cli *DogestryCli, id remote.ID, dst string, r remote.Remote) error {
+	shared.Lock()
+	image, downloading := shared.images[id]
+	if !downloading {
+		image = &sharedImage{done: make(chan struct{})}
+		shared.images[id] = image
+	}
+	shared.Unlock()
+
+	src := filepath.Join(shared.dir, string(id))
+	if downloading {
+		<-image.done
+	} else {
+		image.err = cli.pullImage(id, src, r)
+		if image.err != nil {
+			os.RemoveAll(src)
+			// so a retry downloads it again
+			shared.Lock()
+			delete(shared.images, id)
+			shared.Unlock()
+		}
+		close(image.done)
+	}
+	if image.err != nil {
+		return image.err
+	}
+
+	return linkTree(src, dst)
+}
+
+// Recreates the tree at src at dst, hard linking files, or copying them
+// where they can't be linked.
+func linkTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		os.Remove(target)
+		if err := os.Link(path, target); err == nil {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return writeFile(target, f)
+	})
+}
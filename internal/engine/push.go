@@ -0,0 +1,436 @@
+package engine
+
+import (
+  "github.com/blake-education/dogestry/cache"
+  "github.com/blake-education/dogestry/compressor"
+  "github.com/blake-education/dogestry/remote"
+  "github.com/blake-education/dogestry/utils"
+  "encoding/json"
+
+  "archive/tar"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+func (cli *DogestryCli) push(remoteDef, image string) error {
+  remote, err := cli.newRemote(remoteDef)
+  if err != nil {
+    return err
+  }
+
+  fmt.Fprintln(cli.out, "remote", remote.Desc())
+
+  return cli.pushImage(remote, remoteDef, image)
+}
+
+func (cli *DogestryCli) pushImage(remote remote.Remote, remoteDef, image string) (err error) {
+  imageRoot, err := cli.WorkDir(image)
+  if err != nil {
+    return err
+  }
+
+  if cli.dryRun {
+    return cli.dryRunPush(image, imageRoot, remote)
+  }
+
+  started, before := time.Now(), remote.Stats()
+  defer func() { cli.finishRun("push", remoteDef, image, remote, before, started, err) }()
+
+  span := cli.startRunSpan("push", remoteDef, image)
+  defer func() { span.End(err) }()
+  cli.startProfile()
+
+  if err := cli.preHooks("push", remoteDef, image); err != nil {
+    return err
+  }
+
+  if err := cli.checkWorkDirSpace(cli.pushSpace(image)); err != nil {
+    return err
+  }
+
+  // before anything's written, and without holding the lock for as long as it takes
+  if err := cli.phase("scan", func() error { return cli.scanImage(image) }); err != nil {
+    return err
+  }
+
+  if err := checkRemoteFormat(remote, true); err != nil {
+    return err
+  }
+
+  lock, err := cli.lockForPush(remote, image)
+  if err != nil {
+    return err
+  }
+  defer cli.pushLocks.release(lock)
+
+  if cli.compressor, err = compressor.NewCompressor(cli.Config); err != nil {
+    return err
+  }
+
+  fmt.Fprintln(cli.out, "preparing image")
+  if err := cli.phase("export", func() error { return cli.prepareImage(image, imageRoot) }); err != nil {
+    return err
+  }
+
+  if err := cli.reshapeImage(image, imageRoot); err != nil {
+    return err
+  }
+
+  // before processImage compresses the layers
+  manifests := []registryManifest{}
+  if cli.Config.Dogestry.Registry {
+    if manifests, err = prepareRegistryView(imageRoot); err != nil {
+      return err
+    }
+  }
+
+  if err := cli.phase("compress", func() error { return cli.processImage(image, imageRoot, remote) }); err != nil {
+    return err
+  }
+
+  // before the tags, so there's never a tag on an image without its signature
+  if err := cli.signImage(remote, image, imageRoot); err != nil {
+    return err
+  }
+
+  fmt.Fprintln(cli.out, "pushing image to remote")
+  if err := cli.transferPhase("upload", func() error { return remote.Push(image, imageRoot) }); err != nil {
+    return err
+  }
+
+  return cli.phase("metadata", func() error {
+    return cli.pushMetadata(remote, image, imageRoot, manifests)
+  })
+}
+
+// Writes what's recorded about a pushed image, once it's on the remote:
+// config ids, the registry view, history, the audit log, platforms and targets.
+func (cli *DogestryCli) pushMetadata(remote remote.Remote, image, imageRoot string, manifests []registryManifest) error {
+  if err := putConfigIds(remote, imageRoot); err != nil {
+    return err
+  }
+
+  if err := cli.putRegistryManifests(remote, manifests); err != nil {
+    return err
+  }
+
+  id, err := pushedImageId(image, imageRoot)
+  if err != nil {
+    return err
+  }
+
+  for _, name := range cli.pushedNames(image) {
+    if err := recordHistory(remote, "push", name, id); err != nil {
+      return err
+    }
+  }
+
+  if err := cli.recordAudit(remote, "push", cli.pushedNames(image), id); err != nil {
+    return err
+  }
+
+  if err := recordPlatforms(remote, imageRoot, cli.pushedNames(image), id); err != nil {
+    return err
+  }
+
+  return cli.recordTargets(remote, imageRoot, cli.pushedNames(image), id)
+}
+
+// image, and image's repo with each of the -also-tag tags
+func (cli *DogestryCli) pushedNames(image string) []string {
+  repoName, _ := remote.NormaliseImageName(image)
+
+  names := []string{image}
+  for _, tag := range cli.alsoTags {
+    names = append(names, repoName+":"+tag)
+  }
+  return names
+}
+
+// Tags the prepared image with the -also-tag tags too, so they're pushed with it.
+func (cli *DogestryCli) addTags(image, imageRoot string) error {
+  if len(cli.alsoTags) == 0 {
+    return nil
+  }
+
+  repoName, repoTag := remote.NormaliseImageName(image)
+
+  id, err := ioutil.ReadFile(filepath.Join(imageRoot, "repositories", repoName, repoTag))
+  if os.IsNotExist(err) {
+    return fmt.Errorf("can't add tags to '%s', it isn't a repo:tag", image)
+  } else if err != nil {
+    return err
+  }
+
+  for _, tag := range cli.alsoTags {
+    if tag == "" || strings.ContainsAny(tag, "/:") {
+      return fmt.Errorf("invalid tag '%s'", tag)
+    }
+    dest := filepath.Join(imageRoot, "repositories", repoName, tag)
+    if err := ioutil.WriteFile(dest, id, 0600); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// the id image was tagged with in the prepared imageRoot
+func pushedImageId(image, imageRoot string) (remote.ID, error) {
+  repoName, repoTag := remote.NormaliseImageName(image)
+
+  id, err := ioutil.ReadFile(filepath.Join(imageRoot, "repositories", repoName, repoTag))
+  if os.IsNotExist(err) {
+    // pushed by id rather than repo:tag. Newer dockers' ids are the digest of the image's config
+    if id, err := configImageDir(imageRoot, image); err != nil || id != "" {
+      return id, err
+    }
+    return remote.ID(image), nil
+  } else if err != nil {
+    return "", err
+  }
+
+  return remote.ID(id), nil
+}
+
+// Stream the tarball from docker and translate it into the portable repo format
+// Note that its easier to handle as a stream on the way out.
+func (cli *DogestryCli) prepareImage(image, root string) error {
+  if cli.ociDir != "" {
+    return cli.prepareOciImage(image, root)
+  }
+
+  reader, writer := io.Pipe()
+  defer writer.Close()
+  defer reader.Close()
+
+  tarball := tar.NewReader(reader)
+
+  errch := make(chan error)
+
+  go func() {
+    // consume the tar
+    for {
+      header, err := tarball.Next()
+      if err == io.EOF {
+        // end of tar archive
+        break
+      }
+      if err != nil {
+        errch <- err
+        return
+      }
+
+      if err := cli.processTarEntry(root, header, tarball); err != nil {
+        errch <- err
+        return
+      }
+    }
+
+    // donno... read a bit more?
+    if _, err := ioutil.ReadAll(reader); err != nil {
+      errch <- err
+      return
+    }
+
+    errch <- nil
+  }()
+
+  if err := cli.export(image, writer); err != nil {
+    // this should stop the tar reader
+    writer.Close()
+    <-errch
+    return err
+  }
+
+  writer.Close()
+
+  // wait for the tar reader
+  if err := <-errch; err != nil {
+    return err
+  }
+
+  return applyManifest(root)
+}
+
+// exports image from docker to w, or copies exportOf
+func (cli *DogestryCli) export(image string, w io.Writer) error {
+  if cli.exportOf != nil {
+    _, err := io.Copy(w, cli.exportOf)
+    return err
+  }
+  return dockerError(cli.client.GetImageTarball(image, w))
+}
+
+// Applies -squash and -also-tag to the prepared image.
+func (cli *DogestryCli) reshapeImage(image, root string) error {
+  if cli.squash {
+    if err := cli.squashImage(image, root); err != nil {
+      return err
+    }
+  }
+
+  return cli.addTags(image, root)
+}
+
+// Turns the prepared image into what's stored on the remote: deltas against the
+// previous version of the image where they help, compressed layers, then blobs
+// named by their content.
+func (cli *DogestryCli) processImage(image, root string, r remote.Remote) error {
+  if err := recordDigests(root); err != nil {
+    return err
+  }
+
+  if err := checkDiffIds(root); err != nil {
+    return err
+  }
+
+  if cli.Config.Dogestry.Delta {
+    if err := cli.deltaLayers(image, root, r); err != nil {
+      return err
+    }
+  }
+
+  layers, err := filepath.Glob(filepath.Join(root, "images", "*", "layer.tar"))
+  if err != nil {
+    return err
+  }
+  layerCache := cache.New(cli.Config)
+  for _, layer := range layers {
+    if err := cli.compressLayer(layer, layerCache); err != nil {
+      return err
+    }
+  }
+
+  return remote.ContentAddress(root)
+}
+
+// Compresses layer, taking the compressed layer from the cache if the same
+// layer was compressed the same way before.
+func (cli *DogestryCli) compressLayer(layer string, layerCache *cache.Cache) error {
+  id, size := filepath.Base(filepath.Dir(layer)), diskSize(layer)
+  if cli.compressor.Algorithm == "" {
+    cli.profile.sizes(id, size, size)
+    return nil
+  }
+
+  digest, err := ioutil.ReadFile(filepath.Join(filepath.Dir(layer), LayerDigestFile))
+  if err != nil {
+    return err
+  }
+
+  ext := compressor.Extensions[cli.compressor.Algorithm]
+  key := fmt.Sprintf("layers/%s-%d/%s%s", cli.compressor.Algorithm, cli.compressor.Level, strings.TrimPrefix(string(digest), "sha256:"), ext)
+
+  if found, err := layerCache.Get(key, layer+ext); err != nil {
+    return err
+  } else if found {
+    if cli.Options.Verbose {
+      fmt.Fprintf(cli.out, "using cached compressed %s\n", layer)
+    }
+    cli.profile.sizes(id, size, diskSize(layer+ext))
+    return os.Remove(layer)
+  }
+
+  if err := cli.profile.compress(id, func() error { return cli.compressor.Compress(layer) }); err != nil {
+    return err
+  }
+  cli.profile.sizes(id, size, diskSize(layer+ext))
+  return layerCache.Put(key, layer+ext)
+}
+
+func (cli *DogestryCli) processTarEntry(root string, header *tar.Header, tarball io.Reader) error {
+  // only handle files (directories are implicit)
+  if header.Typeflag == tar.TypeReg {
+    if cli.Options.Verbose {
+      fmt.Fprintf(cli.out, "  tar: processing %s\n", header.Name)
+    }
+
+    barename := strings.TrimPrefix(header.Name, "./")
+
+    // special case - repositories file
+    if filepath.Base(header.Name) == "repositories" {
+      if err := writeRepositories(root, tarball); err != nil {
+        return err
+      }
+
+    } else if !strings.Contains(barename, "/") {
+      // manifest.json and image configs, from docker 1.10 on. applyManifest sorts these out
+      if err := writeFile(filepath.Join(root, barename), tarball); err != nil {
+        return err
+      }
+
+    } else {
+      dest := filepath.Join(root, "images", barename)
+      if err := os.MkdirAll(filepath.Dir(dest), os.ModeDir|0700); err != nil {
+        return err
+      }
+
+      destFile, err := os.Create(dest)
+      if err != nil {
+        return err
+      }
+      defer destFile.Close()
+
+      if wrote, err := io.Copy(destFile, tarball); err != nil {
+        return err
+      } else {
+        if cli.Options.Verbose {
+          fmt.Fprintf(cli.out, "  tar: wrote %s\n", utils.HumanSize(wrote))
+        }
+      }
+      destFile.Close()
+    }
+  }
+
+  // docker 1.10 on links a layer it's already saved in the tarball, rather than saving it twice
+  if header.Typeflag == tar.TypeSymlink {
+    dest := filepath.Join(root, "images", strings.TrimPrefix(header.Name, "./"))
+    target := filepath.Join(filepath.Dir(dest), header.Linkname)
+    if !strings.HasPrefix(target, filepath.Join(root, "images")+"/") {
+      return fmt.Errorf("%s links outside the image: %s", header.Name, header.Linkname)
+    }
+
+    if err := os.MkdirAll(filepath.Dir(dest), os.ModeDir|0700); err != nil {
+      return err
+    }
+    if err := os.Link(target, dest); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+type Repository map[string]string
+
+func writeRepositories(root string, tarball io.Reader) error {
+  destRoot := filepath.Join(root, "repositories")
+
+  repositories := map[string]Repository{}
+  if err := json.NewDecoder(tarball).Decode(&repositories); err != nil {
+    return err
+  }
+
+  for repoName, repo := range repositories {
+    for tag, id := range repo {
+      dest := filepath.Join(destRoot, repoName, tag)
+
+      if err := os.MkdirAll(filepath.Dir(dest), os.ModeDir|0700); err != nil {
+        return err
+      }
+
+      if err := ioutil.WriteFile(dest, []byte(id), 0600); err != nil {
+        return err
+      }
+    }
+  }
+
+  return nil
+}
+
+
@@ -0,0 +1,228 @@
+package engine
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/blake-education/dogestry/oci"
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+)
+
+// With `registry` in the [dogestry] section (or push -registry) the remote
+// also gets a registry v2 view of pushed images: a schema2 manifest for each
+// tag, under v2/<repo>/manifests/, with its config and gzipped layers in
+// blobs/sha256 beside dogestry's own blobs. A thin server mapping
+// /v2/<repo>/blobs/<digest> onto blobs/sha256/ serves it as a read-only registry.
+const RegistryDir = "v2"
+
+// the manifest for a tag of a pushed image
+type registryManifest struct {
+	Repo string
+	Tag  string
+	Data []byte
+}
+
+// Writes a config and gzipped layers for each tagged image in the prepared
+// root into its blobs, returning the manifest for each tag. Needs the
+// prepared image's layers as docker saved them, before processImage.
+func prepareRegistryView(root string) ([]registryManifest, error) {
+	blobsDir := filepath.Join(root, filepath.FromSlash(remote.BlobsDir))
+	if err := os.MkdirAll(blobsDir, 0700); err != nil {
+		return nil, err
+	}
+
+	manifests := make([]registryManifest, 0)
+	built := make(map[remote.ID][]byte)
+	layers := make(map[remote.ID]oci.Descriptor)
+
+	reposRoot := filepath.Join(root, "repositories")
+	err := filepath.Walk(reposRoot, func(tagPath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(reposRoot, tagPath)
+		if err != nil {
+			return err
+		}
+		repo, tag := path.Split(filepath.ToSlash(rel))
+
+		data, err := ioutil.ReadFile(tagPath)
+		if err != nil {
+			return err
+		}
+		id := remote.ID(strings.TrimSpace(string(data)))
+
+		manifest, ok := built[id]
+		if !ok {
+			if manifest, err = registryImage(root, id, blobsDir, layers); err != nil {
+				return err
+			}
+			built[id] = manifest
+		}
+
+		manifests = append(manifests, registryManifest{Repo: strings.TrimSuffix(repo, "/"), Tag: tag, Data: manifest})
+		return nil
+	})
+
+	return manifests, err
+}
+
+// Writes the config and layers of prepared image id into blobsDir, returning
+// its manifest. Layers already written for another image are in layers.
+func registryImage(root string, id remote.ID, blobsDir string, layers map[remote.ID]oci.Descriptor) ([]byte, error) {
+	// base first
+	ids := make([]remote.ID, 0)
+	for image := id; image != ""; {
+		ids = append([]remote.ID{image}, ids...)
+
+		metadata, err := readImageJson(filepath.Join(root, "images", string(image)))
+		if err != nil {
+			return nil, err
+		}
+		image = remote.ID(metadata.Parent)
+	}
+
+	// foreign layers, e.g. Windows base layers, are fetched from their urls
+	// by whoever pulls them, so they aren't written
+	sources, err := readLayerSources(filepath.Join(root, "images", string(id), remote.LayerSourcesFile))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     oci.MediaTypeDockerManifest,
+		Layers:        []oci.Descriptor{},
+	}
+	// images pushed from older dockers get a config made from their metadata
+	config := oci.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS:       oci.RootFS{Type: "layers", DiffIDs: []string{}},
+	}
+
+	for i, image := range ids {
+		dir := filepath.Join(root, "images", string(image))
+
+		metadata, err := readImageJson(dir)
+		if err != nil {
+			return nil, err
+		}
+		history := ociHistory(metadata)
+
+		layerPath := filepath.Join(dir, "layer.tar")
+		if _, err := os.Stat(layerPath); os.IsNotExist(err) {
+			history.EmptyLayer = true
+		} else {
+			hex, err := utils.Sha256File(layerPath)
+			if err != nil {
+				return nil, err
+			}
+			diffId := "sha256:" + hex
+
+			layer, ok := sources[diffId]
+			if !ok {
+				if layer, ok = layers[image]; !ok {
+					if layer, err = gzipBlob(layerPath, blobsDir); err != nil {
+						return nil, err
+					}
+					layers[image] = layer
+				}
+			}
+			manifest.Layers = append(manifest.Layers, layer)
+			config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffId)
+		}
+		config.History = append(config.History, history)
+
+		if i == len(ids)-1 {
+			setTopImage(&config, metadata)
+		}
+	}
+
+	// docker's own config, where it saved one, keeps the image's id
+	configData, err := ioutil.ReadFile(filepath.Join(root, "images", string(id), remote.ImageConfigFile))
+	if os.IsNotExist(err) {
+		if configData, err = json.Marshal(config); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	manifest.Config = oci.Descriptor{
+		MediaType: oci.MediaTypeDockerConfig,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(configData)),
+		Size:      int64(len(configData)),
+	}
+	configPath := filepath.Join(blobsDir, strings.TrimPrefix(manifest.Config.Digest, "sha256:"))
+	if err := ioutil.WriteFile(configPath, configData, 0600); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(manifest)
+}
+
+// Writes a gzipped copy of the layer at src into blobsDir, returning its descriptor.
+func gzipBlob(src, blobsDir string) (oci.Descriptor, error) {
+	desc := oci.Descriptor{MediaType: oci.MediaTypeDockerLayerGz}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return desc, err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(blobsDir, "gzip")
+	if err != nil {
+		return desc, err
+	}
+	defer os.Remove(out.Name())
+
+	hash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(out, hash)}
+	zipped := gzip.NewWriter(counter)
+	_, err = io.Copy(zipped, in)
+	if err == nil {
+		err = zipped.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return desc, err
+	}
+
+	desc.Digest = fmt.Sprintf("sha256:%x", hash.Sum(nil))
+	desc.Size = counter.n
+	return desc, os.Rename(out.Name(), filepath.Join(blobsDir, strings.TrimPrefix(desc.Digest, "sha256:")))
+}
+
+// Writes each manifest to the remote, by digest and then by tag, so a tag's
+// manifest is only there once everything it refers to is.
+func (cli *DogestryCli) putRegistryManifests(r remote.Remote, manifests []registryManifest) error {
+	for _, manifest := range manifests {
+		dir := path.Join(RegistryDir, manifest.Repo, "manifests")
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest.Data))
+
+		fmt.Fprintf(cli.out, "writing registry manifest for '%s:%s'\n", manifest.Repo, manifest.Tag)
+		if err := r.Put(path.Join(dir, digest), manifest.Data); err != nil {
+			return err
+		}
+		if err := r.Put(path.Join(dir, manifest.Tag), manifest.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
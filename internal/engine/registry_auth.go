@@ -0,0 +1,166 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	dockerclient "github.com/blake-education/dogestry/client"
+	"github.com/blake-education/dogestry/remote"
+)
+
+// how docker's config.json knows docker hub
+const DockerHubServer = "https://index.docker.io/v1/"
+
+// The parts of docker's config.json which say how to log in to registries
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+
+	// the credential helper for every registry, and for particular ones,
+	// e.g. osxkeychain or ecr-login, run as docker-credential-<helper>
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+
+	// the context `docker context use` chose
+	CurrentContext string `json:"currentContext"`
+}
+
+// The registry host in repoName, e.g. quay.io in quay.io/myorg/app. Like
+// docker, the first part is only a host if it looks like one. Empty for
+// docker hub.
+func registryHost(repoName string) string {
+	i := strings.Index(repoName, "/")
+	if i == -1 {
+		return ""
+	}
+	if domain := repoName[:i]; strings.ContainsAny(domain, ".:") || domain == "localhost" {
+		return domain
+	}
+	return ""
+}
+
+// The credentials for image's registry, as `docker login` stored them in
+// ~/.docker/config.json (or $DOCKER_CONFIG/config.json): from the registry's
+// credential helper, or credsStore, or the file itself. No credentials if
+// the user hasn't logged in, for public images.
+func registryAuth(image string) (dockerclient.AuthConfiguration, error) {
+	auth := dockerclient.AuthConfiguration{}
+
+	repoName, _ := remote.NormaliseImageName(image)
+	server := registryHost(repoName)
+	if server == "" {
+		server = DockerHubServer
+	}
+
+	path := filepath.Join(dockerConfigDir(), "config.json")
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return auth, nil
+	} else if err != nil {
+		return auth, err
+	}
+
+	cfg := dockerConfigFile{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return auth, fmt.Errorf("invalid docker config %s: %w", path, err)
+	}
+
+	helper := cfg.CredHelpers[authHostname(server)]
+	if helper == "" {
+		helper = cfg.CredsStore
+	}
+	if helper != "" {
+		return credentialHelperAuth(helper, server)
+	}
+
+	for key, entry := range cfg.Auths {
+		if authHostname(key) != authHostname(server) {
+			continue
+		}
+
+		auth.ServerAddress = server
+		auth.IdentityToken = entry.IdentityToken
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return auth, fmt.Errorf("invalid auth for %s in %s: %w", key, path, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return auth, fmt.Errorf("invalid auth for %s in %s: expected user:password", key, path)
+			}
+			auth.Username, auth.Password = parts[0], parts[1]
+		}
+		return auth, nil
+	}
+
+	return auth, nil
+}
+
+// Asks docker-credential-<helper> for server's credentials. None if the
+// helper doesn't have any.
+func credentialHelperAuth(helper, server string) (dockerclient.AuthConfiguration, error) {
+	auth := dockerclient.AuthConfiguration{}
+
+	name := "docker-credential-" + helper
+	bin, err := exec.LookPath(name)
+	if err != nil {
+		return auth, fmt.Errorf("can't find executable %s on the $PATH, which docker's config uses for %s", name, server)
+	}
+
+	cmd := exec.Command(bin, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		// helpers say so on stdout when they've nothing for the server
+		if strings.Contains(string(out), "credentials not found") {
+			return auth, nil
+		}
+		return auth, fmt.Errorf("getting credentials for %s from %s: %s\noutput: %s%s", server, name, err, out, stderr.Bytes())
+	}
+
+	creds := struct {
+		Username string
+		Secret   string
+	}{}
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return auth, fmt.Errorf("invalid credentials for %s from %s: %w", server, name, err)
+	}
+
+	auth.ServerAddress = server
+	// helpers store identity tokens under this username
+	if creds.Username == "<token>" {
+		auth.IdentityToken = creds.Secret
+	} else {
+		auth.Username, auth.Password = creds.Username, creds.Secret
+	}
+	return auth, nil
+}
+
+// the host of a server in docker's config, which can be a url or a bare host
+func authHostname(server string) string {
+	host := server
+	if i := strings.Index(host, "://"); i != -1 {
+		host = host[i+3:]
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+
+	// docker hub goes by several names
+	if host == "docker.io" || host == "registry-1.docker.io" {
+		return "index.docker.io"
+	}
+	return host
+}
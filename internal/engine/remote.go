@@ -1,7 +1,6 @@
-package cli
+package engine
 
 import (
-	"github.com/blake-education/dogestry/remote"
 	"fmt"
 )
 
@@ -11,17 +10,20 @@ func (cli *DogestryCli) CmdRemote(args ...string) error {
 		return nil
 	}
 
-	if len(cmd.Args()) < 1 {
-		return fmt.Errorf("Error: REMOTE not specified")
+	remoteDef, _ := cli.RemoteArgs(cmd)
+	if remoteDef == "" {
+		return MissingArgs("remote", "REMOTE")
 	}
 
-	remoteDef := cmd.Arg(0)
-
-	r, err := remote.NewRemote(remoteDef, cli.Config)
+	r, err := cli.newRemote(remoteDef)
 	if err != nil {
 		return err
 	}
 
+	if cli.Options.Json {
+		return printJson(map[string]string{"remote": remoteDef, "desc": r.Desc()})
+	}
+
 	fmt.Println("remote: ", r.Desc())
 
 	return nil
@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// vulnerability severities, least severe first
+var severities = []string{"unknown", "negligible", "low", "medium", "high", "critical"}
+
+const DefaultScanSeverity = "high"
+
+// A vulnerability the scanner found
+type scanFinding struct {
+	ID       string
+	Package  string
+	Version  string
+	Severity string
+}
+
+// most severe first
+type findingsBySeverity []scanFinding
+
+func (f findingsBySeverity) Len() int      { return len(f) }
+func (f findingsBySeverity) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f findingsBySeverity) Less(i, j int) bool {
+	return severityRank(f[i].Severity) > severityRank(f[j].Severity)
+}
+
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if strings.EqualFold(s, severity) {
+			return i
+		}
+	}
+	return 0
+}
+
+// Scans image with the [scan] section's scanner before it's pushed, and
+// refuses it if anything found is at least as severe as `severity`.
+func (cli *DogestryCli) scanImage(image string) error {
+	scanConfig := cli.Config.Scan
+	if scanConfig.Scanner == "" {
+		return nil
+	}
+	if cli.skipScan {
+		fmt.Fprintf(cli.err, "Warning: -skip-scan, so '%s' isn't scanned for vulnerabilities\n", image)
+		return nil
+	}
+
+	if cli.exportOf != nil {
+		return fmt.Errorf("'%s' is pushed from a tarball, which the [scan] section's scanner can't scan. Push it from docker instead", image)
+	}
+
+	threshold := scanConfig.Severity
+	if threshold == "" {
+		threshold = DefaultScanSeverity
+	}
+	if severityRank(threshold) == 0 {
+		return fmt.Errorf("invalid severity '%s' in the [scan] section, use low, medium, high or critical", threshold)
+	}
+
+	command := scanConfig.Command
+	if command == "" {
+		command = scanConfig.Scanner
+	}
+
+	var args []string
+	var parse func([]byte) ([]scanFinding, error)
+	switch scanConfig.Scanner {
+	case "trivy":
+		args = []string{"image", "--quiet", "--format", "json"}
+		if scanConfig.Server != "" {
+			args = append(args, "--server", scanConfig.Server)
+		}
+		if scanConfig.Ignore_Unfixed {
+			args = append(args, "--ignore-unfixed")
+		}
+		if cli.ociDir != "" {
+			args = append(args, "--input", cli.ociDir)
+		} else {
+			args = append(args, image)
+		}
+		parse = parseTrivyFindings
+	case "grype":
+		if scanConfig.Server != "" {
+			return fmt.Errorf("grype has no server, so `server` in the [scan] section is only for trivy")
+		}
+		source := "docker:" + image
+		if cli.ociDir != "" {
+			source = "oci-dir:" + cli.ociDir
+		}
+		args = []string{source, "--quiet", "--output", "json"}
+		if scanConfig.Ignore_Unfixed {
+			args = append(args, "--only-fixed")
+		}
+		parse = parseGrypeFindings
+	default:
+		return fmt.Errorf("invalid scanner '%s' in the [scan] section, use trivy or grype", scanConfig.Scanner)
+	}
+
+	fmt.Fprintf(cli.out, "scanning '%s' with %s\n", image, scanConfig.Scanner)
+	cmd := exec.Command(command, args...)
+	out, err := cmd.Output()
+	if err != nil {
+		stderr := ""
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr = string(exitErr.Stderr)
+		}
+		return fmt.Errorf("%s: %w\noutput: %s", command, err, stderr)
+	}
+
+	findings, err := parse(out)
+	if err != nil {
+		return fmt.Errorf("reading %s's findings: %w", scanConfig.Scanner, err)
+	}
+
+	failing := []scanFinding{}
+	for _, finding := range findings {
+		if severityRank(finding.Severity) >= severityRank(threshold) {
+			failing = append(failing, finding)
+		}
+	}
+	if len(failing) == 0 {
+		fmt.Fprintf(cli.out, "no %s or worse vulnerabilities in '%s' (%d less severe)\n", strings.ToLower(threshold), image, len(findings))
+		return nil
+	}
+
+	sort.Stable(findingsBySeverity(failing))
+	for _, finding := range failing {
+		fmt.Fprintf(cli.err, "  %-8s  %-20s  %s %s\n", strings.ToLower(finding.Severity), finding.ID, finding.Package, finding.Version)
+	}
+	return fmt.Errorf("'%s' has %d %s or worse vulnerabilities, so it isn't pushed. Push with -skip-scan in an emergency", image, len(failing), strings.ToLower(threshold))
+}
+
+func parseTrivyFindings(data []byte) ([]scanFinding, error) {
+	report := struct {
+		Results []struct {
+			Vulnerabilities []struct {
+				VulnerabilityID  string
+				PkgName          string
+				InstalledVersion string
+				Severity         string
+			}
+		}
+	}{}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+
+	findings := []scanFinding{}
+	for _, result := range report.Results {
+		for _, vuln := range result.Vulnerabilities {
+			findings = append(findings, scanFinding{ID: vuln.VulnerabilityID, Package: vuln.PkgName, Version: vuln.InstalledVersion, Severity: vuln.Severity})
+		}
+	}
+	return findings, nil
+}
+
+func parseGrypeFindings(data []byte) ([]scanFinding, error) {
+	report := struct {
+		Matches []struct {
+			Vulnerability struct {
+				ID       string `json:"id"`
+				Severity string `json:"severity"`
+			} `json:"vulnerability"`
+			Artifact struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"artifact"`
+		} `json:"matches"`
+	}{}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+
+	findings := []scanFinding{}
+	for _, match := range report.Matches {
+		findings = append(findings, scanFinding{ID: match.Vulnerability.ID, Package: match.Artifact.Name, Version: match.Artifact.Version, Severity: match.Vulnerability.Severity})
+	}
+	return findings, nil
+}
@@ -0,0 +1,193 @@
+package engine
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func (cli *DogestryCli) CmdSearch(args ...string) error {
+	cmd := cli.Subcmd("search", "REMOTE PATTERN", "list repo:tags on the REMOTE matching PATTERN, a glob matched against the repo or repo:tag")
+	useRegexp := cmd.Bool("regexp", false, "PATTERN is a regular expression rather than a glob")
+	digests := cmd.Bool("digests", false, "also show the digest of each image's config, which newer dockers call its id")
+	applyTimeouts := cli.TimeoutFlags(cmd)
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	remoteDef, rest := cli.RemoteArgs(cmd)
+	if remoteDef == "" || len(rest) < 1 {
+		return MissingArgs("search", "REMOTE and PATTERN")
+	}
+
+	pattern := rest[0]
+	applyTimeouts()
+
+	match, err := tagMatcher(pattern, *useRegexp)
+	if err != nil {
+		return err
+	}
+
+	return cli.withTimeout("search", func() error {
+		return cli.search(remoteDef, pattern, match, *digests)
+	})
+}
+
+func (cli *DogestryCli) search(remoteDef, pattern string, match func(string) bool, digests bool) error {
+	r, err := cli.newRemote(remoteDef)
+	if err != nil {
+		return err
+	}
+
+	tags, err := remote.ListTags(r)
+	if err != nil {
+		return err
+	}
+
+	matches := make([]remote.Tag, 0)
+	for _, tag := range tags {
+		if match(tag.Repo) || match(tag.Repo+":"+tag.Tag) {
+			matches = append(matches, tag)
+		}
+	}
+
+	if len(matches) == 0 && !cli.Options.Json {
+		fmt.Printf("nothing matches '%s'\n", pattern)
+		return nil
+	}
+
+	sort.Sort(tagsByName(matches))
+
+	sizes := make(map[remote.ID]int64)
+	pushedAt := make(map[string]time.Time)
+	historyRead := make(map[string]bool)
+	results := make([]searchResult, 0, len(matches))
+
+	for _, tag := range matches {
+		size, err := imageTotalSize(r, tag.ID, sizes)
+		if err != nil {
+			return err
+		}
+
+		if !historyRead[tag.Repo] {
+			historyRead[tag.Repo] = true
+			if err := readPushTimes(r, tag.Repo, pushedAt); err != nil {
+				return err
+			}
+		}
+
+		result := searchResult{Tag: tag, Size: size}
+		if t, ok := pushedAt[tag.Repo+":"+tag.Tag]; ok {
+			result.Pushed = &t
+		}
+		if digests {
+			if result.Digest, err = configDigest(r, tag.ID); err != nil {
+				return err
+			}
+		}
+		results = append(results, result)
+	}
+
+	if cli.Options.Json {
+		return printJson(results)
+	}
+
+	for _, result := range results {
+		pushed := "-"
+		if result.Pushed != nil {
+			pushed = result.Pushed.Format("2006-01-02 15:04:05 UTC")
+		}
+
+		if digests {
+			digest := result.Digest
+			if digest == "" {
+				digest = "-"
+			}
+			fmt.Printf("%-40s  %s  %-71s  %10s  %s\n", result.Repo+":"+result.Tag.Tag, result.ID.Short(), digest, utils.HumanSize(result.Size), pushed)
+			continue
+		}
+		fmt.Printf("%-40s  %s  %10s  %s\n", result.Repo+":"+result.Tag.Tag, result.ID.Short(), utils.HumanSize(result.Size), pushed)
+	}
+
+	return nil
+}
+
+type searchResult struct {
+	remote.Tag
+	Size   int64
+	Pushed *time.Time `json:",omitempty"`
+	// with -digests
+	Digest string `json:",omitempty"`
+}
+
+func tagMatcher(pattern string, useRegexp bool) (func(string) bool, error) {
+	if useRegexp {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %w", pattern, err)
+		}
+		return re.MatchString, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s': %w", pattern, err)
+	}
+	return func(name string) bool {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	}, nil
+}
+
+// the size of the image and all its ancestors, memoised in sizes
+func imageTotalSize(r remote.Remote, id remote.ID, sizes map[remote.ID]int64) (int64, error) {
+	if size, ok := sizes[id]; ok {
+		return size, nil
+	}
+
+	var total int64
+	err := r.WalkImages(id, func(id remote.ID, image docker.Image, err error) error {
+		if err != nil {
+			return err
+		}
+		total += image.Size
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	sizes[id] = total
+	return total, nil
+}
+
+// the time of the latest push of each repo:tag in the repo's history
+func readPushTimes(r remote.Remote, repo string, pushedAt map[string]time.Time) error {
+	history, err := remote.History(r, repo)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range history {
+		if entry.Action == "push" {
+			pushedAt[entry.Repo+":"+entry.Tag] = entry.Time
+		}
+	}
+	return nil
+}
+
+type tagsByName []remote.Tag
+
+func (t tagsByName) Len() int      { return len(t) }
+func (t tagsByName) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t tagsByName) Less(i, j int) bool {
+	if t[i].Repo != t[j].Repo {
+		return t[i].Repo < t[j].Repo
+	}
+	return t[i].Tag < t[j].Tag
+}
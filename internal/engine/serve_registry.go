@@ -0,0 +1,183 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blake-education/dogestry/oci"
+	"github.com/blake-education/dogestry/remote"
+)
+
+func (cli *DogestryCli) CmdServeRegistry(args ...string) error {
+	cmd := cli.Subcmd("serve-registry", "REMOTE", "serve the registry view of the REMOTE (see push -registry) as a read-only docker registry, so `docker pull` works straight from it")
+	listen := cmd.String("listen", ":5000", "address to listen on")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	remoteDef, _ := cli.RemoteArgs(cmd)
+	if remoteDef == "" {
+		return MissingArgs("serve-registry", "REMOTE")
+	}
+
+	r, err := cli.newRemote(remoteDef)
+	if err != nil {
+		return err
+	}
+
+	http.HandleFunc("/v2/", func(w http.ResponseWriter, req *http.Request) {
+		serveRegistry(r, w, req)
+	})
+
+	fmt.Println("serving", r.Desc(), "as a registry on", *listen)
+	return http.ListenAndServe(*listen, nil)
+}
+
+// GET /v2/
+// GET /v2/NAME/manifests/REFERENCE
+// GET /v2/NAME/blobs/DIGEST
+// GET /v2/NAME/tags/list
+//
+// HEAD works too, for all but /tags/list.
+func serveRegistry(r remote.Remote, w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	if req.Method != "GET" && req.Method != "HEAD" {
+		registryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the registry is read-only")
+		return
+	}
+
+	rest := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if rest == "" {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, "{}")
+		return
+	}
+
+	if name := strings.TrimSuffix(rest, "/tags/list"); name != rest && validRepoName(name) {
+		serveRegistryTags(r, name, w)
+		return
+	}
+
+	if i := strings.LastIndex(rest, "/manifests/"); i != -1 && validRepoName(rest[:i]) {
+		serveRegistryManifest(r, rest[:i], rest[i+len("/manifests/"):], w, req)
+		return
+	}
+
+	if i := strings.LastIndex(rest, "/blobs/"); i != -1 && validRepoName(rest[:i]) {
+		serveRegistryBlob(r, rest[i+len("/blobs/"):], w, req)
+		return
+	}
+
+	registryError(w, http.StatusNotFound, "NAME_UNKNOWN", "no such repository")
+}
+
+func validRepoName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func serveRegistryManifest(r remote.Remote, name, reference string, w http.ResponseWriter, req *http.Request) {
+	if reference == "" || strings.ContainsAny(reference, "/") || reference == "." || reference == ".." {
+		registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "no such manifest")
+		return
+	}
+
+	data, err := r.Get(path.Join(RegistryDir, name, "manifests", reference))
+	if err == remote.ErrNoSuchKey {
+		registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", fmt.Sprintf("no manifest for %s:%s. Push it with -registry", name, reference))
+		return
+	} else if err != nil {
+		log.Println("serving manifest", name, reference, err)
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", "couldn't read manifest")
+		return
+	}
+
+	manifest := oci.Manifest{}
+	if err := json.Unmarshal(data, &manifest); err != nil || manifest.MediaType == "" {
+		manifest.MediaType = oci.MediaTypeDockerManifest
+	}
+
+	w.Header().Set("Content-Type", manifest.MediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256(data)))
+	if req.Method == "GET" {
+		w.Write(data)
+	}
+}
+
+func serveRegistryBlob(r remote.Remote, digest string, w http.ResponseWriter, req *http.Request) {
+	key, err := remote.BlobKey(digest)
+	if err != nil {
+		registryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+
+	blob, size, err := r.Open(key)
+	if err == remote.ErrNoSuchKey {
+		registryError(w, http.StatusNotFound, "BLOB_UNKNOWN", fmt.Sprintf("no blob %s", digest))
+		return
+	} else if err != nil {
+		log.Println("serving blob", digest, err)
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", "couldn't read blob")
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Docker-Content-Digest", digest)
+	if req.Method == "GET" {
+		if _, err := io.Copy(w, blob); err != nil {
+			log.Println("serving blob", digest, err)
+		}
+	}
+}
+
+func serveRegistryTags(r remote.Remote, name string, w http.ResponseWriter) {
+	tags, err := remote.ListTags(r)
+	if err != nil {
+		log.Println("listing tags", name, err)
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", "couldn't list tags")
+		return
+	}
+
+	names := make([]string, 0)
+	for _, tag := range tags {
+		if tag.Repo == name {
+			names = append(names, tag.Tag)
+		}
+	}
+	if len(names) == 0 {
+		registryError(w, http.StatusNotFound, "NAME_UNKNOWN", fmt.Sprintf("no repository %s", name))
+		return
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "tags": names})
+}
+
+// responds with an error in the form registry clients understand
+func registryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
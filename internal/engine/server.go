@@ -0,0 +1,401 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+)
+
+type server struct {
+	cli  *DogestryCli
+	jobs *jobs
+
+	// nil if requests needn't bear tokens
+	tokens []serverToken
+}
+
+func (cli *DogestryCli) CmdServer(args ...string) error {
+	serverConfig := cli.Config.Server
+	cmd := cli.Subcmd("server", "", "run an http api for triggering pushes and pulls and listing remotes")
+	listen := cmd.String("listen", "127.0.0.1:4244", "address to listen on")
+	tlsCert := cmd.String("tls-cert", serverConfig.Tls_Cert, "serve https with this PEM certificate (default tls-cert in the [server] section)")
+	tlsKey := cmd.String("tls-key", serverConfig.Tls_Key, "and this PEM private key (default tls-key in the [server] section)")
+	clientCa := cmd.String("client-ca", serverConfig.Client_Ca, "only accept clients with certificates signed by the CAs in this PEM file (default client-ca in the [server] section)")
+	tokensFile := cmd.String("tokens", serverConfig.Tokens_File, "only accept requests bearing tokens in this file, each allowed to push or pull some repos (default tokens-file in the [server] section)")
+	maxJobs := cmd.Int("max-jobs", serverMaxJobs(serverConfig.Max_Jobs), "how many pushes and pulls to run at once, queueing the rest (default max-jobs in the [server] section)")
+	keepJobs := cmd.Int("keep-jobs", serverKeepJobs(serverConfig.Keep_Jobs), "how many finished jobs to keep, to list and look up (default keep-jobs in the [server] section)")
+	keepJobsFor := cmd.Duration("keep-jobs-for", DefaultKeepJobsFor, "how long to keep finished jobs (default keep-jobs-for in the [server] section)")
+	if serverConfig.Keep_Jobs_For != "" {
+		configured, err := config.ParseDuration(serverConfig.Keep_Jobs_For)
+		if err != nil {
+			return fmt.Errorf("invalid keep-jobs-for in the [server] section: %w", err)
+		}
+		*keepJobsFor = configured
+	}
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	if *maxJobs < 1 {
+		return fmt.Errorf("-max-jobs must be at least 1")
+	}
+	if *keepJobs < 0 || *keepJobsFor < 0 {
+		return fmt.Errorf("-keep-jobs and -keep-jobs-for can't be negative")
+	}
+
+	s := &server{
+		cli:  cli,
+		jobs: newJobs(*maxJobs, *keepJobs, *keepJobsFor),
+	}
+
+	if *tokensFile != "" {
+		tokens, err := readServerTokens(*tokensFile)
+		if err != nil {
+			return err
+		}
+		s.tokens = tokens
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return fmt.Errorf("-tls-cert and -tls-key go together")
+	}
+	if *clientCa != "" && *tlsCert == "" {
+		return fmt.Errorf("-client-ca needs -tls-cert and -tls-key")
+	}
+	if *tlsCert == "" && s.tokens == nil && !isLoopback(*listen) {
+		fmt.Fprintf(cli.err, "Warning: anyone who can reach %s can push and pull with this host's credentials. Set -tokens, or -client-ca\n", *listen)
+	}
+
+	server := &http.Server{Addr: *listen, Handler: s.handler()}
+
+	fmt.Println("listening on", *listen)
+	if *tlsCert == "" {
+		// gRPC needs http/2, which without TLS clients only speak if they know to
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+		return server.ListenAndServe()
+	}
+
+	tlsConfig, err := serverTLSConfig(*clientCa)
+	if err != nil {
+		return err
+	}
+	server.TLSConfig = tlsConfig
+	return server.ListenAndServeTLS(*tlsCert, *tlsKey)
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/push", s.authorize(s.handleJob("push"), jobAllowed("push")))
+	mux.HandleFunc("/pull", s.authorize(s.handleJob("pull"), jobAllowed("pull")))
+	mux.HandleFunc("/jobs", s.authorize(s.handleJobs, nil))
+	mux.HandleFunc("/jobs/", s.authorize(s.handleJobStatus, s.jobAllowed))
+	mux.HandleFunc("/tags", s.authorize(s.handleTags, tagsAllowed))
+	mux.HandleFunc("/metrics", s.authorize(runMetrics.handle, nil))
+	mux.HandleFunc(grpcService, s.handleGrpc)
+	return mux
+}
+
+// POST /push?remote=REMOTE&image=IMAGE
+// POST /pull?remote=REMOTE&image=IMAGE
+//
+// queues a job and responds with it, without waiting for it to run
+func (s *server) handleJob(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		remoteDef := r.FormValue("remote")
+		image := r.FormValue("image")
+		if remoteDef == "" || image == "" {
+			http.Error(w, "remote and image are required", http.StatusBadRequest)
+			return
+		}
+		if err := s.checkRemote(remoteDef); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJson(w, http.StatusAccepted, s.enqueue(kind, remoteDef, image))
+	}
+}
+
+// A page of jobs, and the id to list the next page after, if there is one
+type jobPage struct {
+	Jobs []Job `json:"jobs"`
+	Next int   `json:"next,omitempty"`
+}
+
+// GET /jobs?after=ID&limit=N
+//
+// the jobs the request's token could have started, oldest first, a page at a time
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	after, limit, err := jobsPage(r.FormValue("after"), r.FormValue("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var page jobPage
+	page.Jobs, page.Next = s.jobs.list(after, limit, func(job Job) bool {
+		return s.canSee(r, job)
+	})
+	writeJson(w, http.StatusOK, page)
+}
+
+// how many jobs a page has, unless a smaller limit's asked for
+const maxJobsPage = 100
+
+// the id to list jobs after, and how many to list
+func jobsPage(after, limit string) (int, int, error) {
+	afterId, pageSize := 0, maxJobsPage
+	if after != "" {
+		id, err := strconv.Atoi(after)
+		if err != nil || id < 0 {
+			return 0, 0, fmt.Errorf("invalid after '%s'", after)
+		}
+		afterId = id
+	}
+	if limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("invalid limit '%s'", limit)
+		}
+		if n < pageSize {
+			pageSize = n
+		}
+	}
+	return afterId, pageSize, nil
+}
+
+// GET /jobs/ID
+// GET /jobs/ID/events
+// POST /jobs/ID/cancel
+func (s *server) handleJobStatus(w http.ResponseWriter, r *http.Request) {
+	id, action, ok := jobPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch action {
+	case "":
+		job, ok := s.jobs.get(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJson(w, http.StatusOK, job)
+
+	case "events":
+		s.streamJob(w, r, id)
+
+	case "cancel":
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		job, err := s.jobs.cancel(id)
+		if err == errNoSuchJob {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJson(w, http.StatusAccepted, job)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// /jobs/ID, or /jobs/ID/ACTION
+func jobPath(path string) (int, string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/jobs/"), "/", 2)
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", false
+	}
+	if len(parts) == 1 {
+		return id, "", true
+	}
+	return id, parts[1], true
+}
+
+// whether a token may see, follow or cancel the job: only if it may start one like it
+func (s *server) jobAllowed(token serverToken, r *http.Request) bool {
+	id, _, ok := jobPath(r.URL.Path)
+	if !ok {
+		return true
+	}
+	job, ok := s.jobs.get(id)
+	return !ok || token.allows(job.Kind, job.Remote, job.Image)
+}
+
+// Streams the job's events so far, then its progress until it's finished, as
+// a line of json for each.
+func (s *server) streamJob(w http.ResponseWriter, r *http.Request, id int) {
+	job, events, updates, ok := s.jobs.watch(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if updates != nil {
+		defer s.jobs.unwatch(id, updates)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	write := func(progress jobProgress) bool {
+		if progress.Event != nil {
+			event := *progress.Event
+			event.Error = utils.Redact(event.Error)
+			progress.Event = &event
+		}
+		if err := encoder.Encode(progress); err != nil {
+			return false
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return true
+	}
+
+	for i := range events {
+		if !write(jobProgress{Job: job, Event: &events[i]}) {
+			return
+		}
+	}
+	if updates == nil {
+		write(jobProgress{Job: job})
+		return
+	}
+
+	for {
+		select {
+		case update, open := <-updates:
+			if !open {
+				return
+			}
+			if !write(update) {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// GET /tags?remote=REMOTE
+func (s *server) handleTags(w http.ResponseWriter, r *http.Request) {
+	remoteDef := r.FormValue("remote")
+	if remoteDef == "" {
+		http.Error(w, "remote is required", http.StatusBadRequest)
+		return
+	}
+	if err := s.checkRemote(remoteDef); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tags, err := s.tags(remoteDef)
+	if err != nil {
+		http.Error(w, utils.Redact(err.Error()), http.StatusBadGateway)
+		return
+	}
+
+	if s.tokens != nil {
+		token, _ := s.bearer(r)
+		tags = token.pullableTags(remoteDef, tags)
+	}
+
+	writeJson(w, http.StatusOK, tags)
+}
+
+func (s *server) tags(remoteDef string) ([]remote.Tag, error) {
+	r, err := remote.NewRemote(remoteDef, s.cli.Config)
+	if err != nil {
+		return nil, err
+	}
+	return remote.ListTags(r)
+}
+
+// Queues a job, starting it now if there's a free slot.
+func (s *server) enqueue(kind, remoteDef, image string) Job {
+	job := s.jobs.add(kind, remoteDef, image)
+	s.dispatch()
+	if started, ok := s.jobs.get(job.ID); ok {
+		job = started
+	}
+	return job
+}
+
+// Starts the queued jobs there are free slots for.
+func (s *server) dispatch() {
+	for _, job := range s.jobs.next() {
+		go s.run(job)
+	}
+}
+
+// run a job with its own cli, so each job gets its own work dir, then start
+// the next in the queue
+func (s *server) run(job Job) {
+	err := func() error {
+		jobCli, err := s.cli.job()
+		if err != nil {
+			return err
+		}
+		defer jobCli.Cleanup()
+		jobCli.control = s.jobs.control(job.ID)
+
+		switch job.Kind {
+		case "push":
+			return jobCli.push(job.Remote, job.Image)
+		case "pull":
+			return jobCli.pull(job.Remote, job.Image)
+		}
+		return fmt.Errorf("unknown job kind '%s'", job.Kind)
+	}()
+
+	if current, _ := s.jobs.get(job.ID); err != nil && current.Status != JobCanceling {
+		runMetrics.remoteError(job.Kind, job.Remote)
+		log.Printf("job %d: %s %s %s failed: %s\n", job.ID, job.Kind, job.Remote, job.Image, err)
+	}
+	s.jobs.finish(job.ID, err)
+	s.dispatch()
+}
+
+func serverMaxJobs(configured int) int {
+	if configured > 0 {
+		return configured
+	}
+	return DefaultMaxJobs
+}
+
+func serverKeepJobs(configured int) int {
+	if configured > 0 {
+		return configured
+	}
+	return DefaultKeepJobs
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("writing response:", err)
+	}
+}
@@ -0,0 +1,244 @@
+package engine
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+)
+
+// A bearer token the server accepts, and what it may do
+type serverToken struct {
+	hash   [sha256.Size]byte
+	scopes []tokenScope
+}
+
+// push or pull, to or from remotes matching remote and of repos matching repo,
+// or any remote or repo if they're empty
+type tokenScope struct {
+	kind   string
+	remote string
+	repo   string
+}
+
+// Reads tokens from tokensFile, a line for each: the token, or sha256:<hex> of it,
+// then its scopes, KIND[@REMOTE][:REPO], e.g. `pull`, `push:teamA/*`, or
+// `push@staging:teamA/*`. Blank lines and lines starting with # are ignored.
+func readServerTokens(tokensFile string) ([]serverToken, error) {
+	file, err := os.Open(tokensFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tokens := []serverToken{}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(strings.Replace(line, ",", " ", -1))
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s line %d: no scopes for the token", tokensFile, n)
+		}
+
+		token := serverToken{}
+		if strings.HasPrefix(fields[0], "sha256:") {
+			hash, err := hex.DecodeString(strings.TrimPrefix(fields[0], "sha256:"))
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("%s line %d: invalid token hash", tokensFile, n)
+			}
+			copy(token.hash[:], hash)
+		} else {
+			token.hash = sha256.Sum256([]byte(fields[0]))
+			utils.AddSecret(fields[0])
+		}
+
+		for _, field := range fields[1:] {
+			scope := tokenScope{kind: field}
+			if i := strings.Index(field, ":"); i != -1 {
+				scope.kind, scope.repo = field[:i], field[i+1:]
+				if _, err := path.Match(scope.repo, ""); err != nil {
+					return nil, fmt.Errorf("%s line %d: invalid repo pattern '%s': %w", tokensFile, n, scope.repo, err)
+				}
+			}
+			if i := strings.Index(scope.kind, "@"); i != -1 {
+				scope.kind, scope.remote = scope.kind[:i], scope.kind[i+1:]
+				if _, err := path.Match(scope.remote, ""); err != nil || scope.remote == "" {
+					return nil, fmt.Errorf("%s line %d: invalid remote pattern '%s'", tokensFile, n, scope.remote)
+				}
+			}
+			if scope.kind != "push" && scope.kind != "pull" {
+				return nil, fmt.Errorf("%s line %d: invalid scope '%s', use push or pull, optionally with @REMOTE and :REPO", tokensFile, n, field)
+			}
+			token.scopes = append(token.scopes, scope)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, scanner.Err()
+}
+
+// whether the token may do kind to image on remoteName
+func (token serverToken) allows(kind, remoteName, image string) bool {
+	repo, _ := remote.NormaliseImageName(image)
+	for _, scope := range token.scopes {
+		if scope.kind != kind || !scope.covers(remoteName) {
+			continue
+		}
+		if scope.repo == "" {
+			return true
+		}
+		if matched, _ := path.Match(scope.repo, repo); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the token may do anything with remoteName, so may list its tags
+func (token serverToken) covers(remoteName string) bool {
+	for _, scope := range token.scopes {
+		if scope.covers(remoteName) {
+			return true
+		}
+	}
+	return false
+}
+
+func (scope tokenScope) covers(remoteName string) bool {
+	if scope.remote == "" {
+		return true
+	}
+	matched, _ := path.Match(scope.remote, remoteName)
+	return matched
+}
+
+// The token the request bears, if it's one of the server's. Every token is
+// compared, so how long it takes doesn't say which matched.
+func (s *server) bearer(r *http.Request) (serverToken, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return serverToken{}, false
+	}
+	hash := sha256.Sum256([]byte(strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))))
+
+	found, ok := serverToken{}, false
+	for _, token := range s.tokens {
+		if subtle.ConstantTimeCompare(hash[:], token.hash[:]) == 1 {
+			found, ok = token, true
+		}
+	}
+	return found, ok
+}
+
+// Requires a token, if the server has any. allowed says whether the token
+// may make the request; nil for any token.
+func (s *server) authorize(handler http.HandlerFunc, allowed func(token serverToken, r *http.Request) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.tokens == nil {
+			handler(w, r)
+			return
+		}
+
+		token, ok := s.bearer(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dogestry"`)
+			http.Error(w, "a valid bearer token is required", http.StatusUnauthorized)
+			return
+		}
+		if allowed != nil && !allowed(token, r) {
+			http.Error(w, "the token isn't allowed to do that", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// whether a token may start a job of kind for the requested remote and image
+func jobAllowed(kind string) func(token serverToken, r *http.Request) bool {
+	return func(token serverToken, r *http.Request) bool {
+		return token.allows(kind, r.FormValue("remote"), r.FormValue("image"))
+	}
+}
+
+// whether a token may list the requested remote's tags
+func tagsAllowed(token serverToken, r *http.Request) bool {
+	return token.covers(r.FormValue("remote"))
+}
+
+// the tags on remoteName of the repos the token may pull
+func (token serverToken) pullableTags(remoteName string, tags []remote.Tag) []remote.Tag {
+	visible := []remote.Tag{}
+	for _, tag := range tags {
+		if token.allows("pull", remoteName, tag.Repo) {
+			visible = append(visible, tag)
+		}
+	}
+	return visible
+}
+
+// whether the request may see and cancel job: only if it may start one like it
+func (s *server) canSee(r *http.Request, job Job) bool {
+	if s.tokens == nil {
+		return true
+	}
+	token, ok := s.bearer(r)
+	return ok && token.allows(job.Kind, job.Remote, job.Image)
+}
+
+// The server only uses the remotes named in its config, so clients can't
+// point its credentials at buckets or directories of their own choosing.
+func (s *server) checkRemote(remoteDef string) error {
+	if _, ok := s.cli.Config.Remote[remoteDef]; !ok {
+		return fmt.Errorf("no remote '%s' in the server's config. The server only uses remotes named in its config", remoteDef)
+	}
+	return nil
+}
+
+// whether only this host can connect to addr
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// The server's TLS config, requiring client certificates signed by clientCa
+// if it's set.
+func serverTLSConfig(clientCa string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCa == "" {
+		return config, nil
+	}
+
+	pem, err := ioutil.ReadFile(clientCa)
+	if err != nil {
+		return nil, fmt.Errorf("reading client-ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in client-ca %s", clientCa)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
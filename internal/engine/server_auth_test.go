@@ -0,0 +1,199 @@
+package engine
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/remote"
+)
+
+func writeTokens(t *testing.T, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadServerTokens(t *testing.T) {
+	tokens, err := readServerTokens(writeTokens(t,
+		"# a comment",
+		"",
+		"deploy pull",
+		"ci push@staging:teamA/* pull:teamA/*,pull:base/*",
+		"sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08 pull@prod-*",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 3 {
+		t.Fatalf("got %d tokens, want 3", len(tokens))
+	}
+
+	deploy, ci, hashed := tokens[0], tokens[1], tokens[2]
+	tests := []struct {
+		token               serverToken
+		kind, remote, image string
+		want                bool
+	}{
+		{deploy, "pull", "central", "anything:v1", true},
+		{deploy, "push", "central", "anything:v1", false},
+
+		{ci, "push", "staging", "teamA/app:v1", true},
+		{ci, "push", "central", "teamA/app:v1", false},
+		{ci, "push", "staging", "teamB/app:v1", false},
+		{ci, "pull", "central", "teamA/app", true},
+		{ci, "pull", "central", "base/alpine:3", true},
+		{ci, "pull", "central", "teamB/app", false},
+
+		{hashed, "pull", "prod-eu", "app", true},
+		{hashed, "pull", "staging", "app", false},
+	}
+	for _, test := range tests {
+		if got := test.token.allows(test.kind, test.remote, test.image); got != test.want {
+			t.Errorf("%v allows(%s, %s, %s) = %v, want %v", test.token.scopes, test.kind, test.remote, test.image, got, test.want)
+		}
+	}
+
+	if !ci.covers("staging") || !ci.covers("central") || hashed.covers("staging") || !hashed.covers("prod-us") {
+		t.Errorf("covers is wrong")
+	}
+}
+
+func TestReadServerTokensInvalid(t *testing.T) {
+	for _, line := range []string{
+		"token",
+		"token delete",
+		"token pull:[",
+		"token pull@",
+		"token pull@[:app",
+		"sha256:abc pull",
+	} {
+		if _, err := readServerTokens(writeTokens(t, line)); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+// A server with central and staging remotes and the tokens in lines, whose
+// jobs never start.
+func newTestServer(t *testing.T, lines ...string) *server {
+	cfg := config.Config{Remote: map[string]*config.RemoteConfig{
+		"central": {Url: filepath.Join(t.TempDir(), "central")},
+		"staging": {Url: filepath.Join(t.TempDir(), "staging")},
+	}}
+	s := &server{cli: &DogestryCli{Config: cfg}, jobs: newJobs(0, DefaultKeepJobs, DefaultKeepJobsFor)}
+	if len(lines) > 0 {
+		tokens, err := readServerTokens(writeTokens(t, lines...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.tokens = tokens
+	}
+	return s
+}
+
+func request(t *testing.T, handler http.Handler, method, url, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestServerAuthorization(t *testing.T) {
+	s := newTestServer(t, "ci push@staging:teamA/*", "deploy pull", "other push@staging:teamB/*")
+	handler := s.handler()
+
+	tests := []struct {
+		method, url, token string
+		status             int
+	}{
+		{"POST", "/push?remote=staging&image=teamA/app", "", http.StatusUnauthorized},
+		{"POST", "/push?remote=staging&image=teamA/app", "wrong", http.StatusUnauthorized},
+		{"POST", "/push?remote=staging&image=teamA/app", "ci", http.StatusAccepted},
+		{"POST", "/push?remote=central&image=teamA/app", "ci", http.StatusForbidden},
+		{"POST", "/push?remote=staging&image=teamB/app", "ci", http.StatusForbidden},
+		{"POST", "/pull?remote=staging&image=teamA/app", "ci", http.StatusForbidden},
+		{"POST", "/pull?remote=central&image=anything", "deploy", http.StatusAccepted},
+
+		// urls, which would let a token use the server's credentials anywhere
+		{"POST", "/pull?remote=s3://elsewhere/&image=anything", "deploy", http.StatusBadRequest},
+		{"POST", "/pull?remote=/tmp/elsewhere&image=anything", "deploy", http.StatusBadRequest},
+		{"GET", "/tags?remote=/tmp/elsewhere", "deploy", http.StatusBadRequest},
+
+		{"GET", "/tags?remote=central", "ci", http.StatusForbidden},
+
+		// job 1 is ci's push
+		{"GET", "/jobs/1", "ci", http.StatusOK},
+		{"GET", "/jobs/1", "deploy", http.StatusForbidden},
+		{"GET", "/jobs/1/events", "other", http.StatusForbidden},
+		{"POST", "/jobs/1/cancel", "deploy", http.StatusForbidden},
+		{"GET", "/jobs/99", "ci", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if w := request(t, handler, test.method, test.url, test.token); w.Code != test.status {
+			t.Errorf("%s %s as %q: got %d, want %d: %s", test.method, test.url, test.token, w.Code, test.status, w.Body.String())
+		}
+	}
+
+	// each token only lists the jobs it could have started
+	for token, want := range map[string]int{"ci": 1, "deploy": 1, "other": 0} {
+		w := request(t, handler, "GET", "/jobs", token)
+		var page jobPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("%s: %s: %s", token, err, w.Body.String())
+		}
+		if len(page.Jobs) != want {
+			t.Errorf("%s sees %d jobs, want %d", token, len(page.Jobs), want)
+		}
+	}
+
+	if w := request(t, handler, "POST", "/jobs/1/cancel", "ci"); w.Code != http.StatusAccepted {
+		t.Errorf("ci couldn't cancel its own job: %d", w.Code)
+	}
+}
+
+func TestServerTagsScope(t *testing.T) {
+	s := newTestServer(t, "ci pull@central:teamA/*", "deploy pull")
+	r, err := remote.NewRemote(s.cli.Config.Remote["central"].Url, config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"repositories/teamA/app/latest", "repositories/teamB/app/latest"} {
+		if err := r.Put(key, []byte("0123456789ab")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// teamB's tags are hidden from ci, which may only pull teamA's
+	for token, want := range map[string]int{"ci": 1, "deploy": 2} {
+		w := request(t, s.handler(), "GET", "/tags?remote=central", token)
+		var tags []remote.Tag
+		if err := json.Unmarshal(w.Body.Bytes(), &tags); err != nil {
+			t.Fatalf("%s: %s: %s", token, err, w.Body.String())
+		}
+		if len(tags) != want || (token == "ci" && tags[0].Repo != "teamA/app") {
+			t.Errorf("%s sees %+v", token, tags)
+		}
+	}
+}
+
+func TestServerWithoutTokens(t *testing.T) {
+	handler := newTestServer(t).handler()
+
+	if w := request(t, handler, "POST", "/push?remote=central&image=app", ""); w.Code != http.StatusAccepted {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	if w := request(t, handler, "POST", "/push?remote=s3://elsewhere/&image=app", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("a url was accepted: %d", w.Code)
+	}
+}
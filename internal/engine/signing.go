@@ -0,0 +1,412 @@
+package engine
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+	"github.com/blake-education/dogestry/vault"
+)
+
+// With `key` in the [signing] section, each pushed image is signed: its
+// metadata, config and the digest of each of its layers, all the way down to
+// its base. Pulls check images against the public keys in `trusted-keys`,
+// refusing any which have been tampered with, or signed by someone else, and
+// with `require`, any which aren't signed at all.
+//
+// Signatures are stored apart from images, as signatures/<id>, so they
+// aren't encrypted with them, and are written before the image's tags.
+const SignaturesDir = "signatures"
+
+// What's signed for an image
+type signedImage struct {
+	ID remote.ID `json:"id"`
+	// the image, then its parent, and so on
+	Layers []signedLayer `json:"layers"`
+}
+
+type signedLayer struct {
+	ID     remote.ID `json:"id"`
+	Json   string    `json:"json"`
+	Layer  string    `json:"layer,omitempty"`
+	Config string    `json:"config,omitempty"`
+}
+
+type imageSignature struct {
+	// the signedImage, as json
+	Payload []byte `json:"payload"`
+	// the sha256 of the signing key's public key
+	Key       string `json:"key"`
+	Signature []byte `json:"signature"`
+}
+
+// Signs the image pushed from imageRoot with the signing key, if there is one.
+func (cli *DogestryCli) signImage(r remote.Remote, image, imageRoot string) error {
+	if cli.Config.Signing.Key == "" && cli.Config.Signing.Key_Vault_Path == "" {
+		return nil
+	}
+
+	key, err := cli.signingKey()
+	if err != nil {
+		return err
+	}
+
+	id, err := pushedImageId(image, imageRoot)
+	if err != nil {
+		return err
+	}
+
+	statement, err := pushedStatement(r, id, imageRoot)
+	if err != nil {
+		return err
+	}
+
+	signature, err := sign(key, statement)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(signature)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cli.out, "signing image '%s' with key %s\n", id.Short(), signature.Key)
+	return r.Put(path.Join(SignaturesDir, string(id)), data)
+}
+
+// Checks image id's signature against the trusted keys, if there are any, and
+// returns the statement signed, or nil if the image isn't signed. The remote
+// may change after this, so it's the files pulled which are checked against
+// the statement (see checkSigned), not those on the remote now.
+func (cli *DogestryCli) verifySignature(r remote.Remote, id remote.ID) ([]byte, error) {
+	signing := cli.Config.Signing
+	if signing.Trusted_Keys == "" {
+		if signing.Require {
+			return nil, fmt.Errorf("`require` in the [signing] section needs `trusted-keys` to check signatures with")
+		}
+		return nil, nil
+	}
+
+	trusted, err := readTrustedKeys(signing.Trusted_Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := r.Get(path.Join(SignaturesDir, string(id)))
+	if err == remote.ErrNoSuchKey {
+		if signing.Require {
+			return nil, fmt.Errorf("image '%s' isn't signed, and the [signing] section requires signatures", id.Short())
+		}
+		fmt.Fprintf(cli.out, "image '%s' isn't signed\n", id.Short())
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	signature := imageSignature{}
+	if err := json.Unmarshal(data, &signature); err != nil {
+		return nil, fmt.Errorf("invalid signature for image '%s': %w", id.Short(), err)
+	}
+
+	key, ok := trusted[signature.Key]
+	if !ok {
+		return nil, fmt.Errorf("image '%s' is signed with key %s, which isn't in %s", id.Short(), signature.Key, signing.Trusted_Keys)
+	}
+	if !verify(key, signature.Payload, signature.Signature) {
+		return nil, fmt.Errorf("image '%s' has an invalid signature", id.Short())
+	}
+
+	fmt.Fprintf(cli.out, "image '%s' is signed with trusted key %s\n", id.Short(), signature.Key)
+	return signature.Payload, nil
+}
+
+// The digests of the files of each image in statement, which must be image
+// id's, by id.
+func signedDigests(id remote.ID, statement []byte) (map[remote.ID]signedLayer, error) {
+	signed := signedImage{}
+	if err := json.Unmarshal(statement, &signed); err != nil {
+		return nil, fmt.Errorf("invalid statement for image '%s': %w", id.Short(), err)
+	}
+	if signed.ID != id {
+		return nil, fmt.Errorf("the statement for image '%s' is for image '%s'", id.Short(), signed.ID.Short())
+	}
+
+	digests := make(map[remote.ID]signedLayer, len(signed.Layers))
+	for _, layer := range signed.Layers {
+		digests[layer.ID] = layer
+	}
+	return digests, nil
+}
+
+// Checks the digests of image id's files, as they were pulled, against those
+// in its image's statement, if it has one. Files it doesn't have are "".
+func (cli *DogestryCli) checkSigned(id remote.ID, digests map[string]string) error {
+	if cli.signed == nil {
+		return nil
+	}
+
+	signed, ok := cli.signed[id]
+	if !ok {
+		return fmt.Errorf("image '%s' isn't one of the images signed", id.Short())
+	}
+
+	expected := map[string]string{"json": signed.Json, remote.ImageConfigFile: signed.Config}
+	// images pushed without a layer digest are only signed down to their metadata
+	if signed.Layer != "" {
+		expected["layer.tar"] = signed.Layer
+	}
+	for name, digest := range expected {
+		if digests[name] != digest {
+			return &remote.ChecksumError{
+				File:     fmt.Sprintf("%s of image '%s'", name, id.Short()),
+				Expected: digest,
+				Actual:   digests[name],
+				Hint:     "It isn't what was signed, so the remote may have been tampered with",
+			}
+		}
+	}
+	return nil
+}
+
+// checkSigned for image id, pulled to dir
+func (cli *DogestryCli) checkPulledSigned(id remote.ID, dir string) error {
+	if cli.signed == nil {
+		return nil
+	}
+
+	digests := map[string]string{}
+	for _, name := range []string{"json", "layer.tar", remote.ImageConfigFile} {
+		hex, err := utils.Sha256File(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		digests[name] = "sha256:" + hex
+	}
+	return cli.checkSigned(id, digests)
+}
+
+// The statement signed for image id, reading each image's files with read.
+// Files which don't exist are nil.
+func imageStatement(id remote.ID, read func(id remote.ID, name string) ([]byte, error)) ([]byte, error) {
+	statement := signedImage{ID: id, Layers: []signedLayer{}}
+
+	for layer := id; layer != ""; {
+		metadata, err := read(layer, "json")
+		if err != nil {
+			return nil, err
+		} else if metadata == nil {
+			return nil, fmt.Errorf("image '%s' has no metadata", layer.Short())
+		}
+
+		digest, err := read(layer, LayerDigestFile)
+		if err != nil {
+			return nil, err
+		}
+		config, err := read(layer, remote.ImageConfigFile)
+		if err != nil {
+			return nil, err
+		}
+
+		signed := signedLayer{ID: layer, Json: sha256Digest(metadata), Layer: string(bytes.TrimSpace(digest))}
+		if config != nil {
+			signed.Config = sha256Digest(config)
+		}
+		statement.Layers = append(statement.Layers, signed)
+
+		parent := struct{ Parent remote.ID }{}
+		if err := json.Unmarshal(metadata, &parent); err != nil {
+			return nil, fmt.Errorf("invalid metadata for image '%s': %w", layer.Short(), err)
+		}
+		layer = parent.Parent
+	}
+
+	return json.Marshal(statement)
+}
+
+// The statement for image id, pushed from imageRoot. Layers which were already
+// on the remote weren't prepared, so they're read from there.
+func pushedStatement(r remote.Remote, id remote.ID, imageRoot string) ([]byte, error) {
+	return imageStatement(id, func(id remote.ID, name string) ([]byte, error) {
+		data, err := ioutil.ReadFile(filepath.Join(imageRoot, "images", string(id), name))
+		if os.IsNotExist(err) {
+			return readRemoteImageFile(r, id, name)
+		}
+		return data, err
+	})
+}
+
+// one of image id's files on the remote, or nil if it doesn't have it
+func readRemoteImageFile(r remote.Remote, id remote.ID, name string) ([]byte, error) {
+	data, err := r.Get(path.Join("images", string(id), name))
+	if err == remote.ErrNoSuchKey {
+		return nil, nil
+	}
+	return data, err
+}
+
+func sha256Digest(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// Reads a PEM ECDSA or RSA private key, e.g. from
+// `openssl ecparam -genkey -name prime256v1 -noout`.
+func readSigningKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading signing key: %w", err)
+	}
+	return parseSigningKey(data, path)
+}
+
+// The [signing] key, from its file, or the `key` of its vault secret.
+func (cli *DogestryCli) signingKey() (crypto.Signer, error) {
+	signing := cli.Config.Signing
+	if signing.Key_Vault_Path == "" {
+		return readSigningKey(signing.Key)
+	}
+
+	client, err := vault.NewClient(cli.Config)
+	if err != nil {
+		return nil, err
+	}
+	data, err := client.ReadField(signing.Key_Vault_Path, "key")
+	if err != nil {
+		return nil, err
+	}
+	return parseSigningKey([]byte(data), "in vault secret "+signing.Key_Vault_Path)
+}
+
+func parseSigningKey(data []byte, source string) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("invalid signing key %s: it isn't PEM", source)
+	}
+
+	var err error
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %s: %w", source, err)
+	}
+
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("invalid signing key %s: only ECDSA and RSA keys are supported", source)
+}
+
+// Reads the PEM public keys in path, e.g. from `openssl ec -pubout`, by their
+// sha256. The file can have any number of them.
+func readTrustedKeys(path string) (map[string]crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading trusted keys: %w", err)
+	}
+	return parsePublicKeys(data, path)
+}
+
+// the PEM public keys in data, read from source, by their sha256
+func parsePublicKeys(data []byte, source string) (map[string]crypto.PublicKey, error) {
+	keys := make(map[string]crypto.PublicKey)
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted key in %s: %w", source, err)
+		}
+		fingerprint, err := keyFingerprint(key)
+		if err != nil {
+			return nil, err
+		}
+		keys[fingerprint] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys in %s", source)
+	}
+	return keys, nil
+}
+
+func keyFingerprint(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return sha256Digest(der), nil
+}
+
+func sign(key crypto.Signer, payload []byte) (imageSignature, error) {
+	signature := imageSignature{Payload: payload}
+	digest := sha256.Sum256(payload)
+
+	var err error
+	if signature.Key, err = keyFingerprint(key.Public()); err != nil {
+		return signature, err
+	}
+
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, key, digest[:]); err == nil {
+			signature.Signature, err = asn1.Marshal(ecdsaSignature{r, s})
+		}
+	default:
+		signature.Signature, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	return signature, err
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func verify(key crypto.PublicKey, payload, signature []byte) bool {
+	digest := sha256.Sum256(payload)
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		sig := ecdsaSignature{}
+		if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+			return false
+		}
+		return ecdsa.Verify(key, digest[:], sig.R, sig.S)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
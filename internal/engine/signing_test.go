@@ -0,0 +1,211 @@
+package engine
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/remote"
+)
+
+func newSigningKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// a trusted keys file with key's public key
+func writeTrustedKeys(t *testing.T, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "trusted.pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// A local remote with image child, whose parent is base, and a cli which
+// trusts trustedKey.
+func newSigningTest(t *testing.T, trustedKey *ecdsa.PrivateKey) (*DogestryCli, remote.Remote) {
+	cfg := config.Config{}
+	cfg.Signing.Trusted_Keys = writeTrustedKeys(t, trustedKey)
+
+	r, err := remote.NewRemote(filepath.Join(t.TempDir(), "remote"), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"images/base/json":                       `{"id":"base"}`,
+		"images/base/" + LayerDigestFile:         "sha256:aaaa",
+		"images/child/json":                      `{"id":"child","parent":"base"}`,
+		"images/child/" + LayerDigestFile:        "sha256:bbbb",
+		"images/child/" + remote.ImageConfigFile: `{"os":"linux"}`,
+	}
+	for key, data := range files {
+		if err := r.Put(key, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &DogestryCli{Config: cfg, out: ioutil.Discard}, r
+}
+
+func putSignature(t *testing.T, r remote.Remote, key *ecdsa.PrivateKey, id remote.ID) []byte {
+	statement, err := imageStatement(id, func(id remote.ID, name string) ([]byte, error) {
+		return readRemoteImageFile(r, id, name)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := sign(key, statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Put(path.Join(SignaturesDir, string(id)), data); err != nil {
+		t.Fatal(err)
+	}
+	return statement
+}
+
+func TestSignAndVerify(t *testing.T) {
+	key := newSigningKey(t)
+	signature, err := sign(key, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !verify(key.Public(), []byte("payload"), signature.Signature) {
+		t.Errorf("the signature didn't verify")
+	}
+	if verify(key.Public(), []byte("payloaD"), signature.Signature) {
+		t.Errorf("the signature verified a different payload")
+	}
+	if verify(newSigningKey(t).Public(), []byte("payload"), signature.Signature) {
+		t.Errorf("the signature verified with another key")
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	key := newSigningKey(t)
+	cli, r := newSigningTest(t, key)
+
+	statement, err := cli.verifySignature(r, "child")
+	if err != nil || statement != nil {
+		t.Fatalf("an unsigned image: got %q, %v", statement, err)
+	}
+	cli.Config.Signing.Require = true
+	if _, err := cli.verifySignature(r, "child"); err == nil {
+		t.Errorf("an unsigned image was allowed with require")
+	}
+
+	signed := putSignature(t, r, key, "child")
+	if statement, err = cli.verifySignature(r, "child"); err != nil {
+		t.Fatal(err)
+	}
+	if string(statement) != string(signed) {
+		t.Errorf("got statement %s, want %s", statement, signed)
+	}
+
+	putSignature(t, r, newSigningKey(t), "child")
+	if _, err := cli.verifySignature(r, "child"); err == nil {
+		t.Errorf("an image signed with an untrusted key was allowed")
+	}
+}
+
+func TestSignedDigests(t *testing.T) {
+	key := newSigningKey(t)
+	_, r := newSigningTest(t, key)
+	statement := putSignature(t, r, key, "child")
+
+	if _, err := signedDigests("base", statement); err == nil {
+		t.Errorf("child's statement was accepted for base")
+	}
+
+	digests, err := signedDigests("child", statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digests) != 2 || digests["base"].Layer != "sha256:aaaa" || digests["child"].Config != sha256Digest([]byte(`{"os":"linux"}`)) {
+		t.Errorf("got %+v", digests)
+	}
+}
+
+// The remote changing after the signature's checked doesn't matter: it's
+// what's pulled which is checked.
+func TestCheckPulledSigned(t *testing.T) {
+	key := newSigningKey(t)
+	cli, r := newSigningTest(t, key)
+	statement := putSignature(t, r, key, "child")
+
+	var err error
+	if cli.signed, err = signedDigests("child", statement); err != nil {
+		t.Fatal(err)
+	}
+
+	layer := []byte("layer")
+	cli.signed["base"] = signedLayer{ID: "base", Json: sha256Digest([]byte(`{"id":"base"}`)), Layer: sha256Digest(layer)}
+
+	pulled := func(json string, layer []byte) string {
+		dir := t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(dir, "json"), []byte(json), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "layer.tar"), layer, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	if err := cli.checkPulledSigned("base", pulled(`{"id":"base"}`, layer)); err != nil {
+		t.Errorf("the signed image: %s", err)
+	}
+
+	var checksumErr *remote.ChecksumError
+	if err := cli.checkPulledSigned("base", pulled(`{"id":"base","evil":true}`, layer)); !errors.As(err, &checksumErr) {
+		t.Errorf("changed metadata: got %v, want a ChecksumError", err)
+	}
+	if err := cli.checkPulledSigned("base", pulled(`{"id":"base"}`, []byte("evil"))); !errors.As(err, &checksumErr) {
+		t.Errorf("a changed layer: got %v, want a ChecksumError", err)
+	}
+
+	// child was signed with a config and a layer, which its pull must have
+	dir := pulled(`{"id":"child","parent":"base"}`, nil)
+	os.Remove(filepath.Join(dir, "layer.tar"))
+	if err := cli.checkPulledSigned("child", dir); !errors.As(err, &checksumErr) {
+		t.Errorf("a missing config: got %v, want a ChecksumError", err)
+	}
+
+	if err := cli.checkPulledSigned("other", dir); err == nil {
+		t.Errorf("an image which wasn't signed was allowed")
+	}
+
+	// the streamed digests are checked the same way
+	streamed := map[string]string{"json": sha256Digest([]byte(`{"id":"base"}`)), "layer.tar": sha256Digest([]byte("evil"))}
+	if err := cli.checkSigned("base", streamed); !errors.As(err, &checksumErr) {
+		t.Errorf("a changed streamed layer: got %v, want a ChecksumError", err)
+	}
+
+	cli.signed = nil
+	if err := cli.checkPulledSigned("other", dir); err != nil {
+		t.Errorf("without a statement: %s", err)
+	}
+}
@@ -0,0 +1,245 @@
+package engine
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+)
+
+const (
+	// a file deleted in a layer, and a dir whose contents in lower layers are hidden
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Replaces the prepared image's layers with one layer holding its final
+// filesystem. The image keeps its config, but gets a new id, as it no longer
+// has a parent, and its tags are moved to it.
+func (cli *DogestryCli) squashImage(image, root string) error {
+	topId, err := pushedImageId(image, root)
+	if err != nil {
+		return err
+	}
+	if topId == remote.ID(image) {
+		return fmt.Errorf("can't squash '%s', it isn't a repo:tag", image)
+	}
+
+	// a Windows image's base layers are registered with the host, not just files
+	if platform, err := remote.PreparedPlatform(root, topId); err != nil {
+		return err
+	} else if platform.OS == "windows" {
+		return fmt.Errorf("can't squash '%s', windows images can't be squashed", image)
+	}
+
+	// base first
+	ids := make([]remote.ID, 0)
+	for id := topId; id != ""; {
+		ids = append([]remote.ID{id}, ids...)
+
+		metadata, err := readImageJson(filepath.Join(root, "images", string(id)))
+		if err != nil {
+			return err
+		}
+		id = remote.ID(metadata.Parent)
+	}
+
+	fmt.Fprintf(cli.out, "squashing %d layers\n", len(ids))
+
+	metadata, err := readImageJson(filepath.Join(root, "images", string(topId)))
+	if err != nil {
+		return err
+	}
+
+	newId := fmt.Sprintf("%x", sha256.Sum256([]byte("squashed\n"+string(topId))))
+	dir := filepath.Join(root, "images", newId)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	layers := make([]string, len(ids))
+	for i, id := range ids {
+		layers[i] = filepath.Join(root, "images", string(id), "layer.tar")
+	}
+
+	size, err := squashLayers(layers, filepath.Join(dir, "layer.tar"))
+	if err != nil {
+		return err
+	}
+
+	metadata.ID = newId
+	metadata.Parent = ""
+	metadata.Size = size
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "json"), data, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "VERSION"), []byte("1.0"), 0600); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := os.RemoveAll(filepath.Join(root, "images", string(id))); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(cli.out, "squashed into image '%s' (%s)\n", remote.ID(newId).Short(), utils.HumanSize(size))
+
+	return retagPrepared(root, topId, remote.ID(newId))
+}
+
+// moves every tag in the prepared root from one image to another
+func retagPrepared(root string, from, to remote.ID) error {
+	return filepath.Walk(filepath.Join(root, "repositories"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		id, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(id)) != string(from) {
+			return nil
+		}
+		return ioutil.WriteFile(path, []byte(to), 0600)
+	})
+}
+
+// where the final version of a path comes from
+type squashedEntry struct {
+	layer int
+	// the entry's position in its layer, as a layer can have a path twice
+	index int
+}
+
+// Writes the filesystem the layers, base first, make when applied in turn
+// to dst, as a single layer. Returns the layer's size.
+func squashLayers(layers []string, dst string) (int64, error) {
+	final := make(map[string]squashedEntry)
+
+	// work out which entry wins for each path, without reading any content
+	for i, layer := range layers {
+		err := eachTarEntry(layer, func(index int, header *tar.Header, _ io.Reader) error {
+			name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+			dir, base := path.Split(name)
+
+			if base == whiteoutOpaque {
+				removeUnder(final, path.Clean(dir))
+				return nil
+			}
+			if strings.HasPrefix(base, whiteoutPrefix) {
+				removed := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+				delete(final, removed)
+				removeUnder(final, removed)
+				return nil
+			}
+
+			// a file replacing a dir replaces what was in it too
+			if header.Typeflag != tar.TypeDir {
+				removeUnder(final, name)
+			}
+			final[name] = squashedEntry{i, index}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	counter := &countingWriter{w: out}
+	tarball := tar.NewWriter(counter)
+
+	for i, layer := range layers {
+		err := eachTarEntry(layer, func(index int, header *tar.Header, content io.Reader) error {
+			name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+			if entry, ok := final[name]; !ok || entry != (squashedEntry{i, index}) {
+				return nil
+			}
+
+			if err := tarball.WriteHeader(header); err != nil {
+				return err
+			}
+			_, err := io.Copy(tarball, content)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tarball.Close(); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+// removes everything under dir, but not dir itself
+func removeUnder(final map[string]squashedEntry, dir string) {
+	prefix := dir + "/"
+	if dir == "." {
+		prefix = ""
+	}
+	for name := range final {
+		if strings.HasPrefix(name, prefix) && name != dir {
+			delete(final, name)
+		}
+	}
+}
+
+// calls fn with each entry in the tar at path, and its position
+func eachTarEntry(path string, fn func(index int, header *tar.Header, content io.Reader) error) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// an image without a layer of its own
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tarball := tar.NewReader(f)
+	for index := 0; ; index++ {
+		header, err := tarball.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+
+		if err := fn(index, header, tarball); err != nil {
+			return err
+		}
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+
+	dockerclient "github.com/blake-education/dogestry/client"
+)
+
+// A client for docker on another host, over ssh. Like the docker cli, this
+// runs `docker system dial-stdio` on the host, which relays to its docker
+// socket, so the daemon needn't listen on tcp. ssh uses the user's own keys,
+// agent and ~/.ssh/config, and mustn't need a password.
+func newSSHDockerClient(connection string) (*dockerclient.Client, error) {
+	u, err := url.Parse(connection)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid docker connection '%s': use ssh://[user@]host[:port]", connection)
+	}
+
+	args := []string{"-o", "BatchMode=yes"}
+	if u.User != nil {
+		args = append(args, "-l", u.User.Username())
+	}
+	host := u.Host
+	if h, port, err := net.SplitHostPort(u.Host); err == nil {
+		host = h
+		args = append(args, "-p", port)
+	}
+	args = append(args, "--", host, "docker", "system", "dial-stdio")
+
+	if _, err := exec.LookPath("ssh"); err != nil {
+		return nil, fmt.Errorf("can't find executable ssh on the $PATH, which docker connection '%s' needs", connection)
+	}
+
+	return dockerclient.NewDialClient("http://docker", func() (net.Conn, error) {
+		return dialSSH(connection, args)
+	})
+}
+
+// Starts ssh with args, returning a connection over its stdin and stdout.
+func dialSSH(connection string, args []string) (net.Conn, error) {
+	cmd := exec.Command("ssh", args...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("connecting to docker over %s: %w", connection, err)
+	}
+	return &sshConn{cmd: cmd, stdin: stdin, stdout: stdout, connection: connection}, nil
+}
+
+// the connection a running ssh gives, as the http client needs it
+type sshConn struct {
+	cmd        *exec.Cmd
+	stdin      io.WriteCloser
+	stdout     io.ReadCloser
+	connection string
+}
+
+func (c *sshConn) Read(p []byte) (int, error)  { return c.stdout.Read(p) }
+func (c *sshConn) Write(p []byte) (int, error) { return c.stdin.Write(p) }
+
+func (c *sshConn) Close() error {
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *sshConn) LocalAddr() net.Addr  { return sshAddr("local") }
+func (c *sshConn) RemoteAddr() net.Addr { return sshAddr(c.connection) }
+
+// ssh takes care of its own timeouts
+func (c *sshConn) SetDeadline(t time.Time) error      { return nil }
+func (c *sshConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sshConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type sshAddr string
+
+func (a sshAddr) Network() string { return "ssh" }
+func (a sshAddr) String() string  { return string(a) }
@@ -0,0 +1,214 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+)
+
+// A push or pull, as logged to the stats file
+type runStats struct {
+	Command     string    `json:"command"`
+	Remote      string    `json:"remote"`
+	Image       string    `json:"image"`
+	Started     time.Time `json:"started"`
+	Seconds     float64   `json:"seconds"`
+	Transferred int       `json:"transferred"`
+	Skipped     int       `json:"skipped"`
+	Bytes       int64     `json:"bytes"`
+	Error       string    `json:"error,omitempty"`
+}
+
+func (run runStats) throughput() string {
+	if run.Seconds <= 0 {
+		return "-"
+	}
+	return utils.HumanSize(int64(float64(run.Bytes)/run.Seconds)) + "/s"
+}
+
+// Prints a summary of a push or pull, and its -profile-layers table, logs it to the stats file, sends it to statsd
+// and runs the post hooks.
+// before is the remote's stats when the run started, as a remote can be shared by several runs.
+func (cli *DogestryCli) finishRun(command, remoteDef, image string, r remote.Remote, before remote.TransferStats, started time.Time, err error) {
+	stats := r.Stats().Since(before)
+	stats.Skipped += cli.localSkipped
+	cli.localSkipped = 0
+	if stats.Transferred > 0 {
+		cli.changed = true
+	}
+
+	run := runStats{
+		Command:     command,
+		Remote:      remoteDef,
+		Image:       image,
+		Started:     started.UTC(),
+		Seconds:     time.Since(started).Seconds(),
+		Transferred: stats.Transferred,
+		Skipped:     stats.Skipped,
+		Bytes:       stats.Bytes,
+	}
+	if err != nil {
+		run.Error = utils.Redact(err.Error())
+	}
+
+	runMetrics.observeRun(run)
+	sendStatsd(cli.Config.Statsd, run)
+
+	direction := "up"
+	if command == "pull" {
+		direction = "down"
+	}
+
+	var transferErr *remote.TransferError
+	if errors.As(err, &transferErr) && !cli.Options.Json {
+		fmt.Fprintln(cli.out, transferErr.Table())
+	}
+
+	if cli.Options.Json {
+		printJson(run)
+	} else {
+		fmt.Fprintf(cli.out, "%s summary: %d transferred, %d skipped, %s %s in %.1fs (%s)\n",
+			command, run.Transferred, run.Skipped, utils.HumanSize(run.Bytes), direction, run.Seconds, run.throughput())
+	}
+
+	cli.printProfile(command)
+
+	if err := logRun(config.StatsFilePath(cli.Config), run); err != nil {
+		fmt.Fprintln(cli.out, "couldn't log stats:", err)
+	}
+
+	cli.postHooks(run)
+}
+
+func logRun(path string, run runStats) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(run)
+}
+
+func readRuns(path string) ([]runStats, error) {
+	runs := make([]runStats, 0)
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return runs, nil
+	} else if err != nil {
+		return runs, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		run := runStats{}
+		// skip lines mangled by e.g. a full disk, rather than give up on the whole log
+		if err := json.Unmarshal(scanner.Bytes(), &run); err != nil {
+			continue
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, scanner.Err()
+}
+
+func (cli *DogestryCli) CmdStats(args ...string) error {
+	cmd := cli.Subcmd("stats", "", "summarise recent pushes and pulls from the stats log")
+	last := cmd.Int("n", 100, "summarise the last n pushes and pulls")
+	since := cmd.Duration("since", 0, "only summarise pushes and pulls in this period (e.g. 24h)")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	runs, err := readRuns(config.StatsFilePath(cli.Config))
+	if err != nil {
+		return err
+	}
+
+	if *since > 0 {
+		recent := make([]runStats, 0)
+		for _, run := range runs {
+			if time.Since(run.Started) <= *since {
+				recent = append(recent, run)
+			}
+		}
+		runs = recent
+	}
+
+	if *last > 0 && len(runs) > *last {
+		runs = runs[len(runs)-*last:]
+	}
+
+	if len(runs) == 0 && !cli.Options.Json {
+		fmt.Println("no pushes or pulls logged")
+		return nil
+	}
+
+	totals := make(map[string]*runStats)
+	counts := make(map[string]int)
+	failures := make(map[string]int)
+	for _, run := range runs {
+		total, ok := totals[run.Command]
+		if !ok {
+			total = &runStats{Command: run.Command}
+			totals[run.Command] = total
+		}
+
+		counts[run.Command]++
+		if run.Error != "" {
+			failures[run.Command]++
+		}
+		total.Seconds += run.Seconds
+		total.Transferred += run.Transferred
+		total.Skipped += run.Skipped
+		total.Bytes += run.Bytes
+	}
+
+	commands := make([]string, 0, len(totals))
+	for command := range totals {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	if cli.Options.Json {
+		summaries := make([]map[string]interface{}, 0, len(commands))
+		for _, command := range commands {
+			total := totals[command]
+			summaries = append(summaries, map[string]interface{}{
+				"command":     command,
+				"runs":        counts[command],
+				"failed":      failures[command],
+				"transferred": total.Transferred,
+				"skipped":     total.Skipped,
+				"bytes":       total.Bytes,
+				"seconds":     total.Seconds,
+			})
+		}
+		return printJson(summaries)
+	}
+
+	fmt.Printf("%d runs since %s\n", len(runs), runs[0].Started.Format("2006-01-02 15:04:05 UTC"))
+	for _, command := range commands {
+		total := totals[command]
+		fmt.Printf("%-5s  %d runs (%d failed)  %d transferred  %d skipped  %s in %.1fs  avg %.1fs/run  %s\n",
+			command, counts[command], failures[command], total.Transferred, total.Skipped,
+			utils.HumanSize(total.Bytes), total.Seconds, total.Seconds/float64(counts[command]), total.throughput())
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/utils"
+)
+
+const DefaultStatsdPrefix = "dogestry"
+
+// how long to wait to resolve the statsd address, so a bad one can't hold up a run
+var StatsdTimeout = time.Second
+
+// Sends run's duration, bytes and result to the [statsd] section's address,
+// or $DOGESTRY_STATSD. It's udp, so nothing waits for statsd, or minds if it's down.
+func sendStatsd(statsdConfig config.StatsdConfig, run runStats) {
+	address := statsdConfig.Address
+	if address == "" {
+		address = os.Getenv("DOGESTRY_STATSD")
+	}
+	if address == "" {
+		return
+	}
+
+	conn, err := net.DialTimeout("udp", address, StatsdTimeout)
+	if err != nil {
+		utils.Detailf("couldn't send stats to statsd: %s\n", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(statsdMetrics(statsdConfig, run))); err != nil {
+		utils.Detailf("couldn't send stats to statsd: %s\n", err)
+	}
+}
+
+// run's metrics, a line each, e.g. dogestry.push.duration:5230|ms
+func statsdMetrics(statsdConfig config.StatsdConfig, run runStats) string {
+	prefix := statsdConfig.Prefix
+	if prefix == "" {
+		prefix = DefaultStatsdPrefix
+	}
+	name := prefix + "." + run.Command
+
+	result := "success"
+	if run.Error != "" {
+		result = "failure"
+	}
+
+	tags := ""
+	if statsdConfig.Dogstatsd {
+		all := append([]string{
+			"command:" + run.Command,
+			"remote:" + statsdTag(utils.Redact(run.Remote)),
+			"image:" + statsdTag(run.Image),
+			"result:" + result,
+		}, statsdConfig.Tag...)
+		tags = "|#" + strings.Join(all, ",")
+	}
+
+	lines := []string{
+		fmt.Sprintf("%s.duration:%d|ms%s", name, int64(run.Seconds*1000), tags),
+		fmt.Sprintf("%s.bytes:%d|c%s", name, run.Bytes, tags),
+		fmt.Sprintf("%s.transferred:%d|c%s", name, run.Transferred, tags),
+		fmt.Sprintf("%s.%s:1|c%s", name, result, tags),
+	}
+	return strings.Join(lines, "\n")
+}
+
+// value, without the characters which separate tags and metrics
+func statsdTag(value string) string {
+	return strings.NewReplacer(",", "_", "|", "_", "\n", "_", "#", "_").Replace(value)
+}
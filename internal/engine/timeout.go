@@ -0,0 +1,55 @@
+package engine
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/blake-education/dogestry/config"
+)
+
+// Adds -timeout and -request-timeout to cmd. The returned func applies them
+// once cmd is parsed.
+func (cli *DogestryCli) TimeoutFlags(cmd *flag.FlagSet) func() {
+	timeout := cmd.Duration("timeout", 0, "give up if the whole command takes longer than this, e.g. 30m (default `timeout` in the [dogestry] section, or never)")
+	requestTimeout := cmd.Duration("request-timeout", 0, "give up on a request to the remote once it's been idle this long, e.g. 1m (default `request-timeout` in the [dogestry] section, or never)")
+
+	return func() {
+		if *timeout > 0 {
+			cli.Config.Dogestry.Timeout = timeout.String()
+		}
+		if *requestTimeout > 0 {
+			cli.Config.Dogestry.Request_Timeout = requestTimeout.String()
+		}
+	}
+}
+
+// Runs fn, failing if it takes longer than the configured timeout. fn can't
+// be stopped, but the error ends the process, which cleans up the work dir
+// on the way out, and push locks are released so later pushes aren't blocked.
+func (cli *DogestryCli) withTimeout(command string, fn func() error) error {
+	timeout, err := config.ParseDuration(cli.Config.Dogestry.Timeout)
+	if err != nil {
+		return fmt.Errorf("invalid timeout: %w", err)
+	}
+	if _, err := config.ParseDuration(cli.Config.Dogestry.Request_Timeout); err != nil {
+		return fmt.Errorf("invalid request-timeout: %w", err)
+	}
+
+	if timeout == 0 {
+		return fn()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		cli.pushLocks.releaseAll(cli.out)
+		return fmt.Errorf("%s timed out after %s", command, timeout)
+	}
+}
@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"errors"
+	"time"
+
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/tracing"
+	"github.com/blake-education/dogestry/utils"
+)
+
+// Starts the span of a push or pull of image, whose phases are its children.
+func (cli *DogestryCli) startRunSpan(command, remoteDef, image string) *tracing.Span {
+	cli.span = tracing.Start(command, nil)
+	cli.span.Set("image", image)
+	cli.span.Set("remote", utils.Redact(remoteDef))
+	return cli.span
+}
+
+// Runs fn as a phase of the push or pull, e.g. exporting the image from docker.
+func (cli *DogestryCli) phase(name string, fn func() error) error {
+	if cli.control.Canceled() {
+		return remote.ErrCanceled
+	}
+	span := cli.span.Child(name)
+	err := fn()
+	span.End(err)
+	return err
+}
+
+// Runs fn as a phase whose transfers, e.g. each layer uploaded, are its children.
+func (cli *DogestryCli) transferPhase(name string, fn func() error) error {
+	if cli.control.Canceled() {
+		return remote.ErrCanceled
+	}
+	span := cli.span.Child(name)
+	cli.eventsLock.Lock()
+	cli.transferSpan = span
+	cli.eventsLock.Unlock()
+
+	err := fn()
+	span.End(err)
+	return err
+}
+
+// Makes a span of a transfer the remote reports, in the current transfer phase.
+func (cli *DogestryCli) traceEvent(event remote.Event) {
+	if event.Event != remote.EventDone && event.Event != remote.EventFailed {
+		return
+	}
+
+	cli.eventsLock.Lock()
+	parent := cli.transferSpan
+	cli.eventsLock.Unlock()
+
+	span := parent.Child("transfer")
+	span.SetStart(event.Time.Add(-time.Duration(event.Seconds * float64(time.Second))))
+	span.Set("key", event.Key)
+	if layer := eventLayer(event.Key); layer != "" {
+		span.Set("layer", layer)
+	}
+	span.Set("bytes", event.Bytes)
+	span.Set("attempt", event.Attempt)
+
+	var err error
+	if event.Error != "" {
+		err = errors.New(event.Error)
+	}
+	span.End(err)
+}
@@ -0,0 +1,640 @@
+package engine
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/remote"
+)
+
+// Repository metadata, after TUF (https://theupdateframework.io), so pulls
+// can tell they're seeing the remote as its owners left it, not just images
+// someone once signed.
+//
+// trust/root.json names the keys allowed to sign targets, and is signed by the
+// root keys. Each version is kept as trust/root.<version>.json, so pulls can
+// follow rotations from the root they first trusted, checking each is signed
+// by the keys of the one before.
+//
+// trust/targets.json maps every tag to its images, and the digest of what's
+// signed for each (see imageStatement). Pushes update it and sign it with
+// the [signing] key, which must be one of the root's targets keys. Pulls
+// refuse an image when:
+//   - its tag points somewhere the targets don't (mix-and-match)
+//   - the targets are older than ones already seen (rollback)
+//   - the root or targets have expired (freeze)
+const TrustDir = "trust"
+
+var (
+	// pushes to a remote with trust metadata lock it while updating the targets,
+	// waiting this long for other pushes to finish
+	TrustLockTTL  = 10 * time.Minute
+	TrustLockWait = 5 * time.Minute
+
+	DefaultTargetsExpiry = 7 * 24 * time.Hour
+	DefaultRootExpiry    = 365 * 24 * time.Hour
+)
+
+// not a valid repo name, so it can't clash with a push's lock
+const trustLockName = ".trust"
+
+// Signed metadata, as stored
+type trustMetadata struct {
+	Signed     json.RawMessage  `json:"signed"`
+	Signatures []trustSignature `json:"signatures"`
+}
+
+type trustSignature struct {
+	KeyId string `json:"keyid"`
+	Sig   []byte `json:"sig"`
+}
+
+type trustRoot struct {
+	Type    string    `json:"_type"`
+	Version int       `json:"version"`
+	Expires time.Time `json:"expires"`
+	// PEM public keys, by their sha256
+	Keys map[string]string `json:"keys"`
+	// root and targets
+	Roles map[string]trustRole `json:"roles"`
+}
+
+type trustRole struct {
+	KeyIds    []string `json:"keyids"`
+	Threshold int      `json:"threshold"`
+}
+
+type trustTargets struct {
+	Type    string    `json:"_type"`
+	Version int       `json:"version"`
+	Expires time.Time `json:"expires"`
+	// by repo:tag
+	Targets map[string]trustTarget `json:"targets"`
+}
+
+type trustTarget struct {
+	// the tag's image for each platform
+	Images map[string]trustImage `json:"images"`
+}
+
+type trustImage struct {
+	ID remote.ID `json:"id"`
+	// the sha256 of the image's signing statement
+	Digest string `json:"digest"`
+}
+
+func (cli *DogestryCli) CmdTrust(args ...string) error {
+	cmd := cli.Subcmd("trust", "root|refresh|status REMOTE", "manage the REMOTE's signed metadata: sign a new version of its root, re-sign its targets before they expire, or show both")
+	keys := cmd.String("key", "", "root: comma separated PEM private keys to sign the root with. A rotation needs enough of both the old and new root keys")
+	rootKeys := cmd.String("root-keys", "", "root: a file of PEM public keys allowed to sign the root")
+	targetsKeys := cmd.String("targets-keys", "", "root: a file of PEM public keys allowed to sign targets, e.g. those of the build hosts' [signing] keys")
+	threshold := cmd.Int("threshold", 1, "root: how many root keys must sign each root")
+	expires := cmd.Duration("expires", 0, "how long the metadata is valid for. Defaults to a year for root, and `targets-expiry` in the [trust] section for refresh")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	if cmd.NArg() < 1 {
+		return MissingArgs("trust", "root, refresh or status")
+	}
+	remoteDef := cli.Options.Remote
+	if remoteDef == "" {
+		remoteDef = cmd.Arg(1)
+	}
+	if remoteDef == "" {
+		return MissingArgs("trust", "REMOTE")
+	}
+
+	r, err := cli.newRemote(remoteDef)
+	if err != nil {
+		return err
+	}
+
+	switch cmd.Arg(0) {
+	case "root":
+		if *keys == "" || *rootKeys == "" || *targetsKeys == "" {
+			return MissingArgs("trust", "-key, -root-keys and -targets-keys")
+		}
+		if *expires == 0 {
+			*expires = DefaultRootExpiry
+		}
+		return signTrustRoot(r, strings.Split(*keys, ","), *rootKeys, *targetsKeys, *threshold, *expires)
+
+	case "refresh":
+		if *expires == 0 {
+			if *expires, err = targetsExpiry(cli.Config); err != nil {
+				return err
+			}
+		}
+		return cli.updateTargets(r, *expires, func(targets *trustTargets) error { return nil })
+
+	case "status":
+		return cli.trustStatus(r)
+	}
+	return fmt.Errorf("unknown trust command '%s'. See 'dogestry help trust'", cmd.Arg(0))
+}
+
+// Signs the next version of the remote's root, with keys, making the keys in
+// the rootKeys and targetsKeys files the root and targets keys.
+func signTrustRoot(r remote.Remote, keyFiles []string, rootKeys, targetsKeys string, threshold int, expires time.Duration) error {
+	previous, _, err := readRemoteRoot(r)
+	if err != nil {
+		return err
+	}
+
+	root := &trustRoot{Type: "root", Version: 1, Expires: time.Now().UTC().Add(expires).Truncate(time.Second), Keys: make(map[string]string), Roles: make(map[string]trustRole)}
+	if previous != nil {
+		root.Version = previous.Version + 1
+	}
+
+	for role, file := range map[string]string{"root": rootKeys, "targets": targetsKeys} {
+		keys, err := readTrustedKeys(file)
+		if err != nil {
+			return err
+		}
+
+		keyRole := trustRole{KeyIds: []string{}, Threshold: 1}
+		for id, key := range keys {
+			der, err := x509.MarshalPKIXPublicKey(key)
+			if err != nil {
+				return err
+			}
+			root.Keys[id] = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+			keyRole.KeyIds = append(keyRole.KeyIds, id)
+		}
+		sort.Strings(keyRole.KeyIds)
+		if role == "root" {
+			if threshold < 1 || threshold > len(keyRole.KeyIds) {
+				return fmt.Errorf("-threshold must be between 1 and the number of root keys, %d", len(keyRole.KeyIds))
+			}
+			keyRole.Threshold = threshold
+		}
+		root.Roles[role] = keyRole
+	}
+
+	signers := []crypto.Signer{}
+	for _, file := range keyFiles {
+		key, err := readSigningKey(strings.TrimSpace(file))
+		if err != nil {
+			return err
+		}
+		signers = append(signers, key)
+	}
+
+	data, err := signMetadata(root, signers)
+	if err != nil {
+		return err
+	}
+
+	// check it now, rather than on every pull host
+	if _, err := parseTrustRoot(data, previous); err != nil {
+		return err
+	}
+
+	if err := r.Put(rootVersionKey(root.Version), data); err != nil {
+		return err
+	}
+	if err := r.Put(path.Join(TrustDir, "root.json"), data); err != nil {
+		return err
+	}
+
+	fmt.Printf("signed root version %d, expiring %s\n", root.Version, root.Expires.Format(time.RFC3339))
+	if previous == nil {
+		fmt.Printf("pulling hosts should trust a copy of %s, with `root` in the [trust] section\n", rootVersionKey(1))
+	}
+	return nil
+}
+
+func rootVersionKey(version int) string {
+	return path.Join(TrustDir, fmt.Sprintf("root.%d.json", version))
+}
+
+// The remote's current root, and its metadata as stored. Nil if it has none.
+// This trusts the remote's word for which root is current: it's for pushes,
+// which only need the targets keys. Pulls use trustedRoot.
+func readRemoteRoot(r remote.Remote) (*trustRoot, []byte, error) {
+	data, err := r.Get(path.Join(TrustDir, "root.json"))
+	if err == remote.ErrNoSuchKey {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	root, err := parseTrustRoot(data, nil)
+	return root, data, err
+}
+
+// Parses root metadata, checking it's signed by the threshold of its own root
+// keys, and of previous's, if it's a rotation from previous.
+func parseTrustRoot(data []byte, previous *trustRoot) (*trustRoot, error) {
+	root := &trustRoot{}
+	metadata, err := parseMetadata(data, "root", root)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := root.verify("root", metadata); err != nil {
+		return nil, fmt.Errorf("root version %d: %w", root.Version, err)
+	}
+	if previous != nil {
+		if root.Version != previous.Version+1 {
+			return nil, fmt.Errorf("root version %d follows version %d", root.Version, previous.Version)
+		}
+		if err := previous.verify("root", metadata); err != nil {
+			return nil, fmt.Errorf("root version %d isn't signed by the keys of version %d: %w", root.Version, previous.Version, err)
+		}
+	}
+	return root, nil
+}
+
+// Parses the targets, checking they're signed by the root's targets keys.
+func parseTrustTargets(data []byte, root *trustRoot) (*trustTargets, error) {
+	targets := &trustTargets{}
+	metadata, err := parseMetadata(data, "targets", targets)
+	if err != nil {
+		return nil, err
+	}
+	if err := root.verify("targets", metadata); err != nil {
+		return nil, fmt.Errorf("targets version %d: %w", targets.Version, err)
+	}
+	if targets.Targets == nil {
+		targets.Targets = make(map[string]trustTarget)
+	}
+	return targets, nil
+}
+
+// Unmarshals data's signed part into signed, checking it's of type kind.
+func parseMetadata(data []byte, kind string, signed interface{}) (trustMetadata, error) {
+	metadata := trustMetadata{}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return metadata, fmt.Errorf("invalid %s metadata: %w", kind, err)
+	}
+	if err := json.Unmarshal(metadata.Signed, signed); err != nil {
+		return metadata, fmt.Errorf("invalid %s metadata: %w", kind, err)
+	}
+
+	typed := struct {
+		Type string `json:"_type"`
+	}{}
+	json.Unmarshal(metadata.Signed, &typed)
+	if typed.Type != kind {
+		return metadata, fmt.Errorf("expected %s metadata, got '%s'", kind, typed.Type)
+	}
+	return metadata, nil
+}
+
+func signMetadata(signed interface{}, keys []crypto.Signer) ([]byte, error) {
+	payload, err := json.Marshal(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := trustMetadata{Signed: payload, Signatures: []trustSignature{}}
+	for _, key := range keys {
+		signature, err := sign(key, payload)
+		if err != nil {
+			return nil, err
+		}
+		metadata.Signatures = append(metadata.Signatures, trustSignature{KeyId: signature.Key, Sig: signature.Signature})
+	}
+	// not indented, which would change the signed bytes
+	return json.Marshal(metadata)
+}
+
+// Checks metadata is signed by at least the threshold of role's keys.
+func (root *trustRoot) verify(role string, metadata trustMetadata) error {
+	r, ok := root.Roles[role]
+	if !ok || r.Threshold < 1 {
+		return fmt.Errorf("the root has no %s keys", role)
+	}
+
+	allowed := make(map[string]bool)
+	for _, id := range r.KeyIds {
+		allowed[id] = true
+	}
+
+	valid := make(map[string]bool)
+	for _, signature := range metadata.Signatures {
+		if !allowed[signature.KeyId] || valid[signature.KeyId] {
+			continue
+		}
+		keys, err := parsePublicKeys([]byte(root.Keys[signature.KeyId]), "the root's key "+signature.KeyId)
+		if err != nil {
+			return err
+		}
+		if key, ok := keys[signature.KeyId]; ok && verify(key, metadata.Signed, signature.Sig) {
+			valid[signature.KeyId] = true
+		}
+	}
+
+	if len(valid) < r.Threshold {
+		return fmt.Errorf("it has %d valid signatures by %s keys, and needs %d", len(valid), role, r.Threshold)
+	}
+	return nil
+}
+
+func (cli *DogestryCli) trustStatus(r remote.Remote) error {
+	root, _, err := readRemoteRoot(r)
+	if err != nil {
+		return err
+	} else if root == nil {
+		return fmt.Errorf("the remote has no trust metadata. Sign a root with `dogestry trust root`")
+	}
+
+	targets := &trustTargets{}
+	data, err := r.Get(path.Join(TrustDir, "targets.json"))
+	if err == nil {
+		if targets, err = parseTrustTargets(data, root); err != nil {
+			return err
+		}
+	} else if err != remote.ErrNoSuchKey {
+		return err
+	}
+
+	if cli.Options.Json {
+		return printJson(map[string]interface{}{"root": root, "targets": targets})
+	}
+
+	fmt.Fprintf(cli.out, "root:    version %d, expires %s, %d of %d root keys, %d targets keys\n", root.Version, root.Expires.Format(time.RFC3339),
+		root.Roles["root"].Threshold, len(root.Roles["root"].KeyIds), len(root.Roles["targets"].KeyIds))
+	if targets.Version == 0 {
+		fmt.Fprintln(cli.out, "targets: none yet, they're signed on push")
+	} else {
+		fmt.Fprintf(cli.out, "targets: version %d, expires %s, %d tags\n", targets.Version, targets.Expires.Format(time.RFC3339), len(targets.Targets))
+	}
+	return nil
+}
+
+func targetsExpiry(cfg config.Config) (time.Duration, error) {
+	expiry, err := config.ParseDuration(cfg.Trust.Targets_Expiry)
+	if err != nil {
+		return 0, fmt.Errorf("invalid targets-expiry in the [trust] section: %w", err)
+	}
+	if expiry == 0 {
+		expiry = DefaultTargetsExpiry
+	}
+	return expiry, nil
+}
+
+// Records image id, pushed from imageRoot, in the remote's targets for each
+// tag in names, if the remote has trust metadata.
+func (cli *DogestryCli) recordTargets(r remote.Remote, imageRoot string, names []string, id remote.ID) error {
+	root, _, err := readRemoteRoot(r)
+	if err != nil || root == nil {
+		return err
+	}
+
+	statement, err := pushedStatement(r, id, imageRoot)
+	if err != nil {
+		return err
+	}
+	platform, err := remote.PreparedPlatform(imageRoot, id)
+	if err != nil {
+		return err
+	}
+
+	expiry, err := targetsExpiry(cli.Config)
+	if err != nil {
+		return err
+	}
+
+	return cli.updateTargets(r, expiry, func(targets *trustTargets) error {
+		for _, name := range names {
+			repoName, repoTag := remote.NormaliseImageName(name)
+			if _, err := os.Stat(filepath.Join(imageRoot, "repositories", repoName, repoTag)); os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			target := targets.Targets[repoName+":"+repoTag]
+			if target.Images == nil {
+				target.Images = make(map[string]trustImage)
+			}
+			target.Images[platform.String()] = trustImage{ID: id, Digest: sha256Digest(statement)}
+			targets.Targets[repoName+":"+repoTag] = target
+		}
+		return nil
+	})
+}
+
+// Signs the next version of the remote's targets, changed by change, with the
+// [signing] key. The remote is locked meanwhile, as other pushes change them too.
+func (cli *DogestryCli) updateTargets(r remote.Remote, expiry time.Duration, change func(*trustTargets) error) error {
+	root, _, err := readRemoteRoot(r)
+	if err != nil {
+		return err
+	} else if root == nil {
+		return fmt.Errorf("the remote has no trust metadata. Sign a root with `dogestry trust root`")
+	}
+
+	if cli.Config.Signing.Key == "" && cli.Config.Signing.Key_Vault_Path == "" {
+		return fmt.Errorf("the remote has trust metadata, so pushes must sign its targets. Set `key` in the [signing] section")
+	}
+	key, err := cli.signingKey()
+	if err != nil {
+		return err
+	}
+
+	lock, err := lockTrust(r)
+	if err != nil {
+		return err
+	}
+	cli.pushLocks.add(lock, r, cli.out)
+	defer cli.pushLocks.release(lock)
+
+	targets := &trustTargets{Type: "targets", Targets: make(map[string]trustTarget)}
+	data, err := r.Get(path.Join(TrustDir, "targets.json"))
+	if err == nil {
+		// don't sign over targets someone else has changed
+		if targets, err = parseTrustTargets(data, root); err != nil {
+			return err
+		}
+	} else if err != remote.ErrNoSuchKey {
+		return err
+	}
+
+	if err := change(targets); err != nil {
+		return err
+	}
+	targets.Version++
+	targets.Expires = time.Now().UTC().Add(expiry).Truncate(time.Second)
+
+	if data, err = signMetadata(targets, []crypto.Signer{key}); err != nil {
+		return err
+	}
+	if _, err := parseTrustTargets(data, root); err != nil {
+		return fmt.Errorf("the [signing] key isn't one of the remote's targets keys: %w", err)
+	}
+
+	fmt.Fprintf(cli.out, "signing targets version %d, expiring %s\n", targets.Version, targets.Expires.Format(time.RFC3339))
+	return r.Put(path.Join(TrustDir, "targets.json"), data)
+}
+
+// locks the remote's trust metadata, waiting for other pushes to finish with it
+func lockTrust(r remote.Remote) (*remote.Lock, error) {
+	deadline := time.Now().Add(TrustLockWait)
+	for {
+		lock, err := remote.AcquireLock(r, trustLockName, TrustLockTTL)
+		var lockedErr *remote.LockedError
+		if !errors.As(err, &lockedErr) || time.Now().After(deadline) {
+			return lock, err
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// Checks image, resolved to id, against the remote's signed targets, if
+// `root` in the [trust] section says which root to trust, and returns the
+// statement for id they name. That's statement, if its signature has already
+// been checked, or else read from the remote. Either way, it's the files
+// pulled which are checked against it (see checkSigned), as the remote may
+// change after this.
+func (cli *DogestryCli) checkTrust(r remote.Remote, remoteDef, image string, id remote.ID, statement []byte) ([]byte, error) {
+	if cli.Config.Trust.Root == "" {
+		return statement, nil
+	}
+
+	// what this host has seen of the remote before
+	stateDir := filepath.Join(config.TrustDirPath(cli.Config), sha256Digest([]byte(remoteDef))[len("sha256:"):][:16])
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, err
+	}
+
+	root, err := cli.trustedRoot(r, stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := r.Get(path.Join(TrustDir, "targets.json"))
+	if err == remote.ErrNoSuchKey {
+		return nil, fmt.Errorf("the remote has no signed targets")
+	} else if err != nil {
+		return nil, err
+	}
+	targets, err := parseTrustTargets(data, root)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(targets.Expires) {
+		return nil, fmt.Errorf("the remote's targets expired at %s. Its metadata may be frozen, or need `dogestry trust refresh`", targets.Expires.Format(time.RFC3339))
+	}
+
+	seenFile := filepath.Join(stateDir, "targets.json")
+	if seen, err := ioutil.ReadFile(seenFile); err == nil {
+		// checked when it was seen, perhaps with keys the root has since dropped
+		previous := &trustTargets{}
+		if _, err := parseMetadata(seen, "targets", previous); err != nil {
+			return nil, err
+		}
+		if targets.Version < previous.Version {
+			return nil, fmt.Errorf("the remote's targets are version %d, but version %d has been seen. It may have been rolled back", targets.Version, previous.Version)
+		}
+		if targets.Version == previous.Version && !bytes.Equal(data, seen) {
+			return nil, fmt.Errorf("the remote's targets version %d isn't the version %d seen before", targets.Version, previous.Version)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(seenFile, data, 0600); err != nil {
+		return nil, err
+	}
+
+	expected, err := targetImage(targets, image, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if statement == nil {
+		statement, err = imageStatement(id, func(id remote.ID, name string) ([]byte, error) {
+			return readRemoteImageFile(r, id, name)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sha256Digest(statement) != expected.Digest {
+		return nil, fmt.Errorf("image '%s' isn't the image in the remote's targets", id.Short())
+	}
+
+	fmt.Fprintf(cli.out, "image '%s' is in the remote's targets, version %d\n", id.Short(), targets.Version)
+	return statement, nil
+}
+
+// The targets' entry for id, which image resolved to. Tags must point at one
+// of their own images, and images pulled by id must be some tag's.
+func targetImage(targets *trustTargets, image string, id remote.ID) (trustImage, error) {
+	repoName, repoTag := remote.NormaliseImageName(image)
+	if target, ok := targets.Targets[repoName+":"+repoTag]; ok {
+		for _, expected := range target.Images {
+			if expected.ID == id {
+				return expected, nil
+			}
+		}
+		return trustImage{}, fmt.Errorf("'%s' points at image '%s', which isn't one of its images in the remote's targets", image, id.Short())
+	}
+
+	if strings.HasPrefix(string(id), image) {
+		for _, target := range targets.Targets {
+			for _, expected := range target.Images {
+				if expected.ID == id {
+					return expected, nil
+				}
+			}
+		}
+	}
+	return trustImage{}, fmt.Errorf("'%s' isn't in the remote's targets", image)
+}
+
+// The newest root this host trusts, following the remote's rotations from
+// the last root it trusted, or from the [trust] section's root.
+func (cli *DogestryCli) trustedRoot(r remote.Remote, stateDir string) (*trustRoot, error) {
+	trustedFile := filepath.Join(stateDir, "root.json")
+	data, err := ioutil.ReadFile(trustedFile)
+	if os.IsNotExist(err) {
+		data, err = ioutil.ReadFile(cli.Config.Trust.Root)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading trusted root: %w", err)
+	}
+
+	root, err := parseTrustRoot(data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		next, err := r.Get(rootVersionKey(root.Version + 1))
+		if err == remote.ErrNoSuchKey {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if root, err = parseTrustRoot(next, root); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(trustedFile, next, 0600); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(cli.out, "trusting the remote's root version %d\n", root.Version)
+	}
+
+	if time.Now().After(root.Expires) {
+		return nil, fmt.Errorf("the remote's root version %d expired at %s. Its metadata may be frozen", root.Version, root.Expires.Format(time.RFC3339))
+	}
+	return root, nil
+}
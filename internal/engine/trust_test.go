@@ -0,0 +1,165 @@
+package engine
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blake-education/dogestry/remote"
+)
+
+func writeSigningKey(t *testing.T, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// The signing test's remote, with a root signed by its own key, and a cli
+// which trusts that root and can sign targets with targetsKey.
+func newTrustTest(t *testing.T) (*DogestryCli, remote.Remote, *ecdsa.PrivateKey) {
+	rootKey, targetsKey := newSigningKey(t), newSigningKey(t)
+	cli, r := newSigningTest(t, targetsKey)
+	cli.Config.Signing.Trusted_Keys = ""
+
+	err := signTrustRoot(r, []string{writeSigningKey(t, rootKey)}, writeTrustedKeys(t, rootKey), writeTrustedKeys(t, targetsKey), 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := r.Get(rootVersionKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Config.Trust.Root = filepath.Join(t.TempDir(), "root.json")
+	if err := ioutil.WriteFile(cli.Config.Trust.Root, root, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cli.Config.Trust.Dir = t.TempDir()
+
+	return cli, r, targetsKey
+}
+
+// signs targets naming id as app:latest's image, with statement's digest
+func putTargets(t *testing.T, r remote.Remote, key crypto.Signer, version int, expires time.Time, id remote.ID, statement []byte) {
+	targets := trustTargets{Type: "targets", Version: version, Expires: expires, Targets: map[string]trustTarget{
+		"app:latest": {Images: map[string]trustImage{"linux/amd64": {ID: id, Digest: sha256Digest(statement)}}},
+	}}
+	data, err := signMetadata(targets, []crypto.Signer{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Put(path.Join(TrustDir, "targets.json"), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func remoteStatement(t *testing.T, r remote.Remote, id remote.ID) []byte {
+	statement, err := imageStatement(id, func(id remote.ID, name string) ([]byte, error) {
+		return readRemoteImageFile(r, id, name)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return statement
+}
+
+func TestCheckTrust(t *testing.T) {
+	cli, r, key := newTrustTest(t)
+	statement := remoteStatement(t, r, "child")
+	putTargets(t, r, key, 1, time.Now().Add(time.Hour), "child", statement)
+
+	got, err := cli.checkTrust(r, "test", "app", "child", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(statement) {
+		t.Errorf("got statement %s, want %s", got, statement)
+	}
+
+	// a signature's statement is checked, rather than the remote
+	if _, err := cli.checkTrust(r, "test", "app", "child", []byte(`{"id":"child","layers":[]}`)); err == nil {
+		t.Errorf("a statement other than the targets' was accepted")
+	}
+
+	// mix-and-match
+	if _, err := cli.checkTrust(r, "test", "app", "base", nil); err == nil {
+		t.Errorf("a tag pointing at another image was accepted")
+	}
+	if _, err := cli.checkTrust(r, "test", "other", "child", nil); err == nil {
+		t.Errorf("a tag not in the targets was accepted")
+	}
+
+	// the remote changing after the check doesn't get past the pull
+	if cli.signed, err = signedDigests("child", got); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "json"), []byte(`{"id":"child","parent":"evil"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.checkPulledSigned("child", dir); err == nil {
+		t.Errorf("metadata which isn't in the targets was pulled")
+	}
+}
+
+func TestCheckTrustChangedImage(t *testing.T) {
+	cli, r, key := newTrustTest(t)
+	putTargets(t, r, key, 1, time.Now().Add(time.Hour), "child", remoteStatement(t, r, "child"))
+
+	if err := r.Put("images/base/"+LayerDigestFile, []byte("sha256:cccc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.checkTrust(r, "test", "app", "child", nil); err == nil {
+		t.Errorf("an image changed since its targets were signed was accepted")
+	}
+}
+
+func TestCheckTrustRollbackAndFreeze(t *testing.T) {
+	cli, r, key := newTrustTest(t)
+	statement := remoteStatement(t, r, "child")
+
+	putTargets(t, r, key, 2, time.Now().Add(time.Hour), "child", statement)
+	if _, err := cli.checkTrust(r, "test", "app", "child", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	putTargets(t, r, key, 1, time.Now().Add(time.Hour), "child", statement)
+	if _, err := cli.checkTrust(r, "test", "app", "child", nil); err == nil || !strings.Contains(err.Error(), "rolled back") {
+		t.Errorf("rolled back targets: got %v", err)
+	}
+
+	putTargets(t, r, key, 3, time.Now().Add(-time.Minute), "child", statement)
+	if _, err := cli.checkTrust(r, "test", "app", "child", nil); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expired targets: got %v", err)
+	}
+
+	// targets signed by a key the root doesn't name
+	putTargets(t, r, newSigningKey(t), 4, time.Now().Add(time.Hour), "child", statement)
+	if _, err := cli.checkTrust(r, "test", "app", "child", nil); err == nil {
+		t.Errorf("targets signed by another key were accepted")
+	}
+}
+
+func TestCheckTrustUnconfigured(t *testing.T) {
+	cli, r, _ := newTrustTest(t)
+	cli.Config.Trust.Root = ""
+	os.RemoveAll(cli.Config.Trust.Dir)
+
+	statement := []byte("signed")
+	if got, err := cli.checkTrust(r, "test", "app", "child", statement); err != nil || string(got) != "signed" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/blake-education/dogestry/remote"
+)
+
+func (cli *DogestryCli) CmdUpgradeRepo(args ...string) error {
+	cmd := cli.Subcmd("upgrade-repo", "REMOTE", "migrate the REMOTE's repository layout in place to the format used by this dogestry")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	remoteDef, _ := cli.RemoteArgs(cmd)
+	if remoteDef == "" {
+		return MissingArgs("upgrade-repo", "REMOTE")
+	}
+
+	r, err := cli.newRemote(remoteDef)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("remote", r.Desc())
+
+	err = remote.UpgradeFormat(r, func(from, to int) {
+		fmt.Printf("upgrading repository format version %d -> %d\n", from, to)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("repository is at format version %d\n", remote.CurrentFormatVersion)
+	return nil
+}
+
+// Checks the remote's format version before reading or writing it.
+// Empty remotes being pushed to are marked with the current version.
+func checkRemoteFormat(r remote.Remote, pushing bool) error {
+	if pushing {
+		version, err := remote.FormatVersion(r)
+		if err != nil {
+			return err
+		}
+
+		if version == 0 {
+			tags, err := remote.ListTags(r)
+			if err != nil {
+				return err
+			}
+
+			if len(tags) == 0 {
+				return remote.SetFormatVersion(r, remote.CurrentFormatVersion)
+			}
+		}
+	}
+
+	return remote.CheckFormatVersion(r)
+}
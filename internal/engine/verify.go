@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/blake-education/dogestry/remote"
+	"github.com/blake-education/dogestry/utils"
+)
+
+// The sha256 of an image's uncompressed layer.tar, and of its config if it
+// has one, recorded on push and checked on pull before either goes anywhere
+// near docker.
+const (
+	LayerDigestFile  = "layer.sha256"
+	ConfigDigestFile = "config.sha256"
+)
+
+// the file each digest file is the digest of
+var digestFiles = map[string]string{
+	LayerDigestFile:  "layer.tar",
+	ConfigDigestFile: remote.ImageConfigFile,
+}
+
+// records the digest of each layer and config in a prepared imageRoot
+func recordDigests(root string) error {
+	for digestFile, name := range digestFiles {
+		files, err := filepath.Glob(filepath.Join(root, "images", "*", name))
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			hex, err := utils.Sha256File(file)
+			if err != nil {
+				return err
+			}
+
+			digest := []byte("sha256:" + hex)
+			if err := ioutil.WriteFile(filepath.Join(filepath.Dir(file), digestFile), digest, 0600); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Checks a pulled image's layer and config against their recorded digests,
+// then removes the digests so docker doesn't see them. Images pushed without
+// them are left alone, as is everything with -insecure-skip-verify.
+func (cli *DogestryCli) verifyImage(imageDir string) error {
+	for digestFile, name := range digestFiles {
+		digestPath := filepath.Join(imageDir, digestFile)
+
+		data, err := ioutil.ReadFile(digestPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if !cli.skipVerify {
+			hex, err := utils.Sha256File(filepath.Join(imageDir, name))
+			if err != nil {
+				return err
+			}
+
+			if err := checkDigest(name, filepath.Base(imageDir), strings.TrimSpace(string(data)), "sha256:"+hex); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Remove(digestPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkDigest(name, id, expected, actual string) error {
+	if expected != actual {
+		return &remote.ChecksumError{
+			File:     fmt.Sprintf("%s of image '%s'", name, id),
+			Expected: expected,
+			Actual:   actual,
+			Hint:     "Pull again with -force to download it again",
+		}
+	}
+	return nil
+}
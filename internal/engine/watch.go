@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	dockerclient "github.com/blake-education/dogestry/client"
+	"github.com/blake-education/dogestry/remote"
+)
+
+// at most this many images wait to be pushed, or pushed again, at once
+var WatchMaxQueued = 100
+
+// a tagged image waiting to be pushed
+type watchedImage struct {
+	due      time.Time
+	attempts int
+}
+
+func (cli *DogestryCli) CmdWatch(args ...string) error {
+	cmd := cli.Subcmd("watch", "REMOTE", "watch docker for images being tagged, and push them to the REMOTE")
+	filter := cmd.String("filter", "", "only push repos matching these comma separated patterns, e.g. 'myorg/*,base/*' (default `watch-filter` in the [dogestry] section, or '*')")
+	debounce := cmd.Duration("debounce", 5*time.Second, "wait this long after an image's last tag before pushing it, so a build tagging it several times pushes once")
+	retries := cmd.Int("retries", 3, "how many times to push an image again if pushing it fails")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	remoteDef, _ := cli.RemoteArgs(cmd)
+	if remoteDef == "" {
+		return MissingArgs("watch", "REMOTE")
+	}
+
+	filters := cli.Config.Dogestry.Watch_Filter
+	if *filter != "" {
+		filters = strings.Split(*filter, ",")
+		for i := range filters {
+			filters[i] = strings.TrimSpace(filters[i])
+		}
+	}
+	if len(filters) == 0 {
+		filters = []string{"*"}
+	}
+
+	// check the filters and remote up front, rather than on the first push
+	for _, pattern := range filters {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid filter '%s': %w", pattern, err)
+		}
+	}
+
+	r, err := cli.newRemote(remoteDef)
+	if err != nil {
+		return err
+	}
+	fmt.Println("remote", r.Desc())
+
+	events := make(chan *dockerclient.APIEvents, 100)
+	errch := make(chan error, 1)
+	go func() {
+		errch <- cli.client.MonitorEvents(events)
+	}()
+
+	queue := make(map[string]*watchedImage)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	fmt.Printf("watching for images matching '%s' being tagged\n", strings.Join(filters, ","))
+	for {
+		select {
+		case event := <-events:
+			image := taggedImage(event)
+			if image == "" || !watchMatches(filters, image) {
+				continue
+			}
+
+			if queued, ok := queue[image]; ok {
+				queued.due = time.Now().Add(*debounce)
+			} else if len(queue) >= WatchMaxQueued {
+				log.Printf("too many images waiting to be pushed, skipping '%s'\n", image)
+			} else {
+				fmt.Printf("image '%s' was tagged, pushing in %s\n", image, *debounce)
+				queue[image] = &watchedImage{due: time.Now().Add(*debounce)}
+			}
+
+		case now := <-tick.C:
+			for image, queued := range queue {
+				if now.Before(queued.due) {
+					continue
+				}
+
+				fmt.Printf("pushing '%s'\n", image)
+				err := cli.push(remoteDef, image)
+				if err == nil {
+					delete(queue, image)
+					continue
+				}
+
+				queued.attempts++
+				if queued.attempts > *retries {
+					log.Printf("pushing '%s' failed: %s. Giving up\n", image, err)
+					delete(queue, image)
+					continue
+				}
+
+				// back off, so a remote having a bad minute isn't hammered
+				wait := time.Duration(queued.attempts*queued.attempts) * 10 * time.Second
+				log.Printf("pushing '%s' failed: %s. Trying again in %s\n", image, err, wait)
+				queued.due = time.Now().Add(wait)
+			}
+
+		case err := <-errch:
+			if err == nil {
+				err = fmt.Errorf("docker closed the event stream")
+			}
+			return err
+		}
+	}
+}
+
+// whether image's repo matches any of the filters
+func watchMatches(filters []string, image string) bool {
+	repo, _ := remote.NormaliseImageName(image)
+	for _, pattern := range filters {
+		if matched, _ := path.Match(pattern, repo); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// the repo:tag of a tag event, or "" if it isn't one
+func taggedImage(event *dockerclient.APIEvents) string {
+	if event.Status != "tag" {
+		return ""
+	}
+
+	// newer dockers put the name in the actor, older ones in the id
+	if name := event.Actor.Attributes["name"]; name != "" {
+		return name
+	}
+	return event.ID
+}
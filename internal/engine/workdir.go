@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/blake-education/dogestry/utils"
+)
+
+// Work dirs are owned by the dogestry which made them, recorded in this
+// file, so ones left behind by a dogestry which crashed or was killed can be
+// told apart from ones still in use, and removed.
+const workDirOwnerFile = ".dogestry-owner"
+
+var (
+	// the names of the dirs TempDir makes
+	tempDirName = regexp.MustCompile(`^dogestry[0-9]+$`)
+
+	// how long a work dir whose owner isn't known, or a pull dir kept to
+	// resume, is left before it's taken to be abandoned
+	OrphanedWorkDirAge = 24 * time.Hour
+)
+
+func (cli *DogestryCli) workDirRoot() string {
+	if cli.tempDirRoot != "" {
+		return cli.tempDirRoot
+	}
+	return os.TempDir()
+}
+
+// Records this process as dir's owner.
+func ownWorkDir(dir string) error {
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%d %s\n", os.Getpid(), hostname)
+	return ioutil.WriteFile(filepath.Join(dir, workDirOwnerFile), []byte(owner), 0600)
+}
+
+// Whether the process which owns dir is still running. Unknown if it's
+// another host's, or there's no owner file.
+func workDirOwnerAlive(dir string) (alive, known bool) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, workDirOwnerFile))
+	if err != nil {
+		return false, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return false, false
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return false, false
+	}
+	if hostname, _ := os.Hostname(); fields[1] != hostname {
+		return false, false
+	}
+
+	err = syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM, true
+}
+
+// Removes the work dirs under root left behind by runs which crashed or
+// were killed: temp dirs whose owner is gone, and pull dirs, which are kept
+// so a pull can resume, once they've been left for OrphanedWorkDirAge too.
+func cleanOrphanedWorkDirs(root string) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, name)
+
+		// each of a -pullhosts pull's hosts has its own root
+		if strings.HasPrefix(name, "dogestry-host-") {
+			cleanOrphanedWorkDirs(dir)
+			continue
+		}
+		// only the dirs TempDir and PullDir make
+		if !tempDirName.MatchString(name) && !strings.HasPrefix(name, "dogestry-pull-") {
+			continue
+		}
+
+		alive, known := workDirOwnerAlive(dir)
+		if alive {
+			continue
+		}
+		stale := time.Since(entry.ModTime()) > OrphanedWorkDirAge
+		resumable := strings.HasPrefix(name, "dogestry-pull-")
+		if (known && !resumable) || stale {
+			utils.Detailf("removing %s, left behind by an earlier run\n", dir)
+			if err := os.RemoveAll(dir); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: couldn't remove %s, left behind by an earlier run: %s\n", dir, err)
+			}
+		}
+	}
+}
+
+// Checks the work dir's filesystem has at least need bytes free, or
+// `temp-dir-min-free-mb` if that's more, so a push or pull doesn't fill it
+// part way through.
+func (cli *DogestryCli) checkWorkDirSpace(need uint64) error {
+	root := cli.workDirRoot()
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+
+	min := MinTempDirSpace
+	if cli.Config.Dogestry.Temp_Dir_Min_Free_Mb > 0 {
+		min = uint64(cli.Config.Dogestry.Temp_Dir_Min_Free_Mb) * 1000 * 1000
+	}
+	if need < min {
+		need = min
+	}
+
+	free, err := utils.FreeSpace(root)
+	if err != nil {
+		return fmt.Errorf("checking free space in %s: %w", root, err)
+	}
+	if free < need {
+		return fmt.Errorf("work dir %s only has %s free, and needs %s. Free some space, or use -work-dir or `temp-dir` in the [dogestry] section to choose a larger volume",
+			root, utils.HumanSize(int64(free)), utils.HumanSize(int64(need)))
+	}
+	return nil
+}
+
+// the space pushing image needs in the work dir: its size in docker, as it's
+// exported there, or nothing if that's not known
+func (cli *DogestryCli) pushSpace(image string) uint64 {
+	if !cli.usesDocker() || cli.exportOf != nil {
+		return 0
+	}
+	inspected, err := cli.client.InspectImage(image)
+	if err != nil {
+		return 0
+	}
+	return uint64(inspected.Size)
+}
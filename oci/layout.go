@@ -0,0 +1,326 @@
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An OCI image layout: a directory of blobs named by their digest, and an
+// index of the manifests in it. This is what skopeo, containerd and CRI-O
+// read and write, so images can move between dogestry and hosts without docker.
+// https://github.com/opencontainers/image-spec/blob/master/image-layout.md
+
+const (
+	LayoutFile    = "oci-layout"
+	IndexFile     = "index.json"
+	LayoutVersion = "1.0.0"
+
+	MediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeLayerGz  = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// what docker's own tools write, which are the same apart from the names
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar"
+	MediaTypeDockerLayerGz      = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// layers which can't be redistributed, e.g. Windows base layers, fetched
+	// from their urls rather than the registry
+	MediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+	MediaTypeNondistributableGz = "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip"
+
+	// the tag a manifest in the index is known by
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+	// the full name containerd imports a manifest as
+	AnnotationContainerdName = "io.containerd.image.name"
+)
+
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	URLs        []string          `json:"urls,omitempty"`
+}
+
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	OSVersion    string `json:"os.version,omitempty"`
+}
+
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+type Image struct {
+	Created      *time.Time  `json:"created,omitempty"`
+	Author       string      `json:"author,omitempty"`
+	Architecture string      `json:"architecture"`
+	OS           string      `json:"os"`
+	OSVersion    string      `json:"os.version,omitempty"`
+	Variant      string      `json:"variant,omitempty"`
+	Config       ImageConfig `json:"config"`
+	RootFS       RootFS      `json:"rootfs"`
+	History      []History   `json:"history,omitempty"`
+}
+
+type ImageConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+}
+
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type History struct {
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	Author     string     `json:"author,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	EmptyLayer bool       `json:"empty_layer,omitempty"`
+}
+
+// the path of the blob with digest in the layout at dir
+func BlobPath(dir, digest string) (string, error) {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	if hex == digest || hex == "" || strings.ContainsAny(hex, "/.") {
+		return "", fmt.Errorf("invalid digest '%s'", digest)
+	}
+	return filepath.Join(dir, "blobs", "sha256", hex), nil
+}
+
+// Creates the layout at dir, if it doesn't exist already.
+func Init(dir string) error {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(map[string]string{"imageLayoutVersion": LayoutVersion})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, LayoutFile), data, 0644)
+}
+
+// Writes data as a blob, returning its descriptor.
+func WriteBlob(dir, mediaType string, data []byte) (Descriptor, error) {
+	desc := Descriptor{
+		MediaType: mediaType,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+		Size:      int64(len(data)),
+	}
+
+	path, err := BlobPath(dir, desc.Digest)
+	if err != nil {
+		return desc, err
+	}
+	return desc, ioutil.WriteFile(path, data, 0644)
+}
+
+// Writes v as a json blob, returning its descriptor.
+func WriteJsonBlob(dir, mediaType string, v interface{}) (Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return WriteBlob(dir, mediaType, data)
+}
+
+// Moves the file at src into the layout as a blob, returning its descriptor.
+// src is copied if it can't be moved, e.g. it's on another filesystem.
+func MoveBlob(dir, mediaType, src string) (Descriptor, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	desc := Descriptor{
+		MediaType: mediaType,
+		Digest:    fmt.Sprintf("sha256:%x", hash.Sum(nil)),
+		Size:      size,
+	}
+
+	dst, err := BlobPath(dir, desc.Digest)
+	if err != nil {
+		return desc, err
+	}
+
+	if err := os.Rename(src, dst); err == nil {
+		return desc, nil
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return desc, err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return desc, err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, f)
+	return desc, err
+}
+
+// Reads the layout's index. A layout without one has an empty index.
+func ReadIndex(dir string) (Index, error) {
+	index := Index{SchemaVersion: 2, Manifests: []Descriptor{}}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, IndexFile))
+	if os.IsNotExist(err) {
+		return index, nil
+	} else if err != nil {
+		return index, err
+	}
+
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("invalid %s: %w", IndexFile, err)
+	}
+	return index, nil
+}
+
+// Adds the manifest to the layout's index, replacing any manifest with the same ref name.
+func AddManifest(dir string, manifest Descriptor) error {
+	index, err := ReadIndex(dir)
+	if err != nil {
+		return err
+	}
+
+	refName := manifest.Annotations[AnnotationRefName]
+	manifests := make([]Descriptor, 0, len(index.Manifests)+1)
+	for _, existing := range index.Manifests {
+		if refName == "" || existing.Annotations[AnnotationRefName] != refName {
+			manifests = append(manifests, existing)
+		}
+	}
+	index.Manifests = append(manifests, manifest)
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, IndexFile), data, 0644)
+}
+
+// Opens the blob with digest.
+func OpenBlob(dir, digest string) (*os.File, error) {
+	path, err := BlobPath(dir, digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Reads the json blob desc describes into v, checking its digest.
+func ReadJsonBlob(dir string, desc Descriptor, v interface{}) error {
+	path, err := BlobPath(dir, desc.Digest)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data)); digest != desc.Digest {
+		return fmt.Errorf("blob %s is corrupt: its digest is %s", desc.Digest, digest)
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// The manifest in the layout called ref, and its image config. With no ref,
+// or a ref the layout doesn't have, the layout must have a single manifest. Multi-platform images resolve to
+// their linux/amd64 manifest.
+func FindImage(dir, ref string) (Manifest, Image, error) {
+	manifest, image := Manifest{}, Image{}
+
+	index, err := ReadIndex(dir)
+	if err != nil {
+		return manifest, image, err
+	}
+
+	var found *Descriptor
+	for i, desc := range index.Manifests {
+		if ref == "" || desc.Annotations[AnnotationRefName] == ref {
+			if found != nil {
+				return manifest, image, fmt.Errorf("%s has several images, name one with its tag", dir)
+			}
+			found = &index.Manifests[i]
+		}
+	}
+	// a layout with one image needn't name it
+	if found == nil && len(index.Manifests) == 1 {
+		found = &index.Manifests[0]
+	}
+	if found == nil {
+		return manifest, image, fmt.Errorf("%s has no image '%s'", dir, ref)
+	}
+
+	desc := *found
+	if desc.MediaType == MediaTypeIndex || desc.MediaType == MediaTypeDockerManifestList {
+		if desc, err = platformManifest(dir, desc); err != nil {
+			return manifest, image, err
+		}
+	}
+
+	if err := ReadJsonBlob(dir, desc, &manifest); err != nil {
+		return manifest, image, err
+	}
+	if err := ReadJsonBlob(dir, manifest.Config, &image); err != nil {
+		return manifest, image, err
+	}
+	return manifest, image, nil
+}
+
+// the linux/amd64 manifest in the index desc describes
+func platformManifest(dir string, desc Descriptor) (Descriptor, error) {
+	index := Index{}
+	if err := ReadJsonBlob(dir, desc, &index); err != nil {
+		return desc, err
+	}
+
+	for _, manifest := range index.Manifests {
+		if manifest.Platform == nil || (manifest.Platform.OS == "linux" && manifest.Platform.Architecture == "amd64") {
+			return manifest, nil
+		}
+	}
+	return desc, fmt.Errorf("image %s has no linux/amd64 manifest", desc.Digest)
+}
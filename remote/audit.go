@@ -0,0 +1,153 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// Each repo has an audit log, audit/<repo>.log, of json records, one per
+// line. Each record has the hash of the one before it, so a record can't be
+// changed or removed without breaking the chain from there on. History is
+// for people; the audit log is for showing it hasn't been tampered with.
+//
+// The hashes aren't keyed or signed, so anyone who can write the remote can
+// rewrite the whole log as a new, intact chain. The log is only tamper
+// evident against a head hash kept somewhere else: a chain which still has
+// that record hasn't changed up to it.
+//
+// The log is rewritten to append a record, so appends must hold the repo's
+// lock, as pushes do.
+const AuditDir = "audit"
+
+type AuditRecord struct {
+	Seq    int       `json:"seq"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Repo   string    `json:"repo"`
+	Tag    string    `json:"tag,omitempty"`
+	ID     ID        `json:"id"`
+	// the digest of the image's config, which newer dockers call its id
+	Digest string `json:"digest,omitempty"`
+	Actor  string `json:"actor"`
+	Host   string `json:"host"`
+
+	// the hash of the record before, and of this one
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+// An error in the chain, at the record with Seq
+type AuditChainError struct {
+	Repo   string
+	Seq    int
+	Reason string
+}
+
+func (err *AuditChainError) Error() string {
+	return fmt.Sprintf("the audit log of '%s' has been tampered with at record %d: %s", err.Repo, err.Seq, err.Reason)
+}
+
+func auditKey(repo string) string {
+	return path.Join(AuditDir, repo+".log")
+}
+
+// The hash of the record, without its own hash
+func (record AuditRecord) hash() string {
+	record.Hash = ""
+	data, _ := json.Marshal(record)
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// Appends a record of action on image, by the current user on this host, to
+// the end of its repo's audit log.
+func AppendAudit(r Remote, action, image string, id ID, digest string) (AuditRecord, error) {
+	repo, tag := NormaliseImageName(image)
+	host, _ := os.Hostname()
+
+	record := AuditRecord{
+		Seq:    1,
+		Time:   time.Now().UTC(),
+		Action: action,
+		Repo:   repo,
+		Tag:    tag,
+		ID:     id,
+		Digest: digest,
+		Actor:  os.Getenv("USER"),
+		Host:   host,
+	}
+
+	data, err := r.Get(auditKey(repo))
+	if err != nil && err != ErrNoSuchKey {
+		return record, err
+	}
+
+	records, err := parseAuditLog(repo, data)
+	if err != nil {
+		return record, err
+	}
+	// don't extend a chain that's already broken
+	if err := VerifyAudit(repo, records); err != nil {
+		return record, err
+	}
+
+	if len(records) > 0 {
+		last := records[len(records)-1]
+		record.Seq, record.Prev = last.Seq+1, last.Hash
+	}
+	record.Hash = record.hash()
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return record, err
+	}
+	return record, r.Put(auditKey(repo), append(data, append(line, '\n')...))
+}
+
+// The repo's audit log, oldest first. Empty if it has none.
+func ReadAudit(r Remote, repo string) ([]AuditRecord, error) {
+	data, err := r.Get(auditKey(repo))
+	if err == ErrNoSuchKey {
+		return []AuditRecord{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseAuditLog(repo, data)
+}
+
+func parseAuditLog(repo string, data []byte) ([]AuditRecord, error) {
+	records := []AuditRecord{}
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		record := AuditRecord{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, &AuditChainError{Repo: repo, Seq: len(records) + 1, Reason: fmt.Sprintf("line %d isn't a record: %s", i+1, err)}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Checks each record's hash, and that each follows the one before.
+func VerifyAudit(repo string, records []AuditRecord) error {
+	prev := ""
+	for i, record := range records {
+		if record.Seq != i+1 {
+			return &AuditChainError{Repo: repo, Seq: i + 1, Reason: fmt.Sprintf("it's numbered %d", record.Seq)}
+		}
+		if record.Prev != prev {
+			return &AuditChainError{Repo: repo, Seq: record.Seq, Reason: "it doesn't follow the record before"}
+		}
+		if record.Hash != record.hash() {
+			return &AuditChainError{Repo: repo, Seq: record.Seq, Reason: "its contents don't match its hash"}
+		}
+		prev = record.Hash
+	}
+	return nil
+}
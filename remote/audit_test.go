@@ -0,0 +1,137 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func appendTestAudit(t *testing.T, r Remote, tags ...string) []AuditRecord {
+	for _, tag := range tags {
+		if _, err := AppendAudit(r, "push", "app:"+tag, ID("0123456789ab"), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := ReadAudit(r, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func writeAudit(t *testing.T, r Remote, records []AuditRecord) {
+	var data bytes.Buffer
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data.Write(append(line, '\n'))
+	}
+	if err := r.Put(auditKey("app"), data.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppendAudit(t *testing.T) {
+	r := newTestLocalRemote(t)
+	if records, err := ReadAudit(r, "app"); err != nil || len(records) != 0 {
+		t.Fatalf("read %+v, %v before any pushes", records, err)
+	}
+
+	records := appendTestAudit(t, r, "v1", "v2", "v3")
+	if len(records) != 3 {
+		t.Fatalf("got %+v", records)
+	}
+	for i, record := range records {
+		if record.Seq != i+1 || record.Repo != "app" || record.Action != "push" || record.Hash != record.hash() {
+			t.Errorf("%d: got %+v", i, record)
+		}
+		if i > 0 && record.Prev != records[i-1].Hash {
+			t.Errorf("%d doesn't follow the record before: %+v", i, record)
+		}
+	}
+	if err := VerifyAudit("app", records); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyAudit(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func([]AuditRecord) []AuditRecord
+		seq    int
+	}{
+		{"edited", func(records []AuditRecord) []AuditRecord {
+			records[1].Tag = "v9"
+			return records
+		}, 2},
+		{"edited and rehashed", func(records []AuditRecord) []AuditRecord {
+			records[1].Tag = "v9"
+			records[1].Hash = records[1].hash()
+			return records
+		}, 3},
+		{"removed", func(records []AuditRecord) []AuditRecord {
+			return append(records[:1], records[2:]...)
+		}, 2},
+		{"reordered", func(records []AuditRecord) []AuditRecord {
+			records[1], records[2] = records[2], records[1]
+			return records
+		}, 2},
+	}
+
+	for _, test := range tests {
+		r := newTestLocalRemote(t)
+		records := test.change(appendTestAudit(t, r, "v1", "v2", "v3"))
+
+		var chainErr *AuditChainError
+		if err := VerifyAudit("app", records); !errors.As(err, &chainErr) || chainErr.Seq != test.seq {
+			t.Errorf("%s: got %v, want a break at %d", test.name, err, test.seq)
+		}
+
+		// nothing more is appended to a broken chain
+		writeAudit(t, r, records)
+		if _, err := AppendAudit(r, "push", "app:v4", ID("0123456789ab"), ""); !errors.As(err, &chainErr) {
+			t.Errorf("%s: appending got %v", test.name, err)
+		}
+	}
+}
+
+// Without a key, removing records from the end, or rewriting every hash,
+// leaves a chain which verifies. Only a head kept elsewhere catches it.
+func TestVerifyAuditUnpinned(t *testing.T) {
+	r := newTestLocalRemote(t)
+	records := appendTestAudit(t, r, "v1", "v2", "v3")
+	head := records[2].Hash
+
+	if err := VerifyAudit("app", records[:2]); err != nil {
+		t.Errorf("truncated: %v", err)
+	}
+
+	records[1].Tag = "v9"
+	for i := range records {
+		if i > 0 {
+			records[i].Prev = records[i-1].Hash
+		}
+		records[i].Hash = records[i].hash()
+	}
+	if err := VerifyAudit("app", records); err != nil {
+		t.Errorf("rewritten: %v", err)
+	}
+	if records[2].Hash == head {
+		t.Error("the rewritten log has the same head")
+	}
+}
+
+func TestParseAuditLog(t *testing.T) {
+	records, err := parseAuditLog("app", []byte("\n{\"seq\":1}\n\n"))
+	if err != nil || len(records) != 1 || records[0].Seq != 1 {
+		t.Errorf("got %+v, %v", records, err)
+	}
+
+	var chainErr *AuditChainError
+	if _, err := parseAuditLog("app", []byte("{\"seq\":1}\nnot json\n")); !errors.As(err, &chainErr) || chainErr.Seq != 2 {
+		t.Errorf("got %v, want a break at 2", err)
+	}
+}
@@ -0,0 +1,320 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/blake-education/dogestry/cache"
+	"github.com/blake-education/dogestry/utils"
+)
+
+// Layers are stored once, named by the sha256 of their content, rather than in
+// their image's directory. Each image's directory has an index mapping the
+// names of its layer files to their digests.
+const (
+	BlobsDir      = "blobs/sha256"
+	BlobIndexFile = "blobs.json"
+)
+
+var (
+	// layers bigger than this are split into chunks, stored as separate blobs,
+	// so they're transferred in parallel and resumed a chunk at a time
+	ChunkThreshold int64 = 1024 * 1024 * 1024
+	ChunkSize      int64 = 256 * 1024 * 1024
+)
+
+// file name in the image directory -> digest ("sha256:<hex>").
+// A chunked file has an entry per chunk, named <file>.chunk-NNNN.
+type BlobIndex map[string]string
+
+// A file in an image directory and the blobs making it up, in order.
+type BlobFile struct {
+	Name    string
+	Digests []string
+}
+
+const chunkSuffix = ".chunk-"
+
+func chunkName(name string, i int) string {
+	return fmt.Sprintf("%s%s%04d", name, chunkSuffix, i)
+}
+
+// The files the index describes, with chunks grouped into their files.
+func (index BlobIndex) Files() []BlobFile {
+	chunks := make(map[string][]string)
+	for name := range index {
+		file := name
+		if i := strings.LastIndex(name, chunkSuffix); i != -1 {
+			file = name[:i]
+		}
+		chunks[file] = append(chunks[file], name)
+	}
+
+	files := make([]BlobFile, 0, len(chunks))
+	for file, names := range chunks {
+		// zero padding makes these sort in order
+		sort.Strings(names)
+
+		digests := make([]string, len(names))
+		for i, name := range names {
+			digests[i] = index[name]
+		}
+		files = append(files, BlobFile{Name: file, Digests: digests})
+	}
+	return files
+}
+
+// the key of the blob with digest, relative to the remote's root
+func BlobKey(digest string) (string, error) {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	if hex == digest || hex == "" || strings.ContainsAny(hex, "/.") {
+		return "", fmt.Errorf("invalid digest '%s'", digest)
+	}
+	return path.Join(BlobsDir, hex), nil
+}
+
+// Moves the layers of each image in a prepared imageRoot into blobs, and
+// writes each image's index.
+func ContentAddress(imageRoot string) error {
+	imageDirs, err := ioutil.ReadDir(filepath.Join(imageRoot, "images"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	blobsDir := filepath.Join(imageRoot, filepath.FromSlash(BlobsDir))
+	if err := os.MkdirAll(blobsDir, 0700); err != nil {
+		return err
+	}
+
+	for _, imageDir := range imageDirs {
+		if !imageDir.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(imageRoot, "images", imageDir.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		index := make(BlobIndex)
+		for _, file := range files {
+			if !strings.HasPrefix(file.Name(), "layer.tar") {
+				continue
+			}
+
+			src := filepath.Join(dir, file.Name())
+
+			if file.Size() > ChunkThreshold {
+				if err := chunkFile(src, blobsDir, index); err != nil {
+					return err
+				}
+				continue
+			}
+
+			hex, err := utils.Sha256File(src)
+			if err != nil {
+				return err
+			}
+
+			if err := os.Rename(src, filepath.Join(blobsDir, hex)); err != nil {
+				return err
+			}
+			index[file.Name()] = "sha256:" + hex
+		}
+
+		if len(index) == 0 {
+			continue
+		}
+
+		data, err := json.Marshal(index)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, BlobIndexFile), data, 0600); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Splits the file at src into ChunkSize blobs, adding them to index.
+func chunkFile(src, blobsDir string, index BlobIndex) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for i := 0; ; i++ {
+		chunk, err := ioutil.TempFile(blobsDir, "chunk")
+		if err != nil {
+			return err
+		}
+
+		hash := sha256.New()
+		n, err := io.CopyN(io.MultiWriter(chunk, hash), f, ChunkSize)
+		chunk.Close()
+		if err != nil && err != io.EOF {
+			os.Remove(chunk.Name())
+			return err
+		}
+
+		if n == 0 {
+			os.Remove(chunk.Name())
+			break
+		}
+
+		hex := fmt.Sprintf("%x", hash.Sum(nil))
+		if err := os.Rename(chunk.Name(), filepath.Join(blobsDir, hex)); err != nil {
+			return err
+		}
+		index[chunkName(filepath.Base(src), i)] = "sha256:" + hex
+
+		if n < ChunkSize {
+			break
+		}
+	}
+
+	return os.Remove(src)
+}
+
+// Parses an image's blob index.
+func ParseBlobIndex(data []byte) (BlobIndex, error) {
+	index := make(BlobIndex)
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid blob index: %w", err)
+	}
+	return index, nil
+}
+
+// Replaces the blob index in a pulled image dir with the blobs it names,
+// fetching several at a time with fetch(key, dst), retrying failures, and checking each one's
+// content matches its digest. Blobs in the local cache aren't fetched at all, and
+// peers (`peer` in the [dogestry] section) are asked for blobs before the remote.
+// Chunks are then joined back into their files. Image dirs without an index are left alone.
+func resolveBlobs(imageDir string, config RemoteConfig, fetch func(key, dst string) error) error {
+	indexPath := filepath.Join(imageDir, BlobIndexFile)
+
+	data, err := ioutil.ReadFile(indexPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	index, err := ParseBlobIndex(data)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(index))
+	for name := range index {
+		names = append(names, name)
+	}
+
+	blobs := cache.New(config.Config)
+	err = TransferEach(names, config.Concurrency(), config.Retries(), config.Control, func(name string) (int64, error) {
+		return fetchBlob(imageDir, name, index[name], blobs, config.Config.Dogestry.Peer, config.Control.output(), fetch)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range index.Files() {
+		if len(file.Digests) == 1 && index[file.Name] != "" {
+			continue
+		}
+		if err := joinChunks(imageDir, file); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(indexPath)
+}
+
+// fetches the blob with digest into imageDir as name, returning how many bytes
+// were fetched. Nothing is fetched if it's cached. Peers failing are printed to out.
+func fetchBlob(imageDir, name, digest string, blobs *cache.Cache, peers []string, out io.Writer, fetch func(key, dst string) error) (int64, error) {
+	key, err := BlobKey(digest)
+	if err != nil {
+		return 0, err
+	}
+
+	dst := filepath.Join(imageDir, filepath.Base(name))
+	if found, err := blobs.Get(key, dst); err != nil {
+		return 0, err
+	} else if found {
+		return 0, nil
+	}
+
+	if !fetchFromPeers(peers, key, digest, dst, out) {
+		if err := fetch(key, dst); err != nil {
+			return 0, err
+		}
+
+		if err := verifyBlob(dst, digest); err != nil {
+			os.Remove(dst)
+			return 0, err
+		}
+	}
+
+	info, err := os.Stat(dst)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), blobs.Put(key, dst)
+}
+
+// concatenates the chunks of file, in imageDir, into the file
+func joinChunks(imageDir string, file BlobFile) error {
+	f, err := os.Create(filepath.Join(imageDir, filepath.Base(file.Name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for i := range file.Digests {
+		path := filepath.Join(imageDir, chunkName(filepath.Base(file.Name), i))
+
+		chunk, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, chunk)
+		chunk.Close()
+		if err != nil {
+			return err
+		}
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checks the file at path has the content digest names
+func verifyBlob(path, digest string) error {
+	hex, err := utils.Sha256File(path)
+	if err != nil {
+		return err
+	}
+
+	if "sha256:"+hex != digest {
+		return &ChecksumError{File: filepath.Base(path), Expected: digest, Actual: "sha256:" + hex}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Docker 1.10 on names images by the digest of their config, rather than by
+// the ids of the legacy image dirs the remote stores. Images pushed from those
+// dockers keep their config in their top image dir, and the remote maps each
+// config digest back to the dir, so images can be found by either id.
+const (
+	ImageConfigFile = "config.json"
+	ConfigIdsDir    = "ids/sha256"
+
+	// Where docker says the foreign layers of image, e.g. Windows base layers,
+	// come from, by diff id, so it doesn't push them to registries
+	LayerSourcesFile = "layer-sources.json"
+)
+
+// The config of image id, as docker 1.10 on saved it. Nil for images pushed
+// from older dockers.
+func ImageConfig(r Remote, id ID) ([]byte, error) {
+	data, err := r.Get(path.Join("images", string(id), ImageConfigFile))
+	if err == ErrNoSuchKey {
+		return nil, nil
+	}
+	return data, err
+}
+
+// The layer sources of image id, as docker saved them. Nil for images without
+// foreign layers.
+func LayerSources(r Remote, id ID) ([]byte, error) {
+	data, err := r.Get(path.Join("images", string(id), LayerSourcesFile))
+	if err == ErrNoSuchKey {
+		return nil, nil
+	}
+	return data, err
+}
+
+// The id docker knows image id by: sha256:<digest of its config> for images
+// pushed from docker 1.10 on, otherwise id itself.
+func DockerImageId(r Remote, id ID) (string, error) {
+	config, err := ImageConfig(r, id)
+	if err != nil {
+		return "", err
+	} else if config == nil {
+		return string(id), nil
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(config)), nil
+}
+
+// Records that the image with config digest (sha256:<hex>) is stored as id.
+func PutConfigId(r Remote, digest string, id ID) error {
+	key, err := configIdKey(digest)
+	if err != nil {
+		return err
+	}
+	return r.Put(key, []byte(id))
+}
+
+// The image stored for a config digest, or ErrNoSuchImage. Config digests are
+// only found whole, not by prefix.
+func configImageId(r Remote, digest string) (ID, error) {
+	key, err := configIdKey(digest)
+	if err != nil {
+		return "", ErrNoSuchImage
+	}
+
+	data, err := r.Get(key)
+	if err == ErrNoSuchKey {
+		return "", ErrNoSuchImage
+	} else if err != nil {
+		return "", err
+	}
+	return ID(strings.TrimSpace(string(data))), nil
+}
+
+func configIdKey(digest string) (string, error) {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	if len(hex) != 2*sha256.Size || strings.Trim(hex, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("invalid config digest '%s'", digest)
+	}
+	return path.Join(ConfigIdsDir, hex), nil
+}
+
+// The full id of the image id names: a remote image id, a unique prefix of
+// one, or the digest of an image's config.
+func findImageId(r Remote, id ID) (ID, error) {
+	fullId, err := r.ImageFullId(ID(strings.TrimPrefix(string(id), "sha256:")))
+	if err == ErrNoSuchImage || (err == nil && fullId == "") {
+		return configImageId(r, string(id))
+	}
+	return fullId, err
+}
@@ -0,0 +1,109 @@
+package remote
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a Core of objects in a map
+type mapCore map[string][]byte
+
+func (core mapCore) Get(key string) ([]byte, error) {
+	data, ok := core[key]
+	if !ok {
+		return nil, ErrNoSuchKey
+	}
+	return data, nil
+}
+
+func (core mapCore) Put(key string, data []byte) error {
+	core[key] = data
+	return nil
+}
+
+func (core mapCore) List(prefix string) ([]string, error) {
+	keys := []string{}
+	for key := range core {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (core mapCore) Delete(key string) error {
+	if _, ok := core[key]; !ok {
+		return ErrNoSuchKey
+	}
+	delete(core, key)
+	return nil
+}
+
+func (core mapCore) ResolveImageNameToId(image string) (ID, error) {
+	repo, tag := NormaliseImageName(image)
+	return ParseTag(core, repo, tag)
+}
+
+func (core mapCore) Desc() string {
+	return "map"
+}
+
+func TestCoreTags(t *testing.T) {
+	core := mapCore{
+		"repositories/app/latest":                       []byte("abc"),
+		"repositories/org/app/v1":                       []byte("def"),
+		"repositories/app/v2" + tagTmpSuffix + "123456": []byte("ghi"),
+	}
+
+	if id, err := ParseTag(core, "org/app", "v1"); err != nil || id != "def" {
+		t.Errorf("org/app:v1: %q, %v", id, err)
+	}
+	if id, err := ParseTag(core, "app", "v2"); err != nil || id != "" {
+		t.Errorf("a missing tag: %q, %v", id, err)
+	}
+
+	tags, err := ListTags(core)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 || tags[0] != (Tag{"app", "latest", "abc"}) || tags[1] != (Tag{"org/app", "v1", "def"}) {
+		t.Errorf("got %+v", tags)
+	}
+}
+
+func TestCoreHistory(t *testing.T) {
+	core := mapCore{}
+	started := time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)
+	for i, repo := range []string{"app", "app/worker", "app"} {
+		entry := NewHistoryEntry("push", repo+":latest", ID("abc"))
+		entry.Time = started.Add(time.Duration(2-i) * time.Minute)
+		if err := AddHistory(core, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// app's own, oldest first, not app/worker's
+	history, err := History(core, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || !history[0].Time.Before(history[1].Time) {
+		t.Errorf("got %+v", history)
+	}
+}
+
+func TestCoreFormatVersion(t *testing.T) {
+	core := mapCore{}
+	if version, err := FormatVersion(core); err != nil || version != 0 {
+		t.Errorf("unmarked: %d, %v", version, err)
+	}
+	if err := SetFormatVersion(core, CurrentFormatVersion); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := FormatVersion(core); err != nil || version != CurrentFormatVersion {
+		t.Errorf("got %d, %v", version, err)
+	}
+}
@@ -0,0 +1,849 @@
+package remote
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/blake-education/dogestry/utils"
+	"github.com/blake-education/dogestry/vault"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// With `encryption-key-file` in its [remote] section, a remote only ever gets
+// images encrypted, with AES-256-GCM, and they're decrypted as they're pulled.
+// Each image's files and layers are encrypted, while tags, history and the
+// other bookkeeping which only names images are left readable.
+//
+// With a key manager (`kms-key-id`, `kms-command`, or age or gpg recipients) instead, each image is
+// encrypted with its own data key, which the key manager wraps. The wrapped
+// key is kept in the header of each of the image's files, so hosts the key
+// manager will unwrap it for can decrypt them, and nothing else is needed.
+//
+// An encrypted file is a magic line, the wrapped data key if there is one, a
+// nonce prefix, then the file in segments, each sealed separately so big
+// layers needn't fit in memory. The nonce prefix is derived from the file's
+// content, so the same layer always encrypts the same way with the same key,
+// and is still only pushed once.
+const (
+	encryptionMagic = "dogestry-aes256gcm-1\n"
+	// followed by the wrapped data key's length, as 2 bytes, and the key
+	envelopeMagic   = "dogestry-aes256gcm-2\n"
+	noncePrefixSize = 8
+	// what GCM adds to each segment
+	gcmOverhead = 16
+)
+
+// how much of a file each encrypted segment holds
+var EncryptionSegmentSize = 64 * 1024
+
+var ErrDecrypt = errors.New("can't decrypt, the encryption key is wrong or the file is corrupt")
+
+var ErrUnencrypted = errors.New("it isn't encrypted, but the remote is. Set allow-unencrypted in its config to pull images pushed before it was")
+
+type EncryptedRemote struct {
+	Remote
+
+	// the key file's key, if there is one
+	key *dataKey
+	// wraps each image's data key, if there is one
+	keys KeyManager
+
+	// accept image files which aren't encrypted
+	allowUnencrypted bool
+
+	control Control
+
+	sync.Mutex
+	// data keys by image, and by wrapped key, so each is unwrapped once
+	imageKeys map[ID]*dataKey
+	unwrapped map[string]*dataKey
+}
+
+// A key files are encrypted with
+type dataKey struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+	// as the key manager wrapped it. Nil for the key file's key
+	wrapped []byte
+}
+
+// Wraps r, encrypting with the key file or key manager in config.
+func NewEncryptedRemote(r Remote, config RemoteConfig) (*EncryptedRemote, error) {
+	remote := &EncryptedRemote{
+		Remote:           r,
+		allowUnencrypted: config.Allow_Unencrypted,
+		control:          config.Control,
+		imageKeys:        make(map[ID]*dataKey),
+		unwrapped:        make(map[string]*dataKey),
+	}
+
+	if config.Encryption_Key_File != "" || config.Encryption_Key_Vault_Path != "" {
+		key, err := encryptionKey(config)
+		if err != nil {
+			return nil, err
+		}
+		if remote.key, err = newDataKey(key, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if remote.keys, err = newKeyManager(config); err != nil {
+		return nil, err
+	}
+	return remote, nil
+}
+
+func newDataKey(key, wrapped []byte) (*dataKey, error) {
+	block, err := aes.NewCipher(deriveKey(key, "encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{aead: aead, nonceKey: deriveKey(key, "nonce"), wrapped: wrapped}, nil
+}
+
+// A key file holds a 256 bit key, as 32 bytes or 64 hex digits, e.g. from
+// `openssl rand -hex 32`.
+func readEncryptionKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading encryption key: %w", err)
+	}
+
+	if len(data) == 32 {
+		return data, nil
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("invalid encryption key %s: it must be 32 bytes, or 64 hex digits", path)
+}
+
+// The key from the remote's key file, or the `key` of its vault secret, as 64
+// hex digits or 32 bytes of base64.
+func encryptionKey(config RemoteConfig) ([]byte, error) {
+	if config.Encryption_Key_Vault_Path == "" {
+		return readEncryptionKey(config.Encryption_Key_File)
+	}
+
+	client, err := vault.NewClient(config.Config)
+	if err != nil {
+		return nil, err
+	}
+	value, err := client.ReadField(config.Encryption_Key_Vault_Path, "key")
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := hex.DecodeString(value); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(value); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("invalid encryption key in vault secret %s: it must be 64 hex digits, or 32 bytes of base64", config.Encryption_Key_Vault_Path)
+}
+
+// a key for one purpose, so the key file's key isn't used for two
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("dogestry " + purpose))
+	return mac.Sum(nil)
+}
+
+func (remote *EncryptedRemote) Desc() string {
+	if remote.keys != nil {
+		return remote.Remote.Desc() + " (encrypted, with " + remote.keys.Desc() + ")"
+	}
+	return remote.Remote.Desc() + " (encrypted)"
+}
+
+// The key to encrypt image id with: with a key manager, the data key the image
+// already has on the remote, if it's been pushed before, otherwise a new one.
+// Otherwise the key file's key.
+func (remote *EncryptedRemote) imageKey(id ID) (*dataKey, error) {
+	if remote.keys == nil {
+		return remote.key, nil
+	}
+
+	remote.Lock()
+	key, ok := remote.imageKeys[id]
+	remote.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	data, err := remote.Remote.Get(path.Join("images", string(id), "json"))
+	if err == nil && bytes.HasPrefix(data, []byte(envelopeMagic)) {
+		if _, key, err = remote.readHeader(bufio.NewReader(bytes.NewReader(data))); err != nil {
+			// e.g. pushing to age recipients without an identity of one's own
+			remote.control.Printf("can't reuse the data key of image '%s', so it's encrypted again with a new one: %s\n", id.Short(), err)
+			key, err = nil, nil
+		}
+	} else if err == ErrNoSuchKey {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// new, or pushed before it was encrypted with data keys
+	if key == nil {
+		if key, err = remote.newKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	remote.Lock()
+	remote.imageKeys[id] = key
+	remote.Unlock()
+	return key, nil
+}
+
+// A new data key, wrapped by the key manager. The key file's key if there isn't one.
+func (remote *EncryptedRemote) newKey() (*dataKey, error) {
+	if remote.keys == nil {
+		return remote.key, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	wrapped, err := remote.keys.WrapKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) > 0xffff {
+		return nil, fmt.Errorf("the wrapped data key is too big, at %d bytes", len(wrapped))
+	}
+	return newDataKey(key, wrapped)
+}
+
+// The data key wrapped is, unwrapped by the key manager.
+func (remote *EncryptedRemote) unwrapKey(wrapped []byte) (*dataKey, error) {
+	if remote.keys == nil {
+		return nil, fmt.Errorf("this is encrypted with a wrapped data key, and the remote has no kms-key-id, kms-command, age or gpg keys to unwrap it with")
+	}
+
+	remote.Lock()
+	key, ok := remote.unwrapped[string(wrapped)]
+	remote.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	plain, err := remote.keys.UnwrapKey(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key: %w", err)
+	}
+	if key, err = newDataKey(plain, wrapped); err != nil {
+		return nil, err
+	}
+
+	remote.Lock()
+	remote.unwrapped[string(wrapped)] = key
+	remote.Unlock()
+	return key, nil
+}
+
+// Encrypts the prepared image's files in imageRoot, then pushes them. The
+// image's metadata is decrypted again afterwards, for whatever the push does next.
+func (remote *EncryptedRemote) Push(image, imageRoot string) error {
+	if err := remote.sealBlobs(imageRoot); err != nil {
+		return err
+	}
+
+	restore, err := remote.sealImageFiles(imageRoot)
+	defer restore()
+	if err != nil {
+		return err
+	}
+
+	return remote.Remote.Push(image, imageRoot)
+}
+
+// Encrypts the blobs in imageRoot. Images' layers are renamed by the digest of
+// their ciphertext, so pulls, caches and peers check what they actually
+// transfer. Other blobs, such as the registry view's, keep their names, which
+// manifests refer to them by.
+func (remote *EncryptedRemote) sealBlobs(imageRoot string) error {
+	blobsDir := filepath.Join(imageRoot, filepath.FromSlash(BlobsDir))
+
+	indexes, err := filepath.Glob(filepath.Join(imageRoot, "images", "*", BlobIndexFile))
+	if err != nil {
+		return err
+	}
+
+	// plaintext digest -> ciphertext digest
+	sealed := make(map[string]string)
+	for _, indexPath := range indexes {
+		data, err := ioutil.ReadFile(indexPath)
+		if err != nil {
+			return err
+		}
+		index, err := ParseBlobIndex(data)
+		if err != nil {
+			return err
+		}
+
+		key, err := remote.imageKey(ID(filepath.Base(filepath.Dir(indexPath))))
+		if err != nil {
+			return err
+		}
+
+		for name, digest := range index {
+			if _, ok := sealed[digest]; !ok {
+				if sealed[digest], err = sealBlob(imageRoot, digest, key); err != nil {
+					return err
+				}
+			}
+			index[name] = sealed[digest]
+		}
+
+		if data, err = json.Marshal(index); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(indexPath, data, 0600); err != nil {
+			return err
+		}
+	}
+
+	renamed := make(map[string]bool)
+	for _, digest := range sealed {
+		renamed[strings.TrimPrefix(digest, "sha256:")] = true
+	}
+
+	blobs, err := ioutil.ReadDir(blobsDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var key *dataKey
+	for _, blob := range blobs {
+		if !blob.Mode().IsRegular() || renamed[blob.Name()] {
+			continue
+		}
+		if key == nil {
+			if key, err = remote.newKey(); err != nil {
+				return err
+			}
+		}
+		if err := key.sealFile(filepath.Join(blobsDir, blob.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encrypts the blob with digest, returning its new digest
+func sealBlob(imageRoot, digest string, key *dataKey) (string, error) {
+	blobKey, err := BlobKey(digest)
+	if err != nil {
+		return "", err
+	}
+	src := filepath.Join(imageRoot, filepath.FromSlash(blobKey))
+
+	if err := key.sealFile(src); err != nil {
+		return "", err
+	}
+
+	hex, err := utils.Sha256File(src)
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex, os.Rename(src, filepath.Join(filepath.Dir(src), hex))
+}
+
+// Encrypts the files in each image dir, apart from the blob index, which only
+// names blobs. Returns a func putting back the plaintext of the small ones,
+// the image's metadata.
+func (remote *EncryptedRemote) sealImageFiles(imageRoot string) (func(), error) {
+	plaintext := make(map[string][]byte)
+	restore := func() {
+		for path, data := range plaintext {
+			ioutil.WriteFile(path, data, 0600)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(imageRoot, "images", "*", "*"))
+	if err != nil {
+		return restore, err
+	}
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return restore, err
+		}
+		if !info.Mode().IsRegular() || info.Name() == BlobIndexFile {
+			continue
+		}
+		key, err := remote.imageKey(ID(filepath.Base(filepath.Dir(file))))
+		if err != nil {
+			return restore, err
+		}
+
+		if !strings.HasPrefix(info.Name(), "layer.tar") {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return restore, err
+			}
+			plaintext[file] = data
+		}
+
+		if err := key.sealFile(file); err != nil {
+			return restore, err
+		}
+	}
+	return restore, nil
+}
+
+// Pulls image id into dst, then decrypts it.
+func (remote *EncryptedRemote) PullImageId(id ID, dst string) error {
+	if err := remote.Remote.PullImageId(id, dst); err != nil {
+		return err
+	}
+
+	return filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		return remote.openFile(path)
+	})
+}
+
+// Streams image id's files to w, decrypting them on the way.
+func (remote *EncryptedRemote) StreamImageId(id ID, w *tar.Writer) error {
+	reader, writer := io.Pipe()
+
+	streamed := make(chan error, 1)
+	go func() {
+		files := tar.NewWriter(writer)
+		err := remote.Remote.StreamImageId(id, files)
+		if err == nil {
+			err = files.Close()
+		}
+		writer.CloseWithError(err)
+		streamed <- err
+	}()
+
+	err := func() error {
+		files := tar.NewReader(reader)
+		for {
+			header, err := files.Next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			plain, headerSize, err := remote.openReader(files, true)
+			if err != nil {
+				return fmt.Errorf("%s: %w", header.Name, err)
+			}
+			if headerSize > 0 {
+				header.Size = plaintextSize(header.Size, headerSize)
+			}
+
+			if err := w.WriteHeader(header); err != nil {
+				return err
+			}
+			if _, err := io.Copy(w, plain); err != nil {
+				return fmt.Errorf("%s: %w", header.Name, err)
+			}
+		}
+	}()
+
+	// stop the stream if we gave up early
+	reader.CloseWithError(err)
+
+	if streamErr := <-streamed; err == nil {
+		err = streamErr
+	}
+	return err
+}
+
+func (remote *EncryptedRemote) ImageMetadata(id ID) (docker.Image, error) {
+	image := docker.Image{}
+
+	data, err := remote.Get(path.Join("images", string(id), "json"))
+	if err == ErrNoSuchKey {
+		return image, ErrNoSuchImage
+	} else if err != nil {
+		return image, err
+	}
+
+	err = json.Unmarshal(data, &image)
+	return image, err
+}
+
+func (remote *EncryptedRemote) WalkImages(id ID, walker ImageWalkFn) error {
+	return WalkImages(remote, id, walker)
+}
+
+func (remote *EncryptedRemote) ResolveImageNameToId(image string) (ID, error) {
+	return ResolveImageNameToId(remote, image)
+}
+
+// Gets key, decrypting it if it's encrypted.
+func (remote *EncryptedRemote) Get(key string) ([]byte, error) {
+	data, err := remote.Remote.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, _, err := remote.openReader(bytes.NewReader(data), sealedKey(key))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	if data, err = ioutil.ReadAll(plain); err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return data, nil
+}
+
+// whether key is one of an image's files or a blob, which are always
+// encrypted, rather than bookkeeping which only names images
+func sealedKey(key string) bool {
+	if strings.HasPrefix(key, BlobsDir+"/") {
+		return true
+	}
+	parts := strings.Split(key, "/")
+	return len(parts) > 2 && parts[0] == "images" && parts[len(parts)-1] != BlobIndexFile
+}
+
+// Puts key, encrypted if it belongs to an image.
+func (remote *EncryptedRemote) Put(key string, data []byte) error {
+	if !sealedKey(key) {
+		return remote.Remote.Put(key, data)
+	}
+
+	var dataKey *dataKey
+	var err error
+	if strings.HasPrefix(key, BlobsDir+"/") {
+		dataKey, err = remote.newKey()
+	} else {
+		dataKey, err = remote.imageKey(ID(strings.Split(key, "/")[1]))
+	}
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, dataKey.nonceKey)
+	mac.Write(data)
+
+	sealed := &bytes.Buffer{}
+	if err := dataKey.seal(sealed, bytes.NewReader(data), mac.Sum(nil)[:noncePrefixSize]); err != nil {
+		return err
+	}
+	return remote.Remote.Put(key, sealed.Bytes())
+}
+
+// Opens key, decrypting it if it's encrypted.
+func (remote *EncryptedRemote) Open(key string) (io.ReadCloser, int64, error) {
+	rc, size, err := remote.Remote.Open(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	plain, headerSize, err := remote.openReader(rc, sealedKey(key))
+	if err != nil {
+		rc.Close()
+		return nil, 0, fmt.Errorf("%s: %w", key, err)
+	}
+	if headerSize > 0 {
+		size = plaintextSize(size, headerSize)
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{plain, rc}, size, nil
+}
+
+// Encrypts the file at path in place. Files already encrypted are left alone.
+func (key *dataKey) sealFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	in := bufio.NewReader(f)
+	if isEncrypted(in) {
+		return nil
+	}
+
+	mac := hmac.New(sha256.New, key.nonceKey)
+	if _, err := io.Copy(mac, in); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+
+	return replaceFile(path, func(out io.Writer) error {
+		return key.seal(out, bufio.NewReader(f), mac.Sum(nil)[:noncePrefixSize])
+	})
+}
+
+// Decrypts the file at path, one of an image's, in place. Files which aren't
+// encrypted are refused, unless the remote allows them.
+func (remote *EncryptedRemote) openFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	plain, headerSize, err := remote.openReader(f, true)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(path), err)
+	} else if headerSize == 0 {
+		return nil
+	}
+
+	return replaceFile(path, func(out io.Writer) error {
+		if _, err := io.Copy(out, plain); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		return nil
+	})
+}
+
+// writes path's new content with write, via a temp file, so a failure leaves path as it was
+func replaceFile(path string, write func(out io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".crypt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	out := bufio.NewWriter(tmp)
+	err = write(out)
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Writes src to dst encrypted. Each segment is sealed with a nonce of the
+// prefix and its number, and the last is marked as such, so a truncated file
+// fails to decrypt rather than coming out short.
+func (key *dataKey) seal(dst io.Writer, src io.Reader, prefix []byte) error {
+	header := []byte(encryptionMagic)
+	if key.wrapped != nil {
+		header = append([]byte(envelopeMagic), byte(len(key.wrapped)>>8), byte(len(key.wrapped)))
+		header = append(header, key.wrapped...)
+	}
+	if _, err := dst.Write(append(header, prefix...)); err != nil {
+		return err
+	}
+
+	in := bufio.NewReaderSize(src, EncryptionSegmentSize)
+	segment := make([]byte, EncryptionSegmentSize)
+	var sealed []byte
+
+	for i := uint32(0); ; i++ {
+		n, err := io.ReadFull(in, segment)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last, err := atEOF(in)
+		if err != nil {
+			return err
+		}
+
+		sealed = key.aead.Seal(sealed[:0], segmentNonce(prefix, i), segment[:n], segmentData(last))
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// A reader of src's plaintext, and the size of its encryption header. Unless
+// sealed says src must be encrypted, and the remote doesn't allow otherwise,
+// anything not encrypted is read as it is, with no header.
+func (remote *EncryptedRemote) openReader(src io.Reader, sealed bool) (io.Reader, int, error) {
+	in := bufio.NewReaderSize(src, EncryptionSegmentSize+gcmOverhead)
+	if !isEncrypted(in) {
+		if sealed && !remote.allowUnencrypted {
+			return nil, 0, ErrUnencrypted
+		}
+		return in, 0, nil
+	}
+
+	headerSize, key, err := remote.readHeader(in)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(in, prefix); err != nil {
+		return nil, 0, ErrDecrypt
+	}
+
+	return &openReader{
+		aead:    key.aead,
+		in:      in,
+		prefix:  prefix,
+		segment: make([]byte, EncryptionSegmentSize+gcmOverhead),
+	}, headerSize + noncePrefixSize, nil
+}
+
+// Reads an encrypted file's magic line and any wrapped key, returning their
+// size and the key the file is encrypted with.
+func (remote *EncryptedRemote) readHeader(in *bufio.Reader) (int, *dataKey, error) {
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(in, magic); err != nil {
+		return 0, nil, ErrDecrypt
+	}
+
+	switch string(magic) {
+	case encryptionMagic:
+		if remote.key == nil {
+			return 0, nil, fmt.Errorf("this is encrypted with a key file's key, and the remote has no encryption-key-file")
+		}
+		return len(magic), remote.key, nil
+
+	case envelopeMagic:
+		size := make([]byte, 2)
+		if _, err := io.ReadFull(in, size); err != nil {
+			return 0, nil, ErrDecrypt
+		}
+		wrapped := make([]byte, int(size[0])<<8|int(size[1]))
+		if _, err := io.ReadFull(in, wrapped); err != nil {
+			return 0, nil, ErrDecrypt
+		}
+
+		key, err := remote.unwrapKey(wrapped)
+		return len(magic) + len(size) + len(wrapped), key, err
+	}
+	return 0, nil, fmt.Errorf("unknown encryption format '%s'", strings.TrimSpace(string(magic)))
+}
+
+type openReader struct {
+	aead    cipher.AEAD
+	in      *bufio.Reader
+	prefix  []byte
+	segment []byte
+
+	// the current segment's plaintext not yet read
+	plain []byte
+	n     uint32
+	done  bool
+}
+
+func (r *openReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// decrypts the next segment
+func (r *openReader) next() error {
+	n, err := io.ReadFull(r.in, r.segment)
+	if err == io.EOF {
+		// there was no last segment
+		return ErrDecrypt
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last, err := atEOF(r.in)
+	if err != nil {
+		return err
+	}
+
+	plain, err := r.aead.Open(r.segment[:0], segmentNonce(r.prefix, r.n), r.segment[:n], segmentData(last))
+	if err != nil {
+		return ErrDecrypt
+	}
+	r.plain, r.done = plain, last
+	r.n++
+	return nil
+}
+
+func isEncrypted(in *bufio.Reader) bool {
+	magic, _ := in.Peek(len(encryptionMagic))
+	return string(magic) == encryptionMagic || string(magic) == envelopeMagic
+}
+
+func atEOF(in *bufio.Reader) (bool, error) {
+	_, err := in.Peek(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+func segmentNonce(prefix []byte, i uint32) []byte {
+	nonce := make([]byte, noncePrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], i)
+	return nonce
+}
+
+// authenticated with each segment: whether it's the last
+func segmentData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// The size of the plaintext of an encrypted file of size bytes, with a header
+// of headerSize. Every segment but the last is full, and even an empty file
+// has a last segment.
+func plaintextSize(size int64, headerSize int) int64 {
+	body := size - int64(headerSize)
+	segment := int64(EncryptionSegmentSize + gcmOverhead)
+
+	full, rest := body/segment, body%segment
+	if rest == 0 {
+		return full * int64(EncryptionSegmentSize)
+	}
+	return full*int64(EncryptionSegmentSize) + rest - gcmOverhead
+}
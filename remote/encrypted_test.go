@@ -0,0 +1,215 @@
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blake-education/dogestry/config"
+)
+
+// An encrypted remote with a key file's key, on a local remote in a temp dir.
+func newTestEncryptedRemote(t *testing.T, allowUnencrypted bool) (*EncryptedRemote, *LocalRemote) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := RemoteConfig{Url: url.URL{Scheme: "local", Path: filepath.Join(dir, "remote")}}
+	cfg.Encryption_Key_File = keyFile
+	cfg.Allow_Unencrypted = allowUnencrypted
+
+	local, err := NewLocalRemote(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := NewEncryptedRemote(local, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted, local
+}
+
+func sealed(t *testing.T, key *dataKey, plain []byte) []byte {
+	out := &bytes.Buffer{}
+	if err := key.seal(out, bytes.NewReader(plain), []byte("noncepfx")); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	defer func(size int) { EncryptionSegmentSize = size }(EncryptionSegmentSize)
+	EncryptionSegmentSize = 16
+
+	remote, _ := newTestEncryptedRemote(t, false)
+	for _, size := range []int{0, 1, 15, 16, 17, 32, 100} {
+		plain := bytes.Repeat([]byte{'x'}, size)
+		ciphertext := sealed(t, remote.key, plain)
+
+		reader, headerSize, err := remote.openReader(bytes.NewReader(ciphertext), true)
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+		got, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: decrypted to %d bytes", size, len(got))
+		}
+		if n := plaintextSize(int64(len(ciphertext)), headerSize); n != int64(size) {
+			t.Errorf("%d bytes: plaintextSize is %d", size, n)
+		}
+	}
+}
+
+func TestEncryptionRejectsTampering(t *testing.T) {
+	defer func(size int) { EncryptionSegmentSize = size }(EncryptionSegmentSize)
+	EncryptionSegmentSize = 16
+
+	remote, _ := newTestEncryptedRemote(t, false)
+	ciphertext := sealed(t, remote.key, bytes.Repeat([]byte{'x'}, 40))
+	header := len(encryptionMagic) + noncePrefixSize
+
+	flipped := append([]byte{}, ciphertext...)
+	flipped[header+3] ^= 1
+
+	segment := EncryptionSegmentSize + gcmOverhead
+	tests := map[string][]byte{
+		"flipped bit":       flipped,
+		"truncated":         ciphertext[:header+segment],
+		"no segments":       ciphertext[:header],
+		"segments swapped":  append(append(append([]byte{}, ciphertext[:header]...), ciphertext[header+segment:header+2*segment]...), ciphertext[header:header+segment]...),
+		"last segment lost": ciphertext[:len(ciphertext)-(len(ciphertext)-header)%segment],
+	}
+
+	for name, data := range tests {
+		reader, _, err := remote.openReader(bytes.NewReader(data), true)
+		if err == nil {
+			_, err = ioutil.ReadAll(reader)
+		}
+		if err != ErrDecrypt {
+			t.Errorf("%s: got %v, want ErrDecrypt", name, err)
+		}
+	}
+}
+
+func TestEncryptionWrongKey(t *testing.T) {
+	remote, _ := newTestEncryptedRemote(t, false)
+	other, err := newDataKey(bytes.Repeat([]byte{1}, 32), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, _, err := remote.openReader(bytes.NewReader(sealed(t, other, []byte("secret"))), true)
+	if err == nil {
+		_, err = ioutil.ReadAll(reader)
+	}
+	if err != ErrDecrypt {
+		t.Errorf("got %v, want ErrDecrypt", err)
+	}
+}
+
+func TestEncryptedRemoteRefusesPlaintext(t *testing.T) {
+	remote, local := newTestEncryptedRemote(t, false)
+
+	// as anyone who can write to the remote could put it there
+	if err := local.Put("images/abc/json", []byte(`{"id":"abc"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Put("repositories/app/latest", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := remote.Get("images/abc/json"); !errors.Is(err, ErrUnencrypted) {
+		t.Errorf("Get of a plaintext image file: got %v, want ErrUnencrypted", err)
+	}
+	if _, _, err := remote.Open("images/abc/json"); !errors.Is(err, ErrUnencrypted) {
+		t.Errorf("Open of a plaintext image file: got %v, want ErrUnencrypted", err)
+	}
+	if _, err := remote.ImageMetadata("abc"); !errors.Is(err, ErrUnencrypted) {
+		t.Errorf("ImageMetadata of a plaintext image: got %v, want ErrUnencrypted", err)
+	}
+
+	// tags are never encrypted
+	if data, err := remote.Get("repositories/app/latest"); err != nil || string(data) != "abc" {
+		t.Errorf("Get of a tag: got %q, %v", data, err)
+	}
+
+	// what it puts itself it can read back
+	if err := remote.Put("images/abc/json", []byte(`{"id":"abc"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := local.Get("images/abc/json"); !bytes.HasPrefix(raw, []byte(encryptionMagic)) {
+		t.Errorf("Put didn't encrypt the image file")
+	}
+	if data, err := remote.Get("images/abc/json"); err != nil || string(data) != `{"id":"abc"}` {
+		t.Errorf("Get after Put: got %q, %v", data, err)
+	}
+}
+
+func TestEncryptedRemoteAllowUnencrypted(t *testing.T) {
+	remote, local := newTestEncryptedRemote(t, true)
+	if err := local.Put("images/abc/json", []byte(`{"id":"abc"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := remote.Get("images/abc/json"); err != nil || string(data) != `{"id":"abc"}` {
+		t.Errorf("got %q, %v", data, err)
+	}
+}
+
+func TestSealedKey(t *testing.T) {
+	tests := map[string]bool{
+		"images/abc/json":             true,
+		"images/abc/layer.tar":        true,
+		"images/abc/" + BlobIndexFile: false,
+		BlobsDir + "/0123":            true,
+		"repositories/app/latest":     false,
+		"history/app":                 false,
+		"images/abc":                  false,
+	}
+	for key, want := range tests {
+		if got := sealedKey(key); got != want {
+			t.Errorf("sealedKey(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestResolveConfigByUrlAppliesSection(t *testing.T) {
+	cfg := config.Config{Remote: map[string]*config.RemoteConfig{
+		"central": {Url: "s3://bucket/repo/?region=us-west-2", Encryption_Key_File: "/etc/key", Readonly: true},
+		"other":   {Url: "s3://bucket/elsewhere/"},
+	}}
+
+	for _, remoteUrl := range []string{"s3://bucket/repo/", "s3://bucket/repo", "s3://bucket/repo/?region=us-east-1"} {
+		resolved, err := ResolveConfig(remoteUrl, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resolved.Encrypted() || !resolved.Readonly {
+			t.Errorf("%s didn't get central's settings", remoteUrl)
+		}
+		if resolved.Url.String() != remoteUrl {
+			t.Errorf("%s: the url given should still be used, got %s", remoteUrl, resolved.Url.String())
+		}
+	}
+
+	resolved, err := ResolveConfig("s3://bucket/unconfigured/", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Encrypted() {
+		t.Errorf("an unconfigured url got a section's settings")
+	}
+
+	cfg.Remote["again"] = &config.RemoteConfig{Url: "s3://bucket/repo"}
+	if _, err := ResolveConfig("s3://bucket/repo/", cfg); err == nil {
+		t.Errorf("a url matching two remotes should be an error")
+	}
+}
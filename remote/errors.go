@@ -0,0 +1,36 @@
+package remote
+
+import (
+	"fmt"
+)
+
+// An error from credentials the remote refused, or from finding none.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// A file whose content doesn't match the digest or checksum recorded for it.
+type ChecksumError struct {
+	File     string
+	Expected string
+	Actual   string
+
+	// what to do about it, if there's anything
+	Hint string
+}
+
+func (e *ChecksumError) Error() string {
+	msg := fmt.Sprintf("%s is corrupt: expected %s, got %s", e.File, e.Expected, e.Actual)
+	if e.Hint != "" {
+		msg += ". " + e.Hint
+	}
+	return msg
+}
@@ -0,0 +1,138 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Something that happened to a file, or image, being transferred. These are
+// what -json prints as a push or pull goes, for tools following its progress.
+type Event struct {
+	Event   string    `json:"event"`
+	Key     string    `json:"key"`
+	Time    time.Time `json:"time"`
+	Attempt int       `json:"attempt,omitempty"`
+	Bytes   int64     `json:"bytes,omitempty"`
+	Seconds float64   `json:"seconds,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+const (
+	EventStarted  = "started"
+	EventRetrying = "retrying"
+	EventDone     = "done"
+	EventFailed   = "failed"
+
+	// how many of a file's bytes have been sent or received so far, as it's
+	// transferred, at most once a ProgressInterval. A resumed file's count
+	// includes what was transferred before
+	EventProgress = "progress"
+
+	// not a file's: a push or pull as a whole has finished. Only the dogestry
+	// package reports it
+	EventComplete = "complete"
+)
+
+// how often a file being transferred reports its progress
+var ProgressInterval = time.Second
+
+var ErrCanceled = errors.New("canceled")
+
+// Following and stopping one push or pull's transfers, among several. The
+// zero Control does neither.
+type Control struct {
+	// called with each event, from whichever goroutine is doing the transfer
+	Report func(Event)
+
+	// closed to stop transferring. Files already started are finished
+	Cancel <-chan struct{}
+
+	// where to print what's happening. Stdout if nil
+	Output io.Writer
+}
+
+func (control Control) output() io.Writer {
+	if control.Output == nil {
+		return os.Stdout
+	}
+	return control.Output
+}
+
+// Prints to the control's output.
+func (control Control) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(control.output(), format, args...)
+}
+
+func (control Control) Canceled() bool {
+	select {
+	case <-control.Cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// Calls fn to transfer key once, reporting it as started, then done with the
+// bytes fn transferred or failed, as TransferEach would.
+func ReportTransfer(control Control, key string, fn func() (int64, error)) error {
+	started := time.Now()
+	reportEvent(control, EventStarted, key, 0, 0, started, nil)
+	bytes, err := fn()
+	if err != nil {
+		reportEvent(control, EventFailed, key, 1, 0, started, err)
+	} else {
+		reportEvent(control, EventDone, key, 1, bytes, started, nil)
+	}
+	return err
+}
+
+func reportEvent(control Control, name, key string, attempt int, bytes int64, started time.Time, err error) {
+	event := Event{
+		Event:   name,
+		Key:     key,
+		Time:    time.Now().UTC(),
+		Attempt: attempt,
+		Bytes:   bytes,
+	}
+	if name != EventStarted {
+		event.Seconds = time.Since(started).Seconds()
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	if control.Report != nil {
+		control.Report(event)
+	}
+}
+
+// Reports the progress of key's transfer as r, its content from offset on,
+// is read. r itself if nothing's following the control's events.
+func (control Control) progressReader(key string, r io.Reader, offset int64) io.Reader {
+	if control.Report == nil {
+		return r
+	}
+	now := time.Now()
+	return &progressReader{r: r, control: control, key: key, read: offset, started: now, reported: now}
+}
+
+type progressReader struct {
+	r       io.Reader
+	control Control
+	key     string
+
+	read              int64
+	started, reported time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if now := time.Now(); now.Sub(p.reported) >= ProgressInterval {
+		p.reported = now
+		reportEvent(p.control, EventProgress, p.key, 0, p.read, p.started, nil)
+	}
+	return n, err
+}
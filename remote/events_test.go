@@ -0,0 +1,48 @@
+package remote
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestProgressReader(t *testing.T) {
+	defer func(interval time.Duration) { ProgressInterval = interval }(ProgressInterval)
+	ProgressInterval = 0
+
+	var events []Event
+	control := Control{Report: func(event Event) { events = append(events, event) }}
+
+	r := control.progressReader("images/abc/layer.tar", bytes.NewReader(make([]byte, 10)), 100)
+	buf := make([]byte, 4)
+	for {
+		if _, err := r.Read(buf); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// resumed at 100, then 4, 8 and 10 more, and once more at EOF
+	want := []int64{104, 108, 110, 110}
+	if len(events) != len(want) {
+		t.Fatalf("got %+v", events)
+	}
+	for i, event := range events {
+		if event.Event != EventProgress || event.Key != "images/abc/layer.tar" || event.Bytes != want[i] {
+			t.Errorf("%d: got %+v, want %d bytes", i, event, want[i])
+		}
+	}
+}
+
+func TestProgressReaderUnfollowed(t *testing.T) {
+	r := bytes.NewReader(nil)
+	if got := (Control{}).progressReader("key", r, 0); got != io.Reader(r) {
+		t.Errorf("got %T, want the reader itself", got)
+	}
+	if _, err := ioutil.ReadAll(Control{Report: func(Event) {}}.progressReader("key", r, 0)); err != nil {
+		t.Error(err)
+	}
+}
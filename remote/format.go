@@ -0,0 +1,105 @@
+package remote
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// the key of the format version marker, relative to the remote's root
+	FormatVersionKey = "dogestry-format"
+
+	// the repository layout this version of dogestry reads and writes
+	CurrentFormatVersion = 2
+)
+
+// migrates a remote from one format version to the next
+type migration func(remote Remote) error
+
+// migrations[v] upgrades a remote from format version v to v+1
+var migrations = map[int]migration{
+	// remotes from before the marker existed already use the version 1 layout
+	0: func(remote Remote) error { return nil },
+	// version 2 stores new layers as content addressed blobs. Version 1 images,
+	// with layers in their image dir, can still be read as they are
+	1: func(remote Remote) error { return nil },
+}
+
+func parseFormatVersion(data []byte) (int, error) {
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid format version marker '%s': %w", FormatVersionKey, err)
+	}
+	return version, nil
+}
+
+func formatVersionData(version int) []byte {
+	return []byte(strconv.Itoa(version) + "\n")
+}
+
+// The repository format version of the remote, 0 if it has no marker.
+func FormatVersion(remote Core) (int, error) {
+	data, err := remote.Get(FormatVersionKey)
+	if err == ErrNoSuchKey {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return parseFormatVersion(data)
+}
+
+// Writes the repository format version marker.
+func SetFormatVersion(remote Core, version int) error {
+	return remote.Put(FormatVersionKey, formatVersionData(version))
+}
+
+// Checks the remote's layout can be used by this version of dogestry.
+func CheckFormatVersion(remote Remote) error {
+	version, err := FormatVersion(remote)
+	if err != nil {
+		return err
+	}
+
+	if version > CurrentFormatVersion {
+		return fmt.Errorf("%s has repository format version %d, but this dogestry only understands up to version %d. Upgrade dogestry", remote.Desc(), version, CurrentFormatVersion)
+	} else if version < CurrentFormatVersion && migrations[version] == nil {
+		return fmt.Errorf("%s has unknown repository format version %d", remote.Desc(), version)
+	} else if version < CurrentFormatVersion {
+		return fmt.Errorf("%s has repository format version %d, but this dogestry needs version %d. Run `dogestry upgrade-repo`", remote.Desc(), version, CurrentFormatVersion)
+	}
+
+	return nil
+}
+
+// Migrates the remote's layout in place to the current format version.
+// Each step's marker is written as soon as it completes, so an interrupted
+// upgrade can be rerun.
+func UpgradeFormat(remote Remote, progress func(from, to int)) error {
+	version, err := FormatVersion(remote)
+	if err != nil {
+		return err
+	}
+
+	if version > CurrentFormatVersion {
+		return fmt.Errorf("%s has repository format version %d, which is newer than this dogestry (version %d)", remote.Desc(), version, CurrentFormatVersion)
+	}
+
+	for ; version < CurrentFormatVersion; version++ {
+		migrate, ok := migrations[version]
+		if !ok {
+			return fmt.Errorf("don't know how to upgrade repository format version %d", version)
+		}
+
+		progress(version, version+1)
+		if err := migrate(remote); err != nil {
+			return fmt.Errorf("upgrading from format version %d: %w", version, err)
+		}
+
+		if err := SetFormatVersion(remote, version+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An audit record of a push or pull, stored in the remote under
+// history/<repo>/. Each entry is its own object, so recording one never
+// needs to rewrite (or race with) another.
+type HistoryEntry struct {
+	Action string    `json:"action"`
+	Repo   string    `json:"repo"`
+	Tag    string    `json:"tag"`
+	ID     ID        `json:"id"`
+	User   string    `json:"user"`
+	Host   string    `json:"host"`
+	Time   time.Time `json:"time"`
+}
+
+// Make an entry for action on image, by the current user on this host.
+func NewHistoryEntry(action, image string, id ID) HistoryEntry {
+	repo, tag := NormaliseImageName(image)
+	host, _ := os.Hostname()
+
+	return HistoryEntry{
+		Action: action,
+		Repo:   repo,
+		Tag:    tag,
+		ID:     id,
+		User:   os.Getenv("USER"),
+		Host:   host,
+		Time:   time.Now().UTC(),
+	}
+}
+
+// the remote key of the entry
+// keys sort by time
+func (entry HistoryEntry) Key() string {
+	name := fmt.Sprintf("%s-%s-%s.json", entry.Time.Format("20060102T150405.000000000Z"), entry.Host, entry.Action)
+	return path.Join(historyPrefix(entry.Repo), name)
+}
+
+func historyPrefix(repo string) string {
+	return path.Join("history", repo) + "/"
+}
+
+func (entry HistoryEntry) marshal() ([]byte, error) {
+	return json.Marshal(entry)
+}
+
+func unmarshalHistoryEntry(data []byte) (entry HistoryEntry, err error) {
+	err = json.Unmarshal(data, &entry)
+	return
+}
+
+type historyEntries []HistoryEntry
+
+func (h historyEntries) Len() int           { return len(h) }
+func (h historyEntries) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h historyEntries) Less(i, j int) bool { return h[i].Time.Before(h[j].Time) }
+
+func sortHistory(entries []HistoryEntry) {
+	sort.Sort(historyEntries(entries))
+}
+
+// Records an entry in its repo's history.
+func AddHistory(remote Core, entry HistoryEntry) error {
+	data, err := entry.marshal()
+	if err != nil {
+		return err
+	}
+	return remote.Put(entry.Key(), data)
+}
+
+// The history of repo, oldest first.
+func History(remote Core, repo string) ([]HistoryEntry, error) {
+	history := make([]HistoryEntry, 0)
+	prefix := historyPrefix(repo)
+
+	keys, err := remote.List(prefix)
+	if err != nil {
+		return history, err
+	}
+
+	for _, key := range keys {
+		// the history of repos under this one, e.g. app/worker under app
+		if strings.Contains(strings.TrimPrefix(key, prefix), "/") {
+			continue
+		}
+
+		data, err := remote.Get(key)
+		if err != nil {
+			return history, err
+		}
+
+		entry, err := unmarshalHistoryEntry(data)
+		if err != nil {
+			return history, err
+		}
+		history = append(history, entry)
+	}
+
+	sortHistory(history)
+	return history, nil
+}
@@ -1,8 +1,13 @@
 package remote
 
+import "strings"
+
 type ID string
 
 func (id ID) Short() ID {
+	// docker 1.10 on prefixes ids with their algorithm
+	id = ID(strings.TrimPrefix(string(id), "sha256:"))
+
 	shortLen := 12
 	if len(id) < shortLen {
 		shortLen = len(id)
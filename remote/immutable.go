@@ -0,0 +1,84 @@
+package remote
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Refuses to push the tags in imageRoot which would overwrite an immutable tag
+// on the remote with a different image. -force overrides this.
+func checkImmutableTags(remote Remote, config RemoteConfig, imageRoot string) error {
+	if len(config.Immutable_Tags) == 0 || config.Force() {
+		return nil
+	}
+
+	reposRoot := filepath.Join(imageRoot, "repositories")
+
+	return filepath.Walk(reposRoot, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(reposRoot, path)
+		if err != nil {
+			return err
+		}
+		repo, tag := filepath.Dir(rel), filepath.Base(rel)
+
+		pattern := config.ImmutableTagPattern(repo, tag)
+		if pattern == "" {
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		id := ID(strings.TrimSpace(string(data)))
+
+		existing, err := ParseTag(remote, repo, tag)
+		if err != nil && err != ErrNoSuchTag {
+			return err
+		}
+
+		if existing != "" && existing != id {
+			// a tag with an image per platform can gain images for new platforms
+			if added, err := addsPlatform(remote, repo, tag, existing, imageRoot, id); err != nil || added {
+				return err
+			}
+			return fmt.Errorf("%s:%s already points at '%s' on %s, and tags matching '%s' can't be overwritten. Push a new tag, or use -force",
+				repo, tag, existing.Short(), remote.Desc(), pattern)
+		}
+		return nil
+	})
+}
+
+// whether image id, prepared in imageRoot, is for a platform repo:tag doesn't
+// have an image for yet, and existing is one of its platforms' images
+func addsPlatform(remote Remote, repo, tag string, existing ID, imageRoot string, id ID) (bool, error) {
+	index, err := ReadPlatformIndex(remote, repo, tag)
+	if err != nil {
+		return false, err
+	}
+
+	found := false
+	for _, image := range index.Manifests {
+		found = found || image.ID == existing
+	}
+	if !found {
+		return false, nil
+	}
+
+	platform, err := PreparedPlatform(imageRoot, id)
+	if err != nil {
+		return false, err
+	}
+	_, taken := index.Find(platform)
+	return !taken, nil
+}
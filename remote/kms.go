@@ -0,0 +1,239 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+// Wraps the data keys images are encrypted with, so only hosts allowed to
+// unwrap them can decrypt the images. See EncryptedRemote.
+type KeyManager interface {
+	WrapKey(key []byte) ([]byte, error)
+	UnwrapKey(wrapped []byte) ([]byte, error)
+	Desc() string
+}
+
+// The key manager the remote's config asks for: `kms-command`, the AWS KMS
+// key `kms-key-id`, or age or gpg recipients. Nil if it has none.
+func newKeyManager(config RemoteConfig) (KeyManager, error) {
+	managers := 0
+	for _, set := range []bool{config.Kms_Command != "", config.Kms_Key_Id != "", hasAge(config), len(config.Gpg_Recipient) > 0} {
+		if set {
+			managers++
+		}
+	}
+	if managers > 1 {
+		return nil, fmt.Errorf("the remote can only use one of kms-command, kms-key-id, age-recipient and gpg-recipient")
+	}
+
+	if hasAge(config) {
+		return &ageKeyManager{recipients: config.Age_Recipient, identities: config.Age_Identity_File}, nil
+	}
+	if len(config.Gpg_Recipient) > 0 {
+		return &gpgKeyManager{recipients: config.Gpg_Recipient}, nil
+	}
+
+	if config.Kms_Command != "" {
+		if _, err := exec.LookPath(config.Kms_Command); err != nil {
+			return nil, fmt.Errorf("can't find kms-command '%s': %w", config.Kms_Command, err)
+		}
+		return commandKeyManager(config.Kms_Command), nil
+	}
+
+	if config.Kms_Key_Id == "" {
+		return nil, nil
+	}
+
+	// the same credentials as s3
+	auth, err := getS3Auth(config)
+	if err != nil {
+		return nil, &AuthError{err}
+	}
+	return &awsKMS{keyId: config.Kms_Key_Id, region: KmsRegion(config), auth: auth, client: http.DefaultClient}, nil
+}
+
+// pulling hosts may only have an identity
+func hasAge(config RemoteConfig) bool {
+	return len(config.Age_Recipient) > 0 || len(config.Age_Identity_File) > 0
+}
+
+// The region of the KMS key: the region in its arn, otherwise kms-region,
+// otherwise the remote's region.
+func KmsRegion(config RemoteConfig) string {
+	if parts := strings.Split(config.Kms_Key_Id, ":"); len(parts) > 3 && parts[0] == "arn" && parts[3] != "" {
+		return parts[3]
+	}
+	if config.Kms_Region != "" {
+		return config.Kms_Region
+	}
+	if region := config.Url.Query().Get("region"); region != "" {
+		return region
+	}
+	return S3DefaultRegion
+}
+
+// Wraps keys with AWS KMS's Encrypt, and unwraps them with Decrypt. Pulling
+// hosts only need kms:Decrypt on the key.
+type awsKMS struct {
+	keyId  string
+	region string
+	auth   aws.Auth
+	client *http.Client
+}
+
+// tied to each wrapped key, so KMS won't decrypt it for anything else
+var kmsEncryptionContext = map[string]string{"dogestry": "data-key"}
+
+func (kms *awsKMS) Desc() string {
+	return "kms key " + kms.keyId
+}
+
+func (kms *awsKMS) WrapKey(key []byte) ([]byte, error) {
+	out := struct{ CiphertextBlob []byte }{}
+	err := kms.call("Encrypt", map[string]interface{}{
+		"KeyId":             kms.keyId,
+		"Plaintext":         key,
+		"EncryptionContext": kmsEncryptionContext,
+	}, &out)
+	return out.CiphertextBlob, err
+}
+
+func (kms *awsKMS) UnwrapKey(wrapped []byte) ([]byte, error) {
+	out := struct{ Plaintext []byte }{}
+	err := kms.call("Decrypt", map[string]interface{}{
+		"CiphertextBlob":    wrapped,
+		"EncryptionContext": kmsEncryptionContext,
+	}, &out)
+	return out.Plaintext, err
+}
+
+// Calls the KMS action with in, decoding its response into out. []byte
+// fields are base64 both ways, as KMS expects.
+func (kms *awsKMS) call(action string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	host := "kms." + kms.region + ".amazonaws.com"
+	req, err := http.NewRequest("POST", "https://"+host+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Host", host)
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	kms.sign(req, body, time.Now())
+
+	resp, err := kms.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("kms %s: %w", action, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		failure := struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}{}
+		json.Unmarshal(data, &failure)
+		return fmt.Errorf("kms %s failed: %s %s", action, failure.Type, failure.Message)
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Signs req, which has body, with AWS signature version 4.
+// http://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func (kms *awsKMS) sign(req *http.Request, body []byte, now time.Time) {
+	date := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	if kms.auth.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", kms.auth.Token)
+	}
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	headers := ""
+	for _, name := range names {
+		headers += name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n"
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{"POST", "/", "", headers, signed, sha256Hex(body)}, "\n")
+	scope := date[:8] + "/" + kms.region + "/kms/aws4_request"
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", date, scope, sha256Hex([]byte(canonical))}, "\n")
+
+	key := []byte("AWS4" + kms.auth.SecretKey)
+	for _, part := range []string{date[:8], kms.region, "kms", "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		kms.auth.AccessKey, scope, signed, hmacSha256(key, toSign)))
+}
+
+func sha256Hex(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Wraps keys with an executable, for other key managers, e.g. vault's transit
+// engine. `kms-command wrap` is given the key in base64 on stdin and prints the
+// wrapped key, in base64. `kms-command unwrap` does the reverse.
+type commandKeyManager string
+
+func (command commandKeyManager) Desc() string {
+	return "kms-command " + string(command)
+}
+
+func (command commandKeyManager) WrapKey(key []byte) ([]byte, error) {
+	return command.run("wrap", key)
+}
+
+func (command commandKeyManager) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return command.run("unwrap", wrapped)
+}
+
+func (command commandKeyManager) run(action string, in []byte) ([]byte, error) {
+	cmd := exec.Command(string(command), action)
+	cmd.Stdin = strings.NewReader(base64.StdEncoding.EncodeToString(in) + "\n")
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s\noutput: %s", command, action, err, stderr.String())
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+	if err != nil {
+		return nil, fmt.Errorf("%s %s printed invalid base64: %w", command, action, err)
+	}
+	return data, nil
+}
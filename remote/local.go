@@ -1,23 +1,30 @@
 package remote
 
 import (
+	"github.com/blake-education/dogestry/utils"
 	docker "github.com/fsouza/go-dockerclient"
 
+	"archive/tar"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 type LocalRemote struct {
 	config RemoteConfig
 	Url    url.URL
 	Path   string
+
+	statsLock sync.Mutex
+	stats     TransferStats
 }
 
 func NewLocalRemote(config RemoteConfig) (*LocalRemote, error) {
@@ -38,27 +45,206 @@ func (remote *LocalRemote) Desc() string {
 	return fmt.Sprintf("local(%s)", remote.Path)
 }
 
+func (remote *LocalRemote) Stats() TransferStats {
+	remote.statsLock.Lock()
+	defer remote.statsLock.Unlock()
+	return remote.stats
+}
+
 // push all of imageRoot to the remote
 func (remote *LocalRemote) Push(image, imageRoot string) error {
-	log.Println("pushing local", remote.Url.Path)
+	utils.Detailf("pushing local %s\n", remote.Url.Path)
+
+	if err := checkImmutableTags(remote, remote.config, imageRoot); err != nil {
+		return err
+	}
+
+	// tags go last, so they never point at images which haven't finished pushing
+	if err := remote.rsyncTo(imageRoot, "", "--exclude=/repositories"); err != nil {
+		return err
+	}
 
-	return remote.rsyncTo(imageRoot, "")
+	reposRoot := filepath.Join(imageRoot, "repositories")
+	if _, err := os.Stat(reposRoot); os.IsNotExist(err) {
+		return nil
+	}
+
+	// rsync writes each file to a temporary name and renames it into place, so tags change atomically
+	return remote.rsyncTo(reposRoot, "repositories")
 }
 
 // pull image with id into dst
 func (remote *LocalRemote) PullImageId(id ID, dst string) error {
-	log.Println("pulling local", "images/"+id, "->", dst)
+	utils.Detailf("pulling local images/%s -> %s\n", id, dst)
+
+	if err := remote.rsyncFrom("images/"+string(id), dst); err != nil {
+		return err
+	}
+
+	return resolveBlobs(dst, remote.config, func(key, dst string) error {
+		return remote.rsync(remote.RemotePath(key), dst)
+	})
+}
+
+func (remote *LocalRemote) StreamImageId(id ID, w *tar.Writer) error {
+	root := remote.imagePath(id)
 
-	return remote.rsyncFrom("images/"+string(id), dst)
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		if rel != BlobIndexFile {
+			return remote.streamFile(w, filepath.Join(string(id), rel), path)
+		}
+
+		// stream the blobs in place of the index
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		index, err := ParseBlobIndex(data)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range index.Files() {
+			paths := make([]string, len(file.Digests))
+			for i, digest := range file.Digests {
+				key, err := BlobKey(digest)
+				if err != nil {
+					return err
+				}
+				paths[i] = remote.RemotePath(key)
+			}
+
+			if err := remote.streamFile(w, filepath.Join(string(id), filepath.Base(file.Name)), paths...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writes the files at paths to w as name, one after the other
+func (remote *LocalRemote) streamFile(w *tar.Writer, name string, paths ...string) error {
+	var size int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+	}
+
+	header := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Now()}
+	if err := w.WriteHeader(header); err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		copied, err := io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		remote.statsLock.Lock()
+		remote.stats.Add(TransferStats{Transferred: 1, Bytes: copied})
+		remote.statsLock.Unlock()
+	}
+
+	return nil
+}
+
+// files which are missing from the remote, or a different size
+func (remote *LocalRemote) PushPlan(imageRoot string) ([]PlannedFile, error) {
+	plan := make([]PlannedFile, 0)
+
+	err := filepath.Walk(imageRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		key, err := filepath.Rel(imageRoot, path)
+		if err != nil {
+			return err
+		}
+
+		if existing, err := os.Stat(remote.RemotePath(key)); err == nil && existing.Size() == info.Size() && !remote.config.Force() {
+			return nil
+		}
+		plan = append(plan, PlannedFile{Key: key, Size: info.Size()})
+		return nil
+	})
+
+	return plan, err
+}
+
+func (remote *LocalRemote) PullPlan(id ID) ([]PlannedFile, error) {
+	plan := make([]PlannedFile, 0)
+	root := remote.imagePath(id)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		if info.Name() != BlobIndexFile {
+			key, err := filepath.Rel(remote.Path, path)
+			if err != nil {
+				return err
+			}
+			plan = append(plan, PlannedFile{Key: key, Size: info.Size()})
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		index, err := ParseBlobIndex(data)
+		if err != nil {
+			return err
+		}
+
+		for _, digest := range index {
+			key, err := BlobKey(digest)
+			if err != nil {
+				return err
+			}
+			blob, err := os.Stat(remote.RemotePath(key))
+			if err != nil {
+				return err
+			}
+			plan = append(plan, PlannedFile{Key: key, Size: blob.Size()})
+		}
+		return nil
+	})
+
+	return plan, err
 }
 
 func (remote *LocalRemote) ImageFullId(id ID) (ID, error) {
 	// look for an image
 	imagesRoot := filepath.Join(filepath.Clean(remote.Url.Path), "images")
 	file, err := os.Open(imagesRoot)
-	if err != nil {
+	if os.IsNotExist(err) {
+		return "", ErrNoSuchImage
+	} else if err != nil {
 		return "", err
 	}
+	defer file.Close()
 
 	names, err := file.Readdirnames(-1)
 	if err != nil {
@@ -82,16 +268,115 @@ func (remote *LocalRemote) ResolveImageNameToId(image string) (ID, error) {
 	return ResolveImageNameToId(remote, image)
 }
 
-func (remote *LocalRemote) ParseTag(repo, tag string) (ID, error) {
-	repoPath := filepath.Join(filepath.Clean(remote.Url.Path), "repositories", repo, tag)
+func (remote *LocalRemote) Get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(remote.RemotePath(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNoSuchKey
+	}
+	return data, err
+}
+
+// Writes key beside it, then renames it into place, so readers never see it
+// half written.
+func (remote *LocalRemote) Put(key string, data []byte) error {
+	dst := remote.RemotePath(key)
+	tmp, err := writeBeside(dst, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
 
-	if id, err := ioutil.ReadFile(repoPath); err == nil {
-		return ID(id), nil
-	} else if os.IsNotExist(err) {
-		return "", nil
-	} else {
+	return os.Rename(tmp, dst)
+}
+
+// Writes key beside it, then links it into place, which fails with
+// ErrKeyExists if key's there.
+func (remote *LocalRemote) PutIfAbsent(key string, data []byte) error {
+	dst := remote.RemotePath(key)
+	tmp, err := writeBeside(dst, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	err = os.Link(tmp, dst)
+	if os.IsExist(err) {
+		return ErrKeyExists
+	}
+	return err
+}
+
+// writes data to a temp file in dst's dir, making the dir if need be
+func writeBeside(dst string, data []byte) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst))
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
 		return "", err
 	}
+	return f.Name(), nil
+}
+
+func (remote *LocalRemote) Open(key string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(remote.RemotePath(key))
+	if os.IsNotExist(err) {
+		return nil, 0, ErrNoSuchKey
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (remote *LocalRemote) Delete(key string) error {
+	err := os.Remove(remote.RemotePath(key))
+	if os.IsNotExist(err) {
+		return ErrNoSuchKey
+	}
+	return err
+}
+
+func (remote *LocalRemote) List(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+
+	// only the dir the prefix is in need be walked
+	root := remote.RemotePath(prefix[:strings.LastIndex(prefix, "/")+1])
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil || info.IsDir() {
+			return err
+		}
+
+		key, err := filepath.Rel(remote.Path, path)
+		if err != nil {
+			return err
+		}
+		if key = filepath.ToSlash(key); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+
+	// Walk goes in lexical order
+	return keys, err
 }
 
 func (remote *LocalRemote) ImageMetadata(id ID) (docker.Image, error) {
@@ -111,20 +396,34 @@ func (remote *LocalRemote) ImageMetadata(id ID) (docker.Image, error) {
 	return image, nil
 }
 
-func (remote *LocalRemote) rsyncTo(src, dst string) error {
-	return remote.rsync(src+"/", remote.RemotePath(dst)+"/")
+func (remote *LocalRemote) rsyncTo(src, dst string, opts ...string) error {
+	return remote.rsync(src+"/", remote.RemotePath(dst)+"/", opts...)
 }
 
-func (remote *LocalRemote) rsyncFrom(src, dst string) error {
-	return remote.rsync(remote.RemotePath(src)+"/", dst+"/")
+func (remote *LocalRemote) rsyncFrom(src, dst string, opts ...string) error {
+	return remote.rsync(remote.RemotePath(src)+"/", dst+"/", opts...)
 }
 
-func (remote *LocalRemote) rsync(src, dst string) error {
-	out, err := exec.Command("rsync", "-av", src, dst).CombinedOutput()
+func (remote *LocalRemote) rsync(src, dst string, opts ...string) error {
+	// --partial keeps partly copied files, so an interrupted transfer can resume
+	args := append([]string{"-av", "--stats", "--partial"}, opts...)
+	if remote.config.Force() {
+		// copy files even if their size and time match
+		args = append(args, "--ignore-times")
+	}
+	if timeout := remote.config.RequestTimeout(); timeout > 0 {
+		// rsync's timeout is for I/O, so a slow copy of a big file is fine
+		args = append(args, fmt.Sprintf("--timeout=%d", int(timeout.Seconds()+0.5)))
+	}
+	out, err := exec.Command("rsync", append(args, src, dst)...).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("rsync failed: %s\noutput: %s", err, string(out))
 	}
-	log.Println(string(out))
+	utils.Detailf("%s\n", out)
+
+	remote.statsLock.Lock()
+	remote.stats.Add(parseRsyncStats(string(out)))
+	remote.statsLock.Unlock()
 
 	return nil
 }
@@ -0,0 +1,214 @@
+package remote
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+var (
+	// how long to wait before checking we really hold a lock we've just written.
+	// Another writer racing us will have overwritten it by then.
+	LockSettleDelay = 2 * time.Second
+)
+
+// A lock object in the remote, at locks/<name>.
+// Locks are advisory: they stop dogestry processes from interleaving writes,
+// they don't stop anything else writing to the remote.
+type Lock struct {
+	Name    string    `json:"name"`
+	Owner   string    `json:"owner"`
+	Token   string    `json:"token"`
+	Created time.Time `json:"created"`
+
+	// the lock is ignored after this. Zero means it never expires
+	Expires time.Time `json:"expires"`
+}
+
+// Returned by PutIfAbsent when the key already exists.
+var ErrKeyExists = errors.New("Key exists")
+
+// Remotes which can write a key only if it doesn't exist yet, atomically.
+// Locks written with it can't be raced, so aren't checked afterwards.
+type ConditionalPutter interface {
+	PutIfAbsent(key string, data []byte) error
+}
+
+// remote's ConditionalPutter, if it has one
+func conditionalPutter(remote Core) (ConditionalPutter, bool) {
+	// locks aren't encrypted, so go straight to the remote underneath
+	if encrypted, ok := remote.(*EncryptedRemote); ok {
+		return conditionalPutter(encrypted.Remote)
+	}
+	putter, ok := remote.(ConditionalPutter)
+	return putter, ok
+}
+
+// Returned when a lock is held by someone else.
+type LockedError struct {
+	Lock *Lock
+}
+
+func (err *LockedError) Error() string {
+	msg := fmt.Sprintf("'%s' is locked by %s since %s", err.Lock.Name, err.Lock.Owner, err.Lock.Created.Format(time.RFC3339))
+	if !err.Lock.Expires.IsZero() {
+		msg += fmt.Sprintf(" (expires %s)", err.Lock.Expires.Format(time.RFC3339))
+	}
+	return msg + ". Use `dogestry unlock -force` if it's stale"
+}
+
+func lockKey(name string) string {
+	return path.Join("locks", name)
+}
+
+func (lock *Lock) Expired() bool {
+	return !lock.Expires.IsZero() && time.Now().After(lock.Expires)
+}
+
+// Reads the lock called name. Returns nil if there's no such lock.
+func ReadLock(remote Remote, name string) (*Lock, error) {
+	data, err := remote.Get(lockKey(name))
+	if err == ErrNoSuchKey {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	lock := &Lock{}
+	if err := json.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("invalid lock '%s': %w", name, err)
+	}
+	return lock, nil
+}
+
+// Acquires the lock called name, held for ttl (or indefinitely if ttl is 0).
+// Fails with a *LockedError if someone else holds it.
+func AcquireLock(remote Remote, name string, ttl time.Duration) (*Lock, error) {
+	existing, err := ReadLock(remote, name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && !existing.Expired() {
+		return nil, &LockedError{existing}
+	}
+
+	token, err := newLockToken()
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	lock := &Lock{
+		Name:    name,
+		Owner:   fmt.Sprintf("%s@%s", os.Getenv("USER"), host),
+		Token:   token,
+		Created: time.Now().UTC(),
+	}
+	if ttl > 0 {
+		lock.Expires = lock.Created.Add(ttl)
+	}
+
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return nil, err
+	}
+
+	// an expired lock is replaced, which a conditional write can't do
+	if putter, ok := conditionalPutter(remote); ok && existing == nil {
+		err := putter.PutIfAbsent(lockKey(name), data)
+		if err == ErrKeyExists {
+			// someone beat us to it since we looked
+			if current, err := ReadLock(remote, name); err != nil {
+				return nil, err
+			} else if current != nil {
+				return nil, &LockedError{current}
+			}
+			return nil, fmt.Errorf("lock '%s' changed while acquiring it", name)
+		} else if err != nil {
+			return nil, err
+		}
+		return lock, nil
+	}
+
+	if err := remote.Put(lockKey(name), data); err != nil {
+		return nil, err
+	}
+
+	// the write wasn't conditional, so check we weren't raced
+	time.Sleep(LockSettleDelay)
+	current, err := ReadLock(remote, name)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil || current.Token != lock.Token {
+		if current == nil {
+			return nil, fmt.Errorf("lock '%s' disappeared while acquiring it", name)
+		}
+		return nil, &LockedError{current}
+	}
+
+	return lock, nil
+}
+
+// Extends the lock to ttl from now. Fails with a *LockedError if someone else
+// has taken it meanwhile, or wrapping ErrNoSuchKey if it's been removed.
+func (lock *Lock) Renew(remote Remote, ttl time.Duration) error {
+	current, err := ReadLock(remote, lock.Name)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf("lock '%s' was removed: %w", lock.Name, ErrNoSuchKey)
+	}
+	if current.Token != lock.Token {
+		return &LockedError{current}
+	}
+
+	renewed := *lock
+	renewed.Expires = time.Now().UTC().Add(ttl)
+	data, err := json.Marshal(&renewed)
+	if err != nil {
+		return err
+	}
+	if err := remote.Put(lockKey(lock.Name), data); err != nil {
+		return err
+	}
+
+	lock.Expires = renewed.Expires
+	return nil
+}
+
+// Releases the lock, unless it has since been taken by someone else.
+func (lock *Lock) Release(remote Remote) error {
+	current, err := ReadLock(remote, lock.Name)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Token != lock.Token {
+		return nil
+	}
+
+	return remote.Delete(lockKey(lock.Name))
+}
+
+// Removes the lock called name, whoever holds it.
+func ForceUnlock(remote Remote, name string) error {
+	err := remote.Delete(lockKey(name))
+	if err == ErrNoSuchKey {
+		return nil
+	}
+	return err
+}
+
+func newLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
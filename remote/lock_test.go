@@ -0,0 +1,109 @@
+package remote
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/blake-education/dogestry/config"
+)
+
+func newTestLocalRemote(t *testing.T) Remote {
+	r, err := NewRemote(t.TempDir(), config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	r := newTestLocalRemote(t)
+	putter, ok := conditionalPutter(r)
+	if !ok {
+		t.Fatalf("%T has no conditional write", r)
+	}
+
+	if err := putter.PutIfAbsent("locks/app", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := putter.PutIfAbsent("locks/app", []byte("second")); err != ErrKeyExists {
+		t.Errorf("putting it again: got %v, want %v", err, ErrKeyExists)
+	}
+	if data, err := r.Get("locks/app"); err != nil || string(data) != "first" {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if keys, err := r.List("locks/"); err != nil || len(keys) != 1 {
+		t.Errorf("listed %v, %v", keys, err)
+	}
+}
+
+func TestAcquireLock(t *testing.T) {
+	defer func(delay time.Duration) { LockSettleDelay = delay }(LockSettleDelay)
+	LockSettleDelay = time.Minute
+	r := newTestLocalRemote(t)
+
+	// written conditionally, so not checked after settling
+	start := time.Now()
+	lock, err := AcquireLock(r, "app", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= LockSettleDelay {
+		t.Errorf("waited %s to acquire it", elapsed)
+	}
+
+	var locked *LockedError
+	if _, err := AcquireLock(r, "app", time.Hour); !errors.As(err, &locked) || locked.Lock.Token != lock.Token {
+		t.Errorf("acquiring a held lock: got %v", err)
+	}
+
+	// an expired lock is replaced, unconditionally
+	LockSettleDelay = 0
+	expired, err := AcquireLock(r, "db", time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	replaced, err := AcquireLock(r, "db", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.Token == expired.Token {
+		t.Error("the expired lock wasn't replaced")
+	}
+}
+
+func TestRenewLock(t *testing.T) {
+	r := newTestLocalRemote(t)
+	lock, err := AcquireLock(r, "app", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := lock.Expires
+	if err := lock.Renew(r, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	current, err := ReadLock(r, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lock.Expires.After(expires) || !current.Expires.Equal(lock.Expires) || current.Token != lock.Token {
+		t.Errorf("renewed %+v, remote has %+v", lock, current)
+	}
+
+	// taken by someone else once it was forced open
+	if err := ForceUnlock(r, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Renew(r, time.Hour); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("renewing a removed lock: got %v", err)
+	}
+	if _, err := AcquireLock(r, "app", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	var locked *LockedError
+	if err := lock.Renew(r, time.Hour); !errors.As(err, &locked) {
+		t.Errorf("renewing a lock someone else took: got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package remote
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/blake-education/dogestry/utils"
+)
+
+// how long to wait for a peer to start sending a blob before trying the next
+var PeerTimeout = 5 * time.Second
+
+var peerClient = &http.Client{
+	Transport: TraceRequests(&http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: PeerTimeout,
+	}),
+}
+
+// Tries to fetch the blob at key from each peer in turn, checking it matches
+// digest. Peers are only trusted as far as the digest, so a bad peer just
+// means the blob comes from the remote, and why is printed to out. False if
+// no peer had it.
+func fetchFromPeers(peers []string, key, digest, dst string, out io.Writer) bool {
+	for _, peer := range peers {
+		err := fetchFromPeer(peer, key, dst)
+		if err == nil {
+			err = verifyBlob(dst, digest)
+		}
+		if err == nil {
+			utils.Detailf("fetched %s from peer %s\n", key, peer)
+			return true
+		}
+
+		os.Remove(dst)
+		if err != errPeerMissing {
+			fmt.Fprintf(out, "couldn't fetch %s from peer %s: %s\n", key, peer, err)
+		}
+	}
+	return false
+}
+
+var errPeerMissing = fmt.Errorf("peer doesn't have blob")
+
+func fetchFromPeer(peer, key, dst string) error {
+	resp, err := peerClient.Get(strings.TrimSuffix(peer, "/") + "/" + key)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errPeerMissing
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer responded %s", resp.Status)
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, resp.Body)
+	return err
+}
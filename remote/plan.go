@@ -0,0 +1,16 @@
+package remote
+
+// A file a push or pull would transfer, for dry runs
+type PlannedFile struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// The total size of files.
+func PlannedSize(files []PlannedFile) int64 {
+	var size int64
+	for _, file := range files {
+		size += file.Size
+	}
+	return size
+}
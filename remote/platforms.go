@@ -0,0 +1,187 @@
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A tag can have an image for each platform, e.g. linux/amd64 and
+// linux/arm64, like a registry's manifest list. Each push records its image in
+// its tag's index under the image's platform, and the tag itself points at
+// the last image pushed, for clients which don't know about platforms.
+const PlatformsDir = "platforms"
+
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+	// Windows images only run on hosts of their build, e.g. 10.0.17763.1879
+	OSVersion string `json:"os.version,omitempty"`
+}
+
+// os/arch[/variant], as docker writes platforms
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// Parses a platform written as os/arch[/variant], e.g. linux/arm64.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform '%s', use os/arch, e.g. linux/arm64", s)
+	}
+
+	platform := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+// The image for a platform in a tag's index
+type PlatformImage struct {
+	Platform Platform `json:"platform"`
+	ID       ID       `json:"id"`
+}
+
+type PlatformIndex struct {
+	Manifests []PlatformImage `json:"manifests"`
+}
+
+func platformIndexKey(repo, tag string) string {
+	return path.Join(PlatformsDir, repo, tag+".json")
+}
+
+// The platform index of repo:tag. Empty for tags only ever pushed before
+// platforms were recorded.
+func ReadPlatformIndex(r Remote, repo, tag string) (PlatformIndex, error) {
+	index := PlatformIndex{Manifests: []PlatformImage{}}
+
+	data, err := r.Get(platformIndexKey(repo, tag))
+	if err == ErrNoSuchKey {
+		return index, nil
+	} else if err != nil {
+		return index, err
+	}
+
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("invalid platform index for %s:%s: %w", repo, tag, err)
+	}
+	return index, nil
+}
+
+// Records id as repo:tag's image for platform, replacing the platform's
+// previous image. Pushes hold the repo's lock, so this doesn't race.
+func AddPlatformImage(r Remote, repo, tag string, platform Platform, id ID) error {
+	index, err := ReadPlatformIndex(r, repo, tag)
+	if err != nil {
+		return err
+	}
+
+	manifests := make([]PlatformImage, 0, len(index.Manifests)+1)
+	for _, image := range index.Manifests {
+		if image.Platform != platform {
+			manifests = append(manifests, image)
+		}
+	}
+	index.Manifests = append(manifests, PlatformImage{Platform: platform, ID: id})
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return r.Put(platformIndexKey(repo, tag), data)
+}
+
+// Whether an image for p runs on platform. A platform without a variant
+// matches images of any variant, and an image without one matches any variant.
+func (p Platform) Matches(platform Platform) bool {
+	return p.OS == platform.OS && p.Architecture == platform.Architecture &&
+		(p.Variant == "" || platform.Variant == "" || p.Variant == platform.Variant)
+}
+
+// The image for platform. Windows images for the platform's build, e.g.
+// 10.0.17763, are preferred, as only those run without hyper-v isolation.
+func (index PlatformIndex) Find(platform Platform) (ID, bool) {
+	if platform.OSVersion != "" {
+		for _, image := range index.Manifests {
+			if image.Platform.Matches(platform) && strings.HasPrefix(image.Platform.OSVersion+".", platform.OSVersion+".") {
+				return image.ID, true
+			}
+		}
+	}
+	for _, image := range index.Manifests {
+		if image.Platform.Matches(platform) {
+			return image.ID, true
+		}
+	}
+	return "", false
+}
+
+// the platforms the index has images for, e.g. "linux/amd64, linux/arm64"
+func (index PlatformIndex) String() string {
+	platforms := make([]string, len(index.Manifests))
+	for i, image := range index.Manifests {
+		platforms[i] = image.Platform.String()
+	}
+	return strings.Join(platforms, ", ")
+}
+
+// The platform of image id, prepared for pushing in imageRoot, going by its
+// config or metadata. Images which don't say are linux/amd64, as docker's
+// were before it ran anywhere else.
+func PreparedPlatform(imageRoot string, id ID) (Platform, error) {
+	platform := Platform{}
+
+	dir := filepath.Join(imageRoot, "images", string(id))
+	data, err := ioutil.ReadFile(filepath.Join(dir, ImageConfigFile))
+	if os.IsNotExist(err) {
+		data, err = ioutil.ReadFile(filepath.Join(dir, "json"))
+	}
+	if err != nil {
+		return platform, err
+	}
+
+	if err := json.Unmarshal(data, &platform); err != nil {
+		return platform, fmt.Errorf("invalid image metadata in %s: %w", dir, err)
+	}
+	return platformDefaults(platform), nil
+}
+
+// The platform of image id on the remote, as PreparedPlatform.
+func ImagePlatform(r Remote, id ID) (Platform, error) {
+	platform := Platform{}
+
+	config, err := ImageConfig(r, id)
+	if err != nil {
+		return platform, err
+	} else if config == nil {
+		metadata, err := r.ImageMetadata(id)
+		if err != nil {
+			return platform, err
+		}
+		platform.Architecture = metadata.Architecture
+	} else if err := json.Unmarshal(config, &platform); err != nil {
+		return platform, fmt.Errorf("invalid config for image %s: %w", id.Short(), err)
+	}
+	return platformDefaults(platform), nil
+}
+
+func platformDefaults(platform Platform) Platform {
+	if platform.OS == "" {
+		platform.OS = "linux"
+	}
+	if platform.Architecture == "" {
+		platform.Architecture = "amd64"
+	}
+	return platform
+}
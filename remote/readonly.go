@@ -0,0 +1,59 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// A remote which refuses every write, so hosts which only pull can't change
+// the repository, whatever their credentials allow.
+type ReadOnlyRemote struct {
+	Remote
+}
+
+var ErrReadOnly = errors.New("the remote is read only")
+
+func NewReadOnlyRemote(remote Remote) *ReadOnlyRemote {
+	return &ReadOnlyRemote{Remote: remote}
+}
+
+// Whether r refuses writes.
+func IsReadOnly(r Remote) bool {
+	_, ok := r.(*ReadOnlyRemote)
+	return ok
+}
+
+// whether the remote, or all remotes, are set readonly, or $DOGESTRY_READONLY is
+// set. Anything but false or 0 counts, so a typo doesn't make a host writable
+func (config RemoteConfig) ReadOnly() bool {
+	if config.Readonly || config.Config.Dogestry.Readonly {
+		return true
+	}
+	if env := os.Getenv("DOGESTRY_READONLY"); env != "" {
+		readonly, err := strconv.ParseBool(env)
+		return readonly || err != nil
+	}
+	return false
+}
+
+func (remote *ReadOnlyRemote) refuse(what string) error {
+	return fmt.Errorf("can't %s: %s. Unset readonly in its config, or $DOGESTRY_READONLY", what, ErrReadOnly)
+}
+
+func (remote *ReadOnlyRemote) Push(image, imageRoot string) error {
+	return remote.refuse("push " + image)
+}
+
+func (remote *ReadOnlyRemote) Put(key string, data []byte) error {
+	return remote.refuse("write " + key)
+}
+
+func (remote *ReadOnlyRemote) Delete(key string) error {
+	return remote.refuse("delete " + key)
+}
+
+func (remote *ReadOnlyRemote) Desc() string {
+	return remote.Remote.Desc() + " (read only)"
+}
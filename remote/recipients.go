@@ -0,0 +1,86 @@
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Wraps keys for a set of age recipients, e.g. one per host in an environment,
+// with the age executable. Hosts unwrap them with their age identity file.
+// https://age-encryption.org
+type ageKeyManager struct {
+	recipients []string
+	identities []string
+}
+
+func (age *ageKeyManager) Desc() string {
+	return fmt.Sprintf("age, for %d recipients", len(age.recipients))
+}
+
+func (age *ageKeyManager) WrapKey(key []byte) ([]byte, error) {
+	if len(age.recipients) == 0 {
+		return nil, fmt.Errorf("no age-recipient to encrypt to")
+	}
+
+	args := []string{}
+	for _, recipient := range age.recipients {
+		args = append(args, "-r", recipient)
+	}
+	return runKeyCommand("age", args, key)
+}
+
+func (age *ageKeyManager) UnwrapKey(wrapped []byte) ([]byte, error) {
+	if len(age.identities) == 0 {
+		return nil, fmt.Errorf("no age-identity-file to decrypt with")
+	}
+
+	args := []string{"-d"}
+	for _, identity := range age.identities {
+		args = append(args, "-i", identity)
+	}
+	return runKeyCommand("age", args, wrapped)
+}
+
+// Wraps keys for a set of gpg recipients, with the gpg executable. Hosts
+// unwrap them with the secret keys in their keyring.
+type gpgKeyManager struct {
+	recipients []string
+}
+
+func (gpg *gpgKeyManager) Desc() string {
+	return fmt.Sprintf("gpg, for %d recipients", len(gpg.recipients))
+}
+
+func (gpg *gpgKeyManager) WrapKey(key []byte) ([]byte, error) {
+	// recipients are named explicitly, so they needn't be trusted in the keyring
+	args := []string{"--batch", "--yes", "--trust-model", "always", "--encrypt"}
+	for _, recipient := range gpg.recipients {
+		args = append(args, "-r", recipient)
+	}
+	return runKeyCommand("gpg", args, key)
+}
+
+func (gpg *gpgKeyManager) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return runKeyCommand("gpg", []string{"--batch", "--quiet", "--decrypt"}, wrapped)
+}
+
+// runs name with args, with in on stdin, returning its stdout
+func runKeyCommand(name string, args []string, in []byte) ([]byte, error) {
+	bin, err := exec.LookPath(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't find executable %s on the $PATH", name)
+	}
+
+	cmd := exec.Command(bin, args...)
+	cmd.Stdin = bytes.NewReader(in)
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s\noutput: %s", name, strings.Join(args, " "), err, stderr.String())
+	}
+	return out, nil
+}
@@ -0,0 +1,63 @@
+package remote
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Makes a remote from its config. config.Url is its url, and config.Kind the
+// url's scheme.
+type Factory func(config RemoteConfig) (Remote, error)
+
+var (
+	factoriesLock sync.RWMutex
+	factories     = make(map[string]Factory)
+)
+
+func init() {
+	RegisterRemote("local", func(config RemoteConfig) (Remote, error) {
+		return NewLocalRemote(config)
+	})
+	RegisterRemote("s3", func(config RemoteConfig) (Remote, error) {
+		return NewS3Remote(config)
+	})
+}
+
+// Registers factory to make the remotes whose urls have scheme, e.g. gcs for
+// gcs://bucket/path, so backends can be added from outside this package, or
+// faked in tests. NewRemote still wraps what factory makes, to encrypt it or
+// make it readonly as it's configured. Registering a scheme twice panics.
+func RegisterRemote(scheme string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+
+	if factory == nil {
+		panic("remote: RegisterRemote factory is nil")
+	}
+	if _, exists := factories[scheme]; exists {
+		panic(fmt.Sprintf("remote: RegisterRemote called twice for '%s'", scheme))
+	}
+	factories[scheme] = factory
+}
+
+// The schemes of the registered remotes, sorted.
+func RemoteSchemes() []string {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	schemes := make([]string, 0, len(factories))
+	for scheme := range factories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+func lookupFactory(scheme string) (Factory, bool) {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	factory, ok := factories[scheme]
+	return factory, ok
+}
@@ -1,10 +1,16 @@
 package remote
 
 import (
+	"archive/tar"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/blake-education/dogestry/config"
 	docker "github.com/fsouza/go-dockerclient"
@@ -16,7 +22,11 @@ var (
 
 	ErrNoSuchImage = errors.New("No such image")
 	ErrNoSuchTag   = errors.New("No such tag")
+	ErrNoSuchKey   = errors.New("No such key")
 	BreakWalk      = errors.New("break walk")
+
+	// how many files remotes transfer at once, unless configured otherwise
+	DefaultConcurrency = 4
 )
 
 type RemoteConfig struct {
@@ -24,22 +34,74 @@ type RemoteConfig struct {
 	Kind   string
 	Config config.Config
 	Url    url.URL
+
+	// the name or url the remote was given by
+	Name string
+
+	// credentials given in the config, if any. Those from `dogestry login`
+	// are in Config.CredentialStore
+	Credentials *config.RemoteCredentials
+
+	// following and stopping the push or pull using the remote
+	Control Control
 }
 
 type ImageWalkFn func(id ID, image docker.Image, err error) error
 
+// A repo:tag on the remote, and the id it points to
+type Tag struct {
+	Repo string
+	Tag  string
+	ID   ID
+}
+
+// The core of a remote: its objects, by key, resolving image names to ids,
+// and describing itself. Tags, history and the format version are objects
+// like any other, read and written by ParseTag, ListTags, History, AddHistory,
+// FormatVersion and SetFormatVersion, which work on any Core, so a remote
+// wrapping another, e.g. to refuse writes, need only wrap these.
+type Core interface {
+	// read a small object, such as a lock, from the remote. ErrNoSuchKey if it doesn't exist
+	Get(key string) ([]byte, error)
+
+	// write a small object to the remote
+	Put(key string, data []byte) error
+
+	// the keys of the objects whose keys start with prefix, e.g. repositories/myapp/, sorted
+	List(prefix string) ([]string, error)
+
+	// remove an object from the remote
+	Delete(key string) error
+
+	// map a ref-like to id. "ref-like" could be a ref or an id. Most remotes
+	// use the ResolveImageNameToId func
+	ResolveImageNameToId(image string) (ID, error)
+
+	// describe the remote
+	Desc() string
+}
+
+// Where images are stored: a Core, and moving images' files to and from it.
+// local and s3 remotes are built in, and others can be added with
+// RegisterRemote. A fake for tests can embed a LocalRemote on a temp dir and
+// override only the methods it's testing.
 type Remote interface {
+	Core
+
 	// push image and parent images to remote
 	Push(image, imageRoot string) error
 
 	// pull a single image from the remote
 	PullImageId(id ID, imageRoot string) error
 
-	// map repo:tag to id (like git rev-parse)
-	ParseTag(repo, tag string) (ID, error)
+	// write a single image's files to w, under ID/, instead of to disk
+	StreamImageId(id ID, w *tar.Writer) error
 
-	// map a ref-like to id. "ref-like" could be a ref or an id.
-	ResolveImageNameToId(image string) (ID, error)
+	// the files in imageRoot Push would upload, without uploading them
+	PushPlan(imageRoot string) ([]PlannedFile, error)
+
+	// the files PullImageId would download for id, without downloading them
+	PullPlan(id ID) ([]PlannedFile, error)
 
 	ImageFullId(id ID) (ID, error)
 
@@ -48,45 +110,102 @@ type Remote interface {
 	// walk the image history on the remote, starting at id
 	WalkImages(id ID, walker ImageWalkFn) error
 
+	// open an object of any size, such as a blob, for reading, with its size. ErrNoSuchKey if it doesn't exist
+	Open(key string) (io.ReadCloser, int64, error)
+
 	// checks the config and connectivity of the remote
 	Validate() error
 
-	// describe the remote
-	Desc() string
+	// what's been transferred to and from the remote so far
+	Stats() TransferStats
+}
+
+func NewRemote(remoteName string, config config.Config) (Remote, error) {
+	return NewControlledRemote(remoteName, config, Control{})
 }
 
-func NewRemote(remoteName string, config config.Config) (remote Remote, err error) {
-	remoteConfig, err := resolveConfig(remoteName, config)
+// NewRemote, for a push or pull followed or stopped with control.
+func NewControlledRemote(remoteName string, config config.Config, control Control) (remote Remote, err error) {
+	remoteConfig, err := ResolveConfig(remoteName, config)
 	if err != nil {
 		return
 	}
+	remoteConfig.Control = control
 
-	switch remoteConfig.Kind {
-	case "local":
-		remote, err = NewLocalRemote(remoteConfig)
-	case "s3":
-		remote, err = NewS3Remote(remoteConfig)
-	default:
-		err = fmt.Errorf("unknown remote type '%s'", remoteConfig.Kind)
+	factory, ok := lookupFactory(remoteConfig.Kind)
+	if !ok {
+		err = fmt.Errorf("unknown remote type '%s', use one of %s", remoteConfig.Kind, strings.Join(RemoteSchemes(), ", "))
 		return
 	}
 
-	if err != nil {
+	if remote, err = factory(remoteConfig); err != nil {
 		return
 	}
 
+	if remoteConfig.Encrypted() {
+		if remote, err = NewEncryptedRemote(remote, remoteConfig); err != nil {
+			return
+		}
+	}
+
+	// outermost, so no write gets past it
+	if remoteConfig.ReadOnly() {
+		remote = NewReadOnlyRemote(remote)
+	}
+
 	err = remote.Validate()
 	return
 }
 
-func resolveConfig(remoteUrl string, config config.Config) (remoteConfig RemoteConfig, err error) {
+// The config of the remote called remoteUrl in config, or at the url
+// remoteUrl, without connecting to it.
+func ResolveConfig(remoteUrl string, config config.Config) (remoteConfig RemoteConfig, err error) {
 	// its a bareword, use it as a lookup key
 	if !strings.Contains(remoteUrl, "/") {
-		return lookupUrlInConfig(remoteUrl, config)
+		remoteConfig, err = lookupUrlInConfig(remoteUrl, config)
+	} else {
+		// its a url, configured as any remote in the config at the same place is
+		remoteConfig, err = makeRemoteFromUrl(remoteUrl, config)
+		if err == nil {
+			err = applyConfigSection(&remoteConfig, config)
+		}
+	}
+
+	if err != nil {
+		return
 	}
 
-	// its a url
-	return makeRemoteFromUrl(remoteUrl, config)
+	remoteConfig.Name = remoteUrl
+	remoteConfig.Credentials = lookupCredentials(remoteUrl, remoteConfig.Url, config.Credentials)
+	return
+}
+
+// find credentials saved under the name the remote was given by, or failing that its url
+func lookupCredentials(remoteName string, remoteUrl url.URL, creds map[string]*config.RemoteCredentials) *config.RemoteCredentials {
+	if c, ok := creds[remoteName]; ok {
+		return c
+	}
+
+	if c, ok := creds[remoteUrl.String()]; ok {
+		return c
+	}
+
+	return nil
+}
+
+// The remote's credentials from the config, or failing that from the
+// credential store. The store is only read when credentials are needed, as it
+// may ask for a passphrase.
+func (config RemoteConfig) StoredCredentials() (*config.RemoteCredentials, error) {
+	if config.Credentials != nil || config.Config.CredentialStore == nil {
+		return config.Credentials, nil
+	}
+
+	stored, err := config.Config.CredentialStore.Load()
+	if err != nil {
+		return nil, err
+	}
+	return lookupCredentials(config.Name, config.Url, stored), nil
 }
 
 func lookupUrlInConfig(remoteName string, config config.Config) (remoteConfig RemoteConfig, err error) {
@@ -96,8 +215,54 @@ func lookupUrlInConfig(remoteName string, config config.Config) (remoteConfig Re
 		return
 	}
 
-	return makeRemoteFromUrl(remote.Url, config)
+	remoteConfig, err = makeRemoteFromUrl(remote.Url, config)
+	if err != nil {
+		return
+	}
+
 	// XXX Extra setup can come from here
+	remoteConfig.RemoteConfig = *remote
+	return
+}
+
+// Gives a remote given by url the settings, such as encryption, of the
+// remote in the config at the same place, so addressing it by url doesn't get
+// around them. The urls' queries, such as s3's region, aren't compared.
+func applyConfigSection(remoteConfig *RemoteConfig, config config.Config) error {
+	names := make([]string, 0, len(config.Remote))
+	for name := range config.Remote {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	matched := []string{}
+	for _, name := range names {
+		section, err := makeRemoteFromUrl(config.Remote[name].Url, config)
+		if err == nil && sameLocation(section.Url, remoteConfig.Url) {
+			matched = append(matched, name)
+		}
+	}
+
+	switch len(matched) {
+	case 0:
+		return nil
+	case 1:
+		remoteConfig.RemoteConfig = *config.Remote[matched[0]]
+		return nil
+	}
+	return fmt.Errorf("%s is the url of remotes %s in the config, use one of their names instead", remoteConfig.Url.String(), strings.Join(matched, ", "))
+}
+
+func sameLocation(a, b url.URL) bool {
+	clean := func(u url.URL) string {
+		if u.Scheme == "local" {
+			if abs, err := filepath.Abs(u.Path); err == nil {
+				return abs
+			}
+		}
+		return strings.TrimSuffix(path.Clean("/"+u.Path), "/")
+	}
+	return a.Scheme == b.Scheme && a.Host == b.Host && clean(a) == clean(b)
 }
 
 func makeRemoteFromUrl(remoteUrl string, config config.Config) (remoteConfig RemoteConfig, err error) {
@@ -121,26 +286,92 @@ func makeRemoteFromUrl(remoteUrl string, config config.Config) (remoteConfig Rem
 	return
 }
 
+// whether images on the remote are encrypted, with a key file or key manager
+func (config RemoteConfig) Encrypted() bool {
+	return config.Encryption_Key_File != "" || config.Encryption_Key_Vault_Path != "" || config.Kms_Key_Id != "" || config.Kms_Command != "" ||
+		len(config.Age_Recipient) > 0 || len(config.Age_Identity_File) > 0 || len(config.Gpg_Recipient) > 0
+}
+
+// how many files to transfer at once
+func (config RemoteConfig) Concurrency() int {
+	if config.Config.Dogestry.Concurrency > 0 {
+		return config.Config.Dogestry.Concurrency
+	}
+	return DefaultConcurrency
+}
+
+// how many times to retry a file which fails to transfer
+func (config RemoteConfig) Retries() int {
+	if config.Config.Dogestry.Retries > 0 {
+		return config.Config.Dogestry.Retries
+	}
+	return DefaultRetries
+}
+
+// how long a request to the remote can be idle before it fails. Zero for never
+func (config RemoteConfig) RequestTimeout() time.Duration {
+	// empty, or invalid, which the cli rejects before any requests, is never
+	timeout, _ := time.ParseDuration(config.Config.Dogestry.Request_Timeout)
+	return timeout
+}
+
+// whether to transfer files even if they look like they're already there,
+// to replace corrupt copies
+func (config RemoteConfig) Force() bool {
+	return config.Config.Dogestry.Force
+}
+
+// the immutable-tags pattern repo:tag matches, if any
+func (config RemoteConfig) ImmutableTagPattern(repo, tag string) string {
+	for _, pattern := range config.Immutable_Tags {
+		if matched, _ := path.Match(pattern, repo+":"+tag); matched {
+			return pattern
+		}
+	}
+	return ""
+}
+
 func NormaliseImageName(image string) (string, string) {
-	repoParts := strings.Split(image, ":")
-	if len(repoParts) == 1 {
-		return repoParts[0], "latest"
+	// the tag is after the last colon, unless that colon is part of a registry host:port
+	i := strings.LastIndex(image, ":")
+	if i == -1 || strings.Contains(image[i+1:], "/") {
+		return image, "latest"
 	} else {
-		return repoParts[0], repoParts[1]
+		return image[:i], image[i+1:]
+	}
+}
+
+// An image can be pinned to exact content as REPO@ID, where ID is an image id,
+// a unique prefix of one, sha256:ID, or the sha256:<digest> docker 1.10 on
+// names the image by. Returns the repo and the id, which is
+// empty when image isn't pinned.
+func SplitImageId(image string) (string, ID) {
+	i := strings.LastIndex(image, "@")
+	if i == -1 {
+		return image, ""
 	}
+	return image[:i], ID(strings.TrimPrefix(image[i+1:], "sha256:"))
 }
 
 func ResolveImageNameToId(remote Remote, image string) (ID, error) {
+	// pinned images skip the tags entirely
+	if repoName, id := SplitImageId(image); repoName != image {
+		if id == "" {
+			return "", fmt.Errorf("no image id after '@' in '%s'", image)
+		}
+		return findImageId(remote, id)
+	}
+
 	// first, try the repos
 	repoName, repoTag := NormaliseImageName(image)
-	if id, err := remote.ParseTag(repoName, repoTag); err != nil {
+	if id, err := ParseTag(remote, repoName, repoTag); err != nil {
 		return "", err
 	} else if id != "" {
 		return id, nil
 	}
 
 	// ok, no repo, search the images:
-	fullId, err := remote.ImageFullId(ID(image))
+	fullId, err := findImageId(remote, ID(image))
 	if err != nil {
 		return "", err
 	} else if fullId != "" {
@@ -150,6 +381,45 @@ func ResolveImageNameToId(remote Remote, image string) (ID, error) {
 	return "", ErrNoSuchImage
 }
 
+// Maps repo:tag to id (like git rev-parse). "" if there's no such tag.
+func ParseTag(remote Core, repo, tag string) (ID, error) {
+	id, err := remote.Get(path.Join("repositories", repo, tag))
+	if err == ErrNoSuchKey {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return ID(id), nil
+}
+
+// Lists all the repo:tags on the remote.
+func ListTags(remote Core) ([]Tag, error) {
+	tags := make([]Tag, 0)
+
+	keys, err := remote.List("repositories/")
+	if err != nil {
+		return tags, err
+	}
+
+	for _, key := range keys {
+		// a tag being written by a push
+		if strings.Contains(path.Base(key), tagTmpSuffix) {
+			continue
+		}
+
+		repo, tag := path.Split(strings.TrimPrefix(key, "repositories/"))
+		repo = strings.TrimSuffix(repo, "/")
+
+		id, err := ParseTag(remote, repo, tag)
+		if err != nil {
+			return tags, err
+		}
+		tags = append(tags, Tag{Repo: repo, Tag: tag, ID: id})
+	}
+
+	return tags, nil
+}
+
 // Common implementation of walking a remote's images
 //
 // Starting at id, follow the ancestry tree, calling walker for each image found.
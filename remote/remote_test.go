@@ -0,0 +1,23 @@
+package remote
+
+import (
+	"testing"
+)
+
+func TestNormaliseImageName(t *testing.T) {
+	tests := []struct {
+		image, repo, tag string
+	}{
+		{"redis", "redis", "latest"},
+		{"redis:2.8", "redis", "2.8"},
+		{"localhost:5000/myorg/app", "localhost:5000/myorg/app", "latest"},
+		{"localhost:5000/myorg/app:v1", "localhost:5000/myorg/app", "v1"},
+	}
+
+	for _, test := range tests {
+		repo, tag := NormaliseImageName(test.image)
+		if repo != test.repo || tag != test.tag {
+			t.Errorf("NormaliseImageName(%q) = %q, %q, want %q, %q", test.image, repo, tag, test.repo, test.tag)
+		}
+	}
+}
@@ -5,19 +5,28 @@ import (
 	"github.com/mitchellh/goamz/aws"
 	"github.com/mitchellh/goamz/s3"
 
+	"archive/tar"
 	"bufio"
+	"bytes"
 	"encoding/json"
 
 	"github.com/blake-education/dogestry/compressor"
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/vault"
 	docker "github.com/fsouza/go-dockerclient"
 
 	"fmt"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"sync"
+	"time"
 )
 
 type S3Remote struct {
@@ -27,16 +36,27 @@ type S3Remote struct {
 	KeyPrefix  string
 	client     *s3.S3
 	compressor compressor.Compressor
+
+	statsLock sync.Mutex
+	stats     TransferStats
 }
 
 var (
 	S3DefaultRegion = "us-west-2"
+
+	// files at least this big are uploaded in parts, so an interrupted upload
+	// can be resumed by pushing again
+	S3MultipartThreshold int64 = 64 * 1024 * 1024
+	S3PartSize           int64 = 16 * 1024 * 1024
+
+	// how many times to try downloading a file, resuming from the last byte received
+	S3DownloadAttempts = 3
 )
 
 func NewS3Remote(config RemoteConfig) (*S3Remote, error) {
 	s3, err := newS3Client(config)
 	if err != nil {
-		return &S3Remote{}, nil
+		return &S3Remote{}, err
 	}
 
 	url := config.Url
@@ -60,7 +80,7 @@ func NewS3Remote(config RemoteConfig) (*S3Remote, error) {
 func newS3Client(config RemoteConfig) (*s3.S3, error) {
 	auth, err := getS3Auth(config)
 	if err != nil {
-		return &s3.S3{}, err
+		return &s3.S3{}, &AuthError{err}
 	}
 
 	var regionName string
@@ -77,17 +97,53 @@ func newS3Client(config RemoteConfig) (*s3.S3, error) {
 	return s3.New(auth, region), nil
 }
 
-// determine the s3 auth from various sources
-func getS3Auth(config RemoteConfig) (aws.Auth, error) {
+// determine the s3 auth from various sources, and make sure it's never printed
+func getS3Auth(config RemoteConfig) (auth aws.Auth, err error) {
+	defer func() { utils.AddSecret(auth.SecretKey, auth.Token) }()
+
+	// credentials from `dogestry login` take precedence over the config file
+	creds, err := config.StoredCredentials()
+	if err != nil {
+		return aws.Auth{}, err
+	}
+	if creds != nil && creds.Access_Key_Id != "" {
+		return aws.GetAuth(creds.Access_Key_Id, creds.Secret_Key)
+	}
+
 	s3config := config.Config.S3
+	if path := config.S3_Vault_Path; path != "" || s3config.Vault_Path != "" {
+		if path == "" {
+			path = s3config.Vault_Path
+		}
+		return vaultS3Auth(config.Config, path)
+	}
 	return aws.GetAuth(s3config.Access_Key_Id, s3config.Secret_Key)
 }
 
+// S3 keys from the vault secret at path: a kv secret with access-key-id and
+// secret-key, or keys from vault's aws secrets engine.
+func vaultS3Auth(cfg config.Config, path string) (aws.Auth, error) {
+	client, err := vault.NewClient(cfg)
+	if err != nil {
+		return aws.Auth{}, err
+	}
+
+	auth := aws.Auth{}
+	if auth.AccessKey, err = client.ReadField(path, "access-key-id", "access_key"); err != nil {
+		return auth, err
+	}
+	if auth.SecretKey, err = client.ReadField(path, "secret-key", "secret_key"); err != nil {
+		return auth, err
+	}
+	auth.Token, _ = client.ReadField(path, "security_token")
+	return auth, nil
+}
+
 func (remote *S3Remote) Validate() error {
 	bucket := remote.getBucket()
 	_, err := bucket.List(remote.KeyPrefix, "", "", 1)
 	if err != nil {
-		return fmt.Errorf("%s unable to ping s3 bucket: %s", remote.Desc(), err)
+		return fmt.Errorf("%s unable to ping s3 bucket: %w", remote.Desc(), err)
 	}
 
 	return nil
@@ -98,64 +154,387 @@ func (remote *S3Remote) Desc() string {
 	return fmt.Sprintf("s3(bucket=%s, prefix=%s, region=%s, accessKey=%s)", remote.BucketName, remote.KeyPrefix, remote.client.Region.Name, remote.client.Auth.AccessKey)
 }
 
+func (remote *S3Remote) Stats() TransferStats {
+	remote.statsLock.Lock()
+	defer remote.statsLock.Unlock()
+	return remote.stats
+}
+
+func (remote *S3Remote) addStats(stats TransferStats) {
+	remote.statsLock.Lock()
+	defer remote.statsLock.Unlock()
+	remote.stats.Add(stats)
+}
+
 func (remote *S3Remote) Push(image, imageRoot string) error {
-	fmt.Println("fetching repo keys")
-	remoteKeys, err := remote.repoKeys("")
-	if err != nil {
-		return fmt.Errorf("error getting repoKeys: %s", err)
+	if err := checkImmutableTags(remote, remote.config, imageRoot); err != nil {
+		return err
 	}
 
-	fmt.Println("fetching local keys")
+	utils.Detailf("fetching local keys\n")
 	localKeys, err := remote.localKeys(imageRoot)
 	if err != nil {
-		return fmt.Errorf("error getting localKeys: %s", err)
+		return fmt.Errorf("error getting localKeys: %w", err)
 	}
 
-	// DEBUG
-	//delete(remoteKeys, "images/8dbd9e392a964056420e5d58ca5cc376ef18e2de93b5cc90e868a1bbc8318c1c/layer.tar.lz4")
-
-	fmt.Println("comparing keys")
-	keysToPush := localKeys.NotIn(remoteKeys)
+	keysToPush := localKeys
+	if !remote.config.Force() {
+		utils.Detailf("checking which keys the remote already has\n")
+		if keysToPush, err = remote.missingKeys(localKeys); err != nil {
+			return fmt.Errorf("error checking remote keys: %w", err)
+		}
+	}
+	remote.addStats(TransferStats{Skipped: len(localKeys) - len(keysToPush)})
 
 	if len(keysToPush) == 0 {
-		fmt.Println("nothing to push")
+		remote.config.Control.Printf("nothing to push\n")
 		return nil
 	}
 
-	// TODO parallelise this
-	for key, localKey := range keysToPush {
-		fmt.Printf("pushing key %s (%s)\n", key, utils.FileHumanSize(localKey.fullPath))
+	// tags go last, so they never point at images which haven't finished pushing
+	tagKeys := keysToPush.WithPrefix("repositories/")
+	imageKeys := keysToPush.NotIn(tagKeys)
 
-		if err := remote.putFile(localKey.fullPath, localKey); err != nil {
+	if err := remote.putFiles(imageKeys); err != nil {
+		return err
+	}
+
+	for _, tagKey := range tagKeys {
+		if err := remote.putTag(tagKey); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
-func (remote *S3Remote) PullImageId(id ID, dst string) error {
+const tagTmpSuffix = ".tmp-"
+
+// Uploads a tag to a temporary key then copies it into place, so the tag only
+// ever changes in one step, once everything it points to is uploaded.
+func (remote *S3Remote) putTag(key *keyDef) error {
+	utils.Detailf("pushing tag %s\n", key.key)
+
+	dstKey := remote.remoteKey(key.key)
+	tmpKey := fmt.Sprintf("%s%s%d", dstKey, tagTmpSuffix, time.Now().UnixNano())
+
+	data, err := ioutil.ReadFile(key.fullPath)
+	if err != nil {
+		return err
+	}
+
+	if err := remote.putData(tmpKey, data, "application/octet-stream"); err != nil {
+		return err
+	}
+	defer remote.getBucket().Del(tmpKey)
+
+	if err := remote.copyObject(dstKey, tmpKey); err != nil {
+		return err
+	}
+
+	remote.addStats(TransferStats{Transferred: 1, Bytes: int64(len(data))})
+
+	return remote.putData(dstKey+".sum", []byte(key.Sum()), "text/plain")
+}
+
+func (remote *S3Remote) PushPlan(imageRoot string) ([]PlannedFile, error) {
+	localKeys, err := remote.localKeys(imageRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := localKeys
+	if !remote.config.Force() {
+		if missing, err = remote.missingKeys(localKeys); err != nil {
+			return nil, err
+		}
+	}
+
+	plan := make([]PlannedFile, 0, len(missing))
+	for _, key := range missing {
+		plan = append(plan, PlannedFile{Key: key.key, Size: key.size})
+	}
+	return plan, nil
+}
+
+func (remote *S3Remote) PullPlan(id ID) ([]PlannedFile, error) {
 	rootKey := "images/" + string(id)
 	imageKeys, err := remote.repoKeys("/" + rootKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return remote.getFiles(dst, rootKey, imageKeys)
+	plan := make([]PlannedFile, 0, len(imageKeys))
+	for _, key := range imageKeys {
+		if key.s3Key.Key == "" {
+			continue
+		}
+
+		if path.Base(key.key) != BlobIndexFile {
+			plan = append(plan, PlannedFile{Key: key.key, Size: key.s3Key.Size})
+			continue
+		}
+
+		data, err := remote.getData(remote.remoteKey(key.key))
+		if err != nil {
+			return nil, err
+		}
+		index, err := ParseBlobIndex(data)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, digest := range index {
+			blobKey, err := BlobKey(digest)
+			if err != nil {
+				return nil, err
+			}
+
+			s3Key, err := remote.getBucket().GetKey(remote.remoteKey(blobKey))
+			if err != nil {
+				return nil, fmt.Errorf("getting %s: %w", blobKey, err)
+			}
+			plan = append(plan, PlannedFile{Key: blobKey, Size: s3Key.Size})
+		}
+	}
+	return plan, nil
 }
 
-func (remote *S3Remote) ParseTag(repo, tag string) (ID, error) {
-	bucket := remote.getBucket()
+// Returns the local keys which the remote doesn't have, or has with a different
+// size or sum. Keys are checked one by one, several at a time, rather than
+// listing the whole bucket.
+func (remote *S3Remote) missingKeys(localKeys keys) (keys, error) {
+	work := make(chan *keyDef)
+	errs := make(chan error, len(localKeys))
+
+	var missingLock sync.Mutex
+	missing := make(keys)
+
+	var wg sync.WaitGroup
+	for i := 0; i < remote.config.Concurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for localKey := range work {
+				has, err := remote.hasKey(localKey)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				if !has {
+					missingLock.Lock()
+					missing[localKey.key] = localKey
+					missingLock.Unlock()
+				}
+			}
+		}()
+	}
 
-	file, err := bucket.Get(remote.tagFilePath(repo, tag))
+	for _, localKey := range localKeys {
+		work <- localKey
+	}
+	close(work)
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return missing, nil
+}
+
+// Whether the remote already has the local key with the same size and sum.
+func (remote *S3Remote) hasKey(localKey *keyDef) (bool, error) {
+	dstKey := remote.remoteKey(localKey.key)
+
+	s3Key, err := remote.getBucket().GetKey(dstKey)
 	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
-		// doesn't exist yet, deal with it
-		return "", nil
+		return false, nil
 	} else if err != nil {
-		return "", err
+		return false, err
+	}
+
+	if s3Key.Size != localKey.size {
+		return false, nil
+	}
+
+	sum, err := remote.getData(dstKey + ".sum")
+	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return string(sum) == localKey.Sum(), nil
+}
+
+// put files to the s3 bucket, several at a time
+func (remote *S3Remote) putFiles(toPush keys) error {
+	names := make([]string, 0, len(toPush))
+	for name := range toPush {
+		names = append(names, name)
+	}
+
+	return TransferEach(names, remote.config.Concurrency(), remote.config.Retries(), remote.config.Control, func(name string) (int64, error) {
+		localKey := toPush[name]
+		utils.Detailf("pushing key %s (%s)\n", localKey.key, utils.FileHumanSize(localKey.fullPath))
+		return localKey.size, remote.putFile(localKey.fullPath, localKey)
+	})
+}
+
+// where to print transfer progress, for -v. Interleaved progress from concurrent transfers is just noise
+func (remote *S3Remote) progressOutput() io.Writer {
+	if remote.config.Concurrency() > 1 || !utils.Verbose(utils.VerbosityDetail) {
+		return ioutil.Discard
+	}
+	return remote.config.Control.output()
+}
+
+func (remote *S3Remote) PullImageId(id ID, dst string) error {
+	rootKey := "images/" + string(id)
+	imageKeys, err := remote.repoKeys("/" + rootKey)
+	if err != nil {
+		return err
+	}
+
+	if err := remote.getFiles(dst, rootKey, imageKeys); err != nil {
+		return err
 	}
 
-	return ID(file), nil
+	return resolveBlobs(dst, remote.config, remote.getBlob)
+}
+
+// get the blob at key to dst
+func (remote *S3Remote) getBlob(key, dst string) error {
+	s3Key, err := remote.getBucket().GetKey(remote.remoteKey(key))
+	if err != nil {
+		return fmt.Errorf("getting %s: %w", key, err)
+	}
+
+	return remote.getFile(dst, &keyDef{
+		key:    key,
+		sumKey: remote.remoteKey(key) + ".sum",
+		s3Key:  *s3Key,
+		remote: remote,
+	})
+}
+
+func (remote *S3Remote) StreamImageId(id ID, w *tar.Writer) error {
+	rootKey := "images/" + string(id)
+	imageKeys, err := remote.repoKeys("/" + rootKey)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range imageKeys {
+		// a sum without its file
+		if key.s3Key.Key == "" {
+			continue
+		}
+
+		relKey := strings.TrimPrefix(strings.TrimPrefix(key.key, rootKey), "/")
+
+		if relKey != BlobIndexFile {
+			if err := remote.streamKey(w, key.key, key.s3Key.Size, path.Join(string(id), relKey)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// stream the blobs in place of the index
+		data, err := remote.getData(remote.remoteKey(key.key))
+		if err != nil {
+			return err
+		}
+		index, err := ParseBlobIndex(data)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range index.Files() {
+			if err := remote.streamBlobs(w, file, path.Join(string(id), path.Base(file.Name))); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// writes the object at key to w as name
+func (remote *S3Remote) streamKey(w *tar.Writer, key string, size int64, name string) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := w.WriteHeader(header); err != nil {
+		return err
+	}
+
+	return remote.copyKey(w, key, size)
+}
+
+// writes the blobs making up file to w as name, joining its chunks
+func (remote *S3Remote) streamBlobs(w *tar.Writer, file BlobFile, name string) error {
+	keys := make([]string, len(file.Digests))
+	sizes := make([]int64, len(file.Digests))
+	var size int64
+
+	for i, digest := range file.Digests {
+		key, err := BlobKey(digest)
+		if err != nil {
+			return err
+		}
+
+		s3Key, err := remote.getBucket().GetKey(remote.remoteKey(key))
+		if err != nil {
+			return fmt.Errorf("getting %s: %w", key, err)
+		}
+
+		keys[i], sizes[i] = key, s3Key.Size
+		size += s3Key.Size
+	}
+
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := w.WriteHeader(header); err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		if err := remote.copyKey(w, key, sizes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (remote *S3Remote) copyKey(w io.Writer, key string, size int64) error {
+	utils.Detailf("streaming key %s (%s)\n", key, utils.HumanSize(size))
+
+	resp, err := remote.getObject(remote.remoteKey(key), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body := remote.config.Control.progressReader(key, bufio.NewReader(resp.Body), 0)
+	copied, err := io.Copy(w, utils.NewProgressReader(body, size, remote.progressOutput()))
+	if err != nil {
+		return err
+	}
+
+	remote.addStats(TransferStats{Transferred: 1, Bytes: copied})
+	return nil
 }
 
 func (remote *S3Remote) ResolveImageNameToId(image string) (ID, error) {
@@ -179,6 +558,74 @@ func (remote *S3Remote) ImageFullId(id ID) (ID, error) {
 	return "", ErrNoSuchImage
 }
 
+func (remote *S3Remote) Get(key string) ([]byte, error) {
+	data, err := remote.getData(remote.remoteKey(key))
+	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
+		return nil, ErrNoSuchKey
+	}
+	return data, err
+}
+
+func (remote *S3Remote) Put(key string, data []byte) error {
+	return remote.putData(remote.remoteKey(key), data, "application/octet-stream")
+}
+
+// Puts key with If-None-Match, so S3 refuses it if key exists. S3-compatible
+// stores which ignore the header overwrite it instead.
+func (remote *S3Remote) PutIfAbsent(key string, data []byte) error {
+	headers := http.Header{
+		"Content-Type":  {"application/octet-stream"},
+		"X-Amz-Acl":     {string(s3.Private)},
+		"If-None-Match": {"*"},
+	}
+	resp, err := remote.request("PUT", remote.remoteKey(key), nil, headers, bytes.NewReader(data), int64(len(data)))
+	// 409 is another conditional write to key still in progress
+	if s3err, ok := err.(*s3.Error); ok && (s3err.StatusCode == 412 || s3err.StatusCode == 409) {
+		return ErrKeyExists
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (remote *S3Remote) Open(key string) (io.ReadCloser, int64, error) {
+	resp, err := remote.getObject(remote.remoteKey(key), nil)
+	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
+		return nil, 0, ErrNoSuchKey
+	} else if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (remote *S3Remote) Delete(key string) error {
+	return remote.getBucket().Del(remote.remoteKey(key))
+}
+
+// The .sum files kept beside pushed files aren't listed.
+func (remote *S3Remote) List(prefix string) ([]string, error) {
+	bucketPrefix := remote.remoteKey(prefix)
+	if bucketPrefix != "" && (prefix == "" || strings.HasSuffix(prefix, "/")) {
+		bucketPrefix += "/"
+	}
+
+	contents, err := remote.getBucket().GetBucketContentsFiltered(bucketPrefix, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("listing bucket contents at prefix '%s': %w", prefix, err)
+	}
+
+	keys := make([]string, 0, len(*contents))
+	for key := range *contents {
+		if key == "" || strings.HasSuffix(key, ".sum") {
+			continue
+		}
+		keys = append(keys, strings.TrimPrefix(strings.TrimPrefix(key, remote.KeyPrefix), "/"))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
 func (remote *S3Remote) WalkImages(id ID, walker ImageWalkFn) error {
 	return WalkImages(remote, id, walker)
 }
@@ -187,7 +634,7 @@ func (remote *S3Remote) ImageMetadata(id ID) (docker.Image, error) {
 	jsonPath := path.Join(remote.imagePath(id), "json")
 	image := docker.Image{}
 
-	imageJson, err := remote.getBucket().Get(jsonPath)
+	imageJson, err := remote.getData(jsonPath)
 	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
 		// doesn't exist yet, deal with it
 		return image, ErrNoSuchImage
@@ -216,6 +663,7 @@ type keyDef struct {
 
 	s3Key    s3.Key
 	fullPath string
+	size     int64
 
 	remote *S3Remote
 }
@@ -235,6 +683,19 @@ func (k keys) Get(key string, remote *S3Remote) *keyDef {
 	return k[key]
 }
 
+// Returns the keys starting with prefix.
+func (k keys) WithPrefix(prefix string) keys {
+	withPrefix := make(keys)
+
+	for key, keyDef := range k {
+		if strings.HasPrefix(key, prefix) {
+			withPrefix[key] = keyDef
+		}
+	}
+
+	return withPrefix
+}
+
 // Returns keys either not existing in other,
 // or whose sum doesn't match.
 func (k keys) NotIn(other keys) keys {
@@ -261,7 +722,7 @@ func (kd *keyDef) Sum() (sum string) {
 	// get sum!
 	// honestly there's not much we can do if we don't get the sum here
 	// maybe a panic??
-	bytesSum, err := kd.remote.getBucket().Get(kd.sumKey)
+	bytesSum, err := kd.remote.getData(kd.sumKey)
 	if err != nil {
 		return ""
 	}
@@ -285,7 +746,7 @@ func (remote *S3Remote) repoKeys(prefix string) (keys, error) {
 
 	cnt, err := bucket.GetBucketContentsFiltered(bucketPrefix, "", "")
 	if err != nil {
-		return repoKeys, fmt.Errorf("getting bucket contents at prefix '%s': %s", prefix, err)
+		return repoKeys, fmt.Errorf("getting bucket contents at prefix '%s': %w", prefix, err)
 	}
 
 	for _, key := range *cnt {
@@ -333,6 +794,7 @@ func (remote *S3Remote) localKeys(root string) (keys, error) {
 			key:      key,
 			sum:      sum,
 			fullPath: path,
+			size:     info.Size(),
 		}
 
 		return nil
@@ -369,20 +831,51 @@ func (remote *S3Remote) putFile(src string, key *keyDef) error {
 		return err
 	}
 
-	progressReader := utils.NewProgressReader(f, finfo.Size(), os.Stdout)
+	if finfo.Size() >= S3MultipartThreshold {
+		err = remote.putMultipart(key.key, dstKey, f)
+	} else {
+		progressReader := utils.NewProgressReader(remote.config.Control.progressReader(key.key, f, 0), finfo.Size(), remote.progressOutput())
 
-	// XXX We don't know how big the file will be ahead of time!
-	//compressorReader,err := remote.compressor.CompressReader(progressReader)
-	//if err != nil {
-	//return err
-	//}
+		// XXX We don't know how big the file will be ahead of time!
+		//compressorReader,err := remote.compressor.CompressReader(progressReader)
+		//if err != nil {
+		//return err
+		//}
+
+		err = remote.putObject(dstKey, progressReader, finfo.Size(), "application/octet-stream")
+	}
+	if err != nil {
+		return err
+	}
+
+	remote.addStats(TransferStats{Transferred: 1, Bytes: finfo.Size()})
 
-	err = remote.getBucket().PutReader(dstKey, progressReader, finfo.Size(), "application/octet-stream", s3.Private)
+	return remote.putData(dstKey+".sum", []byte(key.Sum()), "text/plain")
+}
+
+// Upload f in parts. If an earlier upload of the key was interrupted,
+// the parts it finished are reused rather than uploaded again.
+func (remote *S3Remote) putMultipart(key, dstKey string, f *os.File) error {
+	multi, err := remote.getBucket().Multi(dstKey, "application/octet-stream", s3.Private)
 	if err != nil {
 		return err
 	}
 
-	return remote.getBucket().Put(dstKey+".sum", []byte(key.Sum()), "text/plain", s3.Private)
+	if existing, err := multi.ListParts(); err == nil && len(existing) > 0 {
+		var size int64
+		for _, part := range existing {
+			size += part.Size
+		}
+		remote.config.Control.Printf("resuming upload of %s, %d parts (%s) already uploaded\n", dstKey, len(existing), utils.HumanSize(size))
+	}
+
+	parts, err := remote.putParts(key, multi, f, S3PartSize)
+	if err != nil {
+		// leave the upload unfinished, so the next push can resume it
+		return err
+	}
+
+	return multi.Complete(parts)
 }
 
 // get files from the s3 bucket to a local path, relative to rootKey
@@ -407,38 +900,117 @@ func (remote *S3Remote) getFiles(dst, rootKey string, imageKeys keys) error {
 }
 
 // get a single file from the s3 bucket
+// Gets a file from the s3 bucket. A partly downloaded file at dst is resumed
+// rather than started again, and a complete one with the right sum is kept.
 func (remote *S3Remote) getFile(dst string, key *keyDef) error {
-	fmt.Printf("pulling key %s (%s)\n", key.key, utils.HumanSize(key.s3Key.Size))
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
 
-	srcKey := remote.remoteKey(key.key)
+	if remote.config.Force() {
+		// start again, in case what's there is corrupt
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if info, err := os.Stat(dst); err == nil && info.Size() == key.s3Key.Size {
+		if sum, err := utils.Sha1File(dst); err == nil && sum == key.Sum() {
+			utils.Detailf("already have key %s\n", key.key)
+			remote.addStats(TransferStats{Skipped: 1})
+			return nil
+		}
+		// same size but different contents, start again
+		if err := os.Remove(dst); err != nil {
+			return err
+		}
+	}
 
-	from, err := remote.getBucket().GetReader(srcKey)
+	utils.Detailf("pulling key %s (%s)\n", key.key, utils.HumanSize(key.s3Key.Size))
+
+	var (
+		copied int64
+		err    error
+	)
+	for attempt := 1; attempt <= S3DownloadAttempts; attempt++ {
+		var n int64
+		n, err = remote.getFileFrom(dst, key)
+		copied += n
+		if err == nil {
+			break
+		}
+		if attempt < S3DownloadAttempts {
+			remote.config.Control.Printf("pulling key %s failed, resuming: %s\n", key.key, err)
+		}
+	}
 	if err != nil {
 		return err
 	}
-	defer from.Close()
-	bufFrom := bufio.NewReader(from)
 
-	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
-		return err
+	remote.addStats(TransferStats{Transferred: 1, Bytes: copied})
+
+	if expected := key.Sum(); expected != "" {
+		sum, err := utils.Sha1File(dst)
+		if err != nil {
+			return err
+		}
+		if sum != expected {
+			os.Remove(dst)
+			return &ChecksumError{File: key.key, Expected: "sha1 " + expected, Actual: sum}
+		}
 	}
 
-	to, err := os.Create(dst)
+	return nil
+}
+
+// Appends the rest of the file to dst, using a range request to start from
+// the end of what's already there. Returns the number of bytes received.
+func (remote *S3Remote) getFileFrom(dst string, key *keyDef) (int64, error) {
+	to, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer to.Close()
 
-	// TODO add progress reader
-	progressReaderFrom := utils.NewProgressReader(bufFrom, key.s3Key.Size, os.Stdout)
+	info, err := to.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	offset := info.Size()
+	if offset > key.s3Key.Size {
+		// not a partial download of this key
+		if err := to.Truncate(0); err != nil {
+			return 0, err
+		}
+		offset = 0
+	}
 
-	_, err = io.Copy(to, progressReaderFrom)
+	var headers http.Header
+	if offset > 0 {
+		if offset == key.s3Key.Size {
+			return 0, nil
+		}
+		remote.config.Control.Printf("resuming key %s from %s\n", key.key, utils.HumanSize(offset))
+		headers = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+
+	resp, err := remote.getObject(remote.remoteKey(key.key), headers)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer resp.Body.Close()
 
-	// TODO validate against sum
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		// the range was ignored, so we're getting the whole file
+		if err := to.Truncate(0); err != nil {
+			return 0, err
+		}
+		offset = 0
+	}
 
-	return nil
+	bufFrom := remote.config.Control.progressReader(key.key, bufio.NewReader(resp.Body), offset)
+	progressReaderFrom := utils.NewProgressReader(bufFrom, key.s3Key.Size-offset, remote.progressOutput())
+
+	return io.Copy(to, progressReaderFrom)
 }
 
 // path to a tagfile
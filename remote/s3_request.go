@@ -0,0 +1,300 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// Requests which move an object's data are signed and sent here rather than
+// by goamz, so they go through the remote's http client, which applies
+// -request-timeout and traces requests, and so they can fetch ranges and
+// copy objects, which goamz can't. Listing the bucket, HEADs, deletes and
+// starting and completing multipart uploads are left to goamz, which always
+// uses http.DefaultClient.
+
+// how many times to try a request without a body, as goamz does
+var s3RequestAttempts = 3
+
+// Sends a signed request for the object at key, a full remote key. Responses
+// other than 2xx are returned as an *s3.Error, as goamz's are.
+func (remote *S3Remote) request(method, key string, params url.Values, headers http.Header, body io.Reader, length int64) (*http.Response, error) {
+	region := remote.client.Region
+	signPath := "/" + remote.BucketName + "/" + strings.TrimPrefix(key, "/")
+
+	var endpoint, path string
+	if region.S3BucketEndpoint != "" {
+		if strings.ContainsAny(remote.BucketName, "/:@") {
+			return nil, fmt.Errorf("bad S3 bucket: %q", remote.BucketName)
+		}
+		endpoint = strings.Replace(region.S3BucketEndpoint, "${bucket}", remote.BucketName, -1)
+		path = "/" + strings.TrimPrefix(key, "/")
+	} else {
+		endpoint, path = region.S3Endpoint, signPath
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("bad S3 endpoint URL %q: %w", endpoint, err)
+	}
+	u.Path = path
+	u.RawQuery = params.Encode()
+
+	attempts := 1
+	if body == nil {
+		attempts = s3RequestAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest(method, u.String(), body)
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range headers {
+			req.Header[name] = values
+		}
+		req.ContentLength = length
+		req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
+		signS3(remote.client.Auth, method, signPath, params, req.Header)
+
+		resp, err := remote.httpClient().Do(req)
+		if err == nil && resp.StatusCode/100 == 2 {
+			return resp, nil
+		}
+		if err == nil {
+			err = s3Error(resp)
+		}
+		if attempt >= attempts || !retryS3(err) {
+			return nil, err
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// the client object requests are made with
+func (remote *S3Remote) httpClient() *http.Client {
+	if timeout := remote.config.RequestTimeout(); timeout > 0 {
+		return idleTimeoutClient(timeout)
+	}
+	return &http.Client{Transport: TraceRequests(http.DefaultTransport)}
+}
+
+// network errors and the server's errors are worth trying again
+func retryS3(err error) bool {
+	if s3err, ok := err.(*s3.Error); ok {
+		return s3err.StatusCode >= 500
+	}
+	return true
+}
+
+// The object at key. headers can ask for a range of it, in which case the
+// response's status is 206 if the range was honoured.
+func (remote *S3Remote) getObject(key string, headers http.Header) (*http.Response, error) {
+	return remote.request("GET", key, nil, headers, nil, 0)
+}
+
+func (remote *S3Remote) getData(key string) ([]byte, error) {
+	resp, err := remote.getObject(key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (remote *S3Remote) putObject(key string, r io.Reader, length int64, contentType string) error {
+	headers := http.Header{
+		"Content-Type": {contentType},
+		"X-Amz-Acl":    {string(s3.Private)},
+	}
+	if length == 0 {
+		// a nil body, so the Content-Length is still sent
+		r = nil
+	}
+	resp, err := remote.request("PUT", key, nil, headers, r, length)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (remote *S3Remote) putData(key string, data []byte, contentType string) error {
+	return remote.putObject(key, bytes.NewReader(data), int64(len(data)), contentType)
+}
+
+// Copies the object at src to dst, in the same bucket. S3 makes the copy, so
+// nothing is downloaded or uploaded.
+func (remote *S3Remote) copyObject(dst, src string) error {
+	source := (&url.URL{Path: "/" + remote.BucketName + "/" + strings.TrimPrefix(src, "/")}).String()
+	headers := http.Header{
+		"X-Amz-Acl":         {string(s3.Private)},
+		"X-Amz-Copy-Source": {source},
+	}
+
+	resp, err := remote.request("PUT", dst, nil, headers, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// a copy can fail after it's started, with a 200 and an error as the body
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(body, []byte("<Error>")) {
+		s3err := &s3.Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(body, s3err)
+		return s3err
+	}
+	return nil
+}
+
+// Uploads f to multi in parts of partSize, as goamz's PutAll does: parts an
+// earlier upload of the key finished are reused if their checksums match.
+// Its progress is reported as key's.
+func (remote *S3Remote) putParts(key string, multi *s3.Multi, f *os.File, partSize int64) ([]s3.Part, error) {
+	old, err := multi.ListParts()
+	if s3err, ok := err.(*s3.Error); ok && s3err.Code == "NoSuchUpload" {
+		old = nil
+	} else if err != nil {
+		return nil, err
+	}
+	reused := make(map[int]s3.Part, len(old))
+	for _, part := range old {
+		reused[part.N] = part
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	total := info.Size()
+
+	parts := []s3.Part{}
+	// an empty file is still one, empty, part
+	for n, offset := 1, int64(0); offset < total || n == 1; n, offset = n+1, offset+partSize {
+		size := partSize
+		if offset+size > total {
+			size = total - offset
+		}
+		section := io.NewSectionReader(f, offset, size)
+
+		digest := md5.New()
+		if _, err := io.Copy(digest, section); err != nil {
+			return nil, err
+		}
+		sum := digest.Sum(nil)
+
+		if part, ok := reused[n]; ok && part.Size == size && part.ETag == `"`+hex.EncodeToString(sum)+`"` {
+			parts = append(parts, part)
+			continue
+		}
+
+		if _, err := section.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		params := url.Values{"uploadId": {multi.UploadId}, "partNumber": {strconv.Itoa(n)}}
+		headers := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum)}}
+		body := remote.config.Control.progressReader(key, section, offset)
+		if size == 0 {
+			body = nil
+		}
+		resp, err := remote.request("PUT", multi.Key, params, headers, body, size)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			return nil, fmt.Errorf("part %d of %s was uploaded without an ETag", n, multi.Key)
+		}
+		parts = append(parts, s3.Part{N: n, ETag: etag, Size: size})
+	}
+	return parts, nil
+}
+
+func s3Error(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	err := &s3.Error{}
+	xml.NewDecoder(resp.Body).Decode(err)
+	err.StatusCode = resp.StatusCode
+	if err.Message == "" {
+		err.Message = resp.Status
+	}
+	return err
+}
+
+// the query parameters which are signed
+var s3SignedParams = map[string]bool{
+	"acl":              true,
+	"partNumber":       true,
+	"uploadId":         true,
+	"uploads":          true,
+	"versionId":        true,
+	"response-expires": true,
+}
+
+// Signs a request with S3's signature version 2, as goamz does, adding its
+// Authorization header. http://goo.gl/G1LrK
+func signS3(auth aws.Auth, method, canonicalPath string, params url.Values, headers http.Header) {
+	if auth.Token != "" {
+		headers.Set("X-Amz-Security-Token", auth.Token)
+	}
+
+	amz := []string{}
+	for name, values := range headers {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			amz = append(amz, name+":"+strings.Join(values, ","))
+		}
+	}
+	sort.Strings(amz)
+
+	signed := []string{}
+	for name, values := range params {
+		if !s3SignedParams[name] {
+			continue
+		}
+		for _, value := range values {
+			if value == "" {
+				signed = append(signed, name)
+			} else {
+				// not encoded, when signing
+				signed = append(signed, name+"="+value)
+			}
+		}
+	}
+	if len(signed) > 0 {
+		sort.Strings(signed)
+		canonicalPath += "?" + strings.Join(signed, "&")
+	}
+
+	payload := method + "\n" + headers.Get("Content-Md5") + "\n" + headers.Get("Content-Type") + "\n" + headers.Get("Date") + "\n"
+	for _, header := range amz {
+		payload += header + "\n"
+	}
+	payload += canonicalPath
+
+	hash := hmac.New(sha1.New, []byte(auth.SecretKey))
+	hash.Write([]byte(payload))
+	headers.Set("Authorization", "AWS "+auth.AccessKey+":"+base64.StdEncoding.EncodeToString(hash.Sum(nil)))
+}
@@ -1,3 +1,9 @@
+// The s3 tests need gocheck and lachie's goamz fork, which aren't vendored.
+// Run them with -tags gocheck where they're on the GOPATH.
+
+//go:build gocheck
+// +build gocheck
+
 package remote
 
 var GetListResultDump1 = `
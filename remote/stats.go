@@ -0,0 +1,69 @@
+package remote
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// What a remote has transferred
+type TransferStats struct {
+	// files sent or received
+	Transferred int
+	// files that didn't need sending or receiving
+	Skipped int
+	// bytes sent or received
+	Bytes int64
+}
+
+func (stats *TransferStats) Add(other TransferStats) {
+	stats.Transferred += other.Transferred
+	stats.Skipped += other.Skipped
+	stats.Bytes += other.Bytes
+}
+
+// What's been transferred since before, when the stats were before.
+func (stats TransferStats) Since(before TransferStats) TransferStats {
+	return TransferStats{
+		Transferred: stats.Transferred - before.Transferred,
+		Skipped:     stats.Skipped - before.Skipped,
+		Bytes:       stats.Bytes - before.Bytes,
+	}
+}
+
+var (
+	rsyncFilesRe       = regexp.MustCompile(`Number of files: ([\d,]+)(?: \(reg: ([\d,]+))?`)
+	rsyncTransferredRe = regexp.MustCompile(`Number of (?:regular )?files transferred: ([\d,]+)`)
+	rsyncBytesRe       = regexp.MustCompile(`Total transferred file size: ([\d,]+)`)
+)
+
+// parse the output of rsync --stats
+func parseRsyncStats(out string) TransferStats {
+	stats := TransferStats{}
+
+	files := 0
+	if m := rsyncFilesRe.FindStringSubmatch(out); m != nil {
+		if m[2] != "" {
+			files = parseRsyncNumber(m[2])
+		} else {
+			files = parseRsyncNumber(m[1])
+		}
+	}
+	if m := rsyncTransferredRe.FindStringSubmatch(out); m != nil {
+		stats.Transferred = parseRsyncNumber(m[1])
+	}
+	if m := rsyncBytesRe.FindStringSubmatch(out); m != nil {
+		stats.Bytes = int64(parseRsyncNumber(m[1]))
+	}
+
+	if files > stats.Transferred {
+		stats.Skipped = files - stats.Transferred
+	}
+
+	return stats
+}
+
+func parseRsyncNumber(s string) int {
+	n, _ := strconv.Atoi(strings.Replace(s, ",", "", -1))
+	return n
+}
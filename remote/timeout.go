@@ -0,0 +1,40 @@
+package remote
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// An http client whose requests fail once their connection's been idle for
+// timeout: connecting, waiting for a response, or sending or receiving data.
+// Unlike a limit on the whole request, big files can take as long as they need.
+func idleTimeoutClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: TraceRequests(&http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: func(network, addr string) (net.Conn, error) {
+				conn, err := net.DialTimeout(network, addr, timeout)
+				if err != nil {
+					return nil, err
+				}
+				return &idleTimeoutConn{conn, timeout}, nil
+			},
+		}),
+	}
+}
+
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
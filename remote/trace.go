@@ -0,0 +1,36 @@
+package remote
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/blake-education/dogestry/utils"
+)
+
+// Prints each request made through rt, and how it went, with -vv.
+func TraceRequests(rt http.RoundTripper) http.RoundTripper {
+	return &tracingTransport{rt}
+}
+
+type tracingTransport struct {
+	http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !utils.Verbose(utils.VerbosityTrace) {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	// signatures in the url are redacted when it's printed
+	fmt.Printf("> %s %s\n", req.Method, req.URL)
+	started := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	took := time.Since(started).Seconds()
+	if err != nil {
+		fmt.Printf("< %s %s: %s (%.2fs)\n", req.Method, req.URL, err, took)
+		return resp, err
+	}
+	fmt.Printf("< %s %s: %s, %s (%.2fs)\n", req.Method, req.URL, resp.Status, utils.HumanSize(resp.ContentLength), took)
+	return resp, err
+}
@@ -0,0 +1,185 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/goamz/s3"
+)
+
+// how many times a failed file is retried, unless configured otherwise
+var DefaultRetries = 3
+
+// How long to wait before retrying a failed file: RetryBackoff, doubling
+// with each attempt up to MaxRetryBackoff, less up to half of it at random so
+// files which failed together aren't retried together.
+var (
+	RetryBackoff    = time.Second
+	MaxRetryBackoff = 30 * time.Second
+)
+
+func retryBackoff(attempt int) time.Duration {
+	backoff := RetryBackoff
+	for i := 1; i < attempt && backoff < MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxRetryBackoff {
+		backoff = MaxRetryBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff - time.Duration(rand.Int63n(int64(backoff)/2+1))
+}
+
+// Whether trying again might transfer the file. Refused credentials,
+// corrupt content and canceling won't be any different the next time.
+func isRetryable(err error) bool {
+	var authErr *AuthError
+	var checksumErr *ChecksumError
+	var s3Err *s3.Error
+	switch {
+	case errors.Is(err, ErrCanceled), errors.As(err, &authErr), errors.As(err, &checksumErr):
+		return false
+	case errors.As(err, &s3Err):
+		return s3Err.StatusCode != http.StatusUnauthorized && s3Err.StatusCode != http.StatusForbidden
+	}
+	return true
+}
+
+// Waits out the backoff before attempt, returning false if control is
+// canceled meanwhile.
+func waitToRetry(control Control, attempt int) bool {
+	timer := time.NewTimer(retryBackoff(attempt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-control.Cancel:
+		return false
+	}
+}
+
+// How transferring one file, or image, went
+type FileStatus struct {
+	Key      string
+	Attempts int
+	Err      error
+}
+
+// Returned when some of a batch of files couldn't be transferred, even after
+// retrying them. Has the status of every file in the batch.
+type TransferError struct {
+	Files []FileStatus
+}
+
+func (e *TransferError) failed() []FileStatus {
+	failed := make([]FileStatus, 0)
+	for _, file := range e.Files {
+		if file.Err != nil {
+			failed = append(failed, file)
+		}
+	}
+	return failed
+}
+
+func (e *TransferError) Error() string {
+	failed := e.failed()
+	return fmt.Sprintf("%d of %d transfers failed, first: %s: %s", len(failed), len(e.Files), failed[0].Key, failed[0].Err)
+}
+
+// the first file's error, so callers can tell what kind of failure it was
+func (e *TransferError) Unwrap() error {
+	return e.failed()[0].Err
+}
+
+// A table of what did and didn't transfer, so it's clear what a rerun will redo.
+func (e *TransferError) Table() string {
+	lines := make([]string, 0, len(e.Files))
+	for _, file := range e.Files {
+		status := "ok"
+		if file.Err != nil {
+			status = fmt.Sprintf("failed after %d attempts: %s", file.Attempts, file.Err)
+		}
+		lines = append(lines, fmt.Sprintf("%-80s  %s", file.Key, status))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Calls fn for each key, several at a time, retrying each failed key on its
+// own up to retries times, backing off between attempts, unless its error
+// isn't worth retrying. fn returns how many bytes it transferred, which is
+// reported with the key's events, to control. Once control is canceled, keys
+// not yet started fail with ErrCanceled, and failed keys aren't retried. If
+// any keys fail, returns a *TransferError.
+func TransferEach(keys []string, concurrency, retries int, control Control, fn func(key string) (int64, error)) error {
+	work := make(chan int)
+	statuses := make([]FileStatus, len(keys))
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				status := FileStatus{Key: keys[i]}
+				if control.Canceled() {
+					status.Err = ErrCanceled
+					statuses[i] = status
+					continue
+				}
+				started := time.Now()
+				reportEvent(control, EventStarted, keys[i], 0, 0, started, nil)
+
+				var bytes int64
+				for status.Attempts <= retries {
+					status.Attempts++
+					if bytes, status.Err = fn(keys[i]); status.Err == nil {
+						break
+					}
+					if status.Attempts > retries || !isRetryable(status.Err) || control.Canceled() {
+						break
+					}
+					reportEvent(control, EventRetrying, keys[i], status.Attempts, 0, started, status.Err)
+					if !waitToRetry(control, status.Attempts) {
+						break
+					}
+				}
+				statuses[i] = status
+
+				if status.Err != nil {
+					reportEvent(control, EventFailed, keys[i], status.Attempts, 0, started, status.Err)
+				} else {
+					reportEvent(control, EventDone, keys[i], status.Attempts, bytes, started, nil)
+				}
+			}
+		}()
+	}
+
+	for i := range keys {
+		work <- i
+	}
+	close(work)
+
+	wg.Wait()
+
+	sort.Sort(byKey(statuses))
+	for _, status := range statuses {
+		if status.Err != nil {
+			return &TransferError{Files: statuses}
+		}
+	}
+	return nil
+}
+
+type byKey []FileStatus
+
+func (s byKey) Len() int           { return len(s) }
+func (s byKey) Less(i, j int) bool { return s[i].Key < s[j].Key }
+func (s byKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,95 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/s3"
+)
+
+func TestTransferEachRetries(t *testing.T) {
+	defer func(backoff time.Duration) { RetryBackoff = backoff }(RetryBackoff)
+	RetryBackoff = time.Millisecond
+
+	var events []Event
+	control := Control{Report: func(event Event) { events = append(events, event) }}
+
+	attempts := 0
+	err := TransferEach([]string{"layer.tar"}, 1, 3, control, func(key string) (int64, error) {
+		if attempts++; attempts < 3 {
+			return 0, errors.New("connection reset")
+		}
+		return 42, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, event := range events {
+		names = append(names, event.Event)
+	}
+	if fmt.Sprint(names) != "[started retrying retrying done]" || events[3].Bytes != 42 || events[3].Attempt != 3 {
+		t.Errorf("got %+v", events)
+	}
+}
+
+func TestTransferEachDoesntRetry(t *testing.T) {
+	defer func(backoff time.Duration) { RetryBackoff = backoff }(RetryBackoff)
+	RetryBackoff = time.Millisecond
+
+	for _, fail := range []error{
+		&AuthError{Err: errors.New("no credentials")},
+		fmt.Errorf("getting layer.tar: %w", &ChecksumError{File: "layer.tar"}),
+		&s3.Error{StatusCode: 403, Code: "AccessDenied"},
+		ErrCanceled,
+	} {
+		attempts := 0
+		err := TransferEach([]string{"layer.tar"}, 1, 3, Control{}, func(key string) (int64, error) {
+			attempts++
+			return 0, fail
+		})
+		if err == nil || attempts != 1 {
+			t.Errorf("%v: %d attempts, %v", fail, attempts, err)
+		}
+	}
+}
+
+func TestTransferEachCanceled(t *testing.T) {
+	defer func(backoff time.Duration) { RetryBackoff = backoff }(RetryBackoff)
+	RetryBackoff = time.Hour
+
+	cancel := make(chan struct{})
+	attempts := 0
+	done := make(chan error)
+	go func() {
+		done <- TransferEach([]string{"layer.tar"}, 1, 3, Control{Cancel: cancel}, func(key string) (int64, error) {
+			attempts++
+			return 0, errors.New("connection reset")
+		})
+	}()
+
+	// canceled while waiting to retry, so it gives up rather than waiting an hour
+	time.Sleep(10 * time.Millisecond)
+	close(cancel)
+	select {
+	case err := <-done:
+		if err == nil || attempts != 1 {
+			t.Errorf("%d attempts, %v", attempts, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting to retry once canceled")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for attempt, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 30 * time.Second} {
+		for i := 0; i < 20; i++ {
+			if got := retryBackoff(attempt); got < max/2 || got > max {
+				t.Errorf("attempt %d: waited %s, want %s to %s", attempt, got, max/2, max)
+			}
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/utils"
+)
+
+// Spans of pushes and pulls and their phases, exported to an OpenTelemetry
+// collector as OTLP over http, with json encoding, once each push or pull ends.
+//
+// A nil *Span is a span which isn't recorded, so callers needn't check
+// whether tracing is configured.
+
+const DefaultServiceName = "dogestry"
+
+// how long to wait for the collector, so a slow one can't hold up a run
+var ExportTimeout = 5 * time.Second
+
+var (
+	lock        sync.Mutex
+	endpoint    string
+	headers     = make(map[string]string)
+	serviceName = DefaultServiceName
+
+	// ended spans, by trace, until their trace's root ends
+	ended = make(map[string][]*Span)
+)
+
+type Span struct {
+	name     string
+	traceId  string
+	spanId   string
+	parentId string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	err      string
+}
+
+// Sets where spans are exported to: `endpoint` in the [tracing] section, or
+// $OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or $OTEL_EXPORTER_OTLP_ENDPOINT with
+// /v1/traces. Spans aren't recorded if there's none.
+func Configure(tracingConfig config.TracingConfig) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	endpoint = tracingConfig.Endpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	}
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+
+	// key=value, as $OTEL_EXPORTER_OTLP_HEADERS has them, comma separated
+	pairs := tracingConfig.Header
+	if env := os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"); env != "" {
+		pairs = append(pairs, strings.Split(env, ",")...)
+	}
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i == -1 {
+			return fmt.Errorf("invalid tracing header '%s', use key=value", pair)
+		}
+		headers[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+		// usually an api key
+		utils.AddSecret(strings.TrimSpace(pair[i+1:]))
+	}
+
+	serviceName = tracingConfig.Service_Name
+	if serviceName == "" {
+		serviceName = os.Getenv("OTEL_SERVICE_NAME")
+	}
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+	return nil
+}
+
+func enabled() bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return endpoint != ""
+}
+
+// Starts a span, in parent's trace, or a new trace if parent is nil. Nil if
+// tracing isn't configured.
+func Start(name string, parent *Span) *Span {
+	if !enabled() {
+		return nil
+	}
+
+	span := &Span{
+		name:   name,
+		spanId: randomId(8),
+		start:  time.Now(),
+		attrs:  make(map[string]interface{}),
+	}
+	if parent != nil {
+		span.traceId, span.parentId = parent.traceId, parent.spanId
+	} else {
+		span.traceId = randomId(16)
+	}
+	return span
+}
+
+// Starts a span in s's trace. Nil if s is.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return Start(name, s)
+}
+
+// Sets an attribute, a string or an integer.
+func (s *Span) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs[key] = value
+}
+
+// For spans of things which started before the span did, e.g. transfers
+// reported once they've finished.
+func (s *Span) SetStart(start time.Time) {
+	if s == nil {
+		return
+	}
+	s.start = start
+}
+
+// Ends the span, as failed if err isn't nil. Ending a trace's root span
+// exports the trace.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = utils.Redact(err.Error())
+	}
+
+	lock.Lock()
+	ended[s.traceId] = append(ended[s.traceId], s)
+	spans := ended[s.traceId]
+	if s.parentId == "" {
+		delete(ended, s.traceId)
+	}
+	lock.Unlock()
+
+	if s.parentId == "" {
+		if err := export(spans); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: couldn't export trace: %s\n", err)
+		}
+	}
+}
+
+func randomId(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// OTLP's json encoding of spans
+const (
+	otlpKindInternal = 1
+	otlpStatusError  = 2
+)
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func attributes(attrs map[string]interface{}) []otlpAttribute {
+	list := make([]otlpAttribute, 0, len(attrs))
+	for key, value := range attrs {
+		switch v := value.(type) {
+		case int:
+			list = append(list, otlpAttribute{key, map[string]string{"intValue": strconv.Itoa(v)}})
+		case int64:
+			list = append(list, otlpAttribute{key, map[string]string{"intValue": strconv.FormatInt(v, 10)}})
+		default:
+			list = append(list, otlpAttribute{key, map[string]string{"stringValue": fmt.Sprint(v)}})
+		}
+	}
+	return list
+}
+
+func export(spans []*Span) error {
+	lock.Lock()
+	url, service := endpoint, serviceName
+	header := make(http.Header)
+	for key, value := range headers {
+		header.Set(key, value)
+	}
+	lock.Unlock()
+
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		otlpSpans[i] = otlpSpan{
+			TraceId:           span.traceId,
+			SpanId:            span.spanId,
+			ParentSpanId:      span.parentId,
+			Name:              span.name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Attributes:        attributes(span.attrs),
+		}
+		if span.err != "" {
+			otlpSpans[i].Status.Code = otlpStatusError
+			otlpSpans[i].Status.Message = span.err
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": attributes(map[string]interface{}{"service.name": service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "dogestry"},
+				"spans": otlpSpans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: ExportTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
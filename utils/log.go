@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -log-format json, each line dogestry prints becomes a LogRecord, so
+// log pipelines can index it rather than grep it. Lines which are already
+// json, e.g. -json output, are printed as they are.
+
+type LogRecord struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Component string    `json:"component,omitempty"`
+	Image     string    `json:"image,omitempty"`
+	Layer     string    `json:"layer,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	Bytes     int64     `json:"bytes,omitempty"`
+	Seconds   float64   `json:"seconds,omitempty"`
+	Msg       string    `json:"msg"`
+}
+
+const (
+	LogText = "text"
+	LogJson = "json"
+)
+
+// How much is printed
+const (
+	VerbosityQuiet  = -1 // errors only, from -quiet
+	VerbosityNormal = 0
+	VerbosityDetail = 1 // each layer and file too, from -v
+	VerbosityTrace  = 2 // and each http request, from -vv
+)
+
+var (
+	logLock      sync.RWMutex
+	logFormat    = LogText
+	logComponent string
+	logImage     string
+	verbosity    = VerbosityNormal
+)
+
+// Sets how output is printed, text as it is or json records. Only takes
+// effect once RedactOutput has been called.
+func SetLogFormat(format string) error {
+	if format != LogText && format != LogJson {
+		return fmt.Errorf("invalid log format '%s', use text or json", format)
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+	logFormat = format
+	if format == LogJson {
+		// records have their own time
+		log.SetFlags(0)
+	}
+	return nil
+}
+
+func LogFormat() string {
+	logLock.RLock()
+	defer logLock.RUnlock()
+	return logFormat
+}
+
+func SetVerbosity(level int) {
+	logLock.Lock()
+	defer logLock.Unlock()
+	verbosity = level
+}
+
+// Whether what's printed at level should be.
+func Verbose(level int) bool {
+	logLock.RLock()
+	defer logLock.RUnlock()
+	return verbosity >= level
+}
+
+// Prints detail about each layer or file, for -v.
+func Detailf(format string, args ...interface{}) {
+	if Verbose(VerbosityDetail) {
+		fmt.Printf(format, args...)
+	}
+}
+
+// output without warnings and notes, for -quiet.
+func dropWarnings(output string) string {
+	lines := strings.SplitAfter(output, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "Warning:") && !strings.HasPrefix(line, "Note:") {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "")
+}
+
+// Sets the component, i.e. the command, records are for.
+func SetLogComponent(component string) {
+	logLock.Lock()
+	defer logLock.Unlock()
+	logComponent = component
+}
+
+// Sets the image records are about, or none if it's empty. Lines already
+// printed are still about the image before, though they may not be records yet.
+func SetLogImage(image string) {
+	logLock.Lock()
+	defer logLock.Unlock()
+	logImage = image
+
+	if logFormat == LogJson {
+		for _, w := range outputs {
+			fmt.Fprintf(w, "%s%s\n", logImageMarker, image)
+		}
+	}
+}
+
+// A line saying which image the lines after it are about, so it's in order with them.
+const logImageMarker = "\x00dogestry-log-image:"
+
+// A record at level, with the current component and image.
+func NewLogRecord(level, msg string) LogRecord {
+	logLock.RLock()
+	defer logLock.RUnlock()
+	return LogRecord{
+		Time:      time.Now().UTC(),
+		Level:     level,
+		Component: logComponent,
+		Image:     logImage,
+		Msg:       msg,
+	}
+}
+
+// Prints record to stdout, as a line of json.
+func PrintLogRecord(record LogRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(data))
+	return err
+}
+
+// Logs err, which a command failed with.
+func LogError(err error) {
+	if LogFormat() != LogJson && logSinkFor() == nil {
+		log.Println("err")
+		log.Println(err)
+		return
+	}
+
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "Error:") {
+		msg = "Error: " + msg
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+// The level of a line of output, from its prefix, and the line without it.
+func lineLevel(line string) (string, string) {
+	for prefix, level := range map[string]string{"Warning:": "warn", "Error:": "error", "error:": "error"} {
+		if strings.HasPrefix(line, prefix) {
+			return level, strings.TrimSpace(strings.TrimPrefix(line, prefix))
+		}
+	}
+	return "info", line
+}
+
+// the lines of output, split at progress lines' \r too, without blank ones
+func outputLines(output string) []string {
+	lines := []string{}
+	for _, line := range strings.FieldsFunc(output, func(r rune) bool { return r == '\n' || r == '\r' }) {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// output, as a json record for each line. Progress lines, ending in \r, are
+// split too. image is the image the output is about, as its lines change it.
+func logRecords(output string, image *string) string {
+	var records []string
+	for _, line := range outputLines(output) {
+		if strings.HasPrefix(line, logImageMarker) {
+			*image = strings.TrimPrefix(line, logImageMarker)
+			continue
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "{") && json.Valid([]byte(line)) {
+			records = append(records, line)
+			continue
+		}
+
+		level, msg := lineLevel(line)
+		record := NewLogRecord(level, msg)
+		record.Image = *image
+		data, err := json.Marshal(record)
+		if err != nil {
+			continue
+		}
+		records = append(records, string(data))
+	}
+
+	if len(records) == 0 {
+		return ""
+	}
+	return strings.Join(records, "\n") + "\n"
+}
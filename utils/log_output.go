@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// With -log-output syslog or journald, what would be printed to stdout and
+// stderr is logged there instead, e.g. when running as a daemon or from cron.
+
+const (
+	LogStdout   = "stdout"
+	LogSyslog   = "syslog"
+	LogJournald = "journald"
+
+	DefaultLogTag = "dogestry"
+
+	JournaldSocket = "/run/systemd/journal/socket"
+)
+
+type logSink interface {
+	log(level, msg string) error
+}
+
+var logSinkOutput logSink
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// Sends output to syslog or journald, or stdout and stderr. facility is a
+// syslog facility, e.g. daemon or local0, default user. address is a remote
+// syslog server, e.g. udp://logs:514, or empty for the local one.
+func SetLogOutput(output, facility, tag, address string) error {
+	if tag == "" {
+		tag = DefaultLogTag
+	}
+	if facility == "" {
+		facility = "user"
+	}
+	priority, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return fmt.Errorf("invalid syslog facility '%s', use e.g. daemon, user or local0", facility)
+	}
+
+	var sink logSink
+	switch output {
+	case "", LogStdout:
+	case LogSyslog:
+		network, raddr := "", ""
+		if address != "" {
+			u, err := url.Parse(address)
+			if err != nil || u.Host == "" {
+				return fmt.Errorf("invalid syslog address '%s', use e.g. udp://logs:514", address)
+			}
+			network, raddr = u.Scheme, u.Host
+		}
+		w, err := syslog.Dial(network, raddr, priority|syslog.LOG_INFO, tag)
+		if err != nil {
+			return fmt.Errorf("connecting to syslog: %w", err)
+		}
+		sink = &syslogSink{w}
+	case LogJournald:
+		conn, err := net.Dial("unixgram", JournaldSocket)
+		if err != nil {
+			return fmt.Errorf("connecting to journald: %w", err)
+		}
+		sink = &journaldSink{conn: conn, tag: tag, facility: int(priority) >> 3}
+	default:
+		return fmt.Errorf("invalid log output '%s', use stdout, syslog or journald", output)
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+	logSinkOutput = sink
+	return nil
+}
+
+func logSinkFor() logSink {
+	logLock.RLock()
+	defer logLock.RUnlock()
+	return logSinkOutput
+}
+
+// Logs each line of output to sink, at the level of its prefix, or of its
+// record with -log-format json.
+func logToSink(sink logSink, output string) error {
+	for _, line := range outputLines(output) {
+		line = strings.TrimSpace(line)
+		level, _ := lineLevel(line)
+
+		record := struct{ Level string }{}
+		if strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), &record) == nil && record.Level != "" {
+			level = record.Level
+		}
+
+		if err := sink.log(level, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (s *syslogSink) log(level, msg string) error {
+	switch level {
+	case "error":
+		return s.w.Err(msg)
+	case "warn":
+		return s.w.Warning(msg)
+	}
+	return s.w.Info(msg)
+}
+
+// journald's native protocol, a datagram of FIELD=value lines for each entry
+type journaldSink struct {
+	conn     net.Conn
+	tag      string
+	facility int
+}
+
+func (s *journaldSink) log(level, msg string) error {
+	priority := syslog.LOG_INFO
+	switch level {
+	case "error":
+		priority = syslog.LOG_ERR
+	case "warn":
+		priority = syslog.LOG_WARNING
+	}
+
+	entry := fmt.Sprintf("PRIORITY=%d\nSYSLOG_FACILITY=%d\nSYSLOG_IDENTIFIER=%s\nMESSAGE=%s\n",
+		priority, s.facility, s.tag, strings.Replace(msg, "\n", " ", -1))
+	_, err := s.conn.Write([]byte(entry))
+	return err
+}
@@ -20,6 +20,10 @@ func NewProgressReader(r io.Reader, size int64, w io.Writer) io.Reader {
 
 
 func printProgress(w io.Writer, progress, total int64) {
+  // a record for every update would swamp the log. The transfer's records have its bytes
+  if LogFormat() == LogJson {
+    return
+  }
   fmt.Fprintf(w, "%s/%s         \r", HumanSize(progress), HumanSize(total))
 }
 
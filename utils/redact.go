@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secrets, e.g. AWS keys, presigned url signatures and auth headers, are
+// scrubbed from everything dogestry prints, including errors from the S3
+// and vault clients, which may quote the requests they made.
+
+const redacted = "REDACTED"
+
+var (
+	redactions = []struct {
+		pattern     *regexp.Regexp
+		replacement string
+	}{
+		// presigned url and signed request query parameters
+		{regexp.MustCompile(`(?i)([?&](?:X-Amz-Signature|X-Amz-Credential|X-Amz-Security-Token|Signature|AWSAccessKeyId)=)[^&\s"'<>]+`), "${1}" + redacted},
+		// auth headers, as headers, or in json or Go's %#v of a request
+		{regexp.MustCompile(`(?i)\b(Authorization|X-Amz-Security-Token|X-Vault-Token)("?\s*[:=]\s*(?:\[\]string\{)?["']?)[^\r\n"'}]+`), "${1}${2}" + redacted},
+		// access key ids aren't secret, but needn't be printed whole to say which key it was
+		{regexp.MustCompile(`\b((?:AKIA|ASIA)[A-Z0-9]{4})[A-Z0-9]{12}\b`), "${1}************"},
+	}
+
+	secretsLock sync.RWMutex
+	secrets     []string
+
+	outputDone = make(chan bool, 2)
+	outputs    []*os.File
+
+	// how long the end of a line is waited for before what there is of it is
+	// printed anyway, e.g. a prompt, and how much of one is held at most
+	partialLineWait = 100 * time.Millisecond
+	maxPartialLine  = 64 * 1024
+)
+
+// Redacts secrets from anything printed after this, e.g. a secret key or
+// vault token, once they're read. Short values aren't, as they could be anything.
+func AddSecret(values ...string) {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+
+	for _, value := range values {
+		if len(value) >= 8 {
+			secrets = append(secrets, value)
+		}
+	}
+}
+
+// s, with every secret in it redacted.
+func Redact(s string) string {
+	for _, redaction := range redactions {
+		s = redaction.pattern.ReplaceAllString(s, redaction.replacement)
+	}
+
+	secretsLock.RLock()
+	defer secretsLock.RUnlock()
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	return s
+}
+
+// Sends everything written to stdout and stderr, by this process or commands
+// it runs, through Redact, leaving out warnings for -quiet, making it records
+// for -log-format json and sending it to -log-output. Call Exit rather than os.Exit so none of it's lost.
+func RedactOutput() error {
+	for i, std := range []**os.File{&os.Stdout, &os.Stderr} {
+		stderr := i == 1
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+
+		go func(dst *os.File) {
+			image := ""
+			redactLines(r, func(output string) {
+				if stderr && !Verbose(VerbosityNormal) {
+					output = dropWarnings(output)
+				}
+				if LogFormat() == LogJson {
+					output = logRecords(output, &image)
+				}
+				// output which syslog or journald didn't take isn't lost
+				if sink := logSinkFor(); sink == nil || logToSink(sink, output) != nil {
+					io.WriteString(dst, output)
+				}
+			})
+			outputDone <- true
+		}(*std)
+
+		*std = w
+		outputs = append(outputs, w)
+	}
+
+	// the log package kept the old stderr
+	log.SetOutput(os.Stderr)
+	return nil
+}
+
+// Reads r until it's closed, passing each line of it through Redact to
+// write, so a secret printed a piece at a time is still redacted. A progress
+// bar's \r ends a line too. The end of a line which doesn't come within
+// partialLineWait, e.g. after a prompt, or before r's closed, is written as it is.
+func redactLines(r io.Reader, write func(string)) {
+	chunks := make(chan string)
+	go func() {
+		defer close(chunks)
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				chunks <- string(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	pending := ""
+	for {
+		var wait <-chan time.Time
+		if pending != "" {
+			wait = time.After(partialLineWait)
+		}
+
+		select {
+		case chunk, open := <-chunks:
+			if !open {
+				if pending != "" {
+					write(Redact(pending))
+				}
+				return
+			}
+			pending += chunk
+			if end := strings.LastIndexAny(pending, "\n\r"); end != -1 {
+				write(Redact(pending[:end+1]))
+				pending = pending[end+1:]
+			}
+			if len(pending) >= maxPartialLine {
+				write(Redact(pending))
+				pending = ""
+			}
+		case <-wait:
+			write(Redact(pending))
+			pending = ""
+		}
+	}
+}
+
+// Exits, once everything printed has been through Redact.
+func Exit(code int) {
+	for _, w := range outputs {
+		w.Close()
+	}
+	for _ = range outputs {
+		<-outputDone
+	}
+	os.Exit(code)
+}
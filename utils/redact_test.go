@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactLines(t *testing.T) {
+	r, w := io.Pipe()
+	written := make(chan string, 10)
+	done := make(chan bool)
+	go func() {
+		redactLines(r, func(s string) { written <- s })
+		close(done)
+	}()
+
+	// a key printed a piece at a time is redacted whole
+	io.WriteString(w, "using AKIAABCD")
+	io.WriteString(w, "EFGHIJKLMNOP\n")
+	if got := <-written; got != "using AKIAABCD************\n" {
+		t.Errorf("got %q", got)
+	}
+
+	// a prompt is printed once nothing more comes
+	started := time.Now()
+	io.WriteString(w, "Secret key: ")
+	if got := <-written; got != "Secret key: " || time.Since(started) < partialLineWait {
+		t.Errorf("got %q after %s", got, time.Since(started))
+	}
+
+	// progress bars end with \r, and what's left is printed once closed
+	io.WriteString(w, "1MB/2MB\rdone")
+	if got := <-written; got != "1MB/2MB\r" {
+		t.Errorf("got %q", got)
+	}
+	w.Close()
+	if got := <-written; !strings.HasPrefix(got, "done") {
+		t.Errorf("got %q", got)
+	}
+	<-done
+}
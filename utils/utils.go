@@ -6,6 +6,7 @@ import (
 
   "crypto/md5"
   "crypto/sha1"
+  "crypto/sha256"
   "encoding/hex"
   "bufio"
   "io"
@@ -71,3 +72,22 @@ func Sha1File(path string) (string, error) {
   io.Copy(hash, buff)
   return hex.EncodeToString(hash.Sum(nil)), nil
 }
+
+
+// sha256 file at path
+func Sha256File(path string) (string, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return "", err
+  }
+  defer f.Close()
+
+  // files could be pretty big, lets buffer
+  buff := bufio.NewReader(f)
+  hash := sha256.New()
+
+  if _, err := io.Copy(hash, buff); err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,230 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/blake-education/dogestry/config"
+	"github.com/blake-education/dogestry/utils"
+)
+
+// Reads secrets, e.g. S3 keys, encryption keys and signing keys, from
+// HashiCorp Vault, so they needn't be on every host. Hosts log in with a
+// token, or with an AppRole role id and secret id.
+// https://developer.hashicorp.com/vault/api-docs
+type Client struct {
+	Address string
+	config  config.VaultConfig
+	client  *http.Client
+
+	lock    sync.Mutex
+	token   string
+	secrets map[string]map[string]string
+}
+
+var (
+	clientsLock sync.Mutex
+	// by address, so each process logs in once
+	clients = make(map[string]*Client)
+)
+
+// The client for the [vault] section of cfg.
+func NewClient(cfg config.Config) (*Client, error) {
+	vaultConfig := cfg.Vault
+
+	address := vaultConfig.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address == "" {
+		return nil, fmt.Errorf("no vault address. Set `address` in the [vault] section, or $VAULT_ADDR")
+	}
+	address = strings.TrimRight(address, "/")
+
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+
+	if client, ok := clients[address]; ok {
+		return client, nil
+	}
+
+	httpClient := http.DefaultClient
+	if caCert := vaultConfig.Ca_Cert; caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("reading vault ca-cert: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in vault ca-cert %s", caCert)
+		}
+		httpClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}}
+	}
+
+	client := &Client{Address: address, config: vaultConfig, client: httpClient, secrets: make(map[string]map[string]string)}
+	clients[address] = client
+	return client, nil
+}
+
+// Reads the secret at path, e.g. secret/data/dogestry/s3. Secrets in KV
+// version 2 engines are unwrapped from their metadata. Only string values are
+// returned. Each secret is only read once.
+func (client *Client) Read(path string) (map[string]string, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if secret, ok := client.secrets[path]; ok {
+		return secret, nil
+	}
+
+	if err := client.login(); err != nil {
+		return nil, err
+	}
+
+	out := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	if err := client.call("GET", path, nil, &out); err != nil {
+		return nil, err
+	}
+
+	data := out.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	secret := make(map[string]string)
+	for name, value := range data {
+		if s, ok := value.(string); ok {
+			secret[name] = s
+			utils.AddSecret(s)
+		}
+	}
+	client.secrets[path] = secret
+	return secret, nil
+}
+
+// The value of the first of fields the secret at path has.
+func (client *Client) ReadField(path string, fields ...string) (string, error) {
+	secret, err := client.Read(path)
+	if err != nil {
+		return "", err
+	}
+	for _, field := range fields {
+		if value, ok := secret[field]; ok {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("vault secret %s has no %s", path, strings.Join(fields, " or "))
+}
+
+// Gets a token: with AppRole if there's a role-id, otherwise from
+// `token-file`, $VAULT_TOKEN or ~/.vault-token, as the vault cli does.
+func (client *Client) login() error {
+	if client.token != "" {
+		return nil
+	}
+
+	if client.config.Role_Id != "" {
+		secretId := os.Getenv("VAULT_SECRET_ID")
+		if client.config.Secret_Id_File != "" {
+			data, err := ioutil.ReadFile(client.config.Secret_Id_File)
+			if err != nil {
+				return fmt.Errorf("reading vault secret-id-file: %w", err)
+			}
+			secretId = strings.TrimSpace(string(data))
+		}
+		utils.AddSecret(secretId)
+
+		mount := client.config.Approle_Mount
+		if mount == "" {
+			mount = "approle"
+		}
+
+		out := struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}{}
+		in := map[string]string{"role_id": client.config.Role_Id, "secret_id": secretId}
+		if err := client.call("POST", "auth/"+mount+"/login", in, &out); err != nil {
+			return fmt.Errorf("vault approle login: %w", err)
+		}
+		client.token = out.Auth.ClientToken
+		utils.AddSecret(client.token)
+		return nil
+	}
+
+	if client.config.Token_File != "" {
+		data, err := ioutil.ReadFile(client.config.Token_File)
+		if err != nil {
+			return fmt.Errorf("reading vault token-file: %w", err)
+		}
+		client.token = strings.TrimSpace(string(data))
+	} else if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		client.token = token
+	} else if data, err := ioutil.ReadFile(filepath.Join(os.Getenv("HOME"), ".vault-token")); err == nil {
+		client.token = strings.TrimSpace(string(data))
+	}
+
+	if client.token == "" {
+		return fmt.Errorf("no vault token. Set `role-id` in the [vault] section to log in with AppRole, or `token-file`, or $VAULT_TOKEN")
+	}
+	utils.AddSecret(client.token)
+	return nil
+}
+
+func (client *Client) call(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, client.Address+"/v1/"+strings.TrimLeft(path, "/"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if client.token != "" {
+		req.Header.Set("X-Vault-Token", client.token)
+	}
+	if client.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", client.config.Namespace)
+	}
+
+	resp, err := client.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		failure := struct {
+			Errors []string `json:"errors"`
+		}{}
+		json.Unmarshal(data, &failure)
+		return fmt.Errorf("vault %s %s failed: %s %s", method, path, resp.Status, strings.Join(failure.Errors, ", "))
+	}
+	return json.Unmarshal(data, out)
+}